@@ -0,0 +1,34 @@
+package MaoApi
+
+const (
+	API_PARAM_IN_QUERY = "query"
+	API_PARAM_IN_PATH  = "path"
+	API_PARAM_IN_FORM  = "form" // application/x-www-form-urlencoded body
+
+	API_PARAM_TYPE_STRING  = "string"
+	API_PARAM_TYPE_INTEGER = "integer"
+	API_PARAM_TYPE_BOOLEAN = "boolean"
+)
+
+// ApiParam describes one parameter of an API. In is API_PARAM_IN_*, Type is API_PARAM_TYPE_*.
+type ApiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// ApiDoc describes an API for the generated OpenAPI document.
+// RequestBody and Response are sample values, their schemas are generated by reflection.
+// RequestBody is for JSON bodies, use API_PARAM_IN_FORM params for form bodies.
+// A string Response means text/plain.
+type ApiDoc struct {
+	Summary     string
+	Description string
+	Tag         string // usually the module name
+
+	Params      []*ApiParam
+	RequestBody interface{}
+	Response    interface{}
+}
@@ -0,0 +1,24 @@
+package MaoApi
+
+import "time"
+
+var (
+	AuditModuleRegisterName = "api-audit-module"
+)
+
+type AuditEvent struct {
+	Timestamp time.Time
+
+	Actor  string // username, api key name, or "anonymous"
+	Source string // client address
+
+	Action  string
+	Target  string
+	Success bool
+	Detail  string
+}
+
+type AuditModule interface {
+	Record(event *AuditEvent)
+	GetRecentEvents() []*AuditEvent
+}
@@ -0,0 +1,33 @@
+package MaoApi
+
+import "github.com/gin-gonic/gin"
+
+var (
+	AuthModuleRegisterName = "api-auth-module"
+)
+
+type Role int
+
+const (
+	ROLE_PUBLIC Role = iota // no authentication is required.
+	ROLE_VIEWER
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+var (
+	RoleString = [4]string{"public", "viewer", "operator", "admin"}
+)
+
+const (
+	AUTH_CONTEXT_KEY_USERNAME = "MaoAuthUsername"
+	AUTH_CONTEXT_KEY_ROLE     = "MaoAuthRole"
+
+	AUTH_SESSION_COOKIE_NAME = "MaoSession"
+)
+
+type AuthModule interface {
+	// Authorize checks the credential carried by the request against the required role.
+	// Return http.StatusOK if the request is accepted, otherwise the http status code to reply.
+	Authorize(c *gin.Context, required Role) (httpStatus int)
+}
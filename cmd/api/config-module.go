@@ -1,14 +1,79 @@
 package MaoApi
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 var (
 	ConfigModuleRegisterName = "api-config-module"
 )
 
+const (
+	CONFIG_ACTOR_SYSTEM = "system" // the actor of the config writes not from a user
+	CONFIG_ACTOR_FILE   = "file"   // the config file is edited outside
+	CONFIG_ACTOR_STORE  = "store"  // the shared config store is changed outside, e.g. by another server
+)
+
+// ConfigChangeEvent is published to the subscriptions whose path prefix overlaps the changed path.
+// The values are read-only, they are shared by the subscriptions.
+type ConfigChangeEvent struct {
+	Path     string      // the changed path, or the path of the subscription if a parent path is changed, e.g. by a rollback
+	OldValue interface{} // nil if the path didn't exist
+	NewValue interface{} // nil if the path is removed
+	Sec      bool        // put by PutSecConfig, the values are not published, get it by GetSecConfig
+
+	Actor     string
+	Version   uint64 // the version in the config history, 0 if it is not recorded
+	Timestamp time.Time
+}
+
+// ConfigFieldError is a field of the config not matched with the schema, e.g. "services[0].address".
+type ConfigFieldError struct {
+	Field   string `json:"field"` // relative to the path of the schema, "" for the whole value
+	Message string `json:"message"`
+}
+
+// ConfigSchemaError is returned if the config is rejected by the schema of the path.
+type ConfigSchemaError struct {
+	Path   string              `json:"path"`
+	Fields []*ConfigFieldError `json:"fields"`
+}
+
+func (e *ConfigSchemaError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		if f.Field == "" {
+			fields = append(fields, f.Message)
+		} else {
+			fields = append(fields, f.Field+" "+f.Message)
+		}
+	}
+	return fmt.Sprintf("invalid config of %s: %s", e.Path, strings.Join(fields, "; "))
+}
+
 type ConfigModule interface {
 	GetConfig(path string) (object interface{}, errCode int)
 	GetSecConfig(path string) (object interface{}, errCode int)
 	PutConfig(path string, data interface{}) (success bool, errCode int)
 	PutSecConfig(path string, data interface{}) (success bool, errCode int)
+	// PutConfigBy and PutSecConfigBy record the actor, e.g. the username, in the config history.
+	PutConfigBy(actor string, path string, data interface{}) (success bool, errCode int)
+	PutSecConfigBy(actor string, path string, data interface{}) (success bool, errCode int)
 	RegisterKeyUpdateListener(listener *chan int)
+	// RegisterConfigUpdateListener notifies the listener when the config under the path is changed,
+	// by the modules, a rollback, or an edit of the config file.
+	RegisterConfigUpdateListener(path string, listener *chan int)
+	// Subscribe publishes the changes under the path prefix, e.g. /icmp-ka, "/" for all.
+	// The events are dropped if the channel is full, so consume it in time. Unsubscribe closes the channel.
+	Subscribe(pathPrefix string) <-chan *ConfigChangeEvent
+	Unsubscribe(subscription <-chan *ConfigChangeEvent)
+	// RegisterConfigSchema validates the puts of the path by the schema, a struct, slice or map with "validate" tags,
+	// e.g. `yaml:"address" validate:"required,ip"`. The invalid puts are rejected.
+	RegisterConfigSchema(path string, schema interface{})
+	// ValidateConfig returns *ConfigSchemaError with the invalid fields if the data can't be put to the path.
+	ValidateConfig(path string, data interface{}) error
+	// GetConfigInto decodes the config of the path into dst, e.g. a pointer to the struct of the schema.
+	GetConfigInto(path string, dst interface{}) (errCode int)
 }
-
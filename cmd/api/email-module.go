@@ -1,14 +1,53 @@
 package MaoApi
 
+import "time"
+
 var (
 	EmailModuleRegisterName = "email-module"
 )
 
+const (
+	EMAIL_EVENT_UP     = "UP"
+	EMAIL_EVENT_DOWN   = "DOWN"
+	EMAIL_EVENT_DIGEST = "digest"
+)
+
+// EmailServiceEvent is the context of one service rendered by the email templates.
+type EmailServiceEvent struct {
+	Type        string // EMAIL_EVENT_UP or EMAIL_EVENT_DOWN
+	Source      string // the module detecting it, e.g. ICMP, gRPC
+	ServiceName string
+	Address     string
+	Key         string // the key of the service labels, the address for ICMP, the hostname for gRPC
+	Rtt         time.Duration
+	Timestamp   time.Time
+	LastSeen    time.Time
+	Downtime    time.Duration // UP: how long it was down. DOWN: since it was seen last time.
+	Page        string        // the WebUI page of the service, e.g. /v1/configIcmp
+}
+
+// Name returns the service name, or the address if the name is not set.
+func (e *EmailServiceEvent) Name() string {
+	if e.ServiceName != "" {
+		return e.ServiceName
+	}
+	return e.Address
+}
+
 type EmailMessage struct {
-	Subject string
-	Content string
+	Subject string // used if there is no template for the event
+	Content string // plaintext, for the message without event
+
+	Event    string // EMAIL_EVENT_*, rendered by the templates of the email config
+	Services []*EmailServiceEvent
+	Dropped  int  // digest: the events not listed, the digest is full
+	Critical bool // sent at once, not batched into the digest
+
+	// set by the sender, or routed by the subscriptions of the email config if both are empty.
+	Receivers []string
+	Cc        []string
 }
 
 type EmailModule interface {
 	SendEmail(message *EmailMessage)
-}
\ No newline at end of file
+}
@@ -12,7 +12,7 @@ const (
 )
 
 type MaoIcmpServiceIdentifier struct {
-	ServiceIPv4v6 string `yaml:"address"` // Attention, this value MUST be modified simultaneously with ICMP_CONFIG_KEY_ADDRESS.
+	ServiceIPv4v6 string `yaml:"address" validate:"required,ip"` // Attention, this value MUST be modified simultaneously with ICMP_CONFIG_KEY_ADDRESS.
 	ServiceName string `yaml:"serviceName"` // Attention, this value MUST be modified simultaneously with ICMP_CONFIG_KEY_SERVICE_NAME.
 }
 
@@ -0,0 +1,49 @@
+package MaoApi
+
+// ModuleLifecycle is the lifecycle of a module managed by the service registry.
+// Init of all modules is called in the dependency order, then Start in the same order, and Stop in the reverse order.
+type ModuleLifecycle interface {
+	// Health of the module
+	HealthChecker
+
+	// Dependencies returns the register names of the modules which must be initialized and started before this one.
+	Dependencies() []string
+
+	// Init prepares the module and registers its restful apis. The module is registered to the service registry after Init succeeds.
+	Init() error
+
+	// Start begins to serve, e.g. listening on the port. It is called after all modules are initialized.
+	Start() error
+
+	// Stop releases the resources. It is called if Init succeeded, even if Start is not called.
+	Stop()
+}
+
+const (
+	// /modules/<ModuleOption.ConfigName>/enabled and /modules/<ModuleOption.ConfigName>/settings
+	MODULES_CONFIG_PATH_ROOT    = "/modules"
+	MODULES_CONFIG_KEY_ENABLED  = "enabled"
+	MODULES_CONFIG_KEY_SETTINGS = "settings"
+)
+
+// ModuleOption makes a module optional, it is enabled or disabled by the config.
+type ModuleOption struct {
+	ConfigName       string // e.g. "mysql"
+	EnabledByDefault bool   // if it is not in the config
+
+	// HotToggle modules are stopped or started immediately when they are toggled.
+	// Others are toggled after the server restarts.
+	HotToggle bool
+}
+
+type ModuleStatus struct {
+	Name       string `json:"name"`                 // the register name
+	ConfigName string `json:"configName,omitempty"` // empty for the modules which can't be disabled
+
+	Optional  bool `json:"optional"`
+	HotToggle bool `json:"hotToggle"`
+	Enabled   bool `json:"enabled"` // in the config
+	Running   bool `json:"running"`
+
+	RestartRequired bool `json:"restartRequired"` // Enabled is not applied yet
+}
@@ -0,0 +1,45 @@
+package MaoApi
+
+import (
+	"encoding/json"
+	"time"
+)
+
+var (
+	OutboxModuleRegisterName = "notification-outbox-module"
+)
+
+const (
+	NOTIFICATION_CHANNEL_EMAIL  = "email"
+	NOTIFICATION_CHANNEL_WECHAT = "wechat"
+
+	NOTIFICATION_STATUS_QUEUED = "queued" // waiting for the first delivery or the next retry
+	NOTIFICATION_STATUS_SENT   = "sent"
+	NOTIFICATION_STATUS_FAILED = "failed" // all retries failed, it can be requeued
+)
+
+// Notification is one message of a channel in the outbox, the payload is the message of the channel in JSON.
+type Notification struct {
+	Id          string          `json:"id"`
+	Channel     string          `json:"channel"` // NOTIFICATION_CHANNEL_*
+	Summary     string          `json:"summary"` // e.g. the subject of the email
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"` // NOTIFICATION_STATUS_*
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	SentAt      *time.Time      `json:"sentAt,omitempty"` // nil until it is sent
+}
+
+// NotificationDeliverFunc delivers the payload of the channel, the notification is retried if it returns an error.
+type NotificationDeliverFunc func(payload []byte) error
+
+type OutboxModule interface {
+	// RegisterChannel sets the deliver function of the channel, the notifications of it are kept queued until then.
+	// They are delivered one by one, interval after the last one of the channel.
+	RegisterChannel(channel string, interval time.Duration, deliver NotificationDeliverFunc)
+	// Enqueue saves the message, and delivers it as soon as possible. Returns the id.
+	Enqueue(channel string, summary string, message interface{}) (string, error)
+}
@@ -0,0 +1,42 @@
+package MaoApi
+
+import "time"
+
+var (
+	ReportModuleRegisterName = "sla-report-module"
+)
+
+// SERVICE_EVENT_REMOVED is recorded besides EMAIL_EVENT_UP and EMAIL_EVENT_DOWN when the service is deleted.
+const SERVICE_EVENT_REMOVED = "REMOVED"
+
+// ServiceAvailability is one row of the SLA report, for a service of a source in the period.
+// The time not monitored, e.g. the server is stopped, and the maintenance windows are excluded from the availability.
+type ServiceAvailability struct {
+	Source             string   `json:"source"` // e.g. ICMP, gRPC
+	Key                string   `json:"key"`    // the address for ICMP, the hostname for gRPC
+	ServiceName        string   `json:"serviceName"`
+	Address            string   `json:"address"`
+	Availability       *float64 `json:"availability"` // percent of the UP time in the UP and DOWN time, null if neither
+	UpSeconds          int64    `json:"upSeconds"`
+	DownSeconds        int64    `json:"downSeconds"`
+	MaintenanceSeconds int64    `json:"maintenanceSeconds"`
+	UnknownSeconds     int64    `json:"unknownSeconds"` // not monitored
+	Outages            int      `json:"outages"`        // the DOWN transitions in the period, out of the maintenance windows
+	MttrSeconds        *float64 `json:"mttrSeconds"`    // the DOWN time per outage, null if there is no outage
+	MtbfSeconds        *float64 `json:"mtbfSeconds"`    // the UP time per outage, null if there is no outage
+}
+
+type AvailabilityReport struct {
+	From        time.Time              `json:"from"`
+	To          time.Time              `json:"to"`
+	GeneratedAt time.Time              `json:"generatedAt"`
+	Services    []*ServiceAvailability `json:"services"`
+}
+
+type ReportModule interface {
+	// RecordServiceEvent records the UP or DOWN transition of the service for the availability.
+	RecordServiceEvent(event *EmailServiceEvent)
+	// GetLastServiceEvents returns the last UP or DOWN of each service of the source, except the removed ones.
+	GetLastServiceEvents(source string) []*EmailServiceEvent
+	GetAvailabilityReport(from time.Time, to time.Time) *AvailabilityReport
+}
@@ -7,7 +7,24 @@ var (
 )
 
 type RestfulServerModule interface {
+	// UI pages require ROLE_VIEWER, GET APIs require ROLE_VIEWER, POST APIs require ROLE_OPERATOR.
 	RegisterUiPage(relativePath string, handlers ...gin.HandlerFunc)
 	RegisterGetApi(relativePath string, handlers ...gin.HandlerFunc)
 	RegisterPostApi(relativePath string, handlers ...gin.HandlerFunc)
-}
\ No newline at end of file
+
+	RegisterGetApiWithRole(role Role, relativePath string, handlers ...gin.HandlerFunc)
+	RegisterPostApiWithRole(role Role, relativePath string, handlers ...gin.HandlerFunc)
+
+	// doc is published in the OpenAPI document, /api/openapi.json
+	RegisterGetApiWithDoc(role Role, relativePath string, doc *ApiDoc, handlers ...gin.HandlerFunc)
+	RegisterPostApiWithDoc(role Role, relativePath string, doc *ApiDoc, handlers ...gin.HandlerFunc)
+
+	// public GET at the root path, without the /api prefix, for liveness/readiness probes.
+	RegisterProbeApi(relativePath string, doc *ApiDoc, handlers ...gin.HandlerFunc)
+
+	SetAuthModule(authModule AuthModule)
+
+	// SetRouteOwner marks the routes registered since now as owned by the module, "" for none.
+	// The routes are served only while running(module) is true.
+	SetRouteOwner(module string, running func(module string) bool)
+}
@@ -0,0 +1,32 @@
+package MaoApi
+
+var (
+	SelfCheckModuleRegisterName = "api-self-check-module"
+)
+
+const (
+	HEALTH_STATUS_OK       = "ok"
+	HEALTH_STATUS_DEGRADED = "degraded" // working, but something needs attention, e.g. the sec key is not set.
+	HEALTH_STATUS_DOWN     = "down"
+	HEALTH_STATUS_DISABLED = "disabled" // not configured or not enabled, it is not a failure.
+)
+
+type ModuleHealth struct {
+	Module string `json:"module"`
+	Status string `json:"status"` // HEALTH_STATUS_*
+	Detail string `json:"detail,omitempty"`
+
+	// e.g. queue depths, number of services
+	Metrics map[string]int64 `json:"metrics,omitempty"`
+
+	Critical bool `json:"critical"` // the server is not ready if a critical module is not ok. Filled by the self-check module.
+}
+
+// HealthChecker is implemented by modules which can report their health. CheckHealth should return in a few seconds.
+type HealthChecker interface {
+	CheckHealth() *ModuleHealth
+}
+
+type SelfCheckModule interface {
+	AddHealthChecker(checker HealthChecker, critical bool)
+}
@@ -7,6 +7,9 @@ type EventType int
 const (
 	SOURCE_GRPC = "gRPC"
 	SOURCE_ICMP = "ICMP"
+
+	// /serviceLabels/<source>/<key> : {<label key>: <label value>}, the key is the address for ICMP, the hostname for gRPC.
+	SERVICE_LABELS_CONFIG_PATH = "/serviceLabels"
 )
 const (
 	SERVICE_UP EventType = iota + 1
@@ -7,12 +7,16 @@ var (
 type WechatMessage struct {
 
 	Receivers []string  // length == 0 stands for all receivers; nil stands for unspecified.
+	Parties []string    // department ids, nil stands for unspecified.
+	Tags []string       // tag ids, nil stands for unspecified.
 
 	Title string
 	ContentHttp string
-	Url string
+	Url string // absolute, or the WebUI path resolved by the webUiUrl of the WeChat config
+
+	Event *EmailServiceEvent // the service UP or DOWN, rendered as the title, content and url if they are empty
 }
 
 type WechatModule interface {
 	SendWechatMessage(message *WechatMessage)
-}
\ No newline at end of file
+}
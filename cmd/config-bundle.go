@@ -0,0 +1,139 @@
+package branch
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_BUNDLE_DEFAULT_SERVER = "http://127.0.0.1:29999"
+	CONFIG_BUNDLE_API_KEY_ENV    = "MAO_API_KEY"
+	CONFIG_BUNDLE_TIMEOUT        = 30 * time.Second
+)
+
+// configBundleChange is the change previewed by /api/importConfig.
+type configBundleChange struct {
+	Path     string      `json:"path"`
+	Action   string      `json:"action"`
+	OldValue interface{} `json:"oldValue"`
+	NewValue interface{} `json:"newValue"`
+	Sec      bool        `json:"sec"`
+}
+
+type configBundleImport struct {
+	Applied  bool                  `json:"applied"`
+	Sections []string              `json:"sections"`
+	Changes  []*configBundleChange `json:"changes"`
+}
+
+// callConfigApi calls the api of a running server by an admin api key, e.g. created on the page of the local auth.
+func callConfigApi(server string, apiKey string, insecure bool, method string, api string, form url.Values) ([]byte, error) {
+	if apiKey == "" {
+		apiKey = os.Getenv(CONFIG_BUNDLE_API_KEY_ENV)
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("the api key is required, by --api_key or %s", CONFIG_BUNDLE_API_KEY_ENV)
+	}
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request, err := http.NewRequest(method, strings.TrimRight(server, "/")+"/api"+api, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+apiKey)
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	client := &http.Client{
+		Timeout: CONFIG_BUNDLE_TIMEOUT,
+		Transport: &http.Transport{
+			// the server may use a self-signed cert.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// RunConfigExport saves the config bundle of a running server to the file, "-" for stdout. Returns the exit code.
+func RunConfigExport(server string, apiKey string, insecure bool, secrets string, file string) int {
+	data, err := callConfigApi(server, apiKey, insecure, http.MethodGet, "/exportConfig?secrets="+url.QueryEscape(secrets), nil)
+	if err != nil {
+		fmt.Printf("Fail to export config: %s\n", err.Error())
+		return 1
+	}
+	if file == "-" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	// it may contain the sec configs, and the addresses of the internal services.
+	if err = os.WriteFile(file, data, 0600); err != nil {
+		fmt.Printf("Fail to write the bundle: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Exported to %s, secrets %s\n", file, secrets)
+	return 0
+}
+
+// RunConfigImport previews the changes of the bundle on a running server, and applies them if apply is true. Returns the exit code.
+func RunConfigImport(server string, apiKey string, insecure bool, file string, apply bool) int {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Fail to read the bundle: %s\n", err.Error())
+		return 1
+	}
+	form := url.Values{"bundle": {string(content)}, "apply": {fmt.Sprint(apply)}}
+	data, err := callConfigApi(server, apiKey, insecure, http.MethodPost, "/importConfig", form)
+	if err != nil {
+		fmt.Printf("Fail to import config: %s\n", err.Error())
+		return 1
+	}
+	result := &configBundleImport{}
+	if err = json.Unmarshal(data, result); err != nil {
+		fmt.Printf("Fail to parse the result: %s\n", err.Error())
+		return 1
+	}
+
+	for _, change := range result.Changes {
+		switch {
+		case change.Sec:
+			fmt.Printf("%s %s (sec)\n", change.Action, change.Path)
+		case change.Action == "add":
+			fmt.Printf("%s %s: %v\n", change.Action, change.Path, change.NewValue)
+		default:
+			fmt.Printf("%s %s: %v -> %v\n", change.Action, change.Path, change.OldValue, change.NewValue)
+		}
+	}
+	switch {
+	case len(result.Changes) == 0:
+		fmt.Println("No change.")
+	case result.Applied:
+		fmt.Printf("Applied %d changes in %s.\n", len(result.Changes), strings.Join(result.Sections, ", "))
+	default:
+		fmt.Printf("Dry run, %d changes in %s. Run again with --apply to apply them.\n", len(result.Changes), strings.Join(result.Sections, ", "))
+	}
+	return 0
+}
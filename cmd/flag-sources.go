@@ -0,0 +1,89 @@
+package branch
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+const (
+	FLAG_CONFIG = "config"
+
+	// e.g. MAO_WEB_SERVER_PORT for web_server_port, MAO_CONFIG for the config file.
+	FLAG_ENV_PREFIX = "MAO_"
+)
+
+// FlagEnvName returns the environment variable of the flag.
+func FlagEnvName(flagName string) string {
+	return FLAG_ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ApplyFlagSources fills the flags which are not set in the command line, from the MAO_* environment variables first,
+// then from the config file, which is a YAML map of flag name to value, e.g. "web_server_port: 29999".
+// So the precedence is flag > env > file > default. The values are validated by the readers of the flags as usual.
+func ApplyFlagSources(flags *pflag.FlagSet, lookupEnv func(key string) (string, bool)) error {
+	fileValues, configFile, err := loadFlagConfigFile(flags, lookupEnv)
+	if err != nil {
+		return err
+	}
+	for name := range fileValues {
+		if f := flags.Lookup(name); f == nil || name == FLAG_CONFIG {
+			return fmt.Errorf("unknown flag %s in %s", name, configFile)
+		}
+	}
+
+	var applyErr error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if applyErr != nil || f.Changed || f.Name == FLAG_CONFIG || f.Name == "help" {
+			return
+		}
+		// not flags.Set(), the flag is still not Changed, i.e. not set in the command line.
+		if value, ok := lookupEnv(FlagEnvName(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				applyErr = fmt.Errorf("%s is invalid, %s", FlagEnvName(f.Name), err.Error())
+			}
+			return
+		}
+		if value, ok := fileValues[f.Name]; ok {
+			if err := f.Value.Set(value); err != nil {
+				applyErr = fmt.Errorf("%s in %s is invalid, %s", f.Name, configFile, err.Error())
+			}
+		}
+	})
+	return applyErr
+}
+
+// loadFlagConfigFile reads the file of --config, or MAO_CONFIG. No file is fine.
+func loadFlagConfigFile(flags *pflag.FlagSet, lookupEnv func(key string) (string, bool)) (values map[string]string, configFile string, err error) {
+	values = make(map[string]string)
+
+	if f := flags.Lookup(FLAG_CONFIG); f != nil && f.Changed {
+		configFile = f.Value.String()
+	} else if env, ok := lookupEnv(FlagEnvName(FLAG_CONFIG)); ok {
+		configFile = env
+	}
+	if configFile == "" {
+		return values, "", nil
+	}
+
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, configFile, fmt.Errorf("fail to read the config file, %s", err.Error())
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, configFile, fmt.Errorf("fail to parse the config file %s, %s", configFile, err.Error())
+	}
+	for name, value := range raw {
+		switch value.(type) {
+		case string, bool, int, float64:
+			values[name] = fmt.Sprint(value)
+		default:
+			return nil, configFile, fmt.Errorf("%s in %s should be a string, number or bool", name, configFile)
+		}
+	}
+	return values, configFile, nil
+}
@@ -0,0 +1,82 @@
+package branch
+
+import (
+	"github.com/spf13/pflag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String(FLAG_CONFIG, "", "")
+	flags.String("log_level", "INFO", "")
+	flags.Uint32("web_server_port", 29999, "")
+	flags.Bool("silent", false, "")
+	flags.String("influxdb_url", "", "")
+	return flags
+}
+
+func TestApplyFlagSources_Precedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao.yaml")
+	content := "log_level: ERROR\nweb_server_port: 30000\nsilent: true\ninfluxdb_url: http://file\n"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"MAO_CONFIG":          configFile,
+		"MAO_LOG_LEVEL":       "WARN",
+		"MAO_WEB_SERVER_PORT": "31000",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	flags := newTestFlagSet()
+	if err := flags.Parse([]string{"--web_server_port", "32000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyFlagSources(flags, lookupEnv); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"web_server_port": "32000",       // flag
+		"log_level":       "WARN",        // env
+		"silent":          "true",        // file
+		"influxdb_url":    "http://file", // file
+	}
+	for name, value := range expect {
+		if got := flags.Lookup(name).Value.String(); got != value {
+			t.Errorf("%s: expect %s, got %s", name, value, got)
+		}
+	}
+}
+
+func TestApplyFlagSources_Invalid(t *testing.T) {
+	noEnv := func(key string) (string, bool) { return "", false }
+
+	configFile := filepath.Join(t.TempDir(), "mao.yaml")
+	if err := os.WriteFile(configFile, []byte("web_server_prot: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	flags := newTestFlagSet()
+	flags.Parse([]string{"--config", configFile})
+	if err := ApplyFlagSources(flags, noEnv); err == nil || !strings.Contains(err.Error(), "unknown flag") {
+		t.Errorf("expect unknown flag error, got %v", err)
+	}
+
+	flags = newTestFlagSet()
+	badEnv := func(key string) (string, bool) {
+		if key == "MAO_WEB_SERVER_PORT" {
+			return "http", true
+		}
+		return "", false
+	}
+	if err := ApplyFlagSources(flags, badEnv); err == nil || !strings.Contains(err.Error(), "MAO_WEB_SERVER_PORT") {
+		t.Errorf("expect invalid env error, got %v", err)
+	}
+}
@@ -100,10 +100,14 @@ func (c *GeneralClientV2) getGpsInfo() (*data.GpsData, error) {
 	return c.parseGpsInfo(string(gpsDataStr))
 }
 
-func (c *GeneralClientV2) gpsProcessor(gpsPersistent bool) {
+func (c *GeneralClientV2) gpsProcessor(ctx context.Context, gpsPersistent bool) {
 	var epoch uint32 = 1
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 
 		gpsData, err := c.getGpsInfo()
 		if err != nil {
@@ -154,10 +158,14 @@ func (c *GeneralClientV2) getEnvironmentTemperature() (float64, error) {
 	return INVALID_ENV_TEMP, err
 }
 
-func (c *GeneralClientV2) envTempProcessor(envTempPersistent bool) {
+func (c *GeneralClientV2) envTempProcessor(ctx context.Context, envTempPersistent bool) {
 	var epoch uint32 = 1
 	for {
-		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
 
 		envTempData, err := c.getEnvironmentTemperature()
 		if err != nil {
@@ -209,10 +217,14 @@ func (c *GeneralClientV2) getNat66GatewayData() (uint64, uint64, error) {
 	return v6In, v6Out, nil
 }
 
-func (c *GeneralClientV2) nat66Processor(nat66Persistent bool) {
+func (c *GeneralClientV2) nat66Processor(ctx context.Context, nat66Persistent bool) {
 	var epoch uint32 = 1
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 
 		v6In, v6Out, err := c.getNat66GatewayData()
 		if err != nil {
@@ -275,7 +287,7 @@ func (c *GeneralClientV2) nat66UploadInfluxdb(writeAPI *influxdb2Api.WriteAPI, v
 	//(*writeAPI).Flush()
 }
 
-func (c *GeneralClientV2) influxdbPersistentProcessor(influxdbUrl string, influxdbOrgBucket string, influxdbToken string,
+func (c *GeneralClientV2) influxdbPersistentProcessor(ctx context.Context, influxdbUrl string, influxdbOrgBucket string, influxdbToken string,
 	nat66Persistent bool, gpsPersistent bool, envTempPersistent bool) {
 
 	if !nat66Persistent && !gpsPersistent && !envTempPersistent {
@@ -298,7 +310,22 @@ func (c *GeneralClientV2) influxdbPersistentProcessor(influxdbUrl string, influx
 		case nat66Data := <- c.nat66DataChannel:
 			c.nat66UploadInfluxdb(&influxdbWriteAPI, nat66Data.IPv6In, nat66Data.IPv6Out)
 
-		// todo: case shutdown signal.
+		case <-ctx.Done():
+			// the processors have stopped producing, write the pending data and flush.
+			pending := len(c.envTempDataChannel) + len(c.gpsDataChannel) + len(c.nat66DataChannel)
+			util.MaoLogM(util.INFO, c2_MODULE_NAME, "Exiting, flush %d pending data to influxdb.", pending)
+			for len(c.envTempDataChannel) > 0 {
+				c.envTempUploadInfluxdb(&influxdbWriteAPI, (<-c.envTempDataChannel).Temperature)
+			}
+			for len(c.gpsDataChannel) > 0 {
+				c.gpsDataUploadInfluxdb(&influxdbWriteAPI, <-c.gpsDataChannel)
+			}
+			for len(c.nat66DataChannel) > 0 {
+				nat66Data := <-c.nat66DataChannel
+				c.nat66UploadInfluxdb(&influxdbWriteAPI, nat66Data.IPv6In, nat66Data.IPv6Out)
+			}
+			influxdbWriteAPI.Flush()
+			return
 		}
 	}
 }
@@ -329,18 +356,23 @@ func (c *GeneralClientV2) grpcRttMeasureProcessor(rttStreamClient pb.MaoServerDi
 	}
 }
 
-func (c *GeneralClientV2) gRpcProcessor(
+func (c *GeneralClientV2) gRpcProcessor(ctx context.Context,
 	reportServerAddr *net.IP, reportServerPort uint32, reportInterval uint32, silent bool,
 	nat66Gateway bool, gpsMonitor bool, envTempMonitor bool ) {
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 
 		serverAddr := util.GetAddrPort(reportServerAddr, reportServerPort)
 		util.MaoLogM(util.INFO, c2_MODULE_NAME, "Connect to %s ...", serverAddr)
 
-		ctx, cancelCtx := context.WithTimeout(context.Background(), 3 * time.Second)
-		connect, err := grpc.DialContext(ctx, serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		dialCtx, cancelCtx := context.WithTimeout(ctx, 3 * time.Second)
+		connect, err := grpc.DialContext(dialCtx, serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
 		if err != nil {
+			cancelCtx()
 			util.MaoLogM(util.WARN, c2_MODULE_NAME, "Retry, %s ...", err.Error())
 			continue
 		}
@@ -350,7 +382,7 @@ func (c *GeneralClientV2) gRpcProcessor(
 		client := pb.NewMaoServerDiscoveryClient(connect)
 
 
-		clientCommonContext, cancelCommonContext := context.WithCancel(context.Background())
+		clientCommonContext, cancelCommonContext := context.WithCancel(ctx)
 		rttStreamClient, err := client.RttMeasure(clientCommonContext)
 		if err != nil {
 			util.MaoLogM(util.ERROR, c2_MODULE_NAME, "Fail to get rttStreamClient, %s", err.Error())
@@ -446,9 +478,17 @@ func (c *GeneralClientV2) gRpcProcessor(
 			util.MaoLogM(util.DEBUG, c2_MODULE_NAME, "%d: Sent", count)
 
 			count++
-			time.Sleep(time.Duration(reportInterval) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(reportInterval) * time.Millisecond):
+				continue
+			case <-ctx.Done():
+				// tell the server we are leaving, instead of breaking the stream.
+				reportStreamClient.CloseSend()
+			}
+			break
 		}
 		cancelCommonContext()
+		connect.Close()
 	}
 }
 
@@ -457,10 +497,13 @@ func (c *GeneralClientV2) Run(reportServerAddr *net.IP, reportServerPort uint32,
 	nat66Gateway bool, nat66Persistent bool,
 	gpsMonitor bool, gpsPersistent bool,
 	envTempMonitor bool, envTempPersistent bool,
-	minLogLevel util.MaoLogLevel) {
+	minLogLevel util.MaoLogLevel) (exitCode int) {
 
 	util.InitMaoLog(minLogLevel)
 
+	ctx, stop := shutdownContext()
+	defer stop()
+
 	c.envTempLast = nil
 	c.gpsLast = nil
 	c.nat66Last = nil
@@ -469,19 +512,35 @@ func (c *GeneralClientV2) Run(reportServerAddr *net.IP, reportServerPort uint32,
 	c.gpsDataChannel = make(chan *data.GpsData, 1024)
 	c.nat66DataChannel = make(chan *data.Nat66, 1024)
 
-	go c.influxdbPersistentProcessor(influxdbUrl, influxdbOrgBucket, influxdbToken,
-		nat66Persistent, gpsPersistent, envTempPersistent)
+	influxdbExited := make(chan struct{})
+	go func() {
+		c.influxdbPersistentProcessor(ctx, influxdbUrl, influxdbOrgBucket, influxdbToken,
+			nat66Persistent, gpsPersistent, envTempPersistent)
+		close(influxdbExited)
+	}()
 
 	if gpsMonitor {
-		go c.gpsProcessor(gpsPersistent)
+		go c.gpsProcessor(ctx, gpsPersistent)
 	}
 	if nat66Gateway {
-		go c.nat66Processor(nat66Persistent)
+		go c.nat66Processor(ctx, nat66Persistent)
 	}
 	if envTempMonitor {
-		go c.envTempProcessor(envTempPersistent)
+		go c.envTempProcessor(ctx, envTempPersistent)
 	}
 
-	c.gRpcProcessor(reportServerAddr, reportServerPort, reportInterval, silent,
-		nat66Gateway, gpsMonitor, envTempMonitor)
+	grpcExited := make(chan struct{})
+	go func() {
+		c.gRpcProcessor(ctx, reportServerAddr, reportServerPort, reportInterval, silent,
+			nat66Gateway, gpsMonitor, envTempMonitor)
+		close(grpcExited)
+	}()
+
+	<-ctx.Done()
+	stop()
+	util.MaoLogM(util.INFO, c2_MODULE_NAME, "Shutting down, grace period %s ...", SHUTDOWN_GRACE_PERIOD)
+
+	return shutdownWithin(c2_MODULE_NAME, SHUTDOWN_GRACE_PERIOD,
+		func() { <-grpcExited },
+		func() { <-influxdbExited })
 }
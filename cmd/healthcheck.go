@@ -0,0 +1,41 @@
+package branch
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	HEALTHCHECK_DEFAULT_URL = "http://127.0.0.1:29999/readyz"
+	HEALTHCHECK_TIMEOUT     = 4 * time.Second
+)
+
+// RunHealthCheck probes the readiness of a running server, returns the exit code for container HEALTHCHECK.
+// 0 if the server is ready, 1 otherwise.
+func RunHealthCheck(url string, insecure bool) int {
+	client := &http.Client{
+		Timeout: HEALTHCHECK_TIMEOUT,
+		Transport: &http.Transport{
+			// the server may use a self-signed cert.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Printf("unhealthy: %s\n", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("unhealthy: %s %s\n", resp.Status, string(body))
+		return 1
+	}
+	fmt.Printf("healthy: %s\n", string(body))
+	return 0
+}
@@ -0,0 +1,157 @@
+package Audit
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	MODULE_NAME = "Audit-module"
+
+	DEFAULT_AUDIT_FILE = "mao-audit.log"
+
+	URL_AUDIT_SHOW = "/showAuditLog"
+
+	RECENT_EVENTS_CAPACITY = 1000
+)
+
+type AuditModule struct {
+	auditFilename string
+
+	auditEventChannel chan *MaoApi.AuditEvent
+
+	// only for web showing, i.e. external get operation
+	recentEvents     []*MaoApi.AuditEvent
+	recentEventsLock sync.RWMutex
+
+	needShutdown bool
+	exited       chan struct{} // closed when auditEventLoop exits
+}
+
+func (a *AuditModule) RequireShutdown() {
+	a.needShutdown = true
+}
+
+// Shutdown writes the pending events and waits for auditEventLoop to exit.
+func (a *AuditModule) Shutdown() {
+	a.RequireShutdown()
+	<-a.exited
+}
+
+func (a *AuditModule) Record(event *MaoApi.AuditEvent) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	a.auditEventChannel <- event
+}
+
+func (a *AuditModule) GetRecentEvents() []*MaoApi.AuditEvent {
+	a.recentEventsLock.RLock()
+	defer a.recentEventsLock.RUnlock()
+
+	events := make([]*MaoApi.AuditEvent, len(a.recentEvents))
+	copy(events, a.recentEvents)
+	return events
+}
+
+func (a *AuditModule) CheckHealth() *MaoApi.ModuleHealth {
+	return &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Metrics: map[string]int64{
+			"eventQueueDepth": int64(len(a.auditEventChannel)),
+		},
+	}
+}
+
+func (a *AuditModule) appendRecentEvent(event *MaoApi.AuditEvent) {
+	a.recentEventsLock.Lock()
+	defer a.recentEventsLock.Unlock()
+
+	a.recentEvents = append(a.recentEvents, event)
+	if len(a.recentEvents) > RECENT_EVENTS_CAPACITY {
+		a.recentEvents = a.recentEvents[len(a.recentEvents)-RECENT_EVENTS_CAPACITY:]
+	}
+}
+
+func (a *AuditModule) writeEvent(event *MaoApi.AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(a.auditFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func (a *AuditModule) auditEventLoop() {
+	defer close(a.exited)
+
+	checkInterval := time.Duration(1000) * time.Millisecond
+	checkShutdownTimer := time.NewTimer(checkInterval)
+	for {
+		select {
+		case event := <-a.auditEventChannel:
+			if event.Success {
+				util.MaoLogM(util.INFO, MODULE_NAME, "%s %s by %s from %s: %s", event.Action, event.Target, event.Actor, event.Source, event.Detail)
+			} else {
+				util.MaoLogM(util.WARN, MODULE_NAME, "FAIL %s %s by %s from %s: %s", event.Action, event.Target, event.Actor, event.Source, event.Detail)
+			}
+
+			a.appendRecentEvent(event)
+			if err := a.writeEvent(event); err != nil {
+				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to write audit event to %s, %s", a.auditFilename, err.Error())
+			}
+		case <-checkShutdownTimer.C:
+			if a.needShutdown && len(a.auditEventChannel) == 0 {
+				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+				return
+			}
+			checkShutdownTimer.Reset(checkInterval)
+		}
+	}
+}
+
+func (a *AuditModule) InitAuditModule(auditFilename string) bool {
+	a.auditFilename = auditFilename
+	a.auditEventChannel = make(chan *MaoApi.AuditEvent, 1024)
+	a.recentEvents = make([]*MaoApi.AuditEvent, 0)
+	a.needShutdown = false
+	a.exited = make(chan struct{})
+
+	go a.auditEventLoop()
+
+	a.configRestControlInterface()
+
+	return true
+}
+
+func (a *AuditModule) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUDIT_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the recent audit events",
+		Tag:      MODULE_NAME,
+		Response: []*MaoApi.AuditEvent{},
+	}, a.showAuditLog)
+}
+
+func (a *AuditModule) showAuditLog(c *gin.Context) {
+	c.JSON(200, a.GetRecentEvents())
+}
@@ -0,0 +1,749 @@
+package Auth
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/MaoJianwei/gmsm/sm3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MODULE_NAME = "Local-Auth-module"
+
+	URL_AUTH_LOGIN        = "/login"
+	URL_AUTH_LOGOUT       = "/logout"
+	URL_AUTH_WHOAMI       = "/whoami"
+	URL_AUTH_USER_SHOW    = "/showUsers"
+	URL_AUTH_USER_ADD     = "/addUser"
+	URL_AUTH_USER_DEL     = "/delUser"
+	URL_AUTH_API_KEY_SHOW = "/showApiKeys"
+	URL_AUTH_API_KEY_ADD  = "/addApiKey"
+	URL_AUTH_API_KEY_DEL  = "/delApiKey"
+
+	AUTH_USERS_CONFIG_PATH    = "/auth/users"
+	AUTH_API_KEYS_CONFIG_PATH = "/auth/apiKeys"
+
+	AUTH_CONFIG_KEY_PASSWORD_HASH = "passwordHash"
+	AUTH_CONFIG_KEY_KEY_DIGEST    = "keyDigest"
+	AUTH_CONFIG_KEY_ROLE          = "role"
+
+	AUTH_API_KEY_USERNAME = "username"
+	AUTH_API_KEY_PASSWORD = "password"
+	AUTH_API_KEY_ROLE     = "role"
+	AUTH_API_KEY_NAME     = "name"
+
+	SESSION_COOKIE_NAME = MaoApi.AUTH_SESSION_COOKIE_NAME
+	SESSION_TTL         = 12 * time.Hour
+
+	BEARER_PREFIX  = "Bearer "
+	API_KEY_PREFIX = "mao_"
+
+	DEFAULT_ADMIN_USERNAME = "admin"
+	ACTOR_ANONYMOUS        = "anonymous"
+	ACTOR_API_KEY_PREFIX   = "apikey:"
+
+	MIN_PASSWORD_LENGTH = 8
+)
+
+var (
+	// username and api key name are used as a part of the config path, so "/" is not allowed.
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+	// used to spend the same time for the nonexistent user, against user enumeration.
+	dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("Mao-Service-Discovery"), bcrypt.DefaultCost)
+)
+
+type authUser struct {
+	passwordHash string
+	role         MaoApi.Role
+}
+
+type authApiKey struct {
+	keyDigest string
+	role      MaoApi.Role
+}
+
+type authSession struct {
+	username string
+	role     MaoApi.Role
+	expiry   time.Time
+}
+
+type LocalAuthModule struct {
+	users    map[string]*authUser    // username -> user
+	apiKeys  map[string]*authApiKey  // api key name -> api key
+	sessions map[string]*authSession // session id -> session
+	lock     sync.RWMutex
+
+	needShutdown bool
+}
+
+func (a *LocalAuthModule) RequireShutdown() {
+	a.needShutdown = true
+}
+
+func parseRole(roleStr string) (MaoApi.Role, bool) {
+	for i, s := range MaoApi.RoleString {
+		if s == roleStr && MaoApi.Role(i) != MaoApi.ROLE_PUBLIC {
+			return MaoApi.Role(i), true
+		}
+	}
+	return MaoApi.ROLE_PUBLIC, false
+}
+
+func generateRandomHex(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func generateApiKeyDigest(key string) string {
+	return base64.StdEncoding.EncodeToString(sm3.Sm3Sum([]byte(key)))
+}
+
+func getActor(c *gin.Context) string {
+	return c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+}
+
+// authenticate tries the bearer api key first, then the session cookie.
+func (a *LocalAuthModule) authenticate(c *gin.Context) (actor string, role MaoApi.Role, ok bool) {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, BEARER_PREFIX) {
+		digest := generateApiKeyDigest(strings.TrimPrefix(header, BEARER_PREFIX))
+
+		a.lock.RLock()
+		defer a.lock.RUnlock()
+		for name, apiKey := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(apiKey.keyDigest), []byte(digest)) == 1 {
+				return ACTOR_API_KEY_PREFIX + name, apiKey.role, true
+			}
+		}
+		return ACTOR_ANONYMOUS, MaoApi.ROLE_PUBLIC, false
+	}
+
+	sessionId, err := c.Cookie(SESSION_COOKIE_NAME)
+	if err != nil || sessionId == "" {
+		return ACTOR_ANONYMOUS, MaoApi.ROLE_PUBLIC, false
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	session, ok := a.sessions[sessionId]
+	if !ok || time.Now().After(session.expiry) {
+		return ACTOR_ANONYMOUS, MaoApi.ROLE_PUBLIC, false
+	}
+	return session.username, session.role, true
+}
+
+func (a *LocalAuthModule) Authorize(c *gin.Context, required MaoApi.Role) (httpStatus int) {
+	if required == MaoApi.ROLE_PUBLIC {
+		return http.StatusOK
+	}
+
+	target := fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path)
+
+	actor, role, ok := a.authenticate(c)
+	if !ok {
+		MaoCommon.RecordAudit(actor, c.ClientIP(), "authenticate", target, false, "missing or invalid credential")
+		return http.StatusUnauthorized
+	}
+	if role < required {
+		MaoCommon.RecordAudit(actor, c.ClientIP(), "authorize", target, false,
+			fmt.Sprintf("role %s is lower than %s", MaoApi.RoleString[role], MaoApi.RoleString[required]))
+		return http.StatusForbidden
+	}
+
+	c.Set(MaoApi.AUTH_CONTEXT_KEY_USERNAME, actor)
+	c.Set(MaoApi.AUTH_CONTEXT_KEY_ROLE, role)
+	return http.StatusOK
+}
+
+func (a *LocalAuthModule) sessionCleanLoop() {
+	checkInterval := time.Duration(60000) * time.Millisecond
+	checkTimer := time.NewTimer(checkInterval)
+	for {
+		<-checkTimer.C
+		if a.needShutdown {
+			util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+			return
+		}
+
+		now := time.Now()
+		a.lock.Lock()
+		for sessionId, session := range a.sessions {
+			if now.After(session.expiry) {
+				delete(a.sessions, sessionId)
+			}
+		}
+		a.lock.Unlock()
+
+		checkTimer.Reset(checkInterval)
+	}
+}
+
+func (a *LocalAuthModule) countAdmins() int {
+	count := 0
+	for _, user := range a.users {
+		if user.role == MaoApi.ROLE_ADMIN {
+			count++
+		}
+	}
+	return count
+}
+
+// must be called with a.lock held.
+func (a *LocalAuthModule) removeSessionsOfUser(username string) {
+	for sessionId, session := range a.sessions {
+		if session.username == username {
+			delete(a.sessions, sessionId)
+		}
+	}
+}
+
+func (a *LocalAuthModule) saveUser(actor string, username string, user *authUser) bool {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance, can't save user %s", username)
+		return false
+	}
+
+	var data interface{} // nil means to delete
+	if user != nil {
+		userData := make(map[string]interface{})
+		userData[AUTH_CONFIG_KEY_PASSWORD_HASH] = user.passwordHash
+		userData[AUTH_CONFIG_KEY_ROLE] = MaoApi.RoleString[user.role]
+		data = userData
+	}
+
+	_, errCode := configModule.PutConfigBy(actor, fmt.Sprintf("%s/%s", AUTH_USERS_CONFIG_PATH, username), data)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save user %s to config, errCode: %d", username, errCode)
+		return false
+	}
+	return true
+}
+
+func (a *LocalAuthModule) saveApiKey(actor string, name string, apiKey *authApiKey) bool {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance, can't save api key %s", name)
+		return false
+	}
+
+	var data interface{} // nil means to delete
+	if apiKey != nil {
+		apiKeyData := make(map[string]interface{})
+		apiKeyData[AUTH_CONFIG_KEY_KEY_DIGEST] = apiKey.keyDigest
+		apiKeyData[AUTH_CONFIG_KEY_ROLE] = MaoApi.RoleString[apiKey.role]
+		data = apiKeyData
+	}
+
+	_, errCode := configModule.PutConfigBy(actor, fmt.Sprintf("%s/%s", AUTH_API_KEYS_CONFIG_PATH, name), data)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save api key %s to config, errCode: %d", name, errCode)
+		return false
+	}
+	return true
+}
+
+// loadConfigEntries reads a map of map from the config, e.g. /auth/users/<username>/role
+func loadConfigEntries(path string) map[string]map[string]string {
+	entries := make(map[string]map[string]string)
+
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return entries
+	}
+
+	entriesObj, errCode := configModule.GetConfig(path)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		if errCode != Config.ERR_CODE_PATH_NOT_EXIST && errCode != Config.ERR_CODE_PATH_TRANSIT_FAIL {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read %s from config, errCode: %d", path, errCode)
+		}
+		return entries
+	}
+
+	entriesMap, ok := entriesObj.(map[string]interface{})
+	if !ok {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse %s, can't convert to map[string]interface{}", path)
+		return entries
+	}
+
+	for name, entryObj := range entriesMap {
+		entryMap, ok := entryObj.(map[string]interface{})
+		if !ok {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse %s/%s, can't convert to map[string]interface{}", path, name)
+			continue
+		}
+		entry := make(map[string]string)
+		for k, v := range entryMap {
+			if s, ok := v.(string); ok {
+				entry[k] = s
+			}
+		}
+		entries[name] = entry
+	}
+	return entries
+}
+
+func (a *LocalAuthModule) loadAuthConfig() {
+	for username, entry := range loadConfigEntries(AUTH_USERS_CONFIG_PATH) {
+		role, ok := parseRole(entry[AUTH_CONFIG_KEY_ROLE])
+		if !ok || entry[AUTH_CONFIG_KEY_PASSWORD_HASH] == "" {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse user config - %s", username)
+			continue
+		}
+		a.users[username] = &authUser{
+			passwordHash: entry[AUTH_CONFIG_KEY_PASSWORD_HASH],
+			role:         role,
+		}
+	}
+
+	for name, entry := range loadConfigEntries(AUTH_API_KEYS_CONFIG_PATH) {
+		role, ok := parseRole(entry[AUTH_CONFIG_KEY_ROLE])
+		if !ok || entry[AUTH_CONFIG_KEY_KEY_DIGEST] == "" {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse api key config - %s", name)
+			continue
+		}
+		a.apiKeys[name] = &authApiKey{
+			keyDigest: entry[AUTH_CONFIG_KEY_KEY_DIGEST],
+			role:      role,
+		}
+	}
+
+	util.MaoLogM(util.INFO, MODULE_NAME, "Loaded %d users and %d api keys from config", len(a.users), len(a.apiKeys))
+}
+
+// bootstrapAdmin creates the first admin with a random password, otherwise nobody can login.
+func (a *LocalAuthModule) bootstrapAdmin() bool {
+	if len(a.users) != 0 {
+		return true
+	}
+
+	password, err := generateRandomHex(8)
+	if err != nil {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to generate initial admin password, %s", err.Error())
+		return false
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to hash initial admin password, %s", err.Error())
+		return false
+	}
+
+	user := &authUser{
+		passwordHash: string(passwordHash),
+		role:         MaoApi.ROLE_ADMIN,
+	}
+	a.users[DEFAULT_ADMIN_USERNAME] = user
+	a.saveUser(MODULE_NAME, DEFAULT_ADMIN_USERNAME, user)
+
+	// The password is printed once to the console, not to the log which may be collected and kept.
+	util.MaoLogM(util.WARN, MODULE_NAME, "No user exists, created user \"%s\", the password is printed to stderr. Please change it after login.",
+		DEFAULT_ADMIN_USERNAME)
+	fmt.Fprintf(os.Stderr, "Initial password of user \"%s\": %s\n", DEFAULT_ADMIN_USERNAME, password)
+	return true
+}
+
+func (a *LocalAuthModule) InitLocalAuthModule() bool {
+	a.users = make(map[string]*authUser)
+	a.apiKeys = make(map[string]*authApiKey)
+	a.sessions = make(map[string]*authSession)
+	a.needShutdown = false
+
+	a.loadAuthConfig()
+	if !a.bootstrapAdmin() {
+		return false
+	}
+
+	go a.sessionCleanLoop()
+
+	a.configRestControlInterface()
+
+	return true
+}
+
+func (a *LocalAuthModule) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	restfulServer.SetAuthModule(a)
+
+	usernameParam := &MaoApi.ApiParam{Name: AUTH_API_KEY_USERNAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true}
+	roleParam := &MaoApi.ApiParam{Name: AUTH_API_KEY_ROLE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+		Description: "viewer, operator or admin"}
+	nameParam := &MaoApi.ApiParam{Name: AUTH_API_KEY_NAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+		Description: "name of the api key"}
+
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_PUBLIC, URL_AUTH_LOGIN, &MaoApi.ApiDoc{
+		Summary: "Login with username and password, the session is kept in the cookie",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{usernameParam,
+			{Name: AUTH_API_KEY_PASSWORD, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true}},
+		Response: map[string]string{},
+	}, a.processLogin)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_PUBLIC, URL_AUTH_LOGOUT, &MaoApi.ApiDoc{
+		Summary:  "Logout and remove the session",
+		Tag:      MODULE_NAME,
+		Response: "success",
+	}, a.processLogout)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_AUTH_WHOAMI, &MaoApi.ApiDoc{
+		Summary:  "Show the username and role of the current credential",
+		Tag:      MODULE_NAME,
+		Response: map[string]string{},
+	}, a.showWhoami)
+
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_USER_SHOW, &MaoApi.ApiDoc{
+		Summary:  "List all users and their roles",
+		Tag:      MODULE_NAME,
+		Response: []map[string]string{},
+	}, a.showUsers)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_USER_ADD, &MaoApi.ApiDoc{
+		Summary: "Create a user, or update the password and/or role of an existing user",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{usernameParam, roleParam,
+			{Name: AUTH_API_KEY_PASSWORD, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: fmt.Sprintf("at least %d characters, required for a new user", MIN_PASSWORD_LENGTH)}},
+		Response: "success",
+	}, a.processAddUser)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_USER_DEL, &MaoApi.ApiDoc{
+		Summary:  "Delete a user and all its sessions",
+		Tag:      MODULE_NAME,
+		Params:   []*MaoApi.ApiParam{usernameParam},
+		Response: "success",
+	}, a.processDelUser)
+
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_API_KEY_SHOW, &MaoApi.ApiDoc{
+		Summary:  "List all api keys and their roles",
+		Tag:      MODULE_NAME,
+		Response: []map[string]string{},
+	}, a.showApiKeys)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_API_KEY_ADD, &MaoApi.ApiDoc{
+		Summary:     "Generate an api key",
+		Description: "The key is returned only once in the \"key\" field. Use it as \"Authorization: Bearer <key>\".",
+		Tag:         MODULE_NAME,
+		Params:      []*MaoApi.ApiParam{nameParam, roleParam},
+		Response:    map[string]string{},
+	}, a.processAddApiKey)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_AUTH_API_KEY_DEL, &MaoApi.ApiDoc{
+		Summary:  "Delete an api key",
+		Tag:      MODULE_NAME,
+		Params:   []*MaoApi.ApiParam{nameParam},
+		Response: "success",
+	}, a.processDelApiKey)
+}
+
+func (a *LocalAuthModule) processLogin(c *gin.Context) {
+	username := c.PostForm(AUTH_API_KEY_USERNAME)
+	password := c.PostForm(AUTH_API_KEY_PASSWORD)
+
+	a.lock.RLock()
+	user, ok := a.users[username]
+	a.lock.RUnlock()
+
+	passwordHash := dummyPasswordHash
+	if ok {
+		passwordHash = []byte(user.passwordHash)
+	}
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil || !ok {
+		MaoCommon.RecordAudit(ACTOR_ANONYMOUS, c.ClientIP(), "login", username, false, "wrong username or password")
+		c.String(http.StatusUnauthorized, "wrong username or password")
+		return
+	}
+
+	sessionId, err := generateRandomHex(32)
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to generate session id, %s", err.Error())
+		c.String(http.StatusInternalServerError, "fail to create session")
+		return
+	}
+
+	a.lock.Lock()
+	a.sessions[sessionId] = &authSession{
+		username: username,
+		role:     user.role,
+		expiry:   time.Now().Add(SESSION_TTL),
+	}
+	a.lock.Unlock()
+
+	MaoCommon.RecordAudit(username, c.ClientIP(), "login", username, true, "")
+
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SESSION_COOKIE_NAME, sessionId, int(SESSION_TTL.Seconds()), "/", "", c.Request.TLS != nil, true)
+
+	data := make(map[string]interface{})
+	data[AUTH_API_KEY_USERNAME] = username
+	data[AUTH_API_KEY_ROLE] = MaoApi.RoleString[user.role]
+	c.JSON(200, data)
+}
+
+func (a *LocalAuthModule) processLogout(c *gin.Context) {
+	sessionId, err := c.Cookie(SESSION_COOKIE_NAME)
+	if err == nil {
+		a.lock.Lock()
+		delete(a.sessions, sessionId)
+		a.lock.Unlock()
+	}
+
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SESSION_COOKIE_NAME, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.String(200, "success")
+}
+
+func (a *LocalAuthModule) showWhoami(c *gin.Context) {
+	role, _ := c.Get(MaoApi.AUTH_CONTEXT_KEY_ROLE)
+
+	data := make(map[string]interface{})
+	data[AUTH_API_KEY_USERNAME] = getActor(c)
+	if r, ok := role.(MaoApi.Role); ok {
+		data[AUTH_API_KEY_ROLE] = MaoApi.RoleString[r]
+	}
+	c.JSON(200, data)
+}
+
+func (a *LocalAuthModule) showUsers(c *gin.Context) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	users := make([]map[string]interface{}, 0)
+	for username, user := range a.users {
+		data := make(map[string]interface{})
+		data[AUTH_API_KEY_USERNAME] = username
+		data[AUTH_API_KEY_ROLE] = MaoApi.RoleString[user.role]
+		// Attention: password hash can't be outputted !!!
+		users = append(users, data)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i][AUTH_API_KEY_USERNAME].(string) < users[j][AUTH_API_KEY_USERNAME].(string)
+	})
+	c.JSON(200, users)
+}
+
+// processAddUser creates a user, or updates the password and/or role of an existing user.
+func (a *LocalAuthModule) processAddUser(c *gin.Context) {
+	username := c.PostForm(AUTH_API_KEY_USERNAME)
+	password := c.PostForm(AUTH_API_KEY_PASSWORD)
+	roleStr := c.PostForm(AUTH_API_KEY_ROLE)
+
+	if !namePattern.MatchString(username) {
+		c.String(http.StatusBadRequest, "username is invalid")
+		return
+	}
+	role, ok := parseRole(roleStr)
+	if !ok {
+		c.String(http.StatusBadRequest, "role is invalid, should be one of viewer, operator, admin")
+		return
+	}
+	if password != "" && len(password) < MIN_PASSWORD_LENGTH {
+		c.String(http.StatusBadRequest, "password is too short, at least %d characters", MIN_PASSWORD_LENGTH)
+		return
+	}
+
+	var passwordHash string
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to hash password, %s", err.Error())
+			c.String(http.StatusInternalServerError, "fail to hash password")
+			return
+		}
+		passwordHash = string(hash)
+	}
+
+	a.lock.Lock()
+	user, exist := a.users[username]
+	if !exist {
+		if passwordHash == "" {
+			a.lock.Unlock()
+			c.String(http.StatusBadRequest, "password is required for a new user")
+			return
+		}
+		user = &authUser{}
+	}
+	if exist && user.role == MaoApi.ROLE_ADMIN && role != MaoApi.ROLE_ADMIN && a.countAdmins() == 1 {
+		a.lock.Unlock()
+		c.String(http.StatusBadRequest, "can't downgrade the last admin")
+		return
+	}
+
+	newUser := &authUser{
+		passwordHash: user.passwordHash,
+		role:         role,
+	}
+	if passwordHash != "" {
+		newUser.passwordHash = passwordHash
+	}
+	a.users[username] = newUser
+	a.removeSessionsOfUser(username) // the user need to login again with the new password or role.
+	a.lock.Unlock()
+
+	success := a.saveUser(getActor(c), username, newUser)
+	MaoCommon.RecordAudit(getActor(c), c.ClientIP(), "addUser", username, success, fmt.Sprintf("role %s", roleStr))
+	if !success {
+		a.lock.Lock()
+		if a.users[username] == newUser {
+			if exist {
+				a.users[username] = user
+			} else {
+				delete(a.users, username)
+			}
+		}
+		a.lock.Unlock()
+		c.String(http.StatusInternalServerError, "fail to save user")
+		return
+	}
+	c.String(200, "success")
+}
+
+func (a *LocalAuthModule) processDelUser(c *gin.Context) {
+	username := c.PostForm(AUTH_API_KEY_USERNAME)
+
+	a.lock.Lock()
+	user, exist := a.users[username]
+	if !exist {
+		a.lock.Unlock()
+		c.String(http.StatusNotFound, "user not found")
+		return
+	}
+	if user.role == MaoApi.ROLE_ADMIN && a.countAdmins() == 1 {
+		a.lock.Unlock()
+		c.String(http.StatusBadRequest, "can't delete the last admin")
+		return
+	}
+	delete(a.users, username)
+	a.removeSessionsOfUser(username)
+	a.lock.Unlock()
+
+	success := a.saveUser(getActor(c), username, nil)
+	MaoCommon.RecordAudit(getActor(c), c.ClientIP(), "delUser", username, success, "")
+	if !success {
+		a.lock.Lock()
+		if _, exist := a.users[username]; !exist {
+			a.users[username] = user
+		}
+		a.lock.Unlock()
+		c.String(http.StatusInternalServerError, "fail to delete user")
+		return
+	}
+	c.String(200, "success")
+}
+
+func (a *LocalAuthModule) showApiKeys(c *gin.Context) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	apiKeys := make([]map[string]interface{}, 0)
+	for name, apiKey := range a.apiKeys {
+		data := make(map[string]interface{})
+		data[AUTH_API_KEY_NAME] = name
+		data[AUTH_API_KEY_ROLE] = MaoApi.RoleString[apiKey.role]
+		apiKeys = append(apiKeys, data)
+	}
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i][AUTH_API_KEY_NAME].(string) < apiKeys[j][AUTH_API_KEY_NAME].(string)
+	})
+	c.JSON(200, apiKeys)
+}
+
+// processAddApiKey generates a new api key. The key is returned only once, we store its digest.
+func (a *LocalAuthModule) processAddApiKey(c *gin.Context) {
+	name := c.PostForm(AUTH_API_KEY_NAME)
+	roleStr := c.PostForm(AUTH_API_KEY_ROLE)
+
+	if !namePattern.MatchString(name) {
+		c.String(http.StatusBadRequest, "name is invalid")
+		return
+	}
+	role, ok := parseRole(roleStr)
+	if !ok {
+		c.String(http.StatusBadRequest, "role is invalid, should be one of viewer, operator, admin")
+		return
+	}
+
+	randomHex, err := generateRandomHex(32)
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to generate api key, %s", err.Error())
+		c.String(http.StatusInternalServerError, "fail to generate api key")
+		return
+	}
+	key := API_KEY_PREFIX + randomHex
+
+	apiKey := &authApiKey{
+		keyDigest: generateApiKeyDigest(key),
+		role:      role,
+	}
+
+	a.lock.Lock()
+	oldApiKey, exist := a.apiKeys[name]
+	a.apiKeys[name] = apiKey
+	a.lock.Unlock()
+
+	success := a.saveApiKey(getActor(c), name, apiKey)
+	MaoCommon.RecordAudit(getActor(c), c.ClientIP(), "addApiKey", name, success, fmt.Sprintf("role %s", roleStr))
+	if !success {
+		a.lock.Lock()
+		if a.apiKeys[name] == apiKey {
+			if exist {
+				a.apiKeys[name] = oldApiKey
+			} else {
+				delete(a.apiKeys, name)
+			}
+		}
+		a.lock.Unlock()
+		c.String(http.StatusInternalServerError, "fail to save api key")
+		return
+	}
+
+	data := make(map[string]interface{})
+	data[AUTH_API_KEY_NAME] = name
+	data[AUTH_API_KEY_ROLE] = roleStr
+	data["key"] = key
+	c.JSON(200, data)
+}
+
+func (a *LocalAuthModule) processDelApiKey(c *gin.Context) {
+	name := c.PostForm(AUTH_API_KEY_NAME)
+
+	a.lock.Lock()
+	apiKey, exist := a.apiKeys[name]
+	delete(a.apiKeys, name)
+	a.lock.Unlock()
+
+	if !exist {
+		c.String(http.StatusNotFound, "api key not found")
+		return
+	}
+
+	success := a.saveApiKey(getActor(c), name, nil)
+	MaoCommon.RecordAudit(getActor(c), c.ClientIP(), "delApiKey", name, success, "")
+	if !success {
+		a.lock.Lock()
+		if _, exist := a.apiKeys[name]; !exist {
+			a.apiKeys[name] = apiKey
+		}
+		a.lock.Unlock()
+		c.String(http.StatusInternalServerError, "fail to delete api key")
+		return
+	}
+	c.String(200, "success")
+}
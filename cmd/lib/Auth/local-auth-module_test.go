@@ -0,0 +1,116 @@
+package Auth
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestContext(header string, cookie string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/showServiceIP", nil)
+	if header != "" {
+		c.Request.Header.Set("Authorization", header)
+	}
+	if cookie != "" {
+		c.Request.AddCookie(&http.Cookie{Name: SESSION_COOKIE_NAME, Value: cookie})
+	}
+	return c
+}
+
+func TestLocalAuthModule_Authorize(t *testing.T) {
+	a := &LocalAuthModule{
+		users:    make(map[string]*authUser),
+		apiKeys:  make(map[string]*authApiKey),
+		sessions: make(map[string]*authSession),
+	}
+	a.apiKeys["script"] = &authApiKey{keyDigest: generateApiKeyDigest("mao_key"), role: MaoApi.ROLE_OPERATOR}
+	a.sessions["alive"] = &authSession{username: "beijing", role: MaoApi.ROLE_VIEWER, expiry: time.Now().Add(time.Hour)}
+	a.sessions["expired"] = &authSession{username: "qingdao", role: MaoApi.ROLE_ADMIN, expiry: time.Now().Add(-time.Hour)}
+
+	cases := []struct {
+		header   string
+		cookie   string
+		required MaoApi.Role
+		expected int
+	}{
+		{"", "", MaoApi.ROLE_PUBLIC, http.StatusOK},
+		{"", "", MaoApi.ROLE_VIEWER, http.StatusUnauthorized},
+		{"Bearer mao_key", "", MaoApi.ROLE_OPERATOR, http.StatusOK},
+		{"Bearer mao_key", "", MaoApi.ROLE_ADMIN, http.StatusForbidden},
+		{"Bearer mao_wrong", "alive", MaoApi.ROLE_VIEWER, http.StatusUnauthorized},
+		{"", "alive", MaoApi.ROLE_VIEWER, http.StatusOK},
+		{"", "alive", MaoApi.ROLE_OPERATOR, http.StatusForbidden},
+		{"", "expired", MaoApi.ROLE_VIEWER, http.StatusUnauthorized},
+	}
+	for i, cs := range cases {
+		c := newTestContext(cs.header, cs.cookie)
+		if status := a.Authorize(c, cs.required); status != cs.expected {
+			t.Errorf("case %d: expected %d, got %d", i, cs.expected, status)
+		}
+	}
+
+	c := newTestContext("Bearer mao_key", "")
+	a.Authorize(c, MaoApi.ROLE_VIEWER)
+	if getActor(c) != ACTOR_API_KEY_PREFIX+"script" {
+		t.Errorf("actor is not recorded, got %s", getActor(c))
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	if role, ok := parseRole("operator"); !ok || role != MaoApi.ROLE_OPERATOR {
+		t.Errorf("Fail to parse operator, %v, %v", role, ok)
+	}
+	if _, ok := parseRole("public"); ok {
+		t.Errorf("public should not be assignable")
+	}
+	if _, ok := parseRole("root"); ok {
+		t.Errorf("root should be invalid")
+	}
+}
+
+func newTestPostContext(form url.Values) (*gin.Context, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("POST", "/api/addUser", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c, recorder
+}
+
+// No config module is registered in the test, so every save fails and the change must be restored.
+func TestLocalAuthModule_SaveFail(t *testing.T) {
+	admin := &authUser{passwordHash: "hash", role: MaoApi.ROLE_ADMIN}
+	viewer := &authUser{passwordHash: "hash", role: MaoApi.ROLE_VIEWER}
+	script := &authApiKey{keyDigest: generateApiKeyDigest("mao_key"), role: MaoApi.ROLE_OPERATOR}
+	a := &LocalAuthModule{
+		users:    map[string]*authUser{"admin": admin, "beijing": viewer},
+		apiKeys:  map[string]*authApiKey{"script": script},
+		sessions: make(map[string]*authSession),
+	}
+
+	c, recorder := newTestPostContext(url.Values{AUTH_API_KEY_USERNAME: {"qingdao"}, AUTH_API_KEY_PASSWORD: {"qingdao-password"}, AUTH_API_KEY_ROLE: {"viewer"}})
+	if a.processAddUser(c); recorder.Code != http.StatusInternalServerError || a.users["qingdao"] != nil {
+		t.Errorf("new user is not removed, %d", recorder.Code)
+	}
+	c, recorder = newTestPostContext(url.Values{AUTH_API_KEY_USERNAME: {"beijing"}, AUTH_API_KEY_ROLE: {"operator"}})
+	if a.processAddUser(c); recorder.Code != http.StatusInternalServerError || a.users["beijing"] != viewer {
+		t.Errorf("updated user is not restored, %d", recorder.Code)
+	}
+	c, recorder = newTestPostContext(url.Values{AUTH_API_KEY_USERNAME: {"beijing"}})
+	if a.processDelUser(c); recorder.Code != http.StatusInternalServerError || a.users["beijing"] != viewer {
+		t.Errorf("deleted user is not restored, %d", recorder.Code)
+	}
+	c, recorder = newTestPostContext(url.Values{AUTH_API_KEY_NAME: {"script"}, AUTH_API_KEY_ROLE: {"viewer"}})
+	if a.processAddApiKey(c); recorder.Code != http.StatusInternalServerError || a.apiKeys["script"] != script {
+		t.Errorf("replaced api key is not restored, %d", recorder.Code)
+	}
+	c, recorder = newTestPostContext(url.Values{AUTH_API_KEY_NAME: {"script"}})
+	if a.processDelApiKey(c); recorder.Code != http.StatusInternalServerError || a.apiKeys["script"] != script {
+		t.Errorf("deleted api key is not restored, %d", recorder.Code)
+	}
+}
@@ -0,0 +1,353 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	yaml "gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_BUNDLE_FORMAT = "mao-config-bundle/1"
+
+	CONFIG_BUNDLE_SECRETS_ENCRYPTED = "encrypted" // the sec configs are kept, encrypted under the current sec key
+	CONFIG_BUNDLE_SECRETS_OMITTED   = "omitted"
+
+	CONFIG_BUNDLE_FILENAME = "mao-config-bundle.yaml"
+	CONFIG_BUNDLE_MAX_SIZE = 4 << 20
+
+	CONFIG_IMPORT_ACTION_ADD    = "add"
+	CONFIG_IMPORT_ACTION_UPDATE = "update"
+)
+
+// the users and api keys are hashed, not encrypted under the sec key, they are never exported.
+var configBundleExcludedPaths = []string{"/auth"}
+
+// ConfigBundle is the whole config in one portable YAML document, for rebuilding the server.
+type ConfigBundle struct {
+	Format       string                 `yaml:"format"`
+	ExportedAt   time.Time              `yaml:"exportedAt"`
+	ExportedBy   string                 `yaml:"exportedBy"`
+	Secrets      string                 `yaml:"secrets"`
+	SecKeyDigest string                 `yaml:"secKeyDigest,omitempty"` // the digest of the key encrypting the sec configs
+	Config       map[string]interface{} `yaml:"config"`
+}
+
+// ConfigImportChange is one value changed by the import, the values of sec configs are not shown.
+type ConfigImportChange struct {
+	Path     string      `json:"path"`
+	Action   string      `json:"action"` // add or update, the configs only on this server are kept
+	OldValue interface{} `json:"oldValue,omitempty"`
+	NewValue interface{} `json:"newValue,omitempty"`
+	Sec      bool        `json:"sec"`
+}
+
+type ConfigImportResult struct {
+	Applied  bool                  `json:"applied"`
+	Sections []string              `json:"sections"` // the top level paths put one by one, e.g. /email
+	Changes  []*ConfigImportChange `json:"changes"`
+}
+
+// currentConfig returns a copy of the config and its version, taken in the eventLoop.
+// The version is zero if there is none in the history.
+func (C *ConfigYamlModule) currentConfig() (*configSnapshot, error) {
+	result := make(chan eventResult, 1)
+	ret := C.submitEvent(&configEvent{
+		eventType: EVENT_SNAPSHOT,
+		result:    result,
+	})
+	if ret.errCode != ERR_CODE_SUCCESS {
+		if err, ok := ret.result.(error); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("fail to read the config, errCode: %d", ret.errCode)
+	}
+	return ret.result.(*configSnapshot), nil
+}
+
+// processSnapshot runs in the eventLoop.
+func (C *ConfigYamlModule) processSnapshot(config map[string]interface{}, event *configEvent) {
+	copied, err := copyConfig(config)
+	if err != nil {
+		event.result <- eventResult{errCode: ERR_CODE_PATH_TRANSIT_FAIL, result: err}
+		return
+	}
+	snapshot := &configSnapshot{Config: copied}
+	if versions := C.history.getVersions(); len(versions) > 0 {
+		snapshot.ConfigVersion = *versions[len(versions)-1]
+	}
+	event.result <- eventResult{errCode: ERR_CODE_SUCCESS, result: snapshot}
+}
+
+// removeConfigPath removes the path and the maps left empty.
+func removeConfigPath(config map[string]interface{}, path string) {
+	keys := strings.Split(strings.Trim(path, "/"), "/")
+	parent, ok := lookupConfigPath(config, strings.Join(keys[:len(keys)-1], "/"))
+	parentMap, okMap := parent.(map[string]interface{})
+	if !ok || !okMap {
+		return
+	}
+	delete(parentMap, keys[len(keys)-1])
+	if len(parentMap) == 0 && len(keys) > 1 {
+		removeConfigPath(config, strings.Join(keys[:len(keys)-1], "/"))
+	}
+}
+
+// isSecKey returns the name of the sec config, if the key is its ciphertext, iv or algorithm.
+func isSecKey(key string) (string, bool) {
+	for _, suffix := range []string{ENC_DEC_SUFFIX_IV, ENC_DEC_SUFFIX_ALGORITHM, ENC_DEC_SUFFIX_CIPHER} {
+		if strings.HasSuffix(key, suffix) {
+			return strings.TrimSuffix(key, suffix), true
+		}
+	}
+	return "", false
+}
+
+// removeSecValues removes the sec configs under the config, returns the number of them.
+func removeSecValues(config map[string]interface{}) int {
+	removed := 0
+	for key, value := range config {
+		if subConfig, ok := value.(map[string]interface{}); ok {
+			removed += removeSecValues(subConfig)
+			if len(subConfig) == 0 {
+				delete(config, key)
+			}
+			continue
+		}
+		if _, ok := isSecKey(key); ok {
+			if strings.HasSuffix(key, ENC_DEC_SUFFIX_CIPHER) {
+				removed++
+			}
+			delete(config, key)
+		}
+	}
+	return removed
+}
+
+// mergeConfig puts the values of src into dst, the maps are merged and the others are replaced, e.g. the lists.
+func mergeConfig(dst map[string]interface{}, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, okSrc := value.(map[string]interface{})
+		dstMap, okDst := dst[key].(map[string]interface{})
+		if okSrc && okDst {
+			mergeConfig(dstMap, srcMap)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// diffImport lists the values in the new config different from the old one, sorted by path.
+func diffImport(path string, oldConfig map[string]interface{}, newConfig map[string]interface{}, changes []*ConfigImportChange) []*ConfigImportChange {
+	keys := make([]string, 0, len(newConfig))
+	for key := range newConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		oldValue, exist := oldConfig[key]
+		newValue := newConfig[key]
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		oldMap, okOld := oldValue.(map[string]interface{})
+		newMap, okNew := newValue.(map[string]interface{})
+		if okNew && (okOld || !exist) {
+			changes = diffImport(path+"/"+key, oldMap, newMap, changes)
+			continue
+		}
+
+		change := &ConfigImportChange{Path: path + "/" + key, Action: CONFIG_IMPORT_ACTION_ADD, OldValue: oldValue, NewValue: newValue}
+		if exist {
+			change.Action = CONFIG_IMPORT_ACTION_UPDATE
+		}
+		if name, sec := isSecKey(key); sec {
+			// one change for the ciphertext, iv and algorithm.
+			_, exist = oldConfig[name+ENC_DEC_SUFFIX_CIPHER]
+			change = &ConfigImportChange{Path: path + "/" + name, Action: CONFIG_IMPORT_ACTION_ADD, Sec: true}
+			if exist {
+				change.Action = CONFIG_IMPORT_ACTION_UPDATE
+			}
+			if len(changes) > 0 && changes[len(changes)-1].Path == change.Path {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// ExportConfig outputs the whole config as a bundle, the sec configs are encrypted under the current sec key, or omitted.
+func (C *ConfigYamlModule) ExportConfig(secrets string, actor string) ([]byte, error) {
+	if secrets != CONFIG_BUNDLE_SECRETS_ENCRYPTED && secrets != CONFIG_BUNDLE_SECRETS_OMITTED {
+		return nil, fmt.Errorf("secrets should be %s or %s", CONFIG_BUNDLE_SECRETS_ENCRYPTED, CONFIG_BUNDLE_SECRETS_OMITTED)
+	}
+	snapshot, err := C.currentConfig()
+	if err != nil {
+		return nil, err
+	}
+	config := snapshot.Config
+
+	bundle := &ConfigBundle{
+		Format:     CONFIG_BUNDLE_FORMAT,
+		ExportedAt: time.Now(),
+		ExportedBy: actor,
+		Secrets:    secrets,
+		Config:     config,
+	}
+	digest, _ := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST)
+	for _, path := range append(configBundleExcludedPaths, CONFIG_PATH_SEC_KEY_DIGEST) {
+		removeConfigPath(config, path)
+	}
+	if secrets == CONFIG_BUNDLE_SECRETS_OMITTED {
+		removeSecValues(config)
+	} else {
+		bundle.SecKeyDigest, _ = digest.(string)
+	}
+	return yaml.Marshal(bundle)
+}
+
+// ImportConfig previews the changes of the bundle, and applies them by PutConfig if apply is true.
+// The values in the bundle are added or updated, the configs only on this server are kept.
+// The sec configs need the same sec key as the exporting server, the digest is taken if this server has no sec key yet.
+// If a section fails, the config is rolled back to the version before the import.
+func (C *ConfigYamlModule) ImportConfig(content []byte, apply bool, actor string) (*ConfigImportResult, error) {
+	bundle := &ConfigBundle{}
+	if err := yaml.Unmarshal(content, bundle); err != nil {
+		return nil, fmt.Errorf("the bundle is invalid, %s", err.Error())
+	}
+	if bundle.Format != CONFIG_BUNDLE_FORMAT {
+		return nil, fmt.Errorf("unknown bundle format %s, expect %s", bundle.Format, CONFIG_BUNDLE_FORMAT)
+	}
+	if bundle.Config == nil {
+		bundle.Config = make(map[string]interface{})
+	}
+	for _, path := range append(configBundleExcludedPaths, CONFIG_PATH_SEC_KEY_DIGEST) {
+		removeConfigPath(bundle.Config, path)
+	}
+
+	snapshot, err := C.currentConfig()
+	if err != nil {
+		return nil, err
+	}
+	current := snapshot.Config
+	merged, err := copyConfig(current)
+	if err != nil {
+		return nil, err
+	}
+	mergeConfig(merged, bundle.Config)
+
+	secConfig, err := copyConfig(bundle.Config)
+	if err != nil {
+		return nil, err
+	}
+	if removeSecValues(secConfig) > 0 {
+		currentDigest, _ := lookupConfigPath(current, CONFIG_PATH_SEC_KEY_DIGEST)
+		if bundle.SecKeyDigest == "" {
+			return nil, errors.New("the bundle contains sec configs without the sec key digest")
+		}
+		if currentDigest == nil {
+			mergeConfig(merged, map[string]interface{}{"config": map[string]interface{}{"secKeyDigest": bundle.SecKeyDigest}})
+		} else if currentDigest != bundle.SecKeyDigest {
+			return nil, errors.New("the sec configs are encrypted under another sec key, rotate to the same key first, or export with secrets omitted")
+		}
+	}
+	if err = validateSecPairs(merged, ""); err != nil {
+		return nil, err
+	}
+	if err = C.validateConfigSchemas(merged); err != nil {
+		return nil, err
+	}
+
+	result := &ConfigImportResult{
+		Sections: make([]string, 0),
+		Changes:  diffImport("", current, merged, make([]*ConfigImportChange, 0)),
+	}
+	for _, change := range result.Changes {
+		section := "/" + strings.Split(strings.Trim(change.Path, "/"), "/")[0]
+		if len(result.Sections) == 0 || result.Sections[len(result.Sections)-1] != section {
+			result.Sections = append(result.Sections, section)
+		}
+	}
+	if !apply {
+		return result, nil
+	}
+
+	for i, section := range result.Sections {
+		value, _ := lookupConfigPath(merged, section)
+		if _, errCode := C.PutConfigBy(actor, section, value); errCode != ERR_CODE_SUCCESS {
+			err = fmt.Errorf("fail to put %s, code %d", section, errCode)
+			if i == 0 {
+				return result, err
+			}
+			if snapshot.Version == 0 {
+				return result, fmt.Errorf("%s, the sections before it are imported: %v, there is no version to roll back to", err.Error(), result.Sections[:i])
+			}
+			if _, rollbackErr := C.RollbackConfig(snapshot.Version, actor); rollbackErr != nil {
+				return result, fmt.Errorf("%s, the sections before it are imported: %v, and fail to roll back, %s", err.Error(), result.Sections[:i], rollbackErr.Error())
+			}
+			return result, fmt.Errorf("%s, the config is rolled back to version %d", err.Error(), snapshot.Version)
+		}
+	}
+	result.Applied = true
+	return result, nil
+}
+
+func (C *ConfigYamlModule) processExportConfig(c *gin.Context) {
+	secrets := c.DefaultQuery(CONFIG_API_KEY_SECRETS, CONFIG_BUNDLE_SECRETS_OMITTED)
+	content, err := C.ExportConfig(secrets, c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME))
+	if err != nil {
+		MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "export config", "config", false, err.Error())
+		c.String(400, err.Error())
+		return
+	}
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "export config", "config", true, "secrets "+secrets)
+	c.Header("Content-Disposition", "attachment; filename="+CONFIG_BUNDLE_FILENAME)
+	c.Data(200, "application/x-yaml", content)
+}
+
+// processImportConfig accepts the bundle as an uploaded file or a form value.
+func (C *ConfigYamlModule) processImportConfig(c *gin.Context) {
+	var content []byte
+	if file, err := c.FormFile(CONFIG_API_KEY_BUNDLE); err == nil {
+		reader, err := file.Open()
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		content, err = io.ReadAll(io.LimitReader(reader, CONFIG_BUNDLE_MAX_SIZE))
+		reader.Close()
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+	} else if bundle, ok := c.GetPostForm(CONFIG_API_KEY_BUNDLE); ok {
+		content = []byte(bundle)
+	} else {
+		c.String(400, "Not contained the bundle")
+		return
+	}
+	apply := c.PostForm(CONFIG_API_KEY_APPLY) == "true"
+
+	result, err := C.ImportConfig(content, apply, c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME))
+	if apply {
+		if err != nil {
+			MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "import config", "config", false, err.Error())
+		} else {
+			MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "import config", "config", true, fmt.Sprintf("%d changes in %v", len(result.Changes), result.Sections))
+		}
+	}
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	c.JSON(200, result)
+}
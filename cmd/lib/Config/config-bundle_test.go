@@ -0,0 +1,175 @@
+package Config
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newBundleTestModule(t *testing.T, secKey string) *ConfigYamlModule {
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(filepath.Join(t.TempDir(), "mao-config.yaml")) {
+		t.Fatal("fail to init config module")
+	}
+	if secKey != "" {
+		if err := configModule.unlockSecKey(secKey, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return configModule
+}
+
+func TestConfigBundle_ExportImport(t *testing.T) {
+	source := newBundleTestModule(t, "mao-key")
+	defer source.Shutdown()
+	services := []interface{}{map[string]interface{}{"address": "2001:db8::1"}}
+	source.PutConfig("/icmp-ka/services", services)
+	source.PutConfig("/email/sender", "mao@example.com")
+	source.PutSecConfig("/email/password", "email-secret")
+	source.PutConfig("/modules/onos/enabled", false)
+	source.PutConfig("/auth/users", []interface{}{"admin"})
+
+	if _, err := source.ExportConfig("plain", "admin"); err == nil {
+		t.Errorf("expect error for the unknown secrets option")
+	}
+	omitted, err := source.ExportConfig(CONFIG_BUNDLE_SECRETS_OMITTED, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hidden := range []string{ENC_DEC_SUFFIX_CIPHER, "secKeyDigest", "auth"} {
+		if strings.Contains(string(omitted), hidden) {
+			t.Errorf("%s is exported with secrets omitted:\n%s", hidden, omitted)
+		}
+	}
+	encrypted, err := source.ExportConfig(CONFIG_BUNDLE_SECRETS_ENCRYPTED, "admin")
+	if err != nil || !strings.Contains(string(encrypted), "password"+ENC_DEC_SUFFIX_CIPHER) || strings.Contains(string(encrypted), "auth") {
+		t.Fatalf("unexpected bundle %v:\n%s", err, encrypted)
+	}
+
+	// a new server without the sec key takes the digest of the bundle.
+	target := newBundleTestModule(t, "")
+	defer target.Shutdown()
+	target.PutConfig("/email/sender", "old@example.com")
+	target.PutConfig("/wechat/enabled", true)
+
+	preview, err := target.ImportConfig(encrypted, false, "admin")
+	if err != nil || preview.Applied {
+		t.Fatalf("unexpected preview %+v, %v", preview, err)
+	}
+	changes := make(map[string]string)
+	for _, change := range preview.Changes {
+		changes[change.Path] = change.Action
+		if change.Sec && (change.OldValue != nil || change.NewValue != nil) {
+			t.Errorf("the sec value is shown, %+v", change)
+		}
+	}
+	expect := map[string]string{
+		"/config/secKeyDigest":  CONFIG_IMPORT_ACTION_ADD,
+		"/email/password":       CONFIG_IMPORT_ACTION_ADD,
+		"/email/sender":         CONFIG_IMPORT_ACTION_UPDATE,
+		"/icmp-ka/services":     CONFIG_IMPORT_ACTION_ADD,
+		"/modules/onos/enabled": CONFIG_IMPORT_ACTION_ADD,
+	}
+	if !reflect.DeepEqual(changes, expect) || !reflect.DeepEqual(preview.Sections, []string{"/config", "/email", "/icmp-ka", "/modules"}) {
+		t.Errorf("unexpected changes %v, sections %v", changes, preview.Sections)
+	}
+	if sender, _ := target.GetConfig("/email/sender"); sender != "old@example.com" {
+		t.Errorf("the preview changes the config")
+	}
+
+	result, err := target.ImportConfig(encrypted, true, "admin")
+	if err != nil || !result.Applied {
+		t.Fatalf("unexpected result %+v, %v", result, err)
+	}
+	if value, _ := target.GetConfig("/icmp-ka/services"); !reflect.DeepEqual(value, services) {
+		t.Errorf("unexpected services %v", value)
+	}
+	if value, _ := target.GetConfig("/wechat/enabled"); value != true {
+		t.Errorf("the config only on the target is removed")
+	}
+	if err = target.unlockSecKey("other-key", ""); err == nil {
+		t.Errorf("expect the key not matching the imported digest rejected")
+	}
+	target.unlockSecKey("mao-key", "")
+	if password, _ := target.GetSecConfig("/email/password"); password != "email-secret" {
+		t.Errorf("expect the imported sec config decrypted, got %v", password)
+	}
+	if result, err = target.ImportConfig(encrypted, false, "admin"); err != nil || len(result.Changes) != 0 {
+		t.Errorf("expect no change after import, %+v, %v", result, err)
+	}
+
+	// the server with another sec key only takes the bundle without secrets.
+	other := newBundleTestModule(t, "other-key")
+	defer other.Shutdown()
+	if _, err = other.ImportConfig(encrypted, true, "admin"); err == nil {
+		t.Errorf("expect error for the secrets under another key")
+	}
+	if _, err = other.ImportConfig(omitted, true, "admin"); err != nil {
+		t.Errorf("expect the bundle without secrets imported, %v", err)
+	}
+
+	other.RegisterConfigSchema("/icmp-ka/services", []*testServiceSchema{})
+	invalid := strings.Replace(string(omitted), "2001:db8::1", "not-an-ip", 1)
+	if _, err = other.ImportConfig([]byte(invalid), false, "admin"); err == nil {
+		t.Errorf("expect the invalid bundle rejected")
+	}
+	if _, err = other.ImportConfig([]byte("format: other\n"), false, "admin"); err == nil {
+		t.Errorf("expect the unknown format rejected")
+	}
+}
+
+// failingConfigStore fails the save of the given count once.
+type failingConfigStore struct {
+	ConfigStore
+	saves  int
+	failAt int
+}
+
+func (f *failingConfigStore) Save(content []byte, revision string) (string, error) {
+	f.saves++
+	if f.saves == f.failAt {
+		return "", errors.New("no space left on device")
+	}
+	return f.ConfigStore.Save(content, revision)
+}
+
+func TestConfigBundle_ImportRollback(t *testing.T) {
+	source := newBundleTestModule(t, "")
+	defer source.Shutdown()
+	source.PutConfig("/email/sender", "mao@example.com")
+	source.PutConfig("/icmp-ka/services", []interface{}{map[string]interface{}{"address": "2001:db8::1"}})
+	bundle, err := source.ExportConfig(CONFIG_BUNDLE_SECRETS_OMITTED, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	store := &failingConfigStore{ConfigStore: newFileConfigStore(configFile)}
+	target := &ConfigYamlModule{}
+	target.SetConfigStore(store)
+	if !target.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer target.Shutdown()
+	target.PutConfig("/email/sender", "old@example.com")
+	versions := target.GetConfigHistory()
+	before := versions[len(versions)-1].Version
+
+	// /email is imported, /icmp-ka fails.
+	store.failAt = store.saves + 2
+	if _, err = target.ImportConfig(bundle, true, "admin"); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("expect the import rolled back, %v", err)
+	}
+	if sender, _ := target.GetConfig("/email/sender"); sender != "old@example.com" {
+		t.Errorf("the section imported is not rolled back, %v", sender)
+	}
+	if services, _ := target.GetConfig("/icmp-ka/services"); services != nil {
+		t.Errorf("the failed section is kept, %v", services)
+	}
+	versions = target.GetConfigHistory()
+	if last := versions[len(versions)-1]; last.RollbackOf != before {
+		t.Errorf("expect the rollback to version %d recorded, %+v", before, last)
+	}
+}
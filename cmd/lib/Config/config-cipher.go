@@ -0,0 +1,64 @@
+package Config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"github.com/MaoJianwei/gmsm/sm4"
+)
+
+const (
+	SEC_ALGORITHM_SM4_GCM = "sm4-gcm"
+	SEC_ALGORITHM_AES_GCM = "aes-256-gcm"
+)
+
+// IsSecAlgorithm returns true if the algorithm can encrypt the sec configs.
+func IsSecAlgorithm(algorithm string) bool {
+	return algorithm == SEC_ALGORITHM_SM4_GCM || algorithm == SEC_ALGORITHM_AES_GCM
+}
+
+// SetSecAlgorithm sets the algorithm for the sec configs put later, the existing ones are decrypted by their own algorithm.
+// Call it before InitConfigModule.
+func (C *ConfigYamlModule) SetSecAlgorithm(algorithm string) error {
+	if !IsSecAlgorithm(algorithm) {
+		return fmt.Errorf("unknown sec algorithm %s", algorithm)
+	}
+	C.secAlgorithm = algorithm
+	return nil
+}
+
+func (C *ConfigYamlModule) getSecAlgorithm() string {
+	if C.secAlgorithm == "" {
+		return SEC_ALGORITHM_SM4_GCM
+	}
+	return C.secAlgorithm
+}
+
+// secGcm encrypts or decrypts by the algorithm, "" is SM4-GCM for the sec configs before the algorithm is recorded.
+func secGcm(secKey string, algorithm string, iv []byte, input []byte, encrypt bool) ([]byte, error) {
+	switch algorithm {
+	case "", SEC_ALGORITHM_SM4_GCM:
+		output, _, err := sm4.Sm4GCM(fixSecKey(secKey), iv, input, nil, encrypt) // todo - --- TO check nil A
+		return output, err
+	case SEC_ALGORITHM_AES_GCM:
+		key := sha256.Sum256([]byte(secKey)) // AES-256, the digest stored in the config is SM3.
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(iv) != gcm.NonceSize() {
+			return nil, fmt.Errorf("the length of iv is %d, expect %d", len(iv), gcm.NonceSize())
+		}
+		if encrypt {
+			return gcm.Seal(nil, iv, input, nil), nil
+		}
+		return gcm.Open(nil, iv, input, nil)
+	default:
+		return nil, fmt.Errorf("unknown sec algorithm %s", algorithm)
+	}
+}
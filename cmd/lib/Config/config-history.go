@@ -0,0 +1,347 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"bytes"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CONFIG_HISTORY_DIR_SUFFIX   = ".history" // the history is kept in <config file>.history/
+	CONFIG_HISTORY_MAX_VERSIONS = 100
+
+	// context lines around the changed lines in the diff.
+	CONFIG_DIFF_CONTEXT_LINES = 2
+)
+
+// ConfigVersion is one write of the config file.
+// The whole config of the version is kept in the history dir, for rolling back.
+type ConfigVersion struct {
+	Version   uint64    `json:"version" yaml:"version"`
+	Timestamp time.Time `json:"timestamp" yaml:"timestamp"`
+	Path      string    `json:"path" yaml:"path"`   // "/" for the whole config, e.g. loaded from the file or rolled back
+	Actor     string    `json:"actor" yaml:"actor"` // username, module name or MaoApi.CONFIG_ACTOR_SYSTEM
+	Diff      string    `json:"diff" yaml:"diff"`   // "-" removed line, "+" added line, " " context line
+
+	RollbackOf uint64 `json:"rollbackOf,omitempty" yaml:"rollbackOf,omitempty"` // the version rolled back to
+}
+
+type configSnapshot struct {
+	ConfigVersion `yaml:",inline"`
+	Config        map[string]interface{} `yaml:"config"`
+}
+
+// configHistory is written by the eventLoop only, and read by the restful apis.
+type configHistory struct {
+	dir         string
+	versions    []*ConfigVersion // from old to new
+	lastContent []byte           // the content of the last version, i.e. the config file
+	lock        sync.RWMutex
+}
+
+// marshalConfig outputs the config in a stable form, e.g. the structs put by the modules become sorted maps,
+// so that the diff only contains the real changes.
+func marshalConfig(config map[string]interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make(map[string]interface{})
+	if err = yaml.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(normalized)
+}
+
+func (h *configHistory) snapshotFile(version uint64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%08d.yaml", version))
+}
+
+// load reads the versions in the history dir, it is created if not exist.
+func (h *configHistory) load() error {
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+
+	versions := make([]*ConfigVersion, 0)
+	var latest *configSnapshot
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+		snapshot, err := readSnapshotFile(filepath.Join(h.dir, entry.Name()))
+		if err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Skip the broken config version %s, %s", entry.Name(), err.Error())
+			continue
+		}
+		version := snapshot.ConfigVersion
+		versions = append(versions, &version)
+		if latest == nil || snapshot.Version > latest.Version {
+			latest = snapshot
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.versions = versions
+	h.lastContent = nil
+	if latest != nil {
+		if h.lastContent, err = marshalConfig(latest.Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSnapshotFile(filename string) (*configSnapshot, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &configSnapshot{}
+	if err = yaml.Unmarshal(content, snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Config == nil {
+		snapshot.Config = make(map[string]interface{})
+	}
+	return snapshot, nil
+}
+
+// record keeps the content as a new version if it is changed, returns nil if not changed.
+func (h *configHistory) record(config map[string]interface{}, content []byte, path string, actor string, rollbackOf uint64) (*ConfigVersion, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.lastContent != nil && bytes.Equal(h.lastContent, content) {
+		return nil, nil
+	}
+
+	version := &ConfigVersion{
+		Version:    1,
+		Timestamp:  time.Now(),
+		Path:       path,
+		Actor:      actor,
+		Diff:       diffLines(string(h.lastContent), string(content)),
+		RollbackOf: rollbackOf,
+	}
+	if len(h.versions) > 0 {
+		version.Version = h.versions[len(h.versions)-1].Version + 1
+	}
+
+	data, err := yaml.Marshal(&configSnapshot{ConfigVersion: *version, Config: config})
+	if err != nil {
+		return nil, err
+	}
+	if err = util.WriteFileAtomic(h.snapshotFile(version.Version), data, 0600); err != nil {
+		return nil, err
+	}
+
+	h.versions = append(h.versions, version)
+	h.lastContent = content
+	for len(h.versions) > CONFIG_HISTORY_MAX_VERSIONS {
+		if err := os.Remove(h.snapshotFile(h.versions[0].Version)); err != nil && !os.IsNotExist(err) {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to remove the old config version %d, %s", h.versions[0].Version, err.Error())
+		}
+		h.versions = h.versions[1:]
+	}
+	return version, nil
+}
+
+func (h *configHistory) getLastContent() []byte {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.lastContent
+}
+
+func (h *configHistory) getVersions() []*ConfigVersion {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	versions := make([]*ConfigVersion, len(h.versions))
+	copy(versions, h.versions)
+	return versions
+}
+
+func (h *configHistory) getSnapshot(version uint64) (*configSnapshot, error) {
+	h.lock.RLock()
+	found := false
+	for _, v := range h.versions {
+		if v.Version == version {
+			found = true
+			break
+		}
+	}
+	h.lock.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("version %d is not in the history", version)
+	}
+	return readSnapshotFile(h.snapshotFile(version))
+}
+
+// diffLines compares the lines by LCS, and keeps CONFIG_DIFF_CONTEXT_LINES lines around the changes.
+func diffLines(oldText string, newText string) string {
+	oldLines := splitLines(oldText)
+	newLines := splitLines(newText)
+
+	// lcs[i][j] is the LCS length of oldLines[i:] and newLines[j:]
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]string, 0)
+	for i, j := 0, 0; i < len(oldLines) || j < len(newLines); {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			lines = append(lines, " "+oldLines[i])
+			i++
+			j++
+		case i < len(oldLines) && (j == len(newLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+oldLines[i])
+			i++
+		default:
+			lines = append(lines, "+"+newLines[j])
+			j++
+		}
+	}
+
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if line[0] == ' ' {
+			continue
+		}
+		for k := i - CONFIG_DIFF_CONTEXT_LINES; k <= i+CONFIG_DIFF_CONTEXT_LINES; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+
+	sb := strings.Builder{}
+	skipped := false
+	for i, line := range lines {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped && sb.Len() > 0 {
+			sb.WriteString(" ...\n")
+		}
+		skipped = false
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" || text == "{}" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+func parseVersion(versionStr string) (uint64, bool) {
+	version, err := strconv.ParseUint(versionStr, 10, 64)
+	return version, err == nil && version > 0
+}
+
+// actorOrSystem is for the writes not from a user.
+func actorOrSystem(actor string) string {
+	if actor == "" {
+		return MaoApi.CONFIG_ACTOR_SYSTEM
+	}
+	return actor
+}
+
+// GetConfigHistory returns the kept versions from old to new.
+func (C *ConfigYamlModule) GetConfigHistory() []*ConfigVersion {
+	return C.history.getVersions()
+}
+
+// RollbackConfig replaces the whole config with the one of the version, it is recorded as a new version.
+// Returns nil version if the config is the same as the version.
+func (C *ConfigYamlModule) RollbackConfig(version uint64, actor string) (*ConfigVersion, error) {
+	snapshot, err := C.history.getSnapshot(version)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(chan eventResult, 1)
+	ret := C.submitEvent(&configEvent{
+		eventType: EVENT_ROLLBACK,
+		actor:     actorOrSystem(actor),
+		data:      snapshot,
+		result:    result,
+	})
+	if ret.errCode != ERR_CODE_SUCCESS {
+		return nil, fmt.Errorf("fail to roll back to version %d, errCode: %d", version, ret.errCode)
+	}
+
+	newVersion, _ := ret.result.(*ConfigVersion)
+	return newVersion, nil
+}
+
+// processRollback runs in the eventLoop.
+func (C *ConfigYamlModule) processRollback(config map[string]interface{}, event *configEvent) {
+	snapshot := event.data.(*configSnapshot)
+
+	original := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		original[k] = v
+	}
+	replaceConfig(config, snapshot.Config)
+
+	version, err := C.saveConfig(config, &configChange{path: "/", actor: event.actor, rollbackOf: snapshot.Version})
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save config, the rollback is discarded. (%s)", err.Error())
+		C.restoreConfig(config, original, err)
+		event.result <- eventResult{
+			errCode: ERR_CODE_SAVE_FAIL,
+			result:  nil,
+		}
+		return
+	}
+	C.lastSaveError.Store("")
+
+	// the sec configs of the version may be encrypted by another key, swapped here so no sec config is read in the middle.
+	digest, _ := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST)
+	if digestStr, _ := digest.(string); digestStr != C.secKeyDigest {
+		util.MaoLogM(util.WARN, MODULE_NAME, "The sec key digest is changed by the rollback, please set the sec key again.")
+		C.secKeyDigest = digestStr
+		C.secKey = ""
+	}
+
+	event.result <- eventResult{
+		errCode: ERR_CODE_SUCCESS,
+		result:  version,
+	}
+}
@@ -0,0 +1,79 @@
+package Config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigHistory_Rollback(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	if err := os.WriteFile(configFile, []byte("icmp-ka:\n    services: [\"::1\"]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	configModule.PutConfigBy("admin", "/icmp-ka/services", []string{"::1", "::2"})
+	configModule.PutConfigBy("admin", "/icmp-ka/services", []string{"::1", "::2"}) // not changed
+	configModule.PutConfig("/email/sender", "mao@example.com")
+
+	history := configModule.GetConfigHistory()
+	if len(history) != 3 {
+		t.Fatalf("expect 3 versions, got %d", len(history))
+	}
+	if v := history[1]; v.Actor != "admin" || v.Path != "/icmp-ka/services" || !strings.Contains(v.Diff, "+        - ::2") {
+		t.Errorf("unexpected version %+v", v)
+	}
+	if v := history[2]; v.Actor != "system" || !strings.Contains(v.Diff, "+    sender: mao@example.com") {
+		t.Errorf("unexpected version %+v", v)
+	}
+
+	version, err := configModule.RollbackConfig(1, "admin")
+	if err != nil || version == nil || version.Version != 4 || version.RollbackOf != 1 {
+		t.Fatalf("unexpected rollback %+v, %v", version, err)
+	}
+	if _, errCode := configModule.GetConfig("/email/sender"); errCode != ERR_CODE_PATH_TRANSIT_FAIL {
+		t.Errorf("expect /email removed by rollback, got %d", errCode)
+	}
+	content, _ := os.ReadFile(configFile)
+	if strings.Contains(string(content), "::2") {
+		t.Errorf("expect the file rolled back, got %s", content)
+	}
+
+	// the history is kept after restart, and the temp files are cleaned.
+	configModule.Shutdown()
+	reloaded := &ConfigYamlModule{}
+	if !reloaded.InitConfigModule(configFile) {
+		t.Fatal("fail to reload config module")
+	}
+	defer reloaded.Shutdown()
+	if n := len(reloaded.GetConfigHistory()); n != 4 {
+		t.Errorf("expect 4 versions after restart, got %d", n)
+	}
+	if _, err := reloaded.RollbackConfig(99, "admin"); err == nil {
+		t.Errorf("expect error for the unknown version")
+	}
+	tmpFiles, _ := filepath.Glob(filepath.Join(filepath.Dir(configFile), ".*.tmp-*"))
+	if len(tmpFiles) != 0 {
+		t.Errorf("expect no temp files, got %v", tmpFiles)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	oldText := "a: 1\nb: 2\nc: 3\nd: 4\ne: 5\nf: 6\ng: 7\n"
+	newText := "a: 1\nb: 2\nc: 3\nd: 40\ne: 5\nf: 6\ng: 7\nh: 8\n"
+
+	expect := " b: 2\n c: 3\n-d: 4\n+d: 40\n e: 5\n f: 6\n g: 7\n+h: 8\n"
+	if diff := diffLines(oldText, newText); diff != expect {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+	if diff := diffLines(oldText, oldText); diff != "" {
+		t.Errorf("expect empty diff, got %s", diff)
+	}
+}
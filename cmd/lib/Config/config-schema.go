@@ -0,0 +1,399 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"net"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFIG_SCHEMA_TAG = "validate"
+
+	// the rules in the "validate" tag, separated by ",".
+	// For lists, required, min and max are for the length, the others are for each item.
+	SCHEMA_RULE_REQUIRED = "required" // not empty
+	SCHEMA_RULE_MIN      = "min"      // min=1, the value of numbers, the length of strings and lists
+	SCHEMA_RULE_MAX      = "max"      // max=65535
+	SCHEMA_RULE_ONEOF    = "oneof"    // oneof=text|json
+	SCHEMA_RULE_IP       = "ip"
+	SCHEMA_RULE_EMAIL    = "email"
+	SCHEMA_RULE_HOSTPORT = "hostport" // e.g. smtp.example.com:25
+)
+
+type configSchema struct {
+	path       []string
+	schemaType reflect.Type
+}
+
+// RegisterConfigSchema validates the puts of the path by the schema, it replaces the schema registered before.
+func (C *ConfigYamlModule) RegisterConfigSchema(path string, schema interface{}) {
+	C.schemasLock.Lock()
+	defer C.schemasLock.Unlock()
+
+	segments := splitConfigPath(path)
+	for _, s := range C.schemas {
+		if joinConfigPath(s.path) == joinConfigPath(segments) {
+			s.schemaType = reflect.TypeOf(schema)
+			return
+		}
+	}
+	C.schemas = append(C.schemas, &configSchema{path: segments, schemaType: reflect.TypeOf(schema)})
+}
+
+// ValidateConfig validates the data as if it is put to the path now.
+func (C *ConfigYamlModule) ValidateConfig(path string, data interface{}) error {
+	return C.validatePut(path, data, func(schemaPath string) interface{} {
+		value, _ := C.GetConfig(schemaPath)
+		return value
+	})
+}
+
+// GetConfigInto decodes the config of the path, it is validated if there is a schema of the path.
+func (C *ConfigYamlModule) GetConfigInto(path string, dst interface{}) (errCode int) {
+	value, errCode := C.GetConfig(path)
+	if errCode != ERR_CODE_SUCCESS {
+		return errCode
+	}
+
+	C.schemasLock.RLock()
+	var schemaType reflect.Type
+	for _, s := range C.schemas {
+		if joinConfigPath(s.path) == joinConfigPath(splitConfigPath(path)) {
+			schemaType = s.schemaType
+		}
+	}
+	C.schemasLock.RUnlock()
+	if schemaType != nil {
+		if err := validateBySchema(joinConfigPath(splitConfigPath(path)), schemaType, value); err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "%s", err.Error())
+			return ERR_CODE_SCHEMA_INVALID
+		}
+	}
+
+	if err := DecodeConfig(value, dst); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to decode the config of %s, %s", path, err.Error())
+		return ERR_CODE_SCHEMA_INVALID
+	}
+	return ERR_CODE_SUCCESS
+}
+
+// DecodeConfig decodes the config value, e.g. the NewValue of MaoApi.ConfigChangeEvent, into dst.
+// The value is read from the file, or put by the modules as structs.
+func DecodeConfig(value interface{}, dst interface{}) error {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, dst)
+}
+
+// validatePut validates the schemas overlapping the path, with the value after the put.
+// current returns the value of the schema path before the put.
+func (C *ConfigYamlModule) validatePut(path string, data interface{}, current func(schemaPath string) interface{}) error {
+	// current may submit to the eventLoop, e.g. by ValidateConfig, so the lock is not held while calling it.
+	C.schemasLock.RLock()
+	schemas := make([]configSchema, 0, len(C.schemas))
+	for _, s := range C.schemas {
+		schemas = append(schemas, *s)
+	}
+	C.schemasLock.RUnlock()
+
+	changed := splitConfigPath(path)
+	for _, s := range schemas {
+		var value interface{}
+		switch {
+		case isUnderPath(s.path, changed):
+			// the schema path is put as a whole, or under the put data.
+			normalized, err := normalizeValue(data)
+			if err != nil {
+				return err
+			}
+			value = lookupValue(normalized, s.path[len(changed):])
+		case isUnderPath(changed, s.path):
+			// a field of the schema path is put.
+			copied, err := normalizeValue(current(joinConfigPath(s.path)))
+			if err != nil {
+				return err
+			}
+			value = setValue(copied, changed[len(s.path):], data)
+		default:
+			continue
+		}
+		if err := validateBySchema(joinConfigPath(s.path), s.schemaType, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConfigSchemas validates the whole config, e.g. the edited config file.
+func (C *ConfigYamlModule) validateConfigSchemas(config map[string]interface{}) error {
+	C.schemasLock.RLock()
+	defer C.schemasLock.RUnlock()
+
+	for _, s := range C.schemas {
+		value, _ := lookupConfigPath(config, joinConfigPath(s.path))
+		if err := validateBySchema(joinConfigPath(s.path), s.schemaType, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeValue deep copies the value, the structs become maps.
+func normalizeValue(value interface{}) (interface{}, error) {
+	var normalized interface{}
+	err := DecodeConfig(value, &normalized)
+	return normalized, err
+}
+
+func lookupValue(value interface{}, segments []string) interface{} {
+	for _, key := range segments {
+		valueMap, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = valueMap[key]
+	}
+	return value
+}
+
+// setValue sets the data under the value as the put does, nil data means to delete.
+func setValue(value interface{}, segments []string, data interface{}) interface{} {
+	if len(segments) == 0 {
+		return data
+	}
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		valueMap = make(map[string]interface{})
+	}
+	if len(segments) == 1 && data == nil {
+		delete(valueMap, segments[0])
+		return valueMap
+	}
+	valueMap[segments[0]] = setValue(valueMap[segments[0]], segments[1:], data)
+	return valueMap
+}
+
+// validateBySchema returns *MaoApi.ConfigSchemaError if the value is not matched with the schema.
+// nil value means the config is removed, it is always allowed.
+func validateBySchema(path string, schemaType reflect.Type, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	document := &yaml.Node{}
+	if err = yaml.Unmarshal(data, document); err != nil {
+		return err
+	}
+
+	validator := &schemaValidator{}
+	if len(document.Content) > 0 {
+		validator.check(document.Content[0], schemaType, "", nil)
+	}
+	if len(validator.errors) > 0 {
+		return &MaoApi.ConfigSchemaError{Path: path, Fields: validator.errors}
+	}
+	return nil
+}
+
+type schemaValidator struct {
+	errors []*MaoApi.ConfigFieldError
+}
+
+func (v *schemaValidator) fail(field string, format string, args ...interface{}) {
+	v.errors = append(v.errors, &MaoApi.ConfigFieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func isNullNode(node *yaml.Node) bool {
+	return node == nil || (node.Kind == yaml.ScalarNode && node.Tag == "!!null")
+}
+
+// check validates the node by the type, and the rules of the field.
+func (v *schemaValidator) check(node *yaml.Node, t reflect.Type, field string, rules []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if isNullNode(node) {
+		if hasRule(rules, SCHEMA_RULE_REQUIRED) {
+			v.fail(field, "is required")
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.fail(field, "must be a map")
+			return
+		}
+		children := make(map[string]*yaml.Node)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			children[node.Content[i].Value] = node.Content[i+1]
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name) // the default of yaml.v3
+			}
+			childField := name
+			if field != "" {
+				childField = field + "." + name
+			}
+			v.check(children[name], f.Type, childField, parseRules(f.Tag.Get(CONFIG_SCHEMA_TAG)))
+		}
+	case reflect.Slice, reflect.Array:
+		if node.Kind != yaml.SequenceNode {
+			v.fail(field, "must be a list")
+			return
+		}
+		itemRules := make([]string, 0)
+		for _, rule := range rules {
+			switch ruleName(rule) {
+			case SCHEMA_RULE_REQUIRED, SCHEMA_RULE_MIN, SCHEMA_RULE_MAX:
+				v.checkRule(field, rule, reflect.ValueOf(node.Content))
+			default:
+				itemRules = append(itemRules, rule)
+			}
+		}
+		for i, item := range node.Content {
+			v.check(item, t.Elem(), fmt.Sprintf("%s[%d]", field, i), itemRules)
+		}
+	default:
+		value := reflect.New(t)
+		if err := node.Decode(value.Interface()); err != nil {
+			v.fail(field, "must be %s", kindName(t))
+			return
+		}
+		for _, rule := range rules {
+			failed := len(v.errors)
+			if v.checkRule(field, rule, value.Elem()); len(v.errors) > failed {
+				break // one message for each field.
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) checkRule(field string, rule string, value reflect.Value) {
+	arg := ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		arg = rule[i+1:]
+	}
+	str := fmt.Sprint(value.Interface())
+
+	switch ruleName(rule) {
+	case SCHEMA_RULE_REQUIRED:
+		if value.IsZero() || (value.Kind() == reflect.Slice && value.Len() == 0) {
+			v.fail(field, "is required")
+		}
+	case SCHEMA_RULE_MIN, SCHEMA_RULE_MAX:
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			v.fail(field, "has an invalid rule %s", rule)
+			return
+		}
+		measure, measured := measureValue(value)
+		if !measured {
+			v.fail(field, "has an invalid rule %s", rule)
+		} else if ruleName(rule) == SCHEMA_RULE_MIN && measure < limit {
+			v.fail(field, "must be at least %s", arg)
+		} else if ruleName(rule) == SCHEMA_RULE_MAX && measure > limit {
+			v.fail(field, "must be at most %s", arg)
+		}
+	case SCHEMA_RULE_ONEOF:
+		for _, option := range strings.Split(arg, "|") {
+			if str == option {
+				return
+			}
+		}
+		v.fail(field, "must be one of %s", strings.ReplaceAll(arg, "|", ", "))
+	case SCHEMA_RULE_IP:
+		if net.ParseIP(str) == nil {
+			v.fail(field, "must be an IP address")
+		}
+	case SCHEMA_RULE_EMAIL:
+		if address, err := mail.ParseAddress(str); err != nil || address.Address != str {
+			v.fail(field, "must be an email address")
+		}
+	case SCHEMA_RULE_HOSTPORT:
+		host, port, err := net.SplitHostPort(str)
+		if portNum, errPort := strconv.ParseUint(port, 10, 16); err != nil || host == "" || errPort != nil || portNum == 0 {
+			v.fail(field, "must be host:port")
+		}
+	default:
+		v.fail(field, "has an unknown rule %s", rule)
+	}
+}
+
+// measureValue returns the number, or the length of strings and lists, for min and max.
+func measureValue(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true
+	default:
+		return 0, false
+	}
+}
+
+func kindName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer in range"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Map:
+		return "a map"
+	default:
+		return "a " + t.String()
+	}
+}
+
+func parseRules(tag string) []string {
+	rules := make([]string, 0)
+	for _, rule := range strings.Split(tag, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func ruleName(rule string) string {
+	return strings.SplitN(rule, "=", 2)[0]
+}
+
+func hasRule(rules []string, name string) bool {
+	for _, rule := range rules {
+		if ruleName(rule) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testMailSchema struct {
+	Server   string   `yaml:"server" validate:"required,hostport"`
+	Port     int      `yaml:"port" validate:"min=1,max=65535"`
+	Format   string   `yaml:"format" validate:"oneof=text|html"`
+	Receiver []string `yaml:"receiver" validate:"required,email"`
+}
+
+type testServiceSchema struct {
+	Address string `yaml:"address" validate:"required,ip"`
+	Name    string `yaml:"name"`
+}
+
+func schemaFields(err error) map[string]string {
+	fields := make(map[string]string)
+	if schemaErr, ok := err.(*MaoApi.ConfigSchemaError); ok {
+		for _, f := range schemaErr.Fields {
+			fields[f.Field] = f.Message
+		}
+	}
+	return fields
+}
+
+func TestValidateBySchema(t *testing.T) {
+	mailType := reflect.TypeOf(&testMailSchema{})
+	valid := map[string]interface{}{"server": "smtp.example.com:25", "port": 25, "format": "html", "receiver": []string{"a@example.com"}}
+	if err := validateBySchema("/mail", mailType, valid); err != nil {
+		t.Errorf("expect valid, got %v", err)
+	}
+
+	invalid := map[string]interface{}{"port": "abc", "format": "pdf", "receiver": []interface{}{"a@example.com", "not-an-email"}}
+	expect := map[string]string{
+		"server":      "is required",
+		"port":        "must be an integer in range",
+		"format":      "must be one of text, html",
+		"receiver[1]": "must be an email address",
+	}
+	if fields := schemaFields(validateBySchema("/mail", mailType, invalid)); !reflect.DeepEqual(fields, expect) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if fields := schemaFields(validateBySchema("/mail", mailType, map[string]interface{}{
+		"server": "", "port": 70000, "receiver": []string{}})); !reflect.DeepEqual(fields, map[string]string{
+		"server": "is required", "port": "must be at most 65535", "receiver": "is required"}) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if fields := schemaFields(validateBySchema("/mail", mailType, []string{"a"})); fields[""] != "must be a map" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestConfigSchema_PutAndGet(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	configModule.RegisterConfigSchema("/icmp-ka/services", []*testServiceSchema{})
+
+	if _, errCode := configModule.PutConfig("/icmp-ka/services", []*testServiceSchema{{Address: "2001:db8::1", Name: "a"}}); errCode != ERR_CODE_SUCCESS {
+		t.Fatalf("expect the valid put, got %d", errCode)
+	}
+	if _, errCode := configModule.PutConfig("/icmp-ka/services", []*testServiceSchema{{Address: "bad"}}); errCode != ERR_CODE_SCHEMA_INVALID {
+		t.Errorf("expect the invalid put rejected, got %d", errCode)
+	}
+	// the parent path is put, the schema path under it is validated.
+	if _, errCode := configModule.PutConfig("/icmp-ka", map[string]interface{}{"services": []interface{}{map[string]interface{}{"name": "b"}}}); errCode != ERR_CODE_SCHEMA_INVALID {
+		t.Errorf("expect the invalid parent put rejected, got %d", errCode)
+	}
+	if fields := schemaFields(configModule.ValidateConfig("/icmp-ka/services", []*testServiceSchema{{Address: "bad"}})); fields["[0].address"] != "must be an IP address" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+
+	services := make([]*testServiceSchema, 0)
+	if errCode := configModule.GetConfigInto("/icmp-ka/services", &services); errCode != ERR_CODE_SUCCESS ||
+		len(services) != 1 || services[0].Address != "2001:db8::1" || services[0].Name != "a" {
+		t.Errorf("unexpected services %v, %d", services, errCode)
+	}
+	if errCode := configModule.GetConfigInto("/not/exist", &services); errCode == ERR_CODE_SUCCESS {
+		t.Errorf("expect error for the path not exist")
+	}
+
+	// a field under the schema path is put, it is merged and validated.
+	configModule.RegisterConfigSchema("/mail", &testMailSchema{})
+	configModule.PutConfig("/mail", map[string]interface{}{"server": "smtp.example.com:25", "format": "text", "receiver": []string{"a@example.com"}})
+	if _, errCode := configModule.PutConfig("/mail/server", "no-port"); errCode != ERR_CODE_SCHEMA_INVALID {
+		t.Errorf("expect the invalid field rejected, got %d", errCode)
+	}
+	if _, errCode := configModule.PutConfig("/mail/port", 587); errCode != ERR_CODE_SUCCESS {
+		t.Errorf("expect the valid field put, got %d", errCode)
+	}
+	mail := &testMailSchema{}
+	if errCode := configModule.GetConfigInto("/mail", mail); errCode != ERR_CODE_SUCCESS || mail.Server != "smtp.example.com:25" || mail.Port != 587 {
+		t.Errorf("unexpected mail config %+v, %d", mail, errCode)
+	}
+	// removing is always allowed.
+	if _, errCode := configModule.PutConfig("/mail", nil); errCode != ERR_CODE_SUCCESS {
+		t.Errorf("expect the config removed, got %d", errCode)
+	}
+}
+
+// ValidateConfig reads the current config from the eventLoop, which validates the puts by the schemas.
+// A schema registered meanwhile must not block both of them.
+func TestConfigSchema_ValidateWhileRegistering(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+	configModule.RegisterConfigSchema("/mail", &testMailSchema{})
+	configModule.PutConfig("/mail", map[string]interface{}{"server": "smtp.example.com:25", "receiver": []string{"a@example.com"}})
+
+	done := make(chan error)
+	go func() {
+		done <- configModule.validatePut("/mail/port", 25, func(schemaPath string) interface{} {
+			registered := make(chan struct{})
+			go func() {
+				configModule.RegisterConfigSchema("/mail", &testMailSchema{})
+				close(registered)
+			}()
+			select {
+			case <-registered:
+			case <-time.After(time.Second): // the writer is waiting for the lock
+			}
+			configModule.PutConfig("/mail/port", 587)
+			value, _ := configModule.GetConfig(schemaPath)
+			return value
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the validation is blocked")
+	}
+}
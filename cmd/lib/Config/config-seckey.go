@@ -0,0 +1,348 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	yaml "gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	CONFIG_SEC_KEY_ENV         = "MAO_CONFIG_SEC_KEY"
+	CONFIG_SEC_KEY_FILE_SUFFIX = ".key" // the local key file, <config file>.key, used if it exists
+)
+
+// SecKeyRotation is the result of rotating the sec key.
+type SecKeyRotation struct {
+	Rotated int            `json:"rotated"`           // the number of sec configs re-encrypted
+	Version *ConfigVersion `json:"version"`           // nil if it fails to record the history
+	KeyFile string         `json:"keyFile,omitempty"` // rewritten with the new key, empty if the key is not loaded from a file
+}
+
+type secKeyRotationRequest struct {
+	oldKey string
+	newKey string
+}
+
+// LoadSecKey unlocks the sec configs at startup, from the key file, the environment variable or the local key file in order.
+// No key is fine, it can be set by the restful api later. Call it after InitConfigModule, before the modules reading sec configs.
+func (C *ConfigYamlModule) LoadSecKey(keyFile string) error {
+	source := keyFile
+	secKey := ""
+	if keyFile != "" {
+		var err error
+		if secKey, err = readSecKeyFile(keyFile); err != nil {
+			return err
+		}
+	} else if envKey, ok := os.LookupEnv(CONFIG_SEC_KEY_ENV); ok {
+		os.Unsetenv(CONFIG_SEC_KEY_ENV) // not inherited by the processes we start.
+		source, secKey = CONFIG_SEC_KEY_ENV, strings.TrimSpace(envKey)
+	} else if localKeyFile := C.configFilename + CONFIG_SEC_KEY_FILE_SUFFIX; !fileIsNotExist(localKeyFile) {
+		var err error
+		if secKey, err = readSecKeyFile(localKeyFile); err != nil {
+			return err
+		}
+		source = localKeyFile
+	} else {
+		util.MaoLogM(util.WARN, MODULE_NAME, "No sec key is given, the sec configs can't be used until it is set by %s.", URL_CONFIG_SET_SECKEY)
+		return nil
+	}
+
+	if err := C.unlockSecKey(secKey, MaoApi.CONFIG_ACTOR_SYSTEM); err != nil {
+		return fmt.Errorf("fail to load the sec key from %s, %s", source, err.Error())
+	}
+	C.secKeyFromEnv = source == CONFIG_SEC_KEY_ENV
+	C.secKeyFile = ""
+	if !C.secKeyFromEnv {
+		C.secKeyFile = source
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "The sec key is loaded from %s", source)
+	return nil
+}
+
+// writeSecKeyFile replaces the key in the file atomically, keeping its permissions.
+func writeSecKeyFile(keyFile string, secKey string) error {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(keyFile); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return util.WriteFileAtomic(keyFile, []byte(secKey+"\n"), perm)
+}
+
+// readSecKeyFile reads the key in the file, which can't be accessed by the group and others.
+func readSecKeyFile(keyFile string) (string, error) {
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("fail to read the sec key file, %s", err.Error())
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return "", fmt.Errorf("the permissions %04o of the sec key file %s are too open, it should be 0600 or 0400", perm, keyFile)
+	}
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("fail to read the sec key file, %s", err.Error())
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// unlockSecKey checks the key by the digest, or saves the digest if it is a new key. Then the modules are notified.
+func (C *ConfigYamlModule) unlockSecKey(secKey string, actor string) error {
+	if secKey == "" {
+		return errors.New("sec key is empty")
+	}
+
+	result := make(chan eventResult, 1)
+	ret := C.submitEvent(&configEvent{
+		eventType: EVENT_UNLOCK_KEY,
+		actor:     actorOrSystem(actor),
+		data:      secKey,
+		result:    result,
+	})
+	if ret.errCode != ERR_CODE_SUCCESS {
+		if err, ok := ret.result.(error); ok {
+			return err
+		}
+		return fmt.Errorf("fail to unlock the sec key, errCode: %d", ret.errCode)
+	}
+
+	C.publishKeyUpdate()
+	return nil
+}
+
+// processUnlockSecKey runs in the eventLoop, so the key and the digest are not changed in the middle of a rotation or rollback.
+func (C *ConfigYamlModule) processUnlockSecKey(config map[string]interface{}, event *configEvent) {
+	secKey := event.data.(string)
+	reply := func(errCode int, result interface{}) {
+		event.result <- eventResult{errCode: errCode, result: result}
+	}
+
+	digest := C.generateKeyDigest(secKey)
+	if C.secKeyDigest != "" {
+		if digest != C.secKeyDigest {
+			reply(ERR_CODE_KEY_NOT_MATCHED, errors.New("sec key is not matched"))
+			return
+		}
+		util.MaoLogM(util.INFO, MODULE_NAME, "Succeed to unlock the sec key")
+	} else {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Setting a new sec key")
+	}
+
+	// write the digest to file
+	if savedDigest, _ := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST); savedDigest != digest {
+		original, err := copyConfig(config)
+		if err != nil {
+			reply(ERR_CODE_SAVE_FAIL, err)
+			return
+		}
+		digestParentKey := path.Base(path.Dir(CONFIG_PATH_SEC_KEY_DIGEST))
+		digestParent, ok := config[digestParentKey].(map[string]interface{})
+		if !ok {
+			digestParent = make(map[string]interface{})
+			config[digestParentKey] = digestParent
+		}
+		digestParent[path.Base(CONFIG_PATH_SEC_KEY_DIGEST)] = digest
+		if _, err = C.saveConfig(config, &configChange{path: CONFIG_PATH_SEC_KEY_DIGEST, actor: event.actor}); err != nil {
+			C.restoreConfig(config, original, err)
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save config, the sec key is not set. (%s)", err.Error())
+			reply(ERR_CODE_SAVE_FAIL, fmt.Errorf("fail to save the sec key digest, %s", err.Error()))
+			return
+		}
+		C.lastSaveError.Store("")
+	}
+
+	C.secKey = secKey
+	C.secKeyDigest = digest
+	reply(ERR_CODE_SUCCESS, nil)
+}
+
+// RotateSecKey verifies the old key, re-encrypts all sec configs by the new key and updates the digest.
+// The config is saved in one version, and nothing is changed if any sec config fails.
+func (C *ConfigYamlModule) RotateSecKey(oldKey string, newKey string, actor string) (*SecKeyRotation, error) {
+	if newKey == "" {
+		return nil, errors.New("the new sec key is empty")
+	}
+	if C.secKeyFromEnv {
+		// the next startup would fail with the old key in the environment.
+		return nil, fmt.Errorf("the sec key is given by %s, rotate it offline and restart with the new key", CONFIG_SEC_KEY_ENV)
+	}
+
+	result := make(chan eventResult, 1)
+	ret := C.submitEvent(&configEvent{
+		eventType: EVENT_ROTATE_KEY,
+		actor:     actorOrSystem(actor),
+		data:      &secKeyRotationRequest{oldKey: oldKey, newKey: newKey},
+		result:    result,
+	})
+	if ret.errCode != ERR_CODE_SUCCESS {
+		if err, ok := ret.result.(error); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("fail to rotate the sec key, errCode: %d", ret.errCode)
+	}
+	return ret.result.(*SecKeyRotation), nil
+}
+
+// processRotateSecKey runs in the eventLoop, so the sec configs are not read or written in the middle.
+func (C *ConfigYamlModule) processRotateSecKey(config map[string]interface{}, event *configEvent) {
+	request := event.data.(*secKeyRotationRequest)
+	reply := func(errCode int, result interface{}) {
+		event.result <- eventResult{errCode: errCode, result: result}
+	}
+
+	if C.secKeyDigest == "" {
+		reply(ERR_CODE_ENC_DEC_KEY_NOT_READY, errors.New("there is no sec key to rotate, set it by "+URL_CONFIG_SET_SECKEY))
+		return
+	}
+	if C.generateKeyDigest(request.oldKey) != C.secKeyDigest {
+		reply(ERR_CODE_KEY_NOT_MATCHED, errors.New("the old sec key is not matched"))
+		return
+	}
+	newDigest := C.generateKeyDigest(request.newKey)
+	if newDigest == C.secKeyDigest {
+		reply(ERR_CODE_KEY_NOT_MATCHED, errors.New("the new sec key is the same as the old one"))
+		return
+	}
+
+	// re-encrypt a copy, the config is not touched until all of them succeed.
+	rotatedConfig, err := copyConfig(config)
+	if err != nil {
+		reply(ERR_CODE_ENC_FAIL, err)
+		return
+	}
+	newAlgorithm := C.getSecAlgorithm()
+	rotated, err := rotateSecValues(rotatedConfig, "", func(cipherText string, iv string, algorithm string) (string, string, string, error) {
+		plainText, _, err := C.decryptConfigWithKey(request.oldKey, algorithm, cipherText, iv)
+		if err != nil {
+			return "", "", "", err
+		}
+		cipherText, iv, _, err = C.encryptConfigWithKey(request.newKey, newAlgorithm, plainText)
+		return cipherText, iv, newAlgorithm, err
+	})
+	if err != nil {
+		reply(ERR_CODE_ENC_FAIL, err)
+		return
+	}
+	digestParent, ok := lookupConfigPath(rotatedConfig, path.Dir(CONFIG_PATH_SEC_KEY_DIGEST))
+	digestParentMap, okMap := digestParent.(map[string]interface{})
+	if !ok || !okMap {
+		reply(ERR_CODE_PATH_TRANSIT_FAIL, errors.New("the sec key digest is not in the config"))
+		return
+	}
+	digestParentMap[path.Base(CONFIG_PATH_SEC_KEY_DIGEST)] = newDigest
+
+	original := make(map[string]interface{}, len(config))
+	for k, v := range config {
+		original[k] = v
+	}
+	// the key file is rewritten first, the next startup fails if the config is saved with the new key but the file is not.
+	if C.secKeyFile != "" {
+		if err = writeSecKeyFile(C.secKeyFile, request.newKey); err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to write the sec key file, the sec key is not rotated. (%s)", err.Error())
+			reply(ERR_CODE_SAVE_FAIL, fmt.Errorf("fail to write the sec key file %s, %s", C.secKeyFile, err.Error()))
+			return
+		}
+	}
+
+	replaceConfig(config, rotatedConfig)
+	version, err := C.saveConfig(config, &configChange{path: "/", actor: event.actor})
+	if err != nil {
+		// the file is written atomically, it still has the old key.
+		replaceConfig(config, original)
+		if C.secKeyFile != "" {
+			if keyErr := writeSecKeyFile(C.secKeyFile, request.oldKey); keyErr != nil {
+				util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to restore the old key in %s, please restore it manually. (%s)", C.secKeyFile, keyErr.Error())
+			}
+		}
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save config, the sec key is not rotated. (%s)", err.Error())
+		reply(ERR_CODE_SAVE_FAIL, fmt.Errorf("fail to save config, %s", err.Error()))
+		return
+	}
+	C.lastSaveError.Store("")
+
+	keyWasReady := C.isKeyReady()
+	C.secKey = request.newKey
+	C.secKeyDigest = newDigest
+	util.MaoLogM(util.INFO, MODULE_NAME, "The sec key is rotated by %s, %d sec configs re-encrypted", event.actor, rotated)
+	if !keyWasReady {
+		C.publishKeyUpdate() // the sec configs can be decrypted now.
+	}
+
+	reply(ERR_CODE_SUCCESS, &SecKeyRotation{Rotated: rotated, Version: version, KeyFile: C.secKeyFile})
+}
+
+// copyConfig deep copies the config, the structs put by the modules become maps.
+func copyConfig(config map[string]interface{}) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	copied := make(map[string]interface{})
+	if err = yaml.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+// rotateSecValues replaces each ciphertext, iv and algorithm under the config, returns the number of sec configs.
+func rotateSecValues(config map[string]interface{}, configPath string, rotate func(cipherText string, iv string, algorithm string) (string, string, string, error)) (int, error) {
+	rotated := 0
+	for key, value := range config {
+		if subConfig, ok := value.(map[string]interface{}); ok {
+			n, err := rotateSecValues(subConfig, configPath+"/"+key, rotate)
+			if err != nil {
+				return 0, err
+			}
+			rotated += n
+			continue
+		}
+		if !strings.HasSuffix(key, ENC_DEC_SUFFIX_CIPHER) {
+			continue
+		}
+
+		name := strings.TrimSuffix(key, ENC_DEC_SUFFIX_CIPHER)
+		cipherText, okCipher := value.(string)
+		iv, okIv := config[name+ENC_DEC_SUFFIX_IV].(string)
+		if !okCipher || !okIv {
+			return 0, fmt.Errorf("the sec config %s/%s is broken", configPath, name)
+		}
+		algorithm, _ := config[name+ENC_DEC_SUFFIX_ALGORITHM].(string)
+		newCipherText, newIv, newAlgorithm, err := rotate(cipherText, iv, algorithm)
+		if err != nil {
+			return 0, fmt.Errorf("fail to re-encrypt the sec config %s/%s, %s", configPath, name, err.Error())
+		}
+		config[key] = newCipherText
+		config[name+ENC_DEC_SUFFIX_IV] = newIv
+		config[name+ENC_DEC_SUFFIX_ALGORITHM] = newAlgorithm
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (C *ConfigYamlModule) processRotateSecKeyApi(c *gin.Context) {
+	oldKey, okOld := c.GetPostForm(CONFIG_API_KEY_OLD_SECKEY)
+	newKey, okNew := c.GetPostForm(CONFIG_API_KEY_NEW_SECKEY)
+	if !okOld || !okNew {
+		c.String(400, "Not contained the old and new sec keys")
+		return
+	}
+
+	rotation, err := C.RotateSecKey(oldKey, newKey, c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME))
+	if err != nil {
+		MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "rotate sec key", "config", false, err.Error())
+		c.String(400, err.Error())
+		return
+	}
+
+	detail := fmt.Sprintf("%d sec configs re-encrypted", rotation.Rotated)
+	if rotation.Version != nil {
+		detail = fmt.Sprintf("%s, version %d", detail, rotation.Version.Version)
+	}
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "rotate sec key", "config", true, detail)
+	c.JSON(200, rotation)
+}
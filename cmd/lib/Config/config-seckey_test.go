@@ -0,0 +1,188 @@
+package Config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSecKey_Rotate(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	if _, err := configModule.RotateSecKey("old-key", "new-key", "admin"); err == nil {
+		t.Errorf("expect error without a sec key")
+	}
+
+	configModule.secKey = "old-key"
+	configModule.secKeyDigest = configModule.generateKeyDigest("old-key")
+	configModule.PutConfig(CONFIG_PATH_SEC_KEY_DIGEST, configModule.secKeyDigest)
+	configModule.PutSecConfig("/mysql/password", "mysql-secret")
+	configModule.PutSecConfig("/email/password", "email-secret")
+	oldCipher, _ := configModule.GetConfig("/mysql/password" + ENC_DEC_SUFFIX_CIPHER)
+
+	if _, err := configModule.RotateSecKey("wrong-key", "new-key", "admin"); err == nil {
+		t.Errorf("expect error for the wrong old key")
+	}
+	if _, err := configModule.RotateSecKey("old-key", "old-key", "admin"); err == nil {
+		t.Errorf("expect error for the same key")
+	}
+
+	rotation, err := configModule.RotateSecKey("old-key", "new-key", "admin")
+	if err != nil || rotation.Rotated != 2 || rotation.Version == nil || rotation.Version.Actor != "admin" {
+		t.Fatalf("unexpected rotation %+v, %v", rotation, err)
+	}
+	if password, _ := configModule.GetSecConfig("/mysql/password"); password != "mysql-secret" {
+		t.Errorf("expect the sec config kept, got %v", password)
+	}
+	if newCipher, _ := configModule.GetConfig("/mysql/password" + ENC_DEC_SUFFIX_CIPHER); newCipher == oldCipher {
+		t.Errorf("expect the sec config re-encrypted")
+	}
+	digest, _ := configModule.GetConfig(CONFIG_PATH_SEC_KEY_DIGEST)
+	if digest != configModule.generateKeyDigest("new-key") {
+		t.Errorf("expect the digest of the new key, got %v", digest)
+	}
+
+	// the new key works after restart.
+	configModule.Shutdown()
+	reloaded := &ConfigYamlModule{}
+	if !reloaded.InitConfigModule(configFile) {
+		t.Fatal("fail to reload config module")
+	}
+	defer reloaded.Shutdown()
+	reloaded.secKey = "new-key"
+	if password, _ := reloaded.GetSecConfig("/email/password"); password != "email-secret" {
+		t.Errorf("expect decrypted by the new key, got %v", password)
+	}
+}
+
+func TestConfigSecKey_Load(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	// no key is fine.
+	if err := configModule.LoadSecKey(""); err != nil || configModule.isKeyReady() {
+		t.Fatalf("expect no key loaded, %v", err)
+	}
+
+	keyFile := configFile + CONFIG_SEC_KEY_FILE_SUFFIX
+	os.WriteFile(keyFile, []byte("file-key\n"), 0644)
+	if err := configModule.LoadSecKey(""); err == nil {
+		t.Errorf("expect error for the key file readable by others")
+	}
+	os.Chmod(keyFile, 0600)
+
+	// the environment variable is prior to the local key file.
+	t.Setenv(CONFIG_SEC_KEY_ENV, "env-key")
+	if err := configModule.LoadSecKey(""); err != nil || configModule.secKey != "env-key" {
+		t.Fatalf("expect loaded from env, %v", err)
+	}
+	if _, ok := os.LookupEnv(CONFIG_SEC_KEY_ENV); ok {
+		t.Errorf("expect the environment variable removed")
+	}
+
+	// the digest is saved, the other key is rejected.
+	if err := configModule.LoadSecKey(""); err == nil {
+		t.Errorf("expect error for the key not matched")
+	}
+	os.WriteFile(keyFile, []byte("env-key\n"), 0600)
+	if err := configModule.LoadSecKey(keyFile); err != nil {
+		t.Errorf("expect loaded from the key file, %v", err)
+	}
+}
+
+func TestConfigSecKey_Algorithm(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if configModule.SetSecAlgorithm("des") == nil {
+		t.Errorf("expect error for the unknown algorithm")
+	}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+	configModule.secKey = "mao-key"
+
+	configModule.PutSecConfig("/email/password", "sm4-secret")
+	configModule.SetSecAlgorithm(SEC_ALGORITHM_AES_GCM)
+	configModule.PutSecConfig("/mysql/password", "aes-secret")
+
+	if algorithm, _ := configModule.GetConfig("/email/password" + ENC_DEC_SUFFIX_ALGORITHM); algorithm != SEC_ALGORITHM_SM4_GCM {
+		t.Errorf("expect sm4 recorded, got %v", algorithm)
+	}
+	if algorithm, _ := configModule.GetConfig("/mysql/password" + ENC_DEC_SUFFIX_ALGORITHM); algorithm != SEC_ALGORITHM_AES_GCM {
+		t.Errorf("expect aes recorded, got %v", algorithm)
+	}
+	if password, _ := configModule.GetSecConfig("/email/password"); password != "sm4-secret" {
+		t.Errorf("expect the sm4 config decrypted, got %v", password)
+	}
+	if password, _ := configModule.GetSecConfig("/mysql/password"); password != "aes-secret" {
+		t.Errorf("expect the aes config decrypted, got %v", password)
+	}
+
+	// the sec configs before the algorithm is recorded are SM4.
+	configModule.PutConfig("/email/password"+ENC_DEC_SUFFIX_ALGORITHM, nil)
+	if password, _ := configModule.GetSecConfig("/email/password"); password != "sm4-secret" {
+		t.Errorf("expect decrypted as sm4, got %v", password)
+	}
+
+	// AES-GCM is authenticated.
+	configModule.secKey = "other-key"
+	if _, errCode := configModule.GetSecConfig("/mysql/password"); errCode != ERR_CODE_DEC_FAIL {
+		t.Errorf("expect fail to decrypt by the other key, got %d", errCode)
+	}
+}
+
+func TestConfigSecKey_RotateKeySource(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	keyFile := configFile + CONFIG_SEC_KEY_FILE_SUFFIX
+	os.WriteFile(keyFile, []byte("old-key\n"), 0400)
+
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	if err := configModule.LoadSecKey(""); err != nil {
+		t.Fatal(err)
+	}
+	configModule.PutSecConfig("/mysql/password", "mysql-secret")
+
+	rotation, err := configModule.RotateSecKey("old-key", "new-key", "admin")
+	if err != nil || rotation.KeyFile != keyFile {
+		t.Fatalf("unexpected rotation %+v, %v", rotation, err)
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0400 {
+		t.Errorf("expect the permissions of the key file kept, %04o", info.Mode().Perm())
+	}
+	configModule.Shutdown()
+
+	// the next startup loads the new key.
+	reloaded := &ConfigYamlModule{}
+	if !reloaded.InitConfigModule(configFile) {
+		t.Fatal("fail to reload config module")
+	}
+	defer reloaded.Shutdown()
+	if err = reloaded.LoadSecKey(""); err != nil {
+		t.Fatalf("fail to load the rotated key, %v", err)
+	}
+	if password, _ := reloaded.GetSecConfig("/mysql/password"); password != "mysql-secret" {
+		t.Errorf("expect decrypted by the new key, got %v", password)
+	}
+
+	// the key of the environment variable can't be rewritten.
+	t.Setenv(CONFIG_SEC_KEY_ENV, "new-key")
+	if err = reloaded.LoadSecKey(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloaded.RotateSecKey("new-key", "newer-key", "admin"); err == nil {
+		t.Errorf("expect the key of the environment variable not rotated")
+	}
+}
@@ -0,0 +1,179 @@
+package Config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ETCD_CONFIG_KEY_PREFIX = "/mao/config/"
+	ETCD_REQUEST_TIMEOUT   = 5 * time.Second
+
+	ETCD_API_RANGE = "/v3/kv/range"
+	ETCD_API_TXN   = "/v3/kv/txn"
+)
+
+// etcdConfigStore keeps the config in one key of etcd, by the JSON gRPC gateway of etcd v3, e.g. http://127.0.0.1:2379.
+// The revision is the mod_revision of the key, the save is a transaction comparing it, so the servers don't overwrite each other.
+type etcdConfigStore struct {
+	endpoints []string // tried in order, the first available one is used
+	key       string
+	client    *http.Client
+}
+
+// the int64 of etcd is a string in JSON.
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []*etcdKeyValue `json:"kvs"`
+}
+
+type etcdTxnResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Succeeded bool `json:"succeeded"`
+}
+
+type etcdErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// newEtcdConfigStore accepts the endpoints separated by ",".
+func newEtcdConfigStore(endpoints string, name string) (*etcdConfigStore, error) {
+	e := &etcdConfigStore{
+		endpoints: make([]string, 0),
+		key:       ETCD_CONFIG_KEY_PREFIX + name,
+		client:    &http.Client{Timeout: ETCD_REQUEST_TIMEOUT},
+	}
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint == "" {
+			continue
+		}
+		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+			return nil, fmt.Errorf("the etcd endpoint %s should be http:// or https://", endpoint)
+		}
+		e.endpoints = append(e.endpoints, endpoint)
+	}
+	if len(e.endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoint")
+	}
+	return e, nil
+}
+
+// call posts the request to the endpoints in order, until one of them replies.
+func (e *etcdConfigStore) call(api string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		resp, err := e.client.Post(endpoint+api, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			etcdErr := &etcdErrorResponse{}
+			json.Unmarshal(data, etcdErr)
+			if etcdErr.Message == "" {
+				etcdErr.Message = etcdErr.Error
+			}
+			return fmt.Errorf("etcd %s replies %d, %s", endpoint, resp.StatusCode, etcdErr.Message)
+		}
+		return json.Unmarshal(data, response)
+	}
+	return fmt.Errorf("fail to connect etcd, %s", lastErr.Error())
+}
+
+func (e *etcdConfigStore) get() (*etcdKeyValue, error) {
+	response := &etcdRangeResponse{}
+	err := e.call(ETCD_API_RANGE, map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.key)),
+	}, response)
+	if err != nil || len(response.Kvs) == 0 {
+		return nil, err
+	}
+	return response.Kvs[0], nil
+}
+
+func (e *etcdConfigStore) Load() ([]byte, string, error) {
+	kv, err := e.get()
+	if err != nil || kv == nil {
+		return nil, "", err
+	}
+	content, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, "", fmt.Errorf("the config in etcd is broken, %s", err.Error())
+	}
+	return content, kv.ModRevision, nil
+}
+
+func (e *etcdConfigStore) Revision() (string, error) {
+	kv, err := e.get()
+	if err != nil || kv == nil {
+		return "", err
+	}
+	return kv.ModRevision, nil
+}
+
+func (e *etcdConfigStore) Save(content []byte, revision string) (string, error) {
+	if revision == "" {
+		revision = "0" // the mod_revision of the key not existing.
+	}
+	key := base64.StdEncoding.EncodeToString([]byte(e.key))
+	response := &etcdTxnResponse{}
+	err := e.call(ETCD_API_TXN, map[string]interface{}{
+		"compare": []map[string]string{{
+			"key":          key,
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": revision,
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{
+				"key":   key,
+				"value": base64.StdEncoding.EncodeToString(content),
+			},
+		}},
+	}, response)
+	if err != nil {
+		return "", err
+	}
+	if !response.Succeeded {
+		return "", ErrConfigStoreConflict
+	}
+	return response.Header.Revision, nil
+}
+
+func (e *etcdConfigStore) Check() error {
+	_, err := e.get()
+	return err
+}
+
+func (e *etcdConfigStore) Close() {
+	e.client.CloseIdleConnections()
+}
+
+func (e *etcdConfigStore) String() string {
+	return fmt.Sprintf("etcd %s%s", strings.Join(e.endpoints, ","), e.key)
+}
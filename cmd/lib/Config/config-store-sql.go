@@ -0,0 +1,112 @@
+package Config
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"strconv"
+	"time"
+)
+
+const (
+	SQL_CONFIG_TABLE = "mao_config"
+
+	SQL_CREATE_CONFIG_TABLE = "CREATE TABLE IF NOT EXISTS " + SQL_CONFIG_TABLE + " (" +
+		"name VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"content MEDIUMBLOB NOT NULL, " +
+		"revision BIGINT NOT NULL, " +
+		"updated_at DATETIME NOT NULL)"
+	SQL_SELECT_CONFIG   = "SELECT content, revision FROM " + SQL_CONFIG_TABLE + " WHERE name = ?"
+	SQL_SELECT_REVISION = "SELECT revision FROM " + SQL_CONFIG_TABLE + " WHERE name = ?"
+	SQL_INSERT_CONFIG   = "INSERT INTO " + SQL_CONFIG_TABLE + " (name, content, revision, updated_at) VALUES (?, ?, 1, ?)"
+	SQL_UPDATE_CONFIG   = "UPDATE " + SQL_CONFIG_TABLE + " SET content = ?, revision = revision + 1, updated_at = ? WHERE name = ? AND revision = ?"
+)
+
+// sqlConfigStore keeps the config in one row of the table, the revision is increased on each save,
+// and the update compares it, so the servers don't overwrite each other.
+type sqlConfigStore struct {
+	db   *sql.DB
+	name string
+}
+
+func newSqlConfigStore(driverName string, dsn string, name string) (*sqlConfigStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	if _, err = db.Exec(SQL_CREATE_CONFIG_TABLE); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail to create the config table, %s", err.Error())
+	}
+	return &sqlConfigStore{db: db, name: name}, nil
+}
+
+func (s *sqlConfigStore) Load() ([]byte, string, error) {
+	var content []byte
+	var revision int64
+	err := s.db.QueryRow(SQL_SELECT_CONFIG, s.name).Scan(&content, &revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, strconv.FormatInt(revision, 10), nil
+}
+
+func (s *sqlConfigStore) Revision() (string, error) {
+	var revision int64
+	err := s.db.QueryRow(SQL_SELECT_REVISION, s.name).Scan(&revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(revision, 10), nil
+}
+
+func (s *sqlConfigStore) Save(content []byte, revision string) (string, error) {
+	now := time.Now().UTC()
+	if revision == "" {
+		if _, err := s.db.Exec(SQL_INSERT_CONFIG, s.name, content, now); err != nil {
+			// the row is inserted by another server, or the database is down. The next check tells.
+			if current, errRevision := s.Revision(); errRevision == nil && current != "" {
+				return "", ErrConfigStoreConflict
+			}
+			return "", err
+		}
+		return "1", nil
+	}
+
+	oldRevision, err := strconv.ParseInt(revision, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid revision %s", revision)
+	}
+	result, err := s.db.Exec(SQL_UPDATE_CONFIG, content, now, s.name, oldRevision)
+	if err != nil {
+		return "", err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if rows == 0 {
+		return "", ErrConfigStoreConflict
+	}
+	return strconv.FormatInt(oldRevision+1, 10), nil
+}
+
+func (s *sqlConfigStore) Check() error {
+	_, err := s.Revision()
+	return err
+}
+
+func (s *sqlConfigStore) Close() {
+	s.db.Close()
+}
+
+// String hides the password in the DSN.
+func (s *sqlConfigStore) String() string {
+	return fmt.Sprintf("sql %s/%s", SQL_CONFIG_TABLE, s.name)
+}
@@ -0,0 +1,127 @@
+package Config
+
+import (
+	"MaoServerDiscovery/util"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	CONFIG_BACKEND_FILE  = "file"
+	CONFIG_BACKEND_ETCD  = "etcd"
+	CONFIG_BACKEND_MYSQL = "mysql"
+
+	// the name of the config in the shared stores, the servers with the same name share one config.
+	DEFAULT_CONFIG_STORE_NAME = "mao-config"
+)
+
+// ErrConfigStoreConflict is returned by Save if the config is saved by another server since the revision.
+var ErrConfigStoreConflict = errors.New("the config is changed by another server, it will be reloaded")
+
+// ConfigStore persists the whole config as YAML. The config module keeps the config in memory,
+// loads it at startup, saves it on each change, and polls the revision for the changes outside,
+// e.g. the file edited by hand, or the config saved by another server sharing the store.
+// It is only called in the eventLoop, except Load and Check.
+type ConfigStore interface {
+	// Load returns the content and its revision, the content is empty if the config is not stored yet.
+	Load() (content []byte, revision string, err error)
+	// Revision returns the current revision of the stored config, "" if it is not stored yet.
+	Revision() (string, error)
+	// Save stores the content and returns the new revision.
+	// The shared stores fail with ErrConfigStoreConflict if the stored revision is not the given one.
+	Save(content []byte, revision string) (string, error)
+	// Check returns an error if the store can't be written now, for the health check.
+	Check() error
+	Close()
+	String() string
+}
+
+// IsConfigBackend returns true if the backend can be selected by NewConfigStore.
+func IsConfigBackend(backend string) bool {
+	return backend == CONFIG_BACKEND_FILE || backend == CONFIG_BACKEND_ETCD || backend == CONFIG_BACKEND_MYSQL
+}
+
+// NewConfigStore creates the store of the backend. The endpoint is the config file for "file",
+// the URL of the etcd gRPC gateway for "etcd", e.g. http://127.0.0.1:2379, and the DSN for "mysql".
+func NewConfigStore(backend string, endpoint string) (ConfigStore, error) {
+	switch backend {
+	case CONFIG_BACKEND_FILE:
+		return newFileConfigStore(endpoint), nil
+	case CONFIG_BACKEND_ETCD:
+		return newEtcdConfigStore(endpoint, DEFAULT_CONFIG_STORE_NAME)
+	case CONFIG_BACKEND_MYSQL:
+		return newSqlConfigStore("mysql", endpoint, DEFAULT_CONFIG_STORE_NAME)
+	default:
+		return nil, fmt.Errorf("unknown config backend %s", backend)
+	}
+}
+
+// SetConfigStore replaces the local config file by the store. Call it before InitConfigModule.
+// The config file name is still the base of the local history and the key file.
+func (C *ConfigYamlModule) SetConfigStore(store ConfigStore) {
+	C.store = store
+}
+
+// fileConfigStore is the config file, the default. The edits by hand are found by the modification time and size.
+type fileConfigStore struct {
+	filename string
+}
+
+func newFileConfigStore(filename string) *fileConfigStore {
+	return &fileConfigStore{filename: filename}
+}
+
+func (f *fileConfigStore) Load() ([]byte, string, error) {
+	if fileIsNotExist(f.filename) {
+		return nil, "", nil
+	}
+	content, err := os.ReadFile(f.filename)
+	if err != nil {
+		return nil, "", err
+	}
+	revision, err := f.Revision()
+	return content, revision, err
+}
+
+func (f *fileConfigStore) Revision() (string, error) {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// Save overwrites the file, the edits by hand are merged before each change by the eventLoop.
+func (f *fileConfigStore) Save(content []byte, revision string) (string, error) {
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(f.filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := util.WriteFileAtomic(f.filename, content, perm); err != nil {
+		return "", err
+	}
+	return f.Revision()
+}
+
+// Check opens the file without modification, it may become unwritable before the next save.
+func (f *fileConfigStore) Check() error {
+	if fileIsNotExist(f.filename) {
+		return nil
+	}
+	file, err := os.OpenFile(f.filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (f *fileConfigStore) Close() {
+}
+
+func (f *fileConfigStore) String() string {
+	return "file " + f.filename
+}
@@ -0,0 +1,335 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newEtcdStandIn serves the range and txn apis of the etcd gateway, for one key in memory.
+func newEtcdStandIn() *httptest.Server {
+	lock := sync.Mutex{}
+	values := make(map[string]*etcdKeyValue)
+	revision := int64(1)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := io.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case ETCD_API_RANGE:
+			request := &etcdKeyValue{}
+			json.Unmarshal(body, request)
+			response := &etcdRangeResponse{}
+			if kv, ok := values[request.Key]; ok {
+				response.Kvs = append(response.Kvs, kv)
+			}
+			json.NewEncoder(w).Encode(response)
+		case ETCD_API_TXN:
+			request := &struct {
+				Compare []map[string]string `json:"compare"`
+				Success []struct {
+					RequestPut etcdKeyValue `json:"request_put"`
+				} `json:"success"`
+			}{}
+			json.Unmarshal(body, request)
+			modRevision := "0"
+			if kv, ok := values[request.Compare[0]["key"]]; ok {
+				modRevision = kv.ModRevision
+			}
+			response := &etcdTxnResponse{}
+			if modRevision == request.Compare[0]["mod_revision"] {
+				revision++
+				put := request.Success[0].RequestPut
+				values[put.Key] = &etcdKeyValue{Key: put.Key, Value: put.Value, ModRevision: strconv.FormatInt(revision, 10)}
+				response.Succeeded = true
+			}
+			response.Header.Revision = strconv.FormatInt(revision, 10)
+			json.NewEncoder(w).Encode(response)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Not Found","message":"Not Found"}`))
+		}
+	}))
+}
+
+// stubSqlDriver runs the statements of sqlConfigStore on the rows in memory, the same DSN shares the rows.
+type stubSqlDriver struct{}
+type stubSqlConn struct{ db *stubSqlDb }
+type stubSqlStmt struct {
+	db    *stubSqlDb
+	query string
+}
+type stubSqlDb struct {
+	lock sync.Mutex
+	rows map[string]*stubSqlRow
+}
+type stubSqlRow struct {
+	content  []byte
+	revision int64
+}
+type stubSqlRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+var stubSqlDbs sync.Map
+
+func init() {
+	sql.Register("mao-stub", stubSqlDriver{})
+}
+
+func (stubSqlDriver) Open(dsn string) (driver.Conn, error) {
+	db, _ := stubSqlDbs.LoadOrStore(dsn, &stubSqlDb{rows: make(map[string]*stubSqlRow)})
+	return &stubSqlConn{db: db.(*stubSqlDb)}, nil
+}
+
+func (c *stubSqlConn) Prepare(query string) (driver.Stmt, error) {
+	return &stubSqlStmt{db: c.db, query: query}, nil
+}
+func (c *stubSqlConn) Close() error              { return nil }
+func (c *stubSqlConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (s *stubSqlStmt) Close() error  { return nil }
+func (s *stubSqlStmt) NumInput() int { return -1 }
+
+func (s *stubSqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	switch s.query {
+	case SQL_CREATE_CONFIG_TABLE:
+		return driver.RowsAffected(0), nil
+	case SQL_INSERT_CONFIG:
+		name := args[0].(string)
+		if _, ok := s.db.rows[name]; ok {
+			return nil, errors.New("duplicate entry")
+		}
+		s.db.rows[name] = &stubSqlRow{content: args[1].([]byte), revision: 1}
+		return driver.RowsAffected(1), nil
+	case SQL_UPDATE_CONFIG:
+		row, ok := s.db.rows[args[2].(string)]
+		if !ok || row.revision != args[3].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		row.content = args[0].([]byte)
+		row.revision++
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unknown statement " + s.query)
+}
+
+func (s *stubSqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	rows := &stubSqlRows{}
+	row, ok := s.db.rows[args[0].(string)]
+	switch s.query {
+	case SQL_SELECT_CONFIG:
+		rows.columns = []string{"content", "revision"}
+		if ok {
+			rows.values = append(rows.values, []driver.Value{row.content, row.revision})
+		}
+	case SQL_SELECT_REVISION:
+		rows.columns = []string{"revision"}
+		if ok {
+			rows.values = append(rows.values, []driver.Value{row.revision})
+		}
+	default:
+		return nil, errors.New("unknown statement " + s.query)
+	}
+	return rows, nil
+}
+
+func (r *stubSqlRows) Columns() []string { return r.columns }
+func (r *stubSqlRows) Close() error      { return nil }
+func (r *stubSqlRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func waitConfig(configModule *ConfigYamlModule, path string, expect interface{}) bool {
+	for i := 0; i < 50; i++ {
+		if value, _ := configModule.GetConfig(path); reflect.DeepEqual(value, expect) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// testSharedConfigStore runs two servers sharing the store, each with its own local history.
+func testSharedConfigStore(t *testing.T, newStore func() ConfigStore) {
+	servers := make([]*ConfigYamlModule, 2)
+	for i := range servers {
+		servers[i] = &ConfigYamlModule{}
+		servers[i].SetConfigStore(newStore())
+		if !servers[i].InitConfigModule(filepath.Join(t.TempDir(), "mao-config.yaml")) {
+			t.Fatal("fail to init config module")
+		}
+		defer servers[i].Shutdown()
+	}
+	subscription := servers[1].Subscribe("/icmp-ka")
+
+	services := []interface{}{map[string]interface{}{"address": "2001:db8::1"}}
+	if _, errCode := servers[0].PutConfig("/icmp-ka/services", services); errCode != ERR_CODE_SUCCESS {
+		t.Fatalf("fail to put config, %d", errCode)
+	}
+	if !waitConfig(servers[1], "/icmp-ka/services", services) {
+		t.Fatal("the config is not shared")
+	}
+	select {
+	case event := <-subscription:
+		if event.Path != "/icmp-ka" || event.Actor != MaoApi.CONFIG_ACTOR_STORE {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no change event")
+	}
+
+	// the change by the other server is merged before the put, not overwritten.
+	servers[1].PutConfig("/email/sender", "mao@example.com")
+	servers[0].PutConfig("/email/receiver", []interface{}{"ops@example.com"})
+	for _, server := range servers {
+		if !waitConfig(server, "/email", map[string]interface{}{"sender": "mao@example.com", "receiver": []interface{}{"ops@example.com"}}) {
+			t.Errorf("the puts of both servers are not kept")
+		}
+	}
+	if health := servers[0].CheckHealth(); health.Status == MaoApi.HEALTH_STATUS_DOWN {
+		t.Errorf("unexpected health %+v", health)
+	}
+
+	// the save on a stale revision is rejected.
+	store := newStore()
+	defer store.Close()
+	content, revision, err := store.Load()
+	if err != nil || len(content) == 0 {
+		t.Fatalf("fail to load, %v", err)
+	}
+	if _, err = store.Save(content, revision); err != nil {
+		t.Fatalf("fail to save, %v", err)
+	}
+	if _, err = store.Save(content, revision); err != ErrConfigStoreConflict {
+		t.Errorf("expect conflict, got %v", err)
+	}
+}
+
+func TestConfigStore_Etcd(t *testing.T) {
+	etcd := newEtcdStandIn()
+	defer etcd.Close()
+
+	if _, err := NewConfigStore(CONFIG_BACKEND_ETCD, "127.0.0.1:2379"); err == nil {
+		t.Errorf("expect error for the endpoint without scheme")
+	}
+	testSharedConfigStore(t, func() ConfigStore {
+		// the first endpoint is down.
+		store, err := NewConfigStore(CONFIG_BACKEND_ETCD, "http://127.0.0.1:1,"+etcd.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+
+	kv, _ := (&etcdConfigStore{endpoints: []string{etcd.URL}, key: ETCD_CONFIG_KEY_PREFIX + DEFAULT_CONFIG_STORE_NAME, client: http.DefaultClient}).get()
+	if content, _ := base64.StdEncoding.DecodeString(kv.Value); len(content) == 0 {
+		t.Errorf("the config is not stored in the key")
+	}
+}
+
+func TestConfigStore_Sql(t *testing.T) {
+	testSharedConfigStore(t, func() ConfigStore {
+		store, err := newSqlConfigStore("mao-stub", t.Name(), DEFAULT_CONFIG_STORE_NAME)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// unwatchedConfigStore hides the changes by others from Revision, until watched.
+type unwatchedConfigStore struct {
+	ConfigStore
+	revision string
+	watched  atomic.Bool
+}
+
+func (u *unwatchedConfigStore) Load() ([]byte, string, error) {
+	content, revision, err := u.ConfigStore.Load()
+	u.revision = revision
+	return content, revision, err
+}
+func (u *unwatchedConfigStore) Save(content []byte, revision string) (string, error) {
+	newRevision, err := u.ConfigStore.Save(content, revision)
+	if err == nil {
+		u.revision = newRevision
+	}
+	return newRevision, err
+}
+func (u *unwatchedConfigStore) Revision() (string, error) {
+	if u.watched.Load() {
+		return u.ConfigStore.Revision()
+	}
+	return u.revision, nil
+}
+
+func TestConfigStore_Conflict(t *testing.T) {
+	newStore := func() ConfigStore {
+		store, err := newSqlConfigStore("mao-stub", t.Name(), DEFAULT_CONFIG_STORE_NAME)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	unwatched := &unwatchedConfigStore{ConfigStore: newStore()}
+	servers := []*ConfigYamlModule{{}, {}}
+	servers[0].SetConfigStore(newStore())
+	servers[1].SetConfigStore(unwatched)
+	for _, server := range servers {
+		if !server.InitConfigModule(filepath.Join(t.TempDir(), "mao-config.yaml")) {
+			t.Fatal("fail to init config module")
+		}
+		defer server.Shutdown()
+	}
+
+	if _, errCode := servers[0].PutConfig("/email/sender", "mao@example.com"); errCode != ERR_CODE_SUCCESS {
+		t.Fatalf("fail to put config, %d", errCode)
+	}
+	// servers[1] doesn't merge the change before the put, the save conflicts.
+	if ok, errCode := servers[1].PutConfig("/email/receiver", []interface{}{"ops@example.com"}); ok || errCode != ERR_CODE_SAVE_FAIL {
+		t.Errorf("expect the conflict reported, %v, %d", ok, errCode)
+	}
+	if value, _ := servers[1].GetConfig("/email/receiver"); value != nil {
+		t.Errorf("the put failed is kept, %v", value)
+	}
+	if health := servers[1].CheckHealth(); health.Status == MaoApi.HEALTH_STATUS_DOWN {
+		t.Errorf("unexpected health after the conflict, %+v", health)
+	}
+
+	unwatched.watched.Store(true)
+	if !waitConfig(servers[1], "/email/sender", "mao@example.com") {
+		t.Fatal("the config of the other server is not reloaded")
+	}
+	if _, errCode := servers[1].PutConfig("/email/receiver", []interface{}{"ops@example.com"}); errCode != ERR_CODE_SUCCESS {
+		t.Fatalf("fail to put config again, %d", errCode)
+	}
+	if !waitConfig(servers[0], "/email", map[string]interface{}{"sender": "mao@example.com", "receiver": []interface{}{"ops@example.com"}}) {
+		t.Errorf("the puts of both servers are not kept")
+	}
+}
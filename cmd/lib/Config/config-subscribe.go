@@ -0,0 +1,131 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	// the events are dropped if the subscriber doesn't consume them in time, the eventLoop never blocks.
+	CONFIG_SUBSCRIPTION_BUFFER = 64
+)
+
+type configSubscription struct {
+	prefix  []string // segments of the path prefix, empty for "/"
+	channel chan *MaoApi.ConfigChangeEvent
+}
+
+// configChange describes a write of the config, for the history and the subscriptions.
+type configChange struct {
+	path       string // "/" for the whole config, e.g. loaded from the file or rolled back
+	actor      string
+	rollbackOf uint64
+	sec        bool // put by PutSecConfig
+}
+
+func splitConfigPath(path string) []string {
+	segments := make([]string, 0)
+	for _, key := range strings.Split(strings.Trim(path, "/"), "/") {
+		if key != "" {
+			segments = append(segments, key)
+		}
+	}
+	return segments
+}
+
+func joinConfigPath(segments []string) string {
+	return "/" + strings.Join(segments, "/")
+}
+
+// isUnderPath returns true if the path is the same as the parent, or under it.
+func isUnderPath(path []string, parent []string) bool {
+	if len(path) < len(parent) {
+		return false
+	}
+	for i := range parent {
+		if path[i] != parent[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe publishes the changes under the path prefix to the returned channel.
+func (C *ConfigYamlModule) Subscribe(pathPrefix string) <-chan *MaoApi.ConfigChangeEvent {
+	C.subscriptionsLock.Lock()
+	defer C.subscriptionsLock.Unlock()
+
+	subscription := &configSubscription{
+		prefix:  splitConfigPath(pathPrefix),
+		channel: make(chan *MaoApi.ConfigChangeEvent, CONFIG_SUBSCRIPTION_BUFFER),
+	}
+	C.subscriptions = append(C.subscriptions, subscription)
+	return subscription.channel
+}
+
+// Unsubscribe stops publishing to the channel, and closes it.
+func (C *ConfigYamlModule) Unsubscribe(subscription <-chan *MaoApi.ConfigChangeEvent) {
+	C.subscriptionsLock.Lock()
+	defer C.subscriptionsLock.Unlock()
+
+	for i, s := range C.subscriptions {
+		if (<-chan *MaoApi.ConfigChangeEvent)(s.channel) == subscription {
+			close(s.channel)
+			C.subscriptions = append(C.subscriptions[:i], C.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// publishConfigChange publishes the change to the subscriptions whose prefix overlaps the changed path.
+// The subscription under the changed path gets the values of its prefix, e.g. /icmp-ka/services for a rollback.
+func (C *ConfigYamlModule) publishConfigChange(oldConfig map[string]interface{}, newConfig map[string]interface{}, change *configChange, version *ConfigVersion) {
+	C.subscriptionsLock.Lock()
+	defer C.subscriptionsLock.Unlock()
+
+	if len(C.subscriptions) == 0 {
+		return
+	}
+	changed := splitConfigPath(change.path)
+	timestamp := time.Now()
+	var versionNumber uint64
+	if version != nil {
+		versionNumber = version.Version
+		timestamp = version.Timestamp
+	}
+
+	for _, s := range C.subscriptions {
+		path := changed
+		if !isUnderPath(changed, s.prefix) {
+			if change.sec || !isUnderPath(s.prefix, changed) {
+				continue
+			}
+			path = s.prefix
+		}
+
+		event := &MaoApi.ConfigChangeEvent{
+			Path:      joinConfigPath(path),
+			Sec:       change.sec,
+			Actor:     change.actor,
+			Version:   versionNumber,
+			Timestamp: timestamp,
+		}
+		if !change.sec {
+			// the ciphertexts are stored with other keys, the plaintext is never published.
+			event.OldValue, _ = lookupConfigPath(oldConfig, event.Path)
+			event.NewValue, _ = lookupConfigPath(newConfig, event.Path)
+			if reflect.DeepEqual(event.OldValue, event.NewValue) {
+				continue
+			}
+		}
+
+		select {
+		case s.channel <- event:
+		default:
+			util.MaoLogM(util.WARN, MODULE_NAME, "The subscription of %s is full, drop the change of %s", joinConfigPath(s.prefix), event.Path)
+		}
+	}
+}
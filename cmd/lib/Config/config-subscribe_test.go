@@ -0,0 +1,64 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitChangeEvent(subscription <-chan *MaoApi.ConfigChangeEvent, timeout time.Duration) *MaoApi.ConfigChangeEvent {
+	select {
+	case event := <-subscription:
+		return event
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestConfigSubscribe(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	mysqlSub := configModule.Subscribe("/mysql")
+	servicesSub := configModule.Subscribe("/icmp-ka/services/")
+
+	configModule.PutConfigBy("admin", "/mysql/username", "mao")
+	event := waitChangeEvent(mysqlSub, time.Second)
+	if event == nil || event.Path != "/mysql/username" || event.OldValue != nil || event.NewValue != "mao" ||
+		event.Actor != "admin" || event.Version == 0 || event.Sec {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	configModule.PutConfigBy("admin", "/mysql/username", "jianwei")
+	if event = waitChangeEvent(mysqlSub, time.Second); event == nil || event.OldValue != "mao" || event.NewValue != "jianwei" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event = waitChangeEvent(servicesSub, 100*time.Millisecond); event != nil {
+		t.Errorf("expect no event for /icmp-ka/services, got %+v", event)
+	}
+
+	// the plaintext is not published.
+	configModule.secKey = "0123456789abcdef0123456789abcdef"
+	configModule.PutSecConfig("/mysql/password", "secret")
+	if event = waitChangeEvent(mysqlSub, time.Second); event == nil || event.Path != "/mysql/password" || !event.Sec ||
+		event.OldValue != nil || event.NewValue != nil {
+		t.Fatalf("unexpected sec event %+v", event)
+	}
+
+	// the parent path is changed, the subscription gets the values of its prefix.
+	configModule.PutConfig("/icmp-ka", map[string]interface{}{"services": []string{"::1"}})
+	event = waitChangeEvent(servicesSub, time.Second)
+	if event == nil || event.Path != "/icmp-ka/services" || event.OldValue != nil || len(event.NewValue.([]interface{})) != 1 {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	configModule.Unsubscribe(mysqlSub)
+	if _, ok := <-mysqlSub; ok {
+		t.Errorf("expect the subscription closed")
+	}
+	configModule.PutConfig("/mysql/username", "closed") // not published to the closed channel
+}
@@ -0,0 +1,171 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"errors"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+)
+
+type configUpdateListener struct {
+	path     string
+	listener *chan int
+}
+
+// RegisterConfigUpdateListener registers the channel once for the path, a module re-initialized at runtime may register it again.
+// The listener should be buffered, the notifications are coalesced if it is not consumed in time.
+func (C *ConfigYamlModule) RegisterConfigUpdateListener(path string, listener *chan int) {
+	C.configUpdateListenersLock.Lock()
+	defer C.configUpdateListenersLock.Unlock()
+
+	for _, l := range C.configUpdateListeners {
+		if l.path == path && l.listener == listener {
+			return
+		}
+	}
+	C.configUpdateListeners = append(C.configUpdateListeners, &configUpdateListener{path: path, listener: listener})
+}
+
+// publishConfigUpdate notifies the listeners whose config is different between the two versions.
+func (C *ConfigYamlModule) publishConfigUpdate(oldConfig map[string]interface{}, newConfig map[string]interface{}) {
+	C.configUpdateListenersLock.Lock()
+	defer C.configUpdateListenersLock.Unlock()
+
+	for _, l := range C.configUpdateListeners {
+		oldValue, _ := lookupConfigPath(oldConfig, l.path)
+		newValue, _ := lookupConfigPath(newConfig, l.path)
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		// not blocking, the listener's loop may have stopped, e.g. the module is disabled at runtime.
+		select {
+		case *l.listener <- 0:
+		default:
+		}
+	}
+}
+
+// lookupConfigPath returns the value of the path, e.g. /icmp-ka/services, "/" for the whole config.
+func lookupConfigPath(config map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = config
+	for _, key := range strings.Split(strings.Trim(path, "/"), "/") {
+		if key == "" {
+			continue
+		}
+		currentMap, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = currentMap[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// replaceConfig replaces the content of the config in place, the eventLoop holds the map.
+func replaceConfig(config map[string]interface{}, newConfig map[string]interface{}) {
+	for k := range config {
+		delete(config, k)
+	}
+	for k, v := range newConfig {
+		config[k] = v
+	}
+}
+
+// checkConfigStore runs in the eventLoop. If the config is changed outside, e.g. the config file is edited,
+// or saved by another server sharing the store, it is validated and merged into the config.
+// An invalid change is ignored, and it is overwritten by the next change of the config.
+func (C *ConfigYamlModule) checkConfigStore(config map[string]interface{}) {
+	revision, err := C.store.Revision()
+	if err != nil {
+		util.MaoLogM(util.DEBUG, MODULE_NAME, "Fail to check the config in %s. (%s)", C.store.String(), err.Error())
+		return
+	}
+	if revision == C.storeRevision {
+		return
+	}
+
+	content, revision, err := C.store.Load()
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read the changed config, ignored. (%s)", err.Error())
+		return
+	}
+	C.storeRevision = revision
+	if content == nil {
+		return // e.g. the file is removed, it is written again by the next change.
+	}
+	storeConfig := make(map[string]interface{})
+	if err = yaml.Unmarshal(content, &storeConfig); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "The changed config is invalid, ignored. (%s)", err.Error())
+		return
+	}
+
+	newContent, err := marshalConfig(storeConfig)
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "The changed config is invalid, ignored. (%s)", err.Error())
+		return
+	}
+	oldContent := C.history.getLastContent()
+	if string(newContent) == string(oldContent) {
+		return // e.g. saved by ourselves, or only the format is changed.
+	}
+
+	if err = C.validateConfigEdit(config, storeConfig); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "The changed config is rejected, ignored. (%s)", err.Error())
+		return
+	}
+
+	replaceConfig(config, storeConfig)
+	actor := MaoApi.CONFIG_ACTOR_FILE
+	if _, ok := C.store.(*fileConfigStore); !ok {
+		actor = MaoApi.CONFIG_ACTOR_STORE
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "The config in %s is changed outside, reloaded.", C.store.String())
+	C.commitVersion(config, newContent, &configChange{path: "/", actor: actor})
+}
+
+// validateConfigEdit checks the edit of the config file before merging it.
+func (C *ConfigYamlModule) validateConfigEdit(config map[string]interface{}, fileConfig map[string]interface{}) error {
+	// the sec configs can't be decrypted with the digest of another key, use the rollback api for that.
+	oldDigest, _ := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST)
+	newDigest, _ := lookupConfigPath(fileConfig, CONFIG_PATH_SEC_KEY_DIGEST)
+	if !reflect.DeepEqual(oldDigest, newDigest) {
+		return errors.New("the sec key digest can't be edited")
+	}
+
+	// the sec configs are pairs of ciphertext and iv.
+	if err := validateSecPairs(fileConfig, ""); err != nil {
+		return err
+	}
+	return C.validateConfigSchemas(fileConfig)
+}
+
+func validateSecPairs(config map[string]interface{}, path string) error {
+	for key, value := range config {
+		if subConfig, ok := value.(map[string]interface{}); ok {
+			if err := validateSecPairs(subConfig, path+"/"+key); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(key, ENC_DEC_SUFFIX_CIPHER) {
+			continue
+		}
+		name := strings.TrimSuffix(key, ENC_DEC_SUFFIX_CIPHER)
+		_, okCipher := value.(string)
+		iv, okIv := config[name+ENC_DEC_SUFFIX_IV].(string)
+		if !okCipher || !okIv || iv == "" {
+			return fmt.Errorf("the sec config %s/%s is broken", path, name)
+		}
+		if algorithm, ok := config[name+ENC_DEC_SUFFIX_ALGORITHM]; ok {
+			if algorithmStr, _ := algorithm.(string); !IsSecAlgorithm(algorithmStr) {
+				return fmt.Errorf("the algorithm of the sec config %s/%s is unknown", path, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package Config
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func waitNotified(listener chan int, timeout time.Duration) bool {
+	select {
+	case <-listener:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestConfigWatch_ExternalEdit(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+	if err := os.WriteFile(configFile, []byte("config:\n    secKeyDigest: abc\nicmp-ka:\n    services: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+
+	icmpListener := make(chan int, 1)
+	configModule.RegisterConfigUpdateListener("/icmp-ka/services", &icmpListener)
+	configModule.RegisterConfigUpdateListener("/icmp-ka/services", &icmpListener) // once
+
+	// not notified for other paths.
+	configModule.PutConfig("/email/sender", "mao@example.com")
+	if waitNotified(icmpListener, 100*time.Millisecond) {
+		t.Errorf("expect no notification for /email")
+	}
+
+	// an invalid edit is ignored.
+	os.WriteFile(configFile, []byte("icmp-ka: [\n"), 0600)
+	if waitNotified(icmpListener, 1500*time.Millisecond) {
+		t.Errorf("expect the invalid edit ignored")
+	}
+
+	// the sec key digest can't be edited.
+	os.WriteFile(configFile, []byte("config:\n    secKeyDigest: xyz\nicmp-ka:\n    services: []\n"), 0600)
+	if waitNotified(icmpListener, 1500*time.Millisecond) {
+		t.Errorf("expect the edit of the digest rejected")
+	}
+
+	edited := "config:\n    secKeyDigest: abc\nicmp-ka:\n    services:\n        - address: 2001:db8::1\n          serviceName: edited\n"
+	if err := os.WriteFile(configFile, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !waitNotified(icmpListener, 3*time.Second) {
+		t.Fatal("expect notified for the edit of the config file")
+	}
+
+	services, _ := configModule.GetConfig("/icmp-ka/services")
+	expect := []interface{}{map[string]interface{}{"address": "2001:db8::1", "serviceName": "edited"}}
+	if !reflect.DeepEqual(services, expect) {
+		t.Errorf("expect the edit merged, got %v", services)
+	}
+	if _, errCode := configModule.GetConfig("/email/sender"); errCode == ERR_CODE_SUCCESS {
+		t.Errorf("expect /email removed by the edit")
+	}
+	history := configModule.GetConfigHistory()
+	if last := history[len(history)-1]; last.Actor != MaoApi.CONFIG_ACTOR_FILE {
+		t.Errorf("expect the edit recorded, got %+v", last)
+	}
+}
@@ -1,6 +1,7 @@
 package Config
 
 import (
+	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/util"
 	"crypto/rand"
@@ -8,12 +9,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/MaoJianwei/gmsm/sm3"
-	"github.com/MaoJianwei/gmsm/sm4"
 	"github.com/gin-gonic/gin"
 	yaml "gopkg.in/yaml.v3"
-	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +25,10 @@ const (
 	EVENT_PUT
 	EVENT_GET_SEC
 	EVENT_PUT_SEC
+	EVENT_ROLLBACK
+	EVENT_ROTATE_KEY
+	EVENT_SNAPSHOT
+	EVENT_UNLOCK_KEY
 
 	MODULE_NAME = "Config-YAML-module"
 
@@ -33,6 +38,10 @@ const (
 	ERR_CODE_PATH_TRANSIT_FAIL = 3
 	ERR_CODE_SEC_PATH_NOT_EXIST = 4
 	ERR_CODE_SEC_DATA_TYPE_NOT_STRING = 5
+	ERR_CODE_SHUTDOWN = 6
+	ERR_CODE_SAVE_FAIL = 7
+	ERR_CODE_KEY_NOT_MATCHED = 8
+	ERR_CODE_SCHEMA_INVALID = 9
 
 	ERR_CODE_ENC_DEC_OK                = 20
 	ERR_CODE_ENC_FAIL                  = 21
@@ -45,24 +54,54 @@ const (
 
 	ENC_DEC_SUFFIX_CIPHER = "_MAO_SEC"
 	ENC_DEC_SUFFIX_IV     = "_MAO_SEC_IV"
+	ENC_DEC_SUFFIX_ALGORITHM = "_MAO_SEC_ALG" // not existing for the sec configs before the algorithm is recorded, i.e. SM4-GCM
 
 	URL_CONFIG_ALL_TEXT_SHOW = "/getAllConfigText"
 	URL_CONFIG_SET_SECKEY = "/setConfigSecKey"
+	URL_CONFIG_HISTORY_SHOW = "/showConfigHistory"
+	URL_CONFIG_VERSION_SHOW = "/showConfigVersion"
+	URL_CONFIG_ROLLBACK = "/rollbackConfig"
+	URL_CONFIG_ROTATE_SECKEY = "/rotateConfigSecKey"
+	URL_CONFIG_EXPORT = "/exportConfig"
+	URL_CONFIG_IMPORT = "/importConfig"
 
 	CONFIG_API_KEY_SECKEY = "secKey"
+	CONFIG_API_KEY_VERSION = "version"
+	CONFIG_API_KEY_OLD_SECKEY = "oldSecKey"
+	CONFIG_API_KEY_NEW_SECKEY = "newSecKey"
+	CONFIG_API_KEY_SECRETS = "secrets"
+	CONFIG_API_KEY_BUNDLE = "bundle"
+	CONFIG_API_KEY_APPLY = "apply"
 
 	CONFIG_PATH_SEC_KEY_DIGEST = "/config/secKeyDigest"
 )
 
 type ConfigYamlModule struct {
-	needShutdown bool
+	needShutdown atomic.Bool
+	exited chan struct{} // closed when eventLoop exits
 	eventChannel chan *configEvent
 
 	configFilename string
 
 	secKey string // complement or truncate the key to 32-bytes length for encryption and decryption. But store the hash of the origin key.
 	secKeyDigest string
+	secAlgorithm string // for encrypting the new sec configs, SEC_ALGORITHM_SM4_GCM by default
+	secKeyFile string // the key file loaded at startup, rewritten by the rotation so that the next startup loads the new key
+	secKeyFromEnv bool // the key of CONFIG_SEC_KEY_ENV can't be rewritten, so it is not rotated at runtime
 	keyUpdateListeners []*chan int
+	keyUpdateListenersLock sync.Mutex
+	configUpdateListeners []*configUpdateListener
+	configUpdateListenersLock sync.Mutex
+	subscriptions []*configSubscription
+	subscriptionsLock sync.Mutex
+	schemas []*configSchema
+	schemasLock sync.RWMutex
+
+	lastSaveError atomic.Value // string, empty if the last save succeeded. For health check.
+
+	history *configHistory
+	store ConfigStore // the config file by default
+	storeRevision string // the revision loaded or saved by us, for finding the changes outside
 }
 
 //var (
@@ -73,9 +112,11 @@ type ConfigYamlModule struct {
 type configEvent struct {
 	eventType int
 	path      string
+	actor     string // recorded in the config history
 
 	data      interface{} // plaintext, or ciphertext updated internally
 	iv        interface{} // rewrite internally before using
+	algorithm string      // rewrite internally before using
 
 	result    chan eventResult
 }
@@ -85,19 +126,66 @@ type eventResult struct {
 	result  interface{}
 }
 
-func (C *ConfigYamlModule) saveConfig(config map[string]interface{}) error {
-	data, _ := yaml.Marshal(config)
-	return ioutil.WriteFile(C.configFilename, data, 0666)
+// saveConfig writes the config to the store, e.g. the config file atomically, and records a new version in the history if it is changed.
+func (C *ConfigYamlModule) saveConfig(config map[string]interface{}, change *configChange) (*ConfigVersion, error) {
+	data, err := marshalConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, err := C.store.Save(data, C.storeRevision)
+	if err != nil {
+		return nil, err
+	}
+	C.storeRevision = revision // not a change outside
+
+	return C.commitVersion(config, data, change), nil
+}
+
+// restoreConfig runs in the eventLoop, after the change of the config fails to be saved.
+// If another server saved the shared store in the meantime, its config is reloaded, it was not merged before the change.
+func (C *ConfigYamlModule) restoreConfig(config map[string]interface{}, original map[string]interface{}, err error) {
+	replaceConfig(config, original)
+	if errors.Is(err, ErrConfigStoreConflict) {
+		C.checkConfigStore(config) // the store is fine, the change can be put again.
+		return
+	}
+	C.lastSaveError.Store(err.Error())
+}
+
+// commitVersion records a new version if the config is changed, and notifies the listeners and subscriptions of the changed paths.
+func (C *ConfigYamlModule) commitVersion(config map[string]interface{}, content []byte, change *configChange) *ConfigVersion {
+	oldContent := C.history.getLastContent()
+	version, err := C.history.record(config, content, change.path, change.actor, change.rollbackOf)
+	if err != nil {
+		// the config is saved, only the history is lost.
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to record the config history of %s by %s, %s", change.path, change.actor, err.Error())
+	} else if version != nil {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Config version %d: %s changed by %s", version.Version, change.path, change.actor)
+	}
+	if string(oldContent) == string(content) {
+		return version
+	}
+
+	// both are marshaled by us, and not shared with the eventLoop.
+	oldConfig := make(map[string]interface{})
+	newConfig := make(map[string]interface{})
+	yaml.Unmarshal(oldContent, &oldConfig)
+	yaml.Unmarshal(content, &newConfig)
+	C.publishConfigUpdate(oldConfig, newConfig)
+	C.publishConfigChange(oldConfig, newConfig, change, version)
+	return version
 }
 
 func (C *ConfigYamlModule) loadConfig() (map[string]interface{}, error) {
 
 	config := make(map[string]interface{})
 
-	content, err := ioutil.ReadFile(C.configFilename)
+	content, revision, err := C.store.Load()
 	if err != nil {
 		return nil, err
 	}
+	C.storeRevision = revision
 
 	err = yaml.Unmarshal(content, &config)
 	if err != nil {
@@ -107,6 +195,23 @@ func (C *ConfigYamlModule) loadConfig() (map[string]interface{}, error) {
 	return config, nil
 }
 
+// submitEvent fails with ERR_CODE_SHUTDOWN instead of blocking forever, if the eventLoop has exited.
+func (C *ConfigYamlModule) submitEvent(event *configEvent) eventResult {
+	select {
+	case C.eventChannel <- event:
+	case <-C.exited:
+		return eventResult{errCode: ERR_CODE_SHUTDOWN, result: nil}
+	}
+
+	// TODO: timeout mechanism
+	select {
+	case ret := <-event.result:
+		return ret
+	case <-C.exited:
+		return eventResult{errCode: ERR_CODE_SHUTDOWN, result: nil}
+	}
+}
+
 func (C *ConfigYamlModule) GetConfig(path string) (object interface{}, errCode int) {
 	result := make(chan eventResult, 1)
 	event := &configEvent{
@@ -115,10 +220,7 @@ func (C *ConfigYamlModule) GetConfig(path string) (object interface{}, errCode i
 		data:      nil,
 		result:    result,
 	}
-	C.eventChannel <- event
-
-	// TODO: timeout mechanism
-	ret := <-result
+	ret := C.submitEvent(event)
 
 	util.MaoLogM(util.DEBUG, MODULE_NAME, "GetConfig result: %v", ret)
 	return ret.result, ret.errCode
@@ -128,18 +230,20 @@ func (C *ConfigYamlModule) GetConfig(path string) (object interface{}, errCode i
 // path: e.g. /version, /icmp-detect/services
 // result: bool, true or false
 func (C *ConfigYamlModule) PutConfig(path string, data interface{}) (success bool, errCode int) {
+	return C.PutConfigBy(MaoApi.CONFIG_ACTOR_SYSTEM, path, data)
+}
+
+func (C *ConfigYamlModule) PutConfigBy(actor string, path string, data interface{}) (success bool, errCode int) {
 
 	result := make(chan eventResult, 1)
 	event := &configEvent{
 		eventType: EVENT_PUT,
 		path:      path,
+		actor:     actorOrSystem(actor),
 		data:      data,
 		result:    result,
 	}
-	C.eventChannel <- event
-
-	// TODO: timeout mechanism
-	ret := <-result
+	ret := C.submitEvent(event)
 	retBool := false
 	if ret.result != nil {
 		retBool = ret.result.(bool)
@@ -158,27 +262,26 @@ func (C *ConfigYamlModule) GetSecConfig(path string) (object interface{}, errCod
 		data:      nil,
 		result:    result,
 	}
-	C.eventChannel <- event
-
-	// TODO: timeout mechanism
-	ret := <-result
+	ret := C.submitEvent(event)
 
 	util.MaoLogM(util.DEBUG, MODULE_NAME, "GetSecConfig result: %v", ret)
 	return ret.result, ret.errCode
 }
 func (C *ConfigYamlModule) PutSecConfig(path string, data interface{}) (success bool, errCode int) {
+	return C.PutSecConfigBy(MaoApi.CONFIG_ACTOR_SYSTEM, path, data)
+}
+
+func (C *ConfigYamlModule) PutSecConfigBy(actor string, path string, data interface{}) (success bool, errCode int) {
 	// todo - TBD - test
 	result := make(chan eventResult, 1)
 	event := &configEvent{
 		eventType: EVENT_PUT_SEC,
 		path:      path,
+		actor:     actorOrSystem(actor),
 		data:      data,
 		result:    result,
 	}
-	C.eventChannel <- event
-
-	// TODO: timeout mechanism
-	ret := <-result
+	ret := C.submitEvent(event)
 	retBool := false
 	if ret.result != nil {
 		retBool = ret.result.(bool)
@@ -190,12 +293,36 @@ func (C *ConfigYamlModule) PutSecConfig(path string, data interface{}) (success
 
 
 func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
+	defer close(C.exited)
+	defer C.store.Close()
+
 	checkInterval := time.Duration(1000) * time.Millisecond
 	checkShutdownTimer := time.NewTimer(checkInterval)
 	for {
 		select {
 		case event := <-C.eventChannel:
 
+			if event.eventType != EVENT_GET && event.eventType != EVENT_GET_SEC {
+				// merge the changes outside first, e.g. saved by another server sharing the store.
+				C.checkConfigStore(config)
+			}
+			if event.eventType == EVENT_ROLLBACK {
+				C.processRollback(config, event)
+				continue
+			}
+			if event.eventType == EVENT_ROTATE_KEY {
+				C.processRotateSecKey(config, event)
+				continue
+			}
+			if event.eventType == EVENT_SNAPSHOT {
+				C.processSnapshot(config, event)
+				continue
+			}
+			if event.eventType == EVENT_UNLOCK_KEY {
+				C.processUnlockSecKey(config, event)
+				continue
+			}
+
 			//var posMap map[string]interface{}
 
 
@@ -251,7 +378,20 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 			}
 			util.MaoLogM(util.DEBUG, MODULE_NAME, "We get the transitConfig: %v, %v", transitConfig, missPos)
 
-
+			if event.eventType == EVENT_PUT {
+				err := C.validatePut(event.path, event.data, func(schemaPath string) interface{} {
+					value, _ := lookupConfigPath(config, schemaPath)
+					return value
+				})
+				if err != nil {
+					event.result <- eventResult{
+						errCode: ERR_CODE_SCHEMA_INVALID,
+						result:  false,
+					}
+					util.MaoLogM(util.WARN, MODULE_NAME, "Reject the config put by %s, %s", event.actor, err.Error())
+					continue
+				}
+			}
 
 			switch event.eventType {
 			case EVENT_GET_SEC:
@@ -273,6 +413,7 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 				} else {
 					cipherPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_CIPHER)
 					ivPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_IV)
+					algorithmPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_ALGORITHM)
 					errCode := ERR_CODE_SUCCESS
 
 					ciphertext, okCiphertext := transitConfig[cipherPath]
@@ -299,7 +440,8 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 						continue
 					}
 
-					plaintext, errCode, err := C.decryptConfig(ciphertextStr, ivBase64Str)
+					algorithm, _ := transitConfig[algorithmPath].(string)
+					plaintext, errCode, err := C.decryptConfig(ciphertextStr, ivBase64Str, algorithm)
 					if err != nil {
 						event.result <- eventResult{
 							errCode: errCode,
@@ -389,11 +531,23 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 
 					event.data = cipherText
 					event.iv = ivBase64
+					event.algorithm = C.getSecAlgorithm()
 				}
 				fallthrough
 			case EVENT_PUT:
 				util.MaoLogM(util.DEBUG, MODULE_NAME, "EVENT_PUT, %s, %v, %v", event.path, event.data, event.result)
 
+				// restored if the put fails to be saved, the nested maps are changed in place.
+				original, err := copyConfig(config)
+				if err != nil {
+					event.result <- eventResult{
+						errCode: ERR_CODE_SAVE_FAIL,
+						result:  false,
+					}
+					util.MaoLogM(util.WARN, MODULE_NAME, "Fail to copy config, reject the config put by %s. (%s)", event.actor, err.Error())
+					continue
+				}
+
 				if !ok {
 					// Create transit path, and move transitConfig forward.
 					// If nil is in the config, we will remove it or override it automatically here.
@@ -414,21 +568,40 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 					if event.eventType == EVENT_PUT_SEC {
 						cipherPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_CIPHER)
 						ivPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_IV)
+						algorithmPath := fmt.Sprintf("%s%s", paths[len(paths)-1], ENC_DEC_SUFFIX_ALGORITHM)
 						transitConfig[cipherPath] = event.data
 						transitConfig[ivPath] = event.iv
+						transitConfig[algorithmPath] = event.algorithm
 					} else {
 						transitConfig[paths[len(paths)-1]] = event.data
 					}
 				}
-				event.result <- eventResult{
-					errCode: ERR_CODE_SUCCESS,
-					result:  true,
-				}
 				util.MaoLogM(util.DEBUG, MODULE_NAME, "After config: %v", config)
 
-				err := C.saveConfig(config)
+				// reply after saving, so the version is in the history once PutConfig returns.
+				_, err = C.saveConfig(config, &configChange{
+					path:  event.path,
+					actor: event.actor,
+					sec:   event.eventType == EVENT_PUT_SEC,
+				})
 				if err != nil {
-					util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save config, we will lose config after reboot. (%s)", err.Error())
+					util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save config, the put by %s is discarded. (%s)", event.actor, err.Error())
+					C.restoreConfig(config, original, err)
+					event.result <- eventResult{
+						errCode: ERR_CODE_SAVE_FAIL,
+						result:  false,
+					}
+					continue
+				}
+				C.lastSaveError.Store("")
+				if C.secKeyDigest == "" {
+					// e.g. the sec configs are imported, the sec key set later must match them.
+					digest, _ := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST)
+					C.secKeyDigest, _ = digest.(string)
+				}
+				event.result <- eventResult{
+					errCode: ERR_CODE_SUCCESS,
+					result:  true,
 				}
 
 				// Old Logic
@@ -440,10 +613,16 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 			}
 		case <-checkShutdownTimer.C:
 			util.MaoLogM(util.DEBUG, MODULE_NAME, "CheckShutdown, event queue len %d", len(C.eventChannel))
-			if C.needShutdown && len(C.eventChannel) == 0 {
+			if C.needShutdown.Load() && len(C.eventChannel) == 0 {
+				// persist again, in case the last save failed.
+				C.checkConfigStore(config)
+				if _, err := C.saveConfig(config, &configChange{path: "/", actor: MaoApi.CONFIG_ACTOR_SYSTEM}); err != nil {
+					util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to save config while exiting, we will lose config after reboot. (%s)", err.Error())
+				}
 				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 				return
 			}
+			C.checkConfigStore(config)
 			checkShutdownTimer.Reset(checkInterval)
 		}
 	}
@@ -454,6 +633,37 @@ func (C *ConfigYamlModule) eventLoop(config map[string]interface{}) {
 func (C *ConfigYamlModule) isKeyReady() bool {
 	return C.secKey != ""
 }
+
+func (C *ConfigYamlModule) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Metrics: map[string]int64{
+			"eventQueueDepth": int64(len(C.eventChannel)),
+		},
+	}
+
+	// the store may become unwritable before the next save, check it without modification.
+	if err := C.store.Check(); err != nil {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("config %s is not writable, %s", C.store.String(), err.Error())
+		return health
+	}
+
+	if lastSaveError, _ := C.lastSaveError.Load().(string); lastSaveError != "" {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("fail to save config, %s", lastSaveError)
+		return health
+	}
+
+	if !C.isKeyReady() {
+		health.Status = MaoApi.HEALTH_STATUS_DEGRADED
+		health.Detail = "sec key is not set, sec configs can't be decrypted"
+	} else {
+		health.Detail = "sec key loaded"
+	}
+	return health
+}
 func (C *ConfigYamlModule) generateKeyDigest(key string) string {
 	digest := sm3.Sm3Sum([]byte(key))
 	keyBase64 := base64.StdEncoding.EncodeToString(digest) // convert iv to iv_base64.
@@ -471,8 +681,9 @@ func (C *ConfigYamlModule) generateIV() ([]byte, error) {
 	return iv, err
 }
 
-func (C *ConfigYamlModule) getFixedSecKey() []byte {
-	keyBytes := []byte(C.secKey)
+// fixSecKey complements or truncates the key for SM4.
+func fixSecKey(secKey string) []byte {
+	keyBytes := []byte(secKey)
 
 	result := make([]byte, 16)
 	for i := 0; i < 16; i += 2 {
@@ -497,13 +708,16 @@ func (C *ConfigYamlModule) encryptConfig(plainText string) (string, string, int,
 	if !C.isKeyReady() {
 		return "", "", ERR_CODE_ENC_DEC_KEY_NOT_READY, errors.New("key not ready")
 	}
+	return C.encryptConfigWithKey(C.secKey, C.getSecAlgorithm(), plainText)
+}
 
+func (C *ConfigYamlModule) encryptConfigWithKey(secKey string, algorithm string, plainText string) (string, string, int, error) {
 	iv, err := C.generateIV()
 	if err != nil {
 		return "", "", ERR_CODE_ENC_IV_GEN_FAIL, err
 	}
 
-	gcmMsg, _, err := sm4.Sm4GCM(C.getFixedSecKey(), iv, []byte(plainText), nil, true) // todo - --- TO check nil A
+	gcmMsg, err := secGcm(secKey, algorithm, iv, []byte(plainText), true)
 	if err != nil {
 		return "", "", ERR_CODE_ENC_FAIL, err
 	}
@@ -516,13 +730,16 @@ func (C *ConfigYamlModule) encryptConfig(plainText string) (string, string, int,
 }
 
 // Return plaintext, err_code, error
-func (C *ConfigYamlModule) decryptConfig(cipherTextBase64 string, ivBase64 string) (string, int, error) {
+func (C *ConfigYamlModule) decryptConfig(cipherTextBase64 string, ivBase64 string, algorithm string) (string, int, error) {
 	// TODO: debug
 
 	if !C.isKeyReady() {
 		return "", ERR_CODE_ENC_DEC_KEY_NOT_READY, errors.New("key not ready")
 	}
+	return C.decryptConfigWithKey(C.secKey, algorithm, cipherTextBase64, ivBase64)
+}
 
+func (C *ConfigYamlModule) decryptConfigWithKey(secKey string, algorithm string, cipherTextBase64 string, ivBase64 string) (string, int, error) {
 	iv, err := base64.StdEncoding.DecodeString(ivBase64) // convert iv_base64 to iv.
 	if err != nil {
 		return "", ERR_CODE_DEC_IV_PARSE_FAIL, err
@@ -533,7 +750,7 @@ func (C *ConfigYamlModule) decryptConfig(cipherTextBase64 string, ivBase64 strin
 		return "", ERR_CODE_DEC_IV_PARSE_FAIL, err
 	}
 
-	gcmDec, _, err := sm4.Sm4GCM(C.getFixedSecKey(), iv, cipherText, nil, false) // todo - --- TO check nil A
+	gcmDec, err := secGcm(secKey, algorithm, iv, cipherText, false)
 	if err != nil {
 		return "", ERR_CODE_DEC_FAIL, err
 	}
@@ -542,13 +759,29 @@ func (C *ConfigYamlModule) decryptConfig(cipherTextBase64 string, ivBase64 strin
 }
 
 
+// RegisterKeyUpdateListener registers the channel once, a module re-initialized at runtime may register it again.
+// The listener should be buffered, the notifications are coalesced if it is not consumed in time.
 func (C *ConfigYamlModule) RegisterKeyUpdateListener(listener *chan int) {
-	// TODO: to check parallel access problem
+	C.keyUpdateListenersLock.Lock()
+	defer C.keyUpdateListenersLock.Unlock()
+
+	for _, l := range C.keyUpdateListeners {
+		if l == listener {
+			return
+		}
+	}
 	C.keyUpdateListeners = append(C.keyUpdateListeners, listener)
 }
 func (C *ConfigYamlModule) publishKeyUpdate() {
+	C.keyUpdateListenersLock.Lock()
+	defer C.keyUpdateListenersLock.Unlock()
+
 	for _, listener := range C.keyUpdateListeners {
-		*listener <- 0
+		// not blocking, the listener's loop may have stopped, e.g. the module is disabled at runtime.
+		select {
+		case *listener <- 0:
+		default:
+		}
 	}
 }
 
@@ -556,7 +789,13 @@ func (C *ConfigYamlModule) publishKeyUpdate() {
 
 
 func (C *ConfigYamlModule) RequireShutdown() {
-	C.needShutdown = true
+	C.needShutdown.Store(true)
+}
+
+// Shutdown processes the pending events, persists the config and waits for eventLoop to exit.
+func (C *ConfigYamlModule) Shutdown() {
+	C.RequireShutdown()
+	<-C.exited
 }
 
 func fileIsNotExist(fileName string) bool {
@@ -571,12 +810,82 @@ func (C *ConfigYamlModule) configRestControlInterface() {
 		return
 	}
 
-	restfulServer.RegisterGetApi(URL_CONFIG_ALL_TEXT_SHOW, C.showAllConfigText)
-	restfulServer.RegisterPostApi(URL_CONFIG_SET_SECKEY, C.setSecKey)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_ALL_TEXT_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the whole config file in YAML",
+		Tag:      MODULE_NAME,
+		Response: "",
+	}, C.showAllConfigText)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_SET_SECKEY, &MaoApi.ApiDoc{
+		Summary: "Set the key for encrypting and decrypting sec configs",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_SECKEY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "must match the digest stored in the config, if there is one"},
+		},
+		Response: "sec key ready",
+	}, C.setSecKey)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_HISTORY_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the versions of the config, from old to new",
+		Tag:      MODULE_NAME,
+		Response: []*ConfigVersion{},
+	}, C.showConfigHistory)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_VERSION_SHOW, &MaoApi.ApiDoc{
+		Summary: "Show the whole config of a version in YAML",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_VERSION, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_INTEGER, Required: true},
+		},
+		Response: "",
+	}, C.showConfigVersion)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_ROLLBACK, &MaoApi.ApiDoc{
+		Summary: "Roll back the whole config to a version",
+		Description: "Recorded as a new version. The modules listening to the config, e.g. ICMP, email and ONOS, apply it immediately, others after they restart. " +
+			"If the sec key digest is changed, the sec key needs to be set again.",
+		Tag: MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_VERSION, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_INTEGER, Required: true},
+		},
+		Response: &ConfigVersion{},
+	}, C.processRollbackConfig)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_ROTATE_SECKEY, &MaoApi.ApiDoc{
+		Summary: "Rotate the key of sec configs",
+		Description: "All sec configs are re-encrypted by the new key and saved with the new digest in one version, nothing is changed if any of them fails. " +
+			"The versions before the rotation need the old key after rolling back to them. " +
+			"The key file loaded at startup is rewritten with the new key, the key given by " + CONFIG_SEC_KEY_ENV + " can't be rotated at runtime.",
+		Tag: MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_OLD_SECKEY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "must match the digest stored in the config"},
+			{Name: CONFIG_API_KEY_NEW_SECKEY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true},
+		},
+		Response: &SecKeyRotation{},
+	}, C.processRotateSecKeyApi)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_EXPORT, &MaoApi.ApiDoc{
+		Summary: "Export the whole config as a YAML bundle, for rebuilding the server",
+		Description: "The users and api keys are not exported. The sec configs are encrypted under the current sec key, or omitted.",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_SECRETS, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "encrypted or omitted, omitted by default"},
+		},
+		Response: "",
+	}, C.processExportConfig)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_CONFIG_IMPORT, &MaoApi.ApiDoc{
+		Summary: "Preview or apply the changes of a config bundle",
+		Description: "Only previews the changes unless apply is true. Each changed top level section is put as a new version, the configs only on this server are kept. " +
+			"The sec configs need the same sec key as the exporting server. If a section fails, the config is rolled back to the version before the import.",
+		Tag: MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: CONFIG_API_KEY_BUNDLE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "the exported bundle, as a file or text"},
+			{Name: CONFIG_API_KEY_APPLY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_BOOLEAN},
+		},
+		Response: &ConfigImportResult{},
+	}, C.processImportConfig)
 }
 
 func (C *ConfigYamlModule) showAllConfigText(c *gin.Context) {
-	content, err := ioutil.ReadFile(C.configFilename)
+	content, _, err := C.store.Load()
 	if err != nil {
 		c.String(200, err.Error())
 	} else {
@@ -585,39 +894,76 @@ func (C *ConfigYamlModule) showAllConfigText(c *gin.Context) {
 }
 
 
-func (C *ConfigYamlModule) setSecKey(c *gin.Context) {
-	secKey, ok := c.GetPostForm(CONFIG_API_KEY_SECKEY)
+func (C *ConfigYamlModule) showConfigHistory(c *gin.Context) {
+	c.JSON(200, C.GetConfigHistory())
+}
+
+func (C *ConfigYamlModule) showConfigVersion(c *gin.Context) {
+	version, ok := parseVersion(c.Query(CONFIG_API_KEY_VERSION))
 	if !ok {
-		c.String(400, "Not contained a sec key")
+		c.String(400, "%s is invalid", CONFIG_API_KEY_VERSION)
+		return
+	}
+	snapshot, err := C.history.getSnapshot(version)
+	if err != nil {
+		c.String(404, err.Error())
 		return
 	}
+	content, err := yaml.Marshal(snapshot.Config)
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	c.String(200, string(content))
+}
 
-	if C.secKeyDigest != "" {
-		digest := C.generateKeyDigest(secKey)
-		if digest != C.secKeyDigest {
-			c.String(400, "sec key is not matched")
-			return
-		}
-		util.MaoLogM(util.INFO, MODULE_NAME, "Succeed to unlock the sec key")
-	} else {
-		util.MaoLogM(util.INFO, MODULE_NAME, "Setting a new sec key")
+func (C *ConfigYamlModule) processRollbackConfig(c *gin.Context) {
+	version, ok := parseVersion(c.PostForm(CONFIG_API_KEY_VERSION))
+	if !ok {
+		c.String(400, "%s is invalid", CONFIG_API_KEY_VERSION)
+		return
 	}
 
-	C.secKey = secKey
-	C.secKeyDigest = C.generateKeyDigest(secKey)
+	actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+	newVersion, err := C.RollbackConfig(version, actor)
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "rollback config", fmt.Sprintf("version %d", version), err == nil, errorDetail(err))
+	if err != nil {
+		c.String(400, err.Error())
+		return
+	}
+	if newVersion == nil {
+		c.String(200, "config is the same as version %d", version)
+		return
+	}
+	c.JSON(200, newVersion)
+}
 
-	// write C.secKeyDigest to file
-	C.PutConfig(CONFIG_PATH_SEC_KEY_DIGEST, C.secKeyDigest)
+func errorDetail(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
 
-	C.publishKeyUpdate()
+func (C *ConfigYamlModule) setSecKey(c *gin.Context) {
+	secKey, ok := c.GetPostForm(CONFIG_API_KEY_SECKEY)
+	if !ok {
+		c.String(400, "Not contained a sec key")
+		return
+	}
 
+	if err := C.unlockSecKey(secKey, c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)); err != nil {
+		c.String(400, err.Error())
+		return
+	}
 	c.String(200, "sec key ready")
 }
 
 
 func (C *ConfigYamlModule) InitConfigModule(configFilename string) bool {
 	C.configFilename = configFilename
-	C.needShutdown = false
+	C.needShutdown.Store(false)
+	C.exited = make(chan struct{})
 
 	// support custom size for the channel.
 
@@ -628,9 +974,17 @@ func (C *ConfigYamlModule) InitConfigModule(configFilename string) bool {
 	if C.keyUpdateListeners == nil {
 		C.keyUpdateListeners = make([]*chan int, 0)
 	}
+	if C.configUpdateListeners == nil {
+		C.configUpdateListeners = make([]*configUpdateListener, 0)
+	}
 
 
-	if fileIsNotExist(C.configFilename) {
+	if C.store == nil {
+		C.store = newFileConfigStore(C.configFilename)
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "The config is stored in %s", C.store.String())
+
+	if _, ok := C.store.(*fileConfigStore); ok && fileIsNotExist(C.configFilename) {
 		util.MaoLogM(util.WARN, MODULE_NAME, "config file not found, creating it.")
 		_, err := os.Create(C.configFilename)
 		if err != nil {
@@ -645,21 +999,29 @@ func (C *ConfigYamlModule) InitConfigModule(configFilename string) bool {
 		return false
 	}
 
-	C.configRestControlInterface()
-
-	go C.eventLoop(config)
+	C.history = &configHistory{dir: C.configFilename + CONFIG_HISTORY_DIR_SUFFIX}
+	if err := C.history.load(); err != nil {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to load config history from %s, err: %s", C.history.dir, err.Error())
+		return false
+	}
+	// the first version, or the file is edited while the server is stopped.
+	if content, err := marshalConfig(config); err != nil {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to marshal config, err: %s", err.Error())
+		return false
+	} else if _, err := C.history.record(config, content, "/", MaoApi.CONFIG_ACTOR_SYSTEM, 0); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to record the config history, err: %s", err.Error())
+	}
 
+	C.configRestControlInterface()
 
-	secKey, errCode := C.GetConfig(CONFIG_PATH_SEC_KEY_DIGEST)
-	if errCode == ERR_CODE_SUCCESS {
-		var ok bool
-		C.secKeyDigest, ok = secKey.(string)
-		if !ok {
+	// read before the eventLoop starts, then it is only changed in the eventLoop.
+	if secKeyDigest, ok := lookupConfigPath(config, CONFIG_PATH_SEC_KEY_DIGEST); ok {
+		if C.secKeyDigest, ok = secKeyDigest.(string); !ok {
 			util.MaoLogM(util.WARN, MODULE_NAME, "Fail, the secKeyDigest is not a string")
 		}
-	} else if errCode != ERR_CODE_PATH_TRANSIT_FAIL && errCode != ERR_CODE_PATH_NOT_EXIST {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read secKey config, code: %d", errCode)
 	}
 
+	go C.eventLoop(config)
+
 	return true
 }
@@ -11,6 +11,8 @@ import (
 	//"github.com/tjfoc/gmsm/sm4"
 	"github.com/MaoJianwei/gmsm/sm4"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -544,6 +546,30 @@ func TestConfigYamlModule_main(t *testing.T) {
 	//time.Sleep(1000 * time.Second)
 }
 
+func TestConfigYamlModule_Shutdown(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "mao-config.yaml")
+
+	configModule := &ConfigYamlModule{}
+	if !configModule.InitConfigModule(configFile) {
+		t.Fatal("fail to init config module")
+	}
+	if ok, errCode := configModule.PutConfig("/shutdown/test", "persisted"); !ok {
+		t.Fatalf("fail to put config, %d", errCode)
+	}
+
+	configModule.Shutdown()
+
+	content, err := os.ReadFile(configFile)
+	if err != nil || !strings.Contains(string(content), "persisted") {
+		t.Errorf("config is not persisted after shutdown, %v, %s", err, content)
+	}
+
+	// must not block after the event loop exits.
+	if _, errCode := configModule.GetConfig("/shutdown/test"); errCode != ERR_CODE_SHUTDOWN {
+		t.Errorf("expect ERR_CODE_SHUTDOWN after shutdown, got %d", errCode)
+	}
+}
+
 /**
 content, _ := ioutil.ReadFile(DEFAULT_CONFIG_FILE)
 
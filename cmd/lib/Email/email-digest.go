@@ -0,0 +1,121 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EMAIL_QUEUE_SIZE                = 1024
+	EMAIL_SEND_INTERVAL             = 10 * time.Second // the gap between two emails
+	EMAIL_DIGEST_DEFAULT_MAX_EVENTS = 500
+)
+
+// EmailDigestConfig batches the UP and DOWN emails in a window into one digest.
+type EmailDigestConfig struct {
+	Window    int      `yaml:"window" json:"window" validate:"min=0,max=86400"`                           // seconds from the first event, 0 disables the digest
+	MaxEvents int      `yaml:"maxEvents,omitempty" json:"maxEvents,omitempty" validate:"min=0,max=10000"` // 0 is EMAIL_DIGEST_DEFAULT_MAX_EVENTS
+	Critical  []string `yaml:"critical,omitempty" json:"critical,omitempty"`                              // event types (UP, DOWN), service names or addresses sent at once
+}
+
+// emailDigest collects the events of the window, it is only used in sendEmailLoop except the counters.
+type emailDigest struct {
+	window    time.Duration
+	maxEvents int
+	critical  map[string]bool
+
+	messages []*MaoApi.EmailMessage
+	dropped  int // the events of the window not kept, the digest is full
+	timer    *time.Timer
+
+	pending      atomic.Int64
+	droppedTotal atomic.Int64
+}
+
+func (d *emailDigest) configure(config *EmailDigestConfig) {
+	d.window, d.maxEvents, d.critical = 0, EMAIL_DIGEST_DEFAULT_MAX_EVENTS, make(map[string]bool)
+	if config == nil {
+		return
+	}
+	d.window = time.Duration(config.Window) * time.Second
+	if config.MaxEvents > 0 {
+		d.maxEvents = config.MaxEvents
+	}
+	for _, critical := range config.Critical {
+		d.critical[critical] = true
+	}
+}
+
+func (d *emailDigest) isCritical(m *MaoApi.EmailMessage) bool {
+	if m.Critical || d.critical[m.Event] {
+		return true
+	}
+	for _, service := range m.Services {
+		if d.critical[service.ServiceName] || d.critical[service.Address] {
+			return true
+		}
+	}
+	return false
+}
+
+// add keeps the message for the digest, false if it is sent at once, e.g. the digest is disabled or it is critical.
+func (d *emailDigest) add(m *MaoApi.EmailMessage) bool {
+	if d.window <= 0 || (m.Event != MaoApi.EMAIL_EVENT_UP && m.Event != MaoApi.EMAIL_EVENT_DOWN) || d.isCritical(m) {
+		return false
+	}
+	if len(d.messages) >= d.maxEvents {
+		d.dropped++
+		d.droppedTotal.Add(1)
+	} else {
+		d.messages = append(d.messages, m)
+		d.pending.Store(int64(len(d.messages)))
+	}
+	if d.timer == nil {
+		d.timer = time.NewTimer(d.window)
+	}
+	return true
+}
+
+// C fires when the window ends, nil if there is no event.
+func (d *emailDigest) C() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+	return d.timer.C
+}
+
+// flush returns the digest of the window, or the message itself if it is the only one. nil if there is no event.
+func (d *emailDigest) flush() *MaoApi.EmailMessage {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	messages, dropped := d.messages, d.dropped
+	d.messages, d.dropped = nil, 0
+	d.pending.Store(0)
+
+	if len(messages) == 0 && dropped == 0 {
+		return nil
+	}
+	if len(messages) == 1 && dropped == 0 {
+		return messages[0]
+	}
+	digest := &MaoApi.EmailMessage{
+		Subject: fmt.Sprintf("Digest of %d service events", len(messages)+dropped),
+		Event:   MaoApi.EMAIL_EVENT_DIGEST,
+		Dropped: dropped,
+	}
+	content := make([]string, 0, len(messages)+1)
+	for _, m := range messages {
+		digest.Services = append(digest.Services, m.Services...)
+		content = append(content, m.Content)
+	}
+	if dropped > 0 {
+		content = append(content, fmt.Sprintf("%d more events are dropped, the digest is full.\r\n", dropped))
+	}
+	digest.Content = strings.Join(content, "\r\n")
+	return digest
+}
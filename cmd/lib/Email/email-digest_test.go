@@ -0,0 +1,89 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEventMessage(event string, name string, address string) *MaoApi.EmailMessage {
+	return &MaoApi.EmailMessage{
+		Subject: "ICMP " + event + " notification",
+		Content: "Service: " + name,
+		Event:   event,
+		Services: []*MaoApi.EmailServiceEvent{{
+			Type: event, Source: "ICMP", ServiceName: name, Address: address, Timestamp: time.Now(),
+		}},
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	digest := &emailDigest{}
+	digest.configure(nil)
+	if digest.add(newEventMessage(MaoApi.EMAIL_EVENT_DOWN, "a", "10.0.0.1")) {
+		t.Errorf("expect the email sent at once without the digest config")
+	}
+
+	digest.configure(&EmailDigestConfig{Window: 60, MaxEvents: 3, Critical: []string{"core", "10.0.0.9"}})
+	for _, m := range []*MaoApi.EmailMessage{
+		{Subject: "Test", Content: "Hello"},
+		newEventMessage(MaoApi.EMAIL_EVENT_DOWN, "core", "10.0.0.1"),
+		newEventMessage(MaoApi.EMAIL_EVENT_DOWN, "edge", "10.0.0.9"),
+		{Event: MaoApi.EMAIL_EVENT_UP, Critical: true},
+	} {
+		if digest.add(m) {
+			t.Errorf("expect the email sent at once, %+v", m)
+		}
+	}
+	if digest.C() != nil || digest.flush() != nil {
+		t.Errorf("expect no digest without events")
+	}
+
+	// the only event is sent as it is.
+	single := newEventMessage(MaoApi.EMAIL_EVENT_DOWN, "a", "10.0.0.1")
+	if !digest.add(single) || digest.C() == nil {
+		t.Fatal("expect the event kept for the digest")
+	}
+	if m := digest.flush(); m != single || digest.C() != nil {
+		t.Errorf("expect the single event, got %+v", m)
+	}
+
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		event := MaoApi.EMAIL_EVENT_DOWN
+		if i%2 == 1 {
+			event = MaoApi.EMAIL_EVENT_UP
+		}
+		digest.add(newEventMessage(event, name, "10.0.0."+name))
+	}
+	if digest.pending.Load() != 3 || digest.droppedTotal.Load() != 2 {
+		t.Errorf("unexpected pending %d, dropped %d", digest.pending.Load(), digest.droppedTotal.Load())
+	}
+	m := digest.flush()
+	if m.Event != MaoApi.EMAIL_EVENT_DIGEST || len(m.Services) != 3 || m.Dropped != 2 || digest.pending.Load() != 0 {
+		t.Fatalf("unexpected digest %+v", m)
+	}
+
+	subject, text, html, err := renderEmail(compileEmailTemplates(nil), m, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Digest: 1 UP, 2 DOWN, 2 dropped" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for _, content := range []string{text, html} {
+		if !strings.Contains(content, "3 service events") || !strings.Contains(content, "2 more events are dropped") {
+			t.Errorf("unexpected digest:\n%s", content)
+		}
+	}
+}
+
+func TestSmtpEmailModule_SendEmailQueueFull(t *testing.T) {
+	s := &SmtpEmailModule{sendEmailChannel: make(chan *MaoApi.EmailMessage, 2)}
+	for i := 0; i < 5; i++ {
+		s.SendEmail(&MaoApi.EmailMessage{Subject: "Test"}) // never blocks
+	}
+	if health := s.CheckHealth(); health.Metrics["sendQueueDepth"] != 2 || health.Metrics["droppedEmails"] != 3 {
+		t.Errorf("unexpected metrics %v", health.Metrics)
+	}
+}
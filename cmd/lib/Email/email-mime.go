@@ -0,0 +1,69 @@
+package Email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// newMessageId generates a unique Message-ID in the domain of the sender.
+func newMessageId(sender string, now time.Time) string {
+	domain := "localhost"
+	if i := strings.LastIndex(sender, "@"); i >= 0 && i+1 < len(sender) {
+		domain = sender[i+1:]
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("<%d.%s@%s>", now.UnixNano(), hex.EncodeToString(random), domain)
+}
+
+func writeMimePart(writer *multipart.Writer, contentType string, content string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err = qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// buildMimeMessage builds a multipart/alternative message of the text and the html, the subject is encoded in UTF-8 if needed.
+func buildMimeMessage(sender string, to []string, cc []string, subject string, text string, html string, now time.Time) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writeMimePart(writer, "text/plain", text); err != nil {
+		return nil, err
+	}
+	if err := writeMimePart(writer, "text/html", html); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", sender)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(to, ", "))
+	if len(cc) > 0 {
+		fmt.Fprintf(msg, "Cc: %s\r\n", strings.Join(cc, ", "))
+	}
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-ID: %s\r\n", newMessageId(sender, now))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", writer.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
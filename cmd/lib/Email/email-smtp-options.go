@@ -0,0 +1,202 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/cmd/lib/MaoEnhancedGolang"
+	"MaoServerDiscovery/util"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EMAIL_SMTP_TIMEOUT = 30 * time.Second
+
+	EMAIL_AUTH_LOGIN    = "login" // the default
+	EMAIL_AUTH_PLAIN    = "plain"
+	EMAIL_AUTH_CRAM_MD5 = "cram-md5"
+	EMAIL_AUTH_NONE     = "none"
+
+	// the stage of the probe failing before talking to the server, e.g. the CA file is broken.
+	EMAIL_PROBE_STAGE_CONFIG = "config"
+	EMAIL_PROBE_SUBJECT      = "SMTP probe"
+)
+
+// EmailProbeResult is the reply of URL_EMAIL_TEST.
+type EmailProbeResult struct {
+	Success             bool   `json:"success"`
+	Stage               string `json:"stage,omitempty"` // EMAIL_PROBE_STAGE_CONFIG or MaoEnhancedGolang.SMTP_STAGE_*, where it fails
+	Error               string `json:"error,omitempty"`
+	ElapsedMs           int64  `json:"elapsedMs"`
+	Server              string `json:"server"`
+	Security            string `json:"security"`
+	Auth                string `json:"auth"`
+	TlsVersion          string `json:"tlsVersion,omitempty"` // empty if the session is not encrypted
+	CipherSuite         string `json:"cipherSuite,omitempty"`
+	ServerCertificate   string `json:"serverCertificate,omitempty"`
+	CertificateVerified bool   `json:"certificateVerified"`
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+// loadCaFile returns the system pool with the certificates of the PEM file.
+func loadCaFile(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate is found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func (s *SmtpEmailModule) authMethod() string {
+	if s.auth == "" {
+		return EMAIL_AUTH_LOGIN
+	}
+	return s.auth
+}
+
+func (s *SmtpEmailModule) securityMode() string {
+	if s.security == "" {
+		return MaoEnhancedGolang.SMTP_SECURITY_AUTO
+	}
+	return s.security
+}
+
+// smtpOptions is built everytime, that allows to update the security, auth, CA file and the credentials. Called with configLock held.
+func (s *SmtpEmailModule) smtpOptions() (*MaoEnhancedGolang.SmtpOptions, error) {
+	host, _, err := net.SplitHostPort(s.smtpServerAddrPort)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: s.insecureSkipVerify,
+	}
+	if s.caFile != "" {
+		if tlsConfig.RootCAs, err = loadCaFile(s.caFile); err != nil {
+			return nil, fmt.Errorf("fail to load the CA file, %s", err.Error())
+		}
+	}
+
+	options := &MaoEnhancedGolang.SmtpOptions{
+		Security:  s.securityMode(),
+		TLSConfig: tlsConfig,
+		Timeout:   EMAIL_SMTP_TIMEOUT,
+	}
+	switch s.authMethod() {
+	case EMAIL_AUTH_LOGIN:
+		options.Auth = AuthLOGIN(s.username, s.password)
+	case EMAIL_AUTH_PLAIN:
+		options.Auth = smtp.PlainAuth("", s.username, s.password, host)
+	case EMAIL_AUTH_CRAM_MD5:
+		options.Auth = smtp.CRAMMD5Auth(s.username, s.password)
+	case EMAIL_AUTH_NONE:
+	default:
+		return nil, fmt.Errorf("unknown auth %s", s.auth)
+	}
+	return options, nil
+}
+
+// probe sends a probe email directly, without the outbox and the digest. The receivers are used if not empty.
+func (s *SmtpEmailModule) probe(receivers []string) *EmailProbeResult {
+	s.configLock.RLock()
+	server, sender := s.smtpServerAddrPort, s.sender
+	result := &EmailProbeResult{
+		Server:   server,
+		Security: s.securityMode(),
+		Auth:     s.authMethod(),
+	}
+	if len(receivers) == 0 {
+		receivers = s.receiver
+	}
+	if len(receivers) == 0 {
+		for _, sub := range s.subscriptions {
+			receivers = append(receivers, sub.Email)
+		}
+	}
+	options, optionsErr := s.smtpOptions()
+	s.configLock.RUnlock()
+
+	fail := func(stage string, err error) *EmailProbeResult {
+		result.Stage = stage
+		result.Error = err.Error()
+		return result
+	}
+	if server == "" || sender == "" || len(receivers) == 0 {
+		return fail(EMAIL_PROBE_STAGE_CONFIG, errors.New("the SMTP server, the sender and a receiver are required"))
+	}
+	if optionsErr != nil {
+		return fail(EMAIL_PROBE_STAGE_CONFIG, optionsErr)
+	}
+
+	now := time.Now()
+	content := fmt.Sprintf("This is a probe email sent at %s, via %s with security %s and auth %s.",
+		now.Format(time.RFC3339), server, result.Security, result.Auth)
+	msg, err := buildMimeMessage(sender, receivers, nil, SUBJECT_FIX_PREFIX+EMAIL_PROBE_SUBJECT, content, "", now)
+	if err != nil {
+		return fail(EMAIL_PROBE_STAGE_CONFIG, err)
+	}
+
+	state, err := MaoEnhancedGolang.SendMailWithOptions(server, options, sender, receivers, msg)
+	result.ElapsedMs = time.Since(now).Milliseconds()
+	if state != nil {
+		result.TlsVersion = tlsVersionName(state.Version)
+		result.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		result.CertificateVerified = len(state.VerifiedChains) > 0
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			result.ServerCertificate = fmt.Sprintf("%s, issued by %s, expires at %s",
+				cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if err != nil {
+		var smtpErr *MaoEnhancedGolang.SmtpError
+		if errors.As(err, &smtpErr) {
+			return fail(smtpErr.Stage, smtpErr.Err)
+		}
+		return fail(MaoEnhancedGolang.SMTP_STAGE_CONNECT, err)
+	}
+	result.Success = true
+	return result
+}
+
+func (s *SmtpEmailModule) processEmailProbe(c *gin.Context) {
+	result := s.probe(strings.Fields(c.PostForm(EMAIL_API_KEY_RECEIVER)))
+
+	actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+	detail := fmt.Sprintf("sent in %d ms", result.ElapsedMs)
+	if !result.Success {
+		detail = fmt.Sprintf("failed at %s, %s", result.Stage, result.Error)
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Probe %s by %s, %s", result.Server, actor, detail)
+	MaoCommon.RecordAudit(actor, c.ClientIP(), "probe smtp server", result.Server, result.Success, detail)
+	c.JSON(200, result)
+}
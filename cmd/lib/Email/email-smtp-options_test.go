@@ -0,0 +1,60 @@
+package Email
+
+import (
+	"MaoServerDiscovery/cmd/lib/MaoEnhancedGolang"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSmtpEmailModule_SmtpOptions(t *testing.T) {
+	s := &SmtpEmailModule{smtpServerAddrPort: "smtp.example.com:465", username: "mao", password: "secret"}
+	for auth, mechanism := range map[string]string{"": "LOGIN", EMAIL_AUTH_PLAIN: "PLAIN", EMAIL_AUTH_CRAM_MD5: "CRAM-MD5"} {
+		s.auth = auth
+		options, err := s.smtpOptions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// PLAIN is only started on TLS, or on localhost.
+		if got, _, _ := options.Auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true}); got != mechanism {
+			t.Errorf("auth %q, expect %s, got %s", auth, mechanism, got)
+		}
+		if options.Security != MaoEnhancedGolang.SMTP_SECURITY_AUTO || options.TLSConfig.ServerName != "smtp.example.com" || options.TLSConfig.InsecureSkipVerify {
+			t.Errorf("unexpected options %+v", options)
+		}
+	}
+	s.auth = EMAIL_AUTH_NONE
+	if options, err := s.smtpOptions(); err != nil || options.Auth != nil {
+		t.Errorf("expect no auth, %v", err)
+	}
+
+	s.caFile = filepath.Join(t.TempDir(), "ca.pem")
+	if _, err := s.smtpOptions(); err == nil {
+		t.Errorf("expect the missing CA file failing")
+	}
+	os.WriteFile(s.caFile, []byte("not a certificate"), 0600)
+	if _, err := s.smtpOptions(); err == nil {
+		t.Errorf("expect the broken CA file failing")
+	}
+}
+
+func TestSmtpEmailModule_Probe(t *testing.T) {
+	s := &SmtpEmailModule{smtpServerAddrPort: "127.0.0.1:25", sender: "mao@example.com", auth: EMAIL_AUTH_NONE}
+	if result := s.probe(nil); result.Success || result.Stage != EMAIL_PROBE_STAGE_CONFIG {
+		t.Errorf("expect failing without receivers, %+v", result)
+	}
+
+	// nothing is listening on the port after it is closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.smtpServerAddrPort = listener.Addr().String()
+	listener.Close()
+	result := s.probe([]string{"a@example.com"})
+	if result.Success || result.Stage != MaoEnhancedGolang.SMTP_STAGE_CONNECT || result.Error == "" || result.TlsVersion != "" {
+		t.Errorf("expect failing at connect, %+v", result)
+	}
+}
@@ -0,0 +1,233 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// EmailSubscription routes the matched service events to the email, instead of all events to the receivers.
+// The empty filters match all, and the receivers with subscriptions only get the subscribed events.
+type EmailSubscription struct {
+	Email      string   `yaml:"email" json:"email" validate:"required,email"`
+	Sources    []string `yaml:"sources,omitempty" json:"sources,omitempty" validate:"oneof=ICMP|gRPC"`
+	Services   []string `yaml:"services,omitempty" json:"services,omitempty"` // glob patterns of the service names or addresses, e.g. db-*
+	Labels     []string `yaml:"labels,omitempty" json:"labels,omitempty"`     // key or key=value of the service labels, all must match
+	Events     []string `yaml:"events,omitempty" json:"events,omitempty" validate:"oneof=UP|DOWN"`
+	QuietHours string   `yaml:"quietHours,omitempty" json:"quietHours,omitempty"` // e.g. 22:00-07:00 in the local time, only the critical emails are sent
+}
+
+// quietHours is [start, end) in minutes of the day, it crosses midnight if start > end.
+type quietHours struct {
+	start, end int
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseQuietHours parses "HH:MM-HH:MM", nil if it is empty.
+func parseQuietHours(s string) (*quietHours, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return nil, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+	}
+	q := &quietHours{}
+	var err error
+	if q.start, err = parseMinuteOfDay(start); err != nil {
+		return nil, err
+	}
+	if q.end, err = parseMinuteOfDay(end); err != nil {
+		return nil, err
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("%q is empty", s)
+	}
+	return q, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return q.start <= minute && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// check returns the field and the error the schema can't validate, i.e. the patterns and the quiet hours.
+func (sub *EmailSubscription) check() (string, error) {
+	for _, pattern := range sub.Services {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "services", fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	for _, label := range sub.Labels {
+		if key, _, _ := strings.Cut(label, "="); key == "" {
+			return "labels", fmt.Errorf("invalid label %q", label)
+		}
+	}
+	if _, err := parseQuietHours(sub.QuietHours); err != nil {
+		return "quietHours", err
+	}
+	return "", nil
+}
+
+func matchAny(values []string, filter func(string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if filter(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// match is true if the event passes all filters of the subscription.
+func (sub *EmailSubscription) match(event *MaoApi.EmailServiceEvent, labels map[string]string) bool {
+	if !matchAny(sub.Sources, func(source string) bool { return source == event.Source }) ||
+		!matchAny(sub.Events, func(eventType string) bool { return eventType == event.Type }) {
+		return false
+	}
+	if !matchAny(sub.Services, func(pattern string) bool {
+		if matched, _ := path.Match(pattern, event.ServiceName); matched {
+			return true
+		}
+		matched, _ := path.Match(pattern, event.Address)
+		return matched
+	}) {
+		return false
+	}
+	for _, label := range sub.Labels {
+		key, value, hasValue := strings.Cut(label, "=")
+		if v, ok := labels[key]; !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// inQuietHours is true if the time is in the quiet hours, the invalid quiet hours are ignored.
+func (sub *EmailSubscription) inQuietHours(now time.Time) bool {
+	q, err := parseQuietHours(sub.QuietHours)
+	return err == nil && q != nil && q.contains(now)
+}
+
+// filterEmail returns the message with only the services, the content is rebuilt if some are filtered out.
+func filterEmail(m *MaoApi.EmailMessage, services []*MaoApi.EmailServiceEvent) *MaoApi.EmailMessage {
+	filtered := *m
+	if len(services) == len(m.Services) {
+		return &filtered
+	}
+	filtered.Services = services
+	lines := make([]string, 0, len(services))
+	for _, service := range services {
+		lines = append(lines, fmt.Sprintf("%s %s service: %s - %s\r\n", service.Type, service.Source, service.ServiceName, service.Address))
+	}
+	filtered.Content = strings.Join(lines, "")
+	if m.Event == MaoApi.EMAIL_EVENT_DIGEST {
+		filtered.Subject = fmt.Sprintf("Digest of %d service events", len(services)+m.Dropped)
+	}
+	return &filtered
+}
+
+// routeEmail splits the message into one for the receivers and cc, and one for each subscribed email with its events.
+// The messages without service events go to all. quieted is the number of the emails skipped by the quiet hours.
+func routeEmail(m *MaoApi.EmailMessage, receivers []string, cc []string, subscriptions []*EmailSubscription,
+	labelsOf func(event *MaoApi.EmailServiceEvent) map[string]string, critical bool, now time.Time) (routed []*MaoApi.EmailMessage, quieted int) {
+
+	emails := make([]string, 0, len(subscriptions))
+	subscriptionsOf := make(map[string][]*EmailSubscription)
+	for _, sub := range subscriptions {
+		email := strings.ToLower(sub.Email)
+		if _, ok := subscriptionsOf[email]; !ok {
+			emails = append(emails, sub.Email)
+		}
+		subscriptionsOf[email] = append(subscriptionsOf[email], sub)
+	}
+
+	broadcast := make([]string, 0, len(receivers))
+	for _, receiver := range receivers {
+		if _, subscribed := subscriptionsOf[strings.ToLower(receiver)]; !subscribed {
+			broadcast = append(broadcast, receiver)
+		}
+	}
+	if len(broadcast)+len(cc) > 0 {
+		message := filterEmail(m, m.Services)
+		message.Receivers, message.Cc = broadcast, cc
+		routed = append(routed, message)
+	}
+
+	labels := make(map[*MaoApi.EmailServiceEvent]map[string]string)
+	for _, email := range emails {
+		matched, quiet := make([]*MaoApi.EmailServiceEvent, 0, len(m.Services)), false
+		for _, service := range m.Services {
+			if _, ok := labels[service]; !ok && labelsOf != nil {
+				labels[service] = labelsOf(service)
+			}
+			for _, sub := range subscriptionsOf[strings.ToLower(email)] {
+				if sub.match(service, labels[service]) {
+					if critical || !sub.inQuietHours(now) {
+						matched = append(matched, service)
+						break
+					}
+					quiet = true
+				}
+			}
+		}
+		if len(m.Services) == 0 {
+			// e.g. the plaintext messages of the other modules.
+			quiet = !critical
+			for _, sub := range subscriptionsOf[strings.ToLower(email)] {
+				quiet = quiet && sub.inQuietHours(now)
+			}
+			if !quiet {
+				message := filterEmail(m, nil)
+				message.Receivers = []string{email}
+				routed = append(routed, message)
+				continue
+			}
+		}
+		if len(matched) > 0 {
+			message := filterEmail(m, matched)
+			message.Receivers = []string{email}
+			routed = append(routed, message)
+		} else if quiet {
+			quieted++
+		}
+	}
+	return routed, quieted
+}
+
+// serviceLabels returns the labels of the service set by the RESTful API v2, nil if there is no label.
+func serviceLabels(event *MaoApi.EmailServiceEvent) map[string]string {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil || event.Key == "" {
+		return nil
+	}
+	labelsObj, errCode := configModule.GetConfig(MaoApi.SERVICE_LABELS_CONFIG_PATH + "/" + event.Source + "/" + event.Key)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		return nil
+	}
+	kvMap, ok := labelsObj.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string, len(kvMap))
+	for k, v := range kvMap {
+		labels[k] = fmt.Sprintf("%v", v)
+	}
+	return labels
+}
@@ -0,0 +1,102 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	night, err := parseQuietHours("22:00-07:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for clock, expect := range map[string]bool{"21:59": false, "22:00": true, "03:00": true, "07:29": true, "07:30": false} {
+		if night.contains(at(clock)) != expect {
+			t.Errorf("22:00-07:30 contains %s, expect %v", clock, expect)
+		}
+	}
+	lunch, _ := parseQuietHours("12:00-13:00")
+	if !lunch.contains(at("12:30")) || lunch.contains(at("13:00")) {
+		t.Errorf("unexpected 12:00-13:00")
+	}
+	for _, invalid := range []string{"22:00", "25:00-07:00", "08:00-08:00"} {
+		if _, err := parseQuietHours(invalid); err == nil {
+			t.Errorf("expect %q invalid", invalid)
+		}
+	}
+	if q, err := parseQuietHours(""); q != nil || err != nil {
+		t.Errorf("expect no quiet hours")
+	}
+}
+
+func TestRouteEmail(t *testing.T) {
+	db := &MaoApi.EmailServiceEvent{Type: MaoApi.EMAIL_EVENT_DOWN, Source: "ICMP", ServiceName: "db-1", Address: "10.0.0.1", Key: "10.0.0.1"}
+	web := &MaoApi.EmailServiceEvent{Type: MaoApi.EMAIL_EVENT_UP, Source: "gRPC", ServiceName: "web-1", Address: "10.0.0.2", Key: "web-1"}
+	digest := &MaoApi.EmailMessage{Subject: "Digest of 2 service events", Event: MaoApi.EMAIL_EVENT_DIGEST, Services: []*MaoApi.EmailServiceEvent{db, web}}
+	labelsOf := func(event *MaoApi.EmailServiceEvent) map[string]string {
+		if event == web {
+			return map[string]string{"team": "frontend"}
+		}
+		return nil
+	}
+	noon, _ := time.Parse("15:04", "12:00")
+
+	subscriptions := []*EmailSubscription{
+		{Email: "dba@example.com", Services: []string{"db-*"}, Events: []string{MaoApi.EMAIL_EVENT_DOWN}},
+		{Email: "fe@example.com", Labels: []string{"team=frontend"}},
+		{Email: "grpc@example.com", Sources: []string{"gRPC"}, QuietHours: "11:00-13:00"},
+		{Email: "ALL@example.com", Services: []string{"10.0.0.*"}},
+	}
+	routed, quieted := routeEmail(digest, []string{"all@example.com", "ops@example.com"}, []string{"cc@example.com"}, subscriptions, labelsOf, false, noon)
+	if quieted != 1 || len(routed) != 4 {
+		t.Fatalf("unexpected routing, %d quieted, %d routed", quieted, len(routed))
+	}
+	if r := routed[0]; strings.Join(r.Receivers, ",") != "ops@example.com" || strings.Join(r.Cc, ",") != "cc@example.com" || len(r.Services) != 2 {
+		t.Errorf("expect all events to the receivers without subscriptions, %+v", r)
+	}
+	if r := routed[1]; r.Receivers[0] != "dba@example.com" || len(r.Services) != 1 || r.Services[0] != db ||
+		r.Subject != "Digest of 1 service events" || !strings.Contains(r.Content, "db-1") || strings.Contains(r.Content, "web-1") {
+		t.Errorf("expect the DOWN of db-1 to dba, %+v", r)
+	}
+	if r := routed[2]; r.Receivers[0] != "fe@example.com" || len(r.Services) != 1 || r.Services[0] != web {
+		t.Errorf("expect web-1 to fe by the label, %+v", r)
+	}
+	if r := routed[3]; r.Receivers[0] != "ALL@example.com" || len(r.Services) != 2 || r.Content != digest.Content {
+		t.Errorf("expect all to ALL, %+v", r)
+	}
+	if len(digest.Services) != 2 || digest.Receivers != nil {
+		t.Errorf("the message is modified, %+v", digest)
+	}
+
+	// the critical ones are sent in the quiet hours.
+	routed, quieted = routeEmail(digest, nil, nil, subscriptions[2:3], labelsOf, true, noon)
+	if quieted != 0 || len(routed) != 1 || routed[0].Services[0] != web {
+		t.Errorf("expect the critical one sent, %d quieted, %+v", quieted, routed)
+	}
+
+	// the messages without service events go to all.
+	plain := &MaoApi.EmailMessage{Subject: "notice", Content: "hello"}
+	routed, _ = routeEmail(plain, []string{"ops@example.com"}, nil, subscriptions[:2], labelsOf, false, noon)
+	if len(routed) != 3 || routed[2].Content != "hello" {
+		t.Errorf("expect the plain message to all, %+v", routed)
+	}
+}
+
+func TestEmailSubscription_Check(t *testing.T) {
+	for field, sub := range map[string]*EmailSubscription{
+		"services":   {Email: "a@example.com", Services: []string{"db-["}},
+		"labels":     {Email: "a@example.com", Labels: []string{"=x"}},
+		"quietHours": {Email: "a@example.com", QuietHours: "night"},
+		"":           {Email: "a@example.com", Services: []string{"db-*"}, Labels: []string{"team", "env=prod"}, QuietHours: "22:00-07:00"},
+	} {
+		if got, _ := sub.check(); got != field {
+			t.Errorf("expect %q invalid, got %q", field, got)
+		}
+	}
+}
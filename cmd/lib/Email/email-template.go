@@ -0,0 +1,231 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"bytes"
+	"fmt"
+	htmlTemplate "html/template"
+	"strings"
+	textTemplate "text/template"
+	"time"
+)
+
+const (
+	EMAIL_EVENT_MESSAGE = "" // the message without event, e.g. the plaintext content
+
+	EMAIL_TIME_FORMAT = "2006-01-02 15:04:05 MST"
+)
+
+// EmailTemplate is the Go templates of one event in the email config, the empty ones are the defaults.
+// The data is emailTemplateData.
+type EmailTemplate struct {
+	Subject string `yaml:"subject,omitempty" json:"subject,omitempty"`
+	Text    string `yaml:"text,omitempty" json:"text,omitempty"`
+	Html    string `yaml:"html,omitempty" json:"html,omitempty"`
+}
+
+type emailServiceData struct {
+	*MaoApi.EmailServiceEvent
+	Link string // the page in the WebUI, empty if the WebUI url is not configured
+}
+
+type emailTemplateData struct {
+	Event     string
+	Subject   string
+	Content   string
+	Services  []*emailServiceData
+	First     *emailServiceData // the service of UP and DOWN
+	Up        int
+	Down      int
+	Dropped   int // digest: the events not listed
+	Dashboard string
+	Timestamp time.Time
+}
+
+type compiledEmailTemplate struct {
+	subject *textTemplate.Template
+	text    *textTemplate.Template
+	html    *htmlTemplate.Template
+}
+
+var emailTemplateFuncs = map[string]interface{}{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(EMAIL_TIME_FORMAT)
+	},
+	"duration": func(d time.Duration) string {
+		if d <= 0 {
+			return "-"
+		}
+		return d.Round(time.Second).String()
+	},
+	"rtt": func(d time.Duration) string {
+		if d <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.3f ms", float64(d.Microseconds())/1000)
+	},
+}
+
+const emailHtmlHead = `<html><body style="font-family:sans-serif">`
+const emailHtmlTail = `{{if .Dashboard}}<p><a href="{{.Dashboard}}">Open the dashboard</a></p>{{end}}</body></html>`
+
+var defaultEmailTemplates = map[string]*EmailTemplate{
+	EMAIL_EVENT_MESSAGE: {
+		Subject: `{{.Subject}}`,
+		Text:    `{{.Content}}`,
+		Html:    emailHtmlHead + `<pre>{{.Content}}</pre>` + emailHtmlTail,
+	},
+	MaoApi.EMAIL_EVENT_UP: {
+		Subject: `{{with .First}}{{.Source}} UP: {{.Name}}{{else}}{{.Subject}}{{end}}`,
+		Text: `{{range .Services}}{{.Source}} service {{.Name}} is UP.
+  Address:  {{.Address}}
+  UP time:  {{time .Timestamp}}
+  RTT:      {{rtt .Rtt}}
+  Downtime: {{duration .Downtime}}
+{{if .Link}}  Detail:   {{.Link}}
+{{end}}{{end}}`,
+		Html: emailHtmlHead + `{{range .Services}}<p>{{.Source}} service <b>{{.Name}}</b> is <b style="color:green">UP</b>.</p>
+<table border="1" cellpadding="4" style="border-collapse:collapse">
+<tr><td>Address</td><td>{{.Address}}</td></tr>
+<tr><td>UP time</td><td>{{time .Timestamp}}</td></tr>
+<tr><td>RTT</td><td>{{rtt .Rtt}}</td></tr>
+<tr><td>Downtime</td><td>{{duration .Downtime}}</td></tr>
+</table>
+{{if .Link}}<p><a href="{{.Link}}">Open in the WebUI</a></p>{{end}}{{end}}` + emailHtmlTail,
+	},
+	MaoApi.EMAIL_EVENT_DOWN: {
+		Subject: `{{with .First}}{{.Source}} DOWN: {{.Name}}{{else}}{{.Subject}}{{end}}`,
+		Text: `{{range .Services}}{{.Source}} service {{.Name}} is DOWN.
+  Address:   {{.Address}}
+  DOWN time: {{time .Timestamp}}
+  Last seen: {{time .LastSeen}}
+  Last RTT:  {{rtt .Rtt}}
+{{if .Link}}  Detail:    {{.Link}}
+{{end}}{{end}}`,
+		Html: emailHtmlHead + `{{range .Services}}<p>{{.Source}} service <b>{{.Name}}</b> is <b style="color:red">DOWN</b>.</p>
+<table border="1" cellpadding="4" style="border-collapse:collapse">
+<tr><td>Address</td><td>{{.Address}}</td></tr>
+<tr><td>DOWN time</td><td>{{time .Timestamp}}</td></tr>
+<tr><td>Last seen</td><td>{{time .LastSeen}}</td></tr>
+<tr><td>Last RTT</td><td>{{rtt .Rtt}}</td></tr>
+</table>
+{{if .Link}}<p><a href="{{.Link}}">Open in the WebUI</a></p>{{end}}{{end}}` + emailHtmlTail,
+	},
+	MaoApi.EMAIL_EVENT_DIGEST: {
+		Subject: `Digest: {{.Up}} UP, {{.Down}} DOWN{{if .Dropped}}, {{.Dropped}} dropped{{end}}`,
+		Text: `{{len .Services}} service events, {{.Up}} UP and {{.Down}} DOWN.
+{{range .Services}}
+{{time .Timestamp}}  {{.Type}}  {{.Source}}  {{.Name}} ({{.Address}}){{if eq .Type "UP"}}, down for {{duration .Downtime}}{{end}}{{end}}
+{{if .Dropped}}
+{{.Dropped}} more events are dropped, the digest is full.
+{{end}}{{if .Dashboard}}
+Dashboard: {{.Dashboard}}
+{{end}}`,
+		Html: emailHtmlHead + `<p>{{len .Services}} service events, {{.Up}} UP and {{.Down}} DOWN.</p>
+<table border="1" cellpadding="4" style="border-collapse:collapse">
+<tr><th>Time</th><th>Event</th><th>Source</th><th>Service</th><th>Address</th><th>Downtime</th></tr>
+{{range .Services}}<tr><td>{{time .Timestamp}}</td><td>{{.Type}}</td><td>{{.Source}}</td>` +
+			`<td>{{if .Link}}<a href="{{.Link}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td><td>{{.Address}}</td>` +
+			`<td>{{if eq .Type "UP"}}{{duration .Downtime}}{{end}}</td></tr>
+{{end}}</table>
+{{if .Dropped}}<p>{{.Dropped}} more events are dropped, the digest is full.</p>{{end}}` + emailHtmlTail,
+	},
+}
+
+func compileEmailTemplate(event string, t *EmailTemplate) (*compiledEmailTemplate, error) {
+	compiled := &compiledEmailTemplate{}
+	var err error
+	if compiled.subject, err = textTemplate.New(event + "-subject").Funcs(emailTemplateFuncs).Parse(t.Subject); err != nil {
+		return nil, err
+	}
+	if compiled.text, err = textTemplate.New(event + "-text").Funcs(emailTemplateFuncs).Parse(t.Text); err != nil {
+		return nil, err
+	}
+	if compiled.html, err = htmlTemplate.New(event + "-html").Funcs(emailTemplateFuncs).Parse(t.Html); err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// compileEmailTemplates takes the templates of the config over the defaults, a template failing to parse is ignored.
+func compileEmailTemplates(custom map[string]*EmailTemplate) map[string]*compiledEmailTemplate {
+	templates := make(map[string]*compiledEmailTemplate)
+	for event, defaultTemplate := range defaultEmailTemplates {
+		merged := *defaultTemplate
+		if t, ok := custom[event]; ok && t != nil {
+			if t.Subject != "" {
+				merged.Subject = t.Subject
+			}
+			if t.Text != "" {
+				merged.Text = t.Text
+			}
+			if t.Html != "" {
+				merged.Html = t.Html
+			}
+		}
+		compiled, err := compileEmailTemplate(event, &merged)
+		if err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse the email template of %s, use the default. (%s)", event, err.Error())
+			compiled, _ = compileEmailTemplate(event, defaultTemplate)
+		}
+		templates[event] = compiled
+	}
+	for event := range custom {
+		if _, ok := defaultEmailTemplates[event]; !ok || event == EMAIL_EVENT_MESSAGE {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Unknown email event %s of the template, ignored.", event)
+		}
+	}
+	return templates
+}
+
+// renderEmail renders the subject, the text and the html of the message by the template of its event.
+func renderEmail(templates map[string]*compiledEmailTemplate, m *MaoApi.EmailMessage, webUiUrl string, now time.Time) (string, string, string, error) {
+	webUiUrl = strings.TrimRight(webUiUrl, "/")
+	data := &emailTemplateData{
+		Event:     m.Event,
+		Subject:   m.Subject,
+		Content:   m.Content,
+		Dropped:   m.Dropped,
+		Services:  make([]*emailServiceData, 0, len(m.Services)),
+		Timestamp: now,
+	}
+	if webUiUrl != "" {
+		data.Dashboard = webUiUrl + URL_WEBUI_DASHBOARD
+	}
+	for _, service := range m.Services {
+		serviceData := &emailServiceData{EmailServiceEvent: service}
+		if webUiUrl != "" && service.Page != "" {
+			serviceData.Link = webUiUrl + service.Page
+		}
+		if service.Type == MaoApi.EMAIL_EVENT_UP {
+			data.Up++
+		} else if service.Type == MaoApi.EMAIL_EVENT_DOWN {
+			data.Down++
+		}
+		data.Services = append(data.Services, serviceData)
+	}
+	if len(data.Services) > 0 {
+		data.First = data.Services[0]
+	}
+
+	compiled, ok := templates[m.Event]
+	if !ok {
+		compiled = templates[EMAIL_EVENT_MESSAGE]
+	}
+	subject, text, html := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	if err := compiled.subject.Execute(subject, data); err != nil {
+		return "", "", "", err
+	}
+	if err := compiled.text.Execute(text, data); err != nil {
+		return "", "", "", err
+	}
+	if err := compiled.html.Execute(html, data); err != nil {
+		return "", "", "", err
+	}
+	// the subject is one line.
+	return strings.Join(strings.Fields(subject.String()), " "), text.String(), html.String(), nil
+}
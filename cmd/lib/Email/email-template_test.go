@@ -0,0 +1,125 @@
+package Email
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUpMessage(name string) *MaoApi.EmailMessage {
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	return &MaoApi.EmailMessage{
+		Subject: "ICMP UP notification",
+		Event:   MaoApi.EMAIL_EVENT_UP,
+		Services: []*MaoApi.EmailServiceEvent{{
+			Type:        MaoApi.EMAIL_EVENT_UP,
+			Source:      "ICMP",
+			ServiceName: name,
+			Address:     "2001:db8::1",
+			Rtt:         1500 * time.Microsecond,
+			Timestamp:   now,
+			LastSeen:    now.Add(-90 * time.Second),
+			Downtime:    90 * time.Second,
+			Page:        "/v1/configIcmp",
+		}},
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	templates := compileEmailTemplates(nil)
+	subject, text, html, err := renderEmail(templates, newUpMessage("<b>core</b>"), "https://mao.example.com/", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "ICMP UP: <b>core</b>" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for _, expect := range []string{"<b>core</b> is UP", "2001:db8::1", "1.500 ms", "1m30s", "https://mao.example.com/v1/configIcmp"} {
+		if !strings.Contains(text, expect) {
+			t.Errorf("%q is not in the text:\n%s", expect, text)
+		}
+	}
+	if strings.Contains(html, "<b>core</b>") || !strings.Contains(html, "&lt;b&gt;core&lt;/b&gt;") {
+		t.Errorf("the service name is not escaped in the html:\n%s", html)
+	}
+	if !strings.Contains(html, `href="https://mao.example.com/v1/Dashboard"`) {
+		t.Errorf("the dashboard link is not in the html:\n%s", html)
+	}
+
+	// no link without the WebUI url, and the plaintext message is kept.
+	if _, text, _, _ = renderEmail(templates, newUpMessage("core"), "", time.Now()); strings.Contains(text, "Detail") {
+		t.Errorf("unexpected link in the text:\n%s", text)
+	}
+	subject, text, _, _ = renderEmail(templates, &MaoApi.EmailMessage{Subject: "Test", Content: "Hello"}, "", time.Now())
+	if subject != "Test" || text != "Hello" {
+		t.Errorf("unexpected message %q %q", subject, text)
+	}
+
+	custom := compileEmailTemplates(map[string]*EmailTemplate{
+		MaoApi.EMAIL_EVENT_UP:   {Subject: "[{{.First.Source}}] {{.First.Name}} recovered"},
+		MaoApi.EMAIL_EVENT_DOWN: {Subject: "{{.First.Name"},
+	})
+	if subject, _, _, _ = renderEmail(custom, newUpMessage("core"), "", time.Now()); subject != "[ICMP] core recovered" {
+		t.Errorf("unexpected custom subject %q", subject)
+	}
+	down := newUpMessage("core")
+	down.Event, down.Services[0].Type = MaoApi.EMAIL_EVENT_DOWN, MaoApi.EMAIL_EVENT_DOWN
+	if subject, _, _, _ = renderEmail(custom, down, "", time.Now()); subject != "ICMP DOWN: core" {
+		t.Errorf("expect the default for the invalid template, got %q", subject)
+	}
+}
+
+func TestBuildMimeMessage(t *testing.T) {
+	now := time.Now()
+	raw, err := buildMimeMessage("mao@example.com", []string{"a@example.com", "b@example.com"}, []string{"c@example.com"},
+		"服务 UP", "text body", "<p>html body</p>", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date, err := msg.Header.Date(); err != nil || date.Unix() != now.Unix() {
+		t.Errorf("unexpected date %v, %v", date, err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("unexpected message id %q", id)
+	}
+	if to, _ := msg.Header.AddressList("To"); len(to) != 2 {
+		t.Errorf("unexpected To %v", msg.Header.Get("To"))
+	}
+	if cc, _ := msg.Header.AddressList("Cc"); len(cc) != 1 || cc[0].Address != "c@example.com" {
+		t.Errorf("unexpected Cc %v", msg.Header.Get("Cc"))
+	}
+	if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != "服务 UP" {
+		t.Errorf("unexpected subject %q, %v", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type %s, %v", mediaType, err)
+	}
+	parts := make(map[string]string)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(part)
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(content)
+	}
+	if parts["text/plain"] != "text body" || parts["text/html"] != "<p>html body</p>" {
+		t.Errorf("unexpected parts %v", parts)
+	}
+}
@@ -25,7 +25,7 @@ func (a *authLOGIN) Next(fromServer []byte, more bool) ([]byte, error) {
 		switch string(fromServer) {
 		case "Username:", "username:":
 			return []byte(a.username), nil
-		case "Password:":
+		case "Password:", "password:":
 			return []byte(a.password), nil
 		default:
 			return nil, errors.New(fmt.Sprintf("Unknown message from Server: %s", fromServer))
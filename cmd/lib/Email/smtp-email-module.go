@@ -6,10 +6,15 @@ import (
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/cmd/lib/MaoEnhancedGolang"
 	"MaoServerDiscovery/util"
-	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +26,9 @@ const (
 	URL_EMAIL_HOMEPAGE = "/configEmail"
 	URL_EMAIL_CONFIG   = "/addEmailInfo"
 	URL_EMAIL_SHOW   = "/getEmailInfo"
+	URL_EMAIL_TEST   = "/testEmail"
+
+	URL_WEBUI_DASHBOARD = "/v1/Dashboard"
 
 	EMAIL_INFO_CONFIG_PATH_ROOT     = "/email"
 	EMAIL_INFO_CONFIG_PATH_PASSWORD = "/email/password"
@@ -29,33 +37,84 @@ const (
 	EMAIL_CONFIG_KEY_SERVER_ADDRPORT = "smtpServerAddrPort"
 	EMAIL_CONFIG_KEY_SENDER = "sender"
 	EMAIL_CONFIG_KEY_RECEIVER = "receiver"
+	EMAIL_CONFIG_KEY_CC = "cc"
+	EMAIL_CONFIG_KEY_WEBUI_URL = "webUiUrl"
+	EMAIL_CONFIG_KEY_TEMPLATES = "templates"
+	EMAIL_CONFIG_KEY_DIGEST = "digest"
+	EMAIL_CONFIG_KEY_SECURITY = "security"
+	EMAIL_CONFIG_KEY_AUTH = "auth"
+	EMAIL_CONFIG_KEY_CA_FILE = "caFile"
+	EMAIL_CONFIG_KEY_INSECURE_SKIP_VERIFY = "insecureSkipVerify"
+	EMAIL_CONFIG_KEY_SUBSCRIPTIONS = "subscriptions"
 
 	EMAIL_API_KEY_USERNAME = EMAIL_CONFIG_KEY_USERNAME
 	EMAIL_API_KEY_PASSWORD = "password"
 	EMAIL_API_KEY_SERVER_ADDRPORT = EMAIL_CONFIG_KEY_SERVER_ADDRPORT
 	EMAIL_API_KEY_SENDER = EMAIL_CONFIG_KEY_SENDER
 	EMAIL_API_KEY_RECEIVER = EMAIL_CONFIG_KEY_RECEIVER
+	EMAIL_API_KEY_CC = EMAIL_CONFIG_KEY_CC
+	EMAIL_API_KEY_WEBUI_URL = EMAIL_CONFIG_KEY_WEBUI_URL
+	EMAIL_API_KEY_DIGEST_WINDOW = "digestWindow"
+	EMAIL_API_KEY_CRITICAL = "critical"
+	EMAIL_API_KEY_SECURITY = EMAIL_CONFIG_KEY_SECURITY
+	EMAIL_API_KEY_AUTH = EMAIL_CONFIG_KEY_AUTH
+	EMAIL_API_KEY_CA_FILE = EMAIL_CONFIG_KEY_CA_FILE
+	EMAIL_API_KEY_INSECURE_SKIP_VERIFY = EMAIL_CONFIG_KEY_INSECURE_SKIP_VERIFY
+	EMAIL_API_KEY_SUBSCRIPTIONS = EMAIL_CONFIG_KEY_SUBSCRIPTIONS
 )
 
+// EmailConfig is the schema of EMAIL_INFO_CONFIG_PATH_ROOT, the password is a sec config beside it.
+type EmailConfig struct {
+	Username           string   `yaml:"username"` // Attention, the tags MUST be modified simultaneously with EMAIL_CONFIG_KEY_*.
+	SmtpServerAddrPort string   `yaml:"smtpServerAddrPort" validate:"required,hostport"`
+	Sender             string   `yaml:"sender" validate:"required,email"`
+	Receiver           []string `yaml:"receiver" validate:"email"` // all events, except the ones with subscriptions
+	Cc                 []string `yaml:"cc,omitempty" validate:"email"`
+	WebUiUrl           string   `yaml:"webUiUrl,omitempty"` // e.g. https://mao.example.com:29999, for the links in the emails
+	Templates          map[string]*EmailTemplate `yaml:"templates,omitempty"` // by MaoApi.EMAIL_EVENT_*
+	Digest             *EmailDigestConfig        `yaml:"digest,omitempty"`
+	Security           string `yaml:"security,omitempty" validate:"oneof=auto|starttls|tls|none"` // MaoEnhancedGolang.SMTP_SECURITY_*, auto by default
+	Auth               string `yaml:"auth,omitempty" validate:"oneof=login|plain|cram-md5|none"`  // EMAIL_AUTH_*, login by default
+	CaFile             string `yaml:"caFile,omitempty"`                                            // PEM, trusted besides the system CAs
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`                                // don't verify the server certificate
+	Subscriptions      []*EmailSubscription `yaml:"subscriptions,omitempty"`
+}
+
 type SmtpEmailModule struct {
 
+	// guards the config below, written by sendEmailLoop and the restful apis, read by the outbox when it sends the emails.
+	configLock         sync.RWMutex
 	username           string
 	password           string // Attention: password can't be outputted !!!
 	smtpServerAddrPort string // addr:port, default port for smtp is 25.
 	sender string
 	receiver []string
-
+	cc []string
+	webUiUrl string
+	customTemplates map[string]*EmailTemplate
+	templates map[string]*compiledEmailTemplate
+	digestConfig *EmailDigestConfig
+	digest emailDigest
+	security string
+	auth string
+	caFile string
+	insecureSkipVerify bool
+	subscriptions []*EmailSubscription
 
 	// input the message
 	sendEmailChannel chan *MaoApi.EmailMessage
 	lastSendTimestamp time.Time
+	droppedEmails atomic.Int64 // the queue is full
+	quietedEmails atomic.Int64 // skipped by the quiet hours of the subscriptions
 
 	secConfigChannel chan int
+	configUpdateChannel chan int // the email config is changed, e.g. the config file is edited
 
 	// same as the other module, it is expected to be global
 	//checkInterval uint32
 
 	needShutdown bool
+	exited chan struct{} // closed when sendEmailLoop exits
 }
 
 func (s *SmtpEmailModule) RequireShutdown() {
@@ -63,14 +122,29 @@ func (s *SmtpEmailModule) RequireShutdown() {
 }
 
 
+// Shutdown sends the pending emails and waits for sendEmailLoop to exit.
+func (s *SmtpEmailModule) Shutdown() {
+	s.RequireShutdown()
+	<-s.exited
+}
+
+// SendEmail never blocks the detecting modules, the email is dropped and counted if the queue is full.
 func (s *SmtpEmailModule) SendEmail(message *MaoApi.EmailMessage) {
-	s.sendEmailChannel <- message
+	select {
+	case s.sendEmailChannel <- message:
+	default:
+		if dropped := s.droppedEmails.Add(1); dropped%100 == 1 {
+			util.MaoLogM(util.WARN, MODULE_NAME, "The email queue is full, drop the email %q, %d dropped.", message.Subject, dropped)
+		}
+	}
 }
 
+// checkEmailInfo is called with configLock held.
 func (s *SmtpEmailModule) checkEmailInfo() bool {
 
 	// password may be empty?
-	if s.username == "" || s.smtpServerAddrPort == "" || s.sender == "" || len(s.receiver) == 0 {
+	if (s.username == "" && s.authMethod() != EMAIL_AUTH_NONE) || s.smtpServerAddrPort == "" || s.sender == "" ||
+		(len(s.receiver) == 0 && len(s.subscriptions) == 0) {
 		// can adapt to "s.receiver == nil"
 		return false
 	}
@@ -78,81 +152,213 @@ func (s *SmtpEmailModule) checkEmailInfo() bool {
 }
 
 
-func (s *SmtpEmailModule) sendEmail(m *MaoApi.EmailMessage) {
-
+func (s *SmtpEmailModule) CheckHealth() *MaoApi.ModuleHealth {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: fmt.Sprintf("SMTP server %s", s.smtpServerAddrPort),
+		Metrics: map[string]int64{
+			"sendQueueDepth":      int64(len(s.sendEmailChannel)),
+			"droppedEmails":       s.droppedEmails.Load(),
+			"digestPending":       s.digest.pending.Load(),
+			"droppedDigestEvents": s.digest.droppedTotal.Load(),
+			"quietedEmails":       s.quietedEmails.Load(),
+		},
+	}
 	if !s.checkEmailInfo() {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send email, please config email info first.")
+		health.Status = MaoApi.HEALTH_STATUS_DISABLED
+		health.Detail = "SMTP is not configured"
+	}
+	return health
+}
+
+// deliverEmail routes the email by the subscriptions if it is not addressed, and saves them to the outbox, which sends them and retries on failure.
+// Before the email info is configured, the email is saved as it is, and sent to the receivers configured by then.
+func (s *SmtpEmailModule) deliverEmail(m *MaoApi.EmailMessage) {
+	s.configLock.RLock()
+	configured := s.checkEmailInfo()
+	receiver, cc, subscriptions := s.receiver, s.cc, s.subscriptions
+	s.configLock.RUnlock()
+
+	if !configured {
+		if MaoCommon.ServiceRegistryGetOutboxModule() == nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send email, please config email info first.")
+			return
+		}
+		util.MaoLogM(util.WARN, MODULE_NAME, "Email info is not configured, keep %q in the outbox until it is.", m.Subject)
+		s.enqueueEmail(m)
 		return
 	}
 
-	// Set up authentication information everytime, that allows to update:
-	// username, password, smtpServerAddrPort, sender, receiver
-	auth := AuthLOGIN(s.username, s.password)
+	// the messages addressed by the sender, e.g. the reports, are not routed.
+	routed := []*MaoApi.EmailMessage{m}
+	if len(m.Receivers) == 0 && len(m.Cc) == 0 {
+		var quieted int
+		routed, quieted = routeEmail(m, receiver, cc, subscriptions, serviceLabels, s.digest.isCritical(m), time.Now())
+		if quieted > 0 {
+			s.quietedEmails.Add(int64(quieted))
+			util.MaoLogM(util.INFO, MODULE_NAME, "Skip %q for %d subscribers in the quiet hours.", m.Subject, quieted)
+		}
+	}
+	for _, message := range routed {
+		s.enqueueEmail(message)
+	}
+}
 
-	// TODO: how to build multiple receivers string?
-	// TODO: support multiple receivers
-	msg := fmt.Sprintf("To: %s\r\n" +
-		"Subject: %s%s\r\n" + "\r\n" +
-		"%s\r\n",
-		s.receiver[0], SUBJECT_FIX_PREFIX, m.Subject, m.Content)
+// enqueueEmail saves the email to the outbox. It is sent directly without the outbox.
+func (s *SmtpEmailModule) enqueueEmail(m *MaoApi.EmailMessage) {
+	outbox := MaoCommon.ServiceRegistryGetOutboxModule()
+	if outbox != nil {
+		_, err := outbox.Enqueue(MaoApi.NOTIFICATION_CHANNEL_EMAIL, m.Subject, m)
+		if err == nil {
+			return
+		}
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save the email to the outbox, send it directly. (%s)", err.Error())
+	}
+	if err := s.sendEmail(m); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send email, %s", err.Error())
+	}
+}
 
-	//msg := []byte("To: @.com\r\n" +
-	//	"Subject: MaoReport: beijing tower\r\n" +
-	//	"\r\n" +
-	//	"This is the email body.\r\n")
+// deliverOutboxEmail is the deliver function of the email channel of the outbox.
+func (s *SmtpEmailModule) deliverOutboxEmail(payload []byte) error {
+	m := &MaoApi.EmailMessage{}
+	if err := json.Unmarshal(payload, m); err != nil {
+		return err
+	}
+	return s.sendEmail(m)
+}
 
-	// TODO: make it configurable
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+func (s *SmtpEmailModule) sendEmail(m *MaoApi.EmailMessage) error {
+	s.configLock.RLock()
+	server, sender := s.smtpServerAddrPort, s.sender
+	recipients, msg, options, err := s.buildEmail(m)
+	s.configLock.RUnlock()
+	if err != nil {
+		return err
 	}
 
 	// Connect to the server, authenticate, set the sender and recipient,
 	// and send the email all in one step.
-	err := MaoEnhancedGolang.SendMail(s.smtpServerAddrPort, auth, s.sender, s.receiver, []byte(msg), tlsConfig)
+	_, err = MaoEnhancedGolang.SendMailWithOptions(server, options, sender, recipients, msg)
+	return err
+}
+
+// buildEmail renders the email and sets up the options by the config, with configLock held.
+func (s *SmtpEmailModule) buildEmail(m *MaoApi.EmailMessage) ([]string, []byte, *MaoEnhancedGolang.SmtpOptions, error) {
+
+	if !s.checkEmailInfo() {
+		return nil, nil, nil, errors.New("email info is not configured")
+	}
+
+	now := time.Now()
+	subject, text, html, err := renderEmail(s.templates, m, s.webUiUrl, now)
 	if err != nil {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send email, %s", err.Error())
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to render the email of %s, send it as plaintext. (%s)", m.Event, err.Error())
+		subject, text, html, _ = renderEmail(s.templates, &MaoApi.EmailMessage{Subject: m.Subject, Content: m.Content}, s.webUiUrl, now)
 	}
+	to, cc := m.Receivers, m.Cc
+	if len(to) == 0 && len(cc) == 0 {
+		to, cc = s.receiver, s.cc
+	}
+	msg, err := buildMimeMessage(s.sender, to, cc, SUBJECT_FIX_PREFIX+subject, text, html, now)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("fail to build the email, %s", err.Error())
+	}
+
+	// Set up the options everytime, that allows to update:
+	// username, password, smtpServerAddrPort, security, auth, caFile
+	options, err := s.smtpOptions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	recipients := append(append(make([]string, 0, len(to)+len(cc)), to...), cc...)
+	return recipients, msg, options, nil
+}
+
+// flushPendingEmails saves all pending emails and the digest to the outbox without the interval, because we are exiting.
+func (s *SmtpEmailModule) flushPendingEmails() {
+	messages := make([]*MaoApi.EmailMessage, 0, len(s.sendEmailChannel)+1)
+	for len(s.sendEmailChannel) > 0 {
+		if message := <-s.sendEmailChannel; !s.digest.add(message) {
+			messages = append(messages, message)
+		}
+	}
+	if digest := s.digest.flush(); digest != nil {
+		messages = append(messages, digest)
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	util.MaoLogM(util.INFO, MODULE_NAME, "Exiting, flush %d pending emails.", len(messages))
+	for _, message := range messages {
+		s.deliverEmail(message)
+	}
+}
+
+// sendEmailWithInterval sends the email EMAIL_SEND_INTERVAL after the last one, false if exiting meanwhile.
+func (s *SmtpEmailModule) sendEmailWithInterval(message *MaoApi.EmailMessage, checkShutdownTimer *time.Timer, checkInterval time.Duration) bool {
+	if wait := EMAIL_SEND_INTERVAL - time.Since(s.lastSendTimestamp); wait > 0 {
+		freezeTimer := time.NewTimer(wait)
+		defer freezeTimer.Stop()
+		for sent := false; !sent; {
+			select {
+			case <-freezeTimer.C:
+				sent = true
+			case <-checkShutdownTimer.C:
+				util.MaoLogM(util.DEBUG, MODULE_NAME, "CheckShutdown while freezing, event queue len %d", len(s.sendEmailChannel))
+				if s.needShutdown {
+					util.MaoLogM(util.INFO, MODULE_NAME, "Exiting while freezing, send the email now.")
+					s.deliverEmail(message)
+					s.flushPendingEmails()
+					util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+					return false
+				}
+				checkShutdownTimer.Reset(checkInterval)
+			}
+		}
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Sending email, pending: %d, in digest: %d", len(s.sendEmailChannel), len(s.digest.messages))
+	s.deliverEmail(message)
+	s.lastSendTimestamp = time.Now()
+	return true
 }
 
 func (s *SmtpEmailModule) sendEmailLoop() {
+	defer close(s.exited)
+
 	checkInterval := time.Duration(1000) * time.Millisecond
 	checkShutdownTimer := time.NewTimer(checkInterval)
 	for {
 		select {
 		case message := <-s.sendEmailChannel:
-			if time.Now().Sub(s.lastSendTimestamp) < 10 * time.Second {
-				freezeTimer := time.NewTimer(time.Duration(10) * time.Second)
-				sent := false
-				for !sent {
-					select {
-					case <-freezeTimer.C:
-						util.MaoLogM(util.INFO, MODULE_NAME, "Sending email, pending: %d", len(s.sendEmailChannel))
-						s.sendEmail(message)
-						s.lastSendTimestamp = time.Now()
-						sent = true
-					case <-checkShutdownTimer.C:
-						util.MaoLogM(util.DEBUG, MODULE_NAME, "CheckShutdown while freezing, event queue len %d", len(s.sendEmailChannel))
-						if s.needShutdown {
-							util.MaoLogM(util.WARN, MODULE_NAME, "Exit while freezing, the sendEmailChannel len: %d", len(s.sendEmailChannel))
-							return
-						}
-						checkShutdownTimer.Reset(checkInterval)
-					}
-				}
-			} else {
-				util.MaoLogM(util.INFO, MODULE_NAME, "Sending email, pending: %d", len(s.sendEmailChannel))
-				s.sendEmail(message)
-				s.lastSendTimestamp = time.Now()
+			if s.digest.add(message) {
+				continue
+			}
+			if !s.sendEmailWithInterval(message, checkShutdownTimer, checkInterval) {
+				return
+			}
+		case <-s.digest.C():
+			if digest := s.digest.flush(); digest != nil && !s.sendEmailWithInterval(digest, checkShutdownTimer, checkInterval) {
+				return
 			}
 
 		case <-s.secConfigChannel:
 			s.loadEmailSecConfig()
+		case <-s.configUpdateChannel:
+			s.loadEmailConfig()
+			s.loadEmailSecConfig()
+			s.configLock.RLock()
+			s.digest.configure(s.digestConfig)
+			s.configLock.RUnlock()
 		case <-checkShutdownTimer.C:
 			util.MaoLogM(util.DEBUG, MODULE_NAME, "CheckShutdown, event queue len %d", len(s.sendEmailChannel))
 			if s.needShutdown {
-				if len(s.sendEmailChannel) != 0 {
-					util.MaoLogM(util.WARN, MODULE_NAME, "Exiting, but the sendEmailChannel is not empty, len: %d", len(s.sendEmailChannel))
-				}
+				s.flushPendingEmails()
 				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 				return
 			}
@@ -162,13 +368,24 @@ func (s *SmtpEmailModule) sendEmailLoop() {
 }
 
 func (s *SmtpEmailModule) InitSmtpEmailModule() bool {
-	s.sendEmailChannel = make(chan *MaoApi.EmailMessage, 1024)
-	s.secConfigChannel = make(chan int)
+	s.sendEmailChannel = make(chan *MaoApi.EmailMessage, EMAIL_QUEUE_SIZE)
+	s.secConfigChannel = make(chan int, 1)
+	s.configUpdateChannel = make(chan int, 1)
 	s.needShutdown = false
+	s.exited = make(chan struct{})
+	s.templates = compileEmailTemplates(nil)
 
 
 	s.registerSecConfigListener()
+	if outbox := MaoCommon.ServiceRegistryGetOutboxModule(); outbox != nil {
+		outbox.RegisterChannel(MaoApi.NOTIFICATION_CHANNEL_EMAIL, EMAIL_SEND_INTERVAL, s.deliverOutboxEmail)
+	}
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		configModule.RegisterConfigSchema(EMAIL_INFO_CONFIG_PATH_ROOT, &EmailConfig{})
+	}
 	s.loadEmailConfig()
+	s.loadEmailSecConfig() // the sec key may be loaded at startup.
+	s.digest.configure(s.digestConfig)
 
 	go s.sendEmailLoop()
 
@@ -186,6 +403,7 @@ func (s *SmtpEmailModule) registerSecConfigListener() {
 
 	// register config-secKey listener
 	configModule.RegisterKeyUpdateListener(&s.secConfigChannel)
+	configModule.RegisterConfigUpdateListener(EMAIL_INFO_CONFIG_PATH_ROOT, &s.configUpdateChannel)
 }
 func (s *SmtpEmailModule) loadEmailSecConfig() {
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
@@ -200,12 +418,14 @@ func (s *SmtpEmailModule) loadEmailSecConfig() {
 		return
 	}
 
-	var ok bool
-	s.password, ok = password.(string)
+	passwordStr, ok := password.(string)
 	if !ok {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - password")
 		return
 	}
+	s.configLock.Lock()
+	s.password = passwordStr
+	s.configLock.Unlock()
 
 	util.MaoLogM(util.INFO, MODULE_NAME, "Loaded sec config")
 }
@@ -216,56 +436,34 @@ func (s *SmtpEmailModule) loadEmailConfig() {
 		return
 	}
 
-	emailConfig, errCode := configModule.GetConfig(EMAIL_INFO_CONFIG_PATH_ROOT)
-	if errCode != Config.ERR_CODE_SUCCESS {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read email config, code: %d, %v", errCode, errCode)
-		return
-	}
-	if emailConfig == nil {
+	emailConfig := &EmailConfig{}
+	errCode := configModule.GetConfigInto(EMAIL_INFO_CONFIG_PATH_ROOT, emailConfig)
+	if errCode == Config.ERR_CODE_PATH_TRANSIT_FAIL || errCode == Config.ERR_CODE_PATH_NOT_EXIST {
 		util.MaoLogM(util.WARN, MODULE_NAME, "There is no email config. You may need to config email module.")
 		return
 	}
-
-	emailConfigMap, ok := emailConfig.(map[string]interface{})
-	if !ok {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config, can't convert to map[string]interface{}")
-		return
-	}
-
-	username, ok := emailConfigMap[EMAIL_CONFIG_KEY_USERNAME].(string)
-	if !ok {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - username")
-		return
-	}
-	smtpServerAddrPort, ok := emailConfigMap[EMAIL_CONFIG_KEY_SERVER_ADDRPORT].(string)
-	if !ok {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - smtpServerAddrPort")
-		return
-	}
-	sender, ok := emailConfigMap[EMAIL_CONFIG_KEY_SENDER].(string)
-	if !ok {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - sender")
-		return
-	}
-	receiverIntfs, ok := emailConfigMap[EMAIL_CONFIG_KEY_RECEIVER].([]interface{})
-	if !ok {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - receiver")
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read email config, code: %d, %v", errCode, errCode)
 		return
 	}
-	receivers := make([]string, 0)
-	for _, receiverIntf := range receiverIntfs {
-		if r, ok := receiverIntf.(string); ok {
-			receivers = append(receivers, r)
-		} else {
-			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse email config - receiverIntf")
-			return
-		}
-	}
 
-	s.username = username
-	s.smtpServerAddrPort = smtpServerAddrPort
-	s.sender = sender
-	s.receiver = receivers
+	templates := compileEmailTemplates(emailConfig.Templates)
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.username = emailConfig.Username
+	s.smtpServerAddrPort = emailConfig.SmtpServerAddrPort
+	s.sender = emailConfig.Sender
+	s.receiver = emailConfig.Receiver
+	s.cc = emailConfig.Cc
+	s.webUiUrl = emailConfig.WebUiUrl
+	s.customTemplates = emailConfig.Templates
+	s.templates = templates
+	s.digestConfig = emailConfig.Digest
+	s.security = emailConfig.Security
+	s.auth = emailConfig.Auth
+	s.caFile = emailConfig.CaFile
+	s.insecureSkipVerify = emailConfig.InsecureSkipVerify
+	s.subscriptions = emailConfig.Subscriptions
 }
 
 
@@ -277,8 +475,53 @@ func (s *SmtpEmailModule) configRestControlInterface() {
 	}
 
 	restfulServer.RegisterUiPage(URL_EMAIL_HOMEPAGE, s.showEmailPage)
-	restfulServer.RegisterGetApi(URL_EMAIL_SHOW, s.showEmailInfo)
-	restfulServer.RegisterPostApi(URL_EMAIL_CONFIG, s.processEmailInfo)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_EMAIL_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the email config, without the password",
+		Tag:      MODULE_NAME,
+		Response: map[string]interface{}{},
+	}, s.showEmailInfo)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_EMAIL_CONFIG, &MaoApi.ApiDoc{
+		Summary:     "Update the email config",
+		Description: "Only the provided fields are updated. Replies the email config page, or 400 with the invalid fields (MaoApi.ConfigSchemaError).",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: EMAIL_API_KEY_USERNAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING},
+			{Name: EMAIL_API_KEY_PASSWORD, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING},
+			{Name: EMAIL_API_KEY_SERVER_ADDRPORT, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "e.g. smtp.example.com:587"},
+			{Name: EMAIL_API_KEY_SENDER, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING},
+			{Name: EMAIL_API_KEY_RECEIVER, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "email addresses separated by whitespace"},
+			{Name: EMAIL_API_KEY_CC, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "email addresses separated by whitespace"},
+			{Name: EMAIL_API_KEY_WEBUI_URL, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "e.g. https://mao.example.com:29999, for the links in the emails"},
+			{Name: EMAIL_API_KEY_DIGEST_WINDOW, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_INTEGER,
+				Description: "seconds, the UP and DOWN emails in it are sent as one digest, 0 sends them one by one"},
+			{Name: EMAIL_API_KEY_CRITICAL, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "event types (UP, DOWN), service names or addresses sent at once, separated by whitespace"},
+			{Name: EMAIL_API_KEY_SECURITY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "auto (implicit TLS on port 465, otherwise STARTTLS if supported), starttls, tls or none"},
+			{Name: EMAIL_API_KEY_AUTH, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "login, plain, cram-md5 or none"},
+			{Name: EMAIL_API_KEY_CA_FILE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "path of the PEM CA bundle trusted besides the system CAs, empty for the system CAs only"},
+			{Name: EMAIL_API_KEY_INSECURE_SKIP_VERIFY, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_BOOLEAN,
+				Description: "don't verify the server certificate, false by default"},
+			{Name: EMAIL_API_KEY_SUBSCRIPTIONS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "JSON list of {email, sources, services, labels, events, quietHours}, the subscribed receivers only get the matched events"},
+		},
+	}, s.processEmailInfo)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_EMAIL_TEST, &MaoApi.ApiDoc{
+		Summary:     "Send a probe email by the saved config",
+		Description: "The probe is sent at once, without the outbox and the digest. Replies the result with the stage it fails at, and the TLS session.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: EMAIL_API_KEY_RECEIVER, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "email addresses separated by whitespace, the configured receivers if empty"},
+		},
+		Response: &EmailProbeResult{},
+	}, s.processEmailProbe)
 }
 
 func (s *SmtpEmailModule) showEmailPage(c *gin.Context) {
@@ -286,11 +529,22 @@ func (s *SmtpEmailModule) showEmailPage(c *gin.Context) {
 }
 
 func (s *SmtpEmailModule) showEmailInfo(c *gin.Context) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
 	data := make(map[string]interface{})
 	data[EMAIL_CONFIG_KEY_USERNAME] = s.username
 	data[EMAIL_CONFIG_KEY_SERVER_ADDRPORT] = s.smtpServerAddrPort
 	data[EMAIL_CONFIG_KEY_SENDER] = s.sender
 	data[EMAIL_CONFIG_KEY_RECEIVER] = s.receiver
+	data[EMAIL_CONFIG_KEY_CC] = s.cc
+	data[EMAIL_CONFIG_KEY_WEBUI_URL] = s.webUiUrl
+	data[EMAIL_CONFIG_KEY_TEMPLATES] = s.customTemplates
+	data[EMAIL_CONFIG_KEY_DIGEST] = s.digestConfig
+	data[EMAIL_CONFIG_KEY_SECURITY] = s.securityMode()
+	data[EMAIL_CONFIG_KEY_AUTH] = s.authMethod()
+	data[EMAIL_CONFIG_KEY_CA_FILE] = s.caFile
+	data[EMAIL_CONFIG_KEY_INSECURE_SKIP_VERIFY] = s.insecureSkipVerify
+	data[EMAIL_CONFIG_KEY_SUBSCRIPTIONS] = s.subscriptions
 
 	// Attention: password can't be outputted !!!
 	c.JSON(200, data)
@@ -298,48 +552,215 @@ func (s *SmtpEmailModule) showEmailInfo(c *gin.Context) {
 
 func (s *SmtpEmailModule) processEmailInfo(c *gin.Context) {
 
-	// TODO: check email address, limit the length of username/password/email. Prevent injection attack
-
-	username, ok := c.GetPostForm(EMAIL_API_KEY_USERNAME)
-	if ok {
-		s.username = username
+	// TODO: limit the length of username/password/email. Prevent injection attack
+
+	s.configLock.RLock()
+	emailConfig := &EmailConfig{
+		Username:           s.username,
+		SmtpServerAddrPort: s.smtpServerAddrPort,
+		Sender:             s.sender,
+		Receiver:           s.receiver,
+		Cc:                 s.cc,
+		WebUiUrl:           s.webUiUrl,
+		Templates:          s.customTemplates,
+		Digest:             s.digestConfig,
+		Security:           s.security,
+		Auth:               s.auth,
+		CaFile:             s.caFile,
+		InsecureSkipVerify: s.insecureSkipVerify,
+		Subscriptions:      s.subscriptions,
 	}
+	password := s.password
+	s.configLock.RUnlock()
 
-	password, ok := c.GetPostForm(EMAIL_API_KEY_PASSWORD)
-	if ok {
-		s.password = password
+	if username, ok := c.GetPostForm(EMAIL_API_KEY_USERNAME); ok {
+		emailConfig.Username = username
 	}
-
-	smtpServerAddrPort, ok := c.GetPostForm(EMAIL_API_KEY_SERVER_ADDRPORT)
-	if ok {
-		s.smtpServerAddrPort = smtpServerAddrPort
+	postPassword, hasPassword := c.GetPostForm(EMAIL_API_KEY_PASSWORD)
+	if smtpServerAddrPort, ok := c.GetPostForm(EMAIL_API_KEY_SERVER_ADDRPORT); ok {
+		emailConfig.SmtpServerAddrPort = smtpServerAddrPort
 	}
-
-	sender, ok := c.GetPostForm(EMAIL_API_KEY_SENDER)
-	if ok {
-		s.sender = sender
+	if sender, ok := c.GetPostForm(EMAIL_API_KEY_SENDER); ok {
+		emailConfig.Sender = sender
+	}
+	if receiverStr, ok := c.GetPostForm(EMAIL_API_KEY_RECEIVER); ok {
+		emailConfig.Receiver = strings.Fields(receiverStr)
+	}
+	if ccStr, ok := c.GetPostForm(EMAIL_API_KEY_CC); ok {
+		emailConfig.Cc = strings.Fields(ccStr)
+	}
+	if webUiUrl, ok := c.GetPostForm(EMAIL_API_KEY_WEBUI_URL); ok {
+		emailConfig.WebUiUrl = strings.TrimSpace(webUiUrl)
+	}
+	_, hasWindow := c.GetPostForm(EMAIL_API_KEY_DIGEST_WINDOW)
+	criticalStr, hasCritical := c.GetPostForm(EMAIL_API_KEY_CRITICAL)
+	if hasWindow || hasCritical {
+		digest := &EmailDigestConfig{}
+		if emailConfig.Digest != nil {
+			*digest = *emailConfig.Digest
+		}
+		if hasWindow {
+			window, err := strconv.Atoi(strings.TrimSpace(c.PostForm(EMAIL_API_KEY_DIGEST_WINDOW)))
+			if err != nil {
+				c.JSON(400, &MaoApi.ConfigSchemaError{Path: EMAIL_INFO_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+					{Field: EMAIL_CONFIG_KEY_DIGEST + ".window", Message: "must be an integer"},
+				}})
+				return
+			}
+			digest.Window = window
+		}
+		if hasCritical {
+			digest.Critical = strings.Fields(criticalStr)
+		}
+		emailConfig.Digest = digest
+	}
+	if security, ok := c.GetPostForm(EMAIL_API_KEY_SECURITY); ok {
+		emailConfig.Security = strings.TrimSpace(security)
+	}
+	if auth, ok := c.GetPostForm(EMAIL_API_KEY_AUTH); ok {
+		emailConfig.Auth = strings.TrimSpace(auth)
+	}
+	if caFile, ok := c.GetPostForm(EMAIL_API_KEY_CA_FILE); ok {
+		emailConfig.CaFile = strings.TrimSpace(caFile)
+	}
+	if insecureStr, ok := c.GetPostForm(EMAIL_API_KEY_INSECURE_SKIP_VERIFY); ok {
+		insecure, err := strconv.ParseBool(strings.TrimSpace(insecureStr))
+		if err != nil {
+			c.JSON(400, &MaoApi.ConfigSchemaError{Path: EMAIL_INFO_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+				{Field: EMAIL_CONFIG_KEY_INSECURE_SKIP_VERIFY, Message: "must be true or false"},
+			}})
+			return
+		}
+		emailConfig.InsecureSkipVerify = insecure
+	}
+	if subscriptionsStr, ok := c.GetPostForm(EMAIL_API_KEY_SUBSCRIPTIONS); ok {
+		subscriptions := make([]*EmailSubscription, 0)
+		if strings.TrimSpace(subscriptionsStr) != "" {
+			if err := json.Unmarshal([]byte(subscriptionsStr), &subscriptions); err != nil {
+				c.JSON(400, &MaoApi.ConfigSchemaError{Path: EMAIL_INFO_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+					{Field: EMAIL_CONFIG_KEY_SUBSCRIPTIONS, Message: "must be a JSON list, " + err.Error()},
+				}})
+				return
+			}
+		}
+		for i, sub := range subscriptions {
+			if sub == nil {
+				continue // rejected by the schema
+			}
+			if field, err := sub.check(); err != nil {
+				c.JSON(400, &MaoApi.ConfigSchemaError{Path: EMAIL_INFO_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+					{Field: fmt.Sprintf("%s[%d].%s", EMAIL_CONFIG_KEY_SUBSCRIPTIONS, i, field), Message: err.Error()},
+				}})
+				return
+			}
+		}
+		emailConfig.Subscriptions = subscriptions
+	}
+	if emailConfig.CaFile != "" {
+		if _, err := loadCaFile(emailConfig.CaFile); err != nil {
+			c.JSON(400, &MaoApi.ConfigSchemaError{Path: EMAIL_INFO_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+				{Field: EMAIL_CONFIG_KEY_CA_FILE, Message: err.Error()},
+			}})
+			return
+		}
 	}
 
-	receiverStr, ok := c.GetPostForm(EMAIL_API_KEY_RECEIVER)
-	if ok {
-		receivers := strings.Fields(receiverStr)
-		s.receiver = receivers
+	// the password is only written if it is posted and the auth needs it, writing it fails until the sec key is set.
+	putPassword := hasPassword && postPassword != "" && emailConfig.Auth != EMAIL_AUTH_NONE
+	if putPassword {
+		password = postPassword
 	}
 
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance, can't save email info")
 	} else {
+		// the invalid fields are shown, and nothing is changed.
+		if err := configModule.ValidateConfig(EMAIL_INFO_CONFIG_PATH_ROOT, emailConfig); err != nil {
+			c.JSON(400, err)
+			return
+		}
+
 		data := make(map[string]interface{})
-		data[EMAIL_CONFIG_KEY_USERNAME] = s.username
-		data[EMAIL_CONFIG_KEY_SERVER_ADDRPORT] = s.smtpServerAddrPort
-		data[EMAIL_CONFIG_KEY_SENDER] = s.sender
-		data[EMAIL_CONFIG_KEY_RECEIVER] = s.receiver
+		data[EMAIL_CONFIG_KEY_USERNAME] = emailConfig.Username
+		data[EMAIL_CONFIG_KEY_SERVER_ADDRPORT] = emailConfig.SmtpServerAddrPort
+		data[EMAIL_CONFIG_KEY_SENDER] = emailConfig.Sender
+		data[EMAIL_CONFIG_KEY_RECEIVER] = emailConfig.Receiver
+		if len(emailConfig.Cc) > 0 {
+			data[EMAIL_CONFIG_KEY_CC] = emailConfig.Cc
+		}
+		if emailConfig.WebUiUrl != "" {
+			data[EMAIL_CONFIG_KEY_WEBUI_URL] = emailConfig.WebUiUrl
+		}
+		if len(emailConfig.Templates) > 0 {
+			data[EMAIL_CONFIG_KEY_TEMPLATES] = emailConfig.Templates
+		}
+		if emailConfig.Digest != nil {
+			data[EMAIL_CONFIG_KEY_DIGEST] = emailConfig.Digest
+		}
+		if emailConfig.Security != "" {
+			data[EMAIL_CONFIG_KEY_SECURITY] = emailConfig.Security
+		}
+		if emailConfig.Auth != "" {
+			data[EMAIL_CONFIG_KEY_AUTH] = emailConfig.Auth
+		}
+		if emailConfig.CaFile != "" {
+			data[EMAIL_CONFIG_KEY_CA_FILE] = emailConfig.CaFile
+		}
+		if emailConfig.InsecureSkipVerify {
+			data[EMAIL_CONFIG_KEY_INSECURE_SKIP_VERIFY] = true
+		}
+		if len(emailConfig.Subscriptions) > 0 {
+			data[EMAIL_CONFIG_KEY_SUBSCRIPTIONS] = emailConfig.Subscriptions
+		}
 
 		// Attention: password can't be outputted !!!
-		configModule.PutConfig(EMAIL_INFO_CONFIG_PATH_ROOT, data)
-		configModule.PutSecConfig(EMAIL_INFO_CONFIG_PATH_PASSWORD, s.password)
+		// the put of the root removes the password, it is put again after that. If either fails, nothing is changed.
+		actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+		oldData, _ := configModule.GetConfig(EMAIL_INFO_CONFIG_PATH_ROOT)
+		if !putPassword {
+			// the stored password is kept as it is, it can be saved without the sec key.
+			if oldMap, ok := oldData.(map[string]interface{}); ok {
+				name := path.Base(EMAIL_INFO_CONFIG_PATH_PASSWORD)
+				for _, suffix := range []string{Config.ENC_DEC_SUFFIX_CIPHER, Config.ENC_DEC_SUFFIX_IV, Config.ENC_DEC_SUFFIX_ALGORITHM} {
+					if value, exist := oldMap[name+suffix]; exist {
+						data[name+suffix] = value
+					}
+				}
+			}
+		}
+		if _, errCode := configModule.PutConfigBy(actor, EMAIL_INFO_CONFIG_PATH_ROOT, data); errCode != Config.ERR_CODE_SUCCESS {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save email info, errCode: %d", errCode)
+			c.String(500, "fail to save email info, errCode: %d", errCode)
+			return
+		}
+		if putPassword {
+			if _, errCode := configModule.PutSecConfigBy(actor, EMAIL_INFO_CONFIG_PATH_PASSWORD, password); errCode != Config.ERR_CODE_SUCCESS {
+				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save email password, errCode: %d", errCode)
+				if _, restoreErrCode := configModule.PutConfigBy(actor, EMAIL_INFO_CONFIG_PATH_ROOT, oldData); restoreErrCode != Config.ERR_CODE_SUCCESS {
+					util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to restore email info, errCode: %d", restoreErrCode)
+				}
+				c.String(500, "fail to save email password, errCode: %d", errCode)
+				return
+			}
+		}
 	}
 
+	s.configLock.Lock()
+	s.username = emailConfig.Username
+	s.password = password
+	s.smtpServerAddrPort = emailConfig.SmtpServerAddrPort
+	s.sender = emailConfig.Sender
+	s.receiver = emailConfig.Receiver
+	s.cc = emailConfig.Cc
+	s.webUiUrl = emailConfig.WebUiUrl
+	s.security = emailConfig.Security
+	s.auth = emailConfig.Auth
+	s.caFile = emailConfig.CaFile
+	s.insecureSkipVerify = emailConfig.InsecureSkipVerify
+	s.subscriptions = emailConfig.Subscriptions
+	s.digestConfig = emailConfig.Digest // applied by sendEmailLoop on the config update.
+	s.configLock.Unlock()
+
 	s.showEmailPage(c)
 }
\ No newline at end of file
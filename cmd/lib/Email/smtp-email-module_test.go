@@ -1,12 +1,116 @@
 package Email
 
 import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"github.com/gin-gonic/gin"
+	"html/template"
 	"log"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSmtpEmailModule_InitSmtpEmailModule(t *testing.T) {
 	var receivers []string
 
 	log.Println(len(receivers))
-}
\ No newline at end of file
+}
+
+func TestSmtpEmailModule_ProcessEmailInfoSaveFail(t *testing.T) {
+	configModule := &Config.ConfigYamlModule{}
+	if !configModule.InitConfigModule(filepath.Join(t.TempDir(), "mao-config.yaml")) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+	MaoCommon.RegisterService(MaoApi.ConfigModuleRegisterName, configModule)
+	defer MaoCommon.RegisterService(MaoApi.ConfigModuleRegisterName, nil)
+	configModule.PutConfig(EMAIL_INFO_CONFIG_PATH_ROOT+"/"+EMAIL_CONFIG_KEY_SENDER, "old@example.com")
+
+	// no sec key, the password can't be saved.
+	s := &SmtpEmailModule{sender: "old@example.com"}
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	form := url.Values{EMAIL_API_KEY_SENDER: {"new@example.com"}, EMAIL_API_KEY_PASSWORD: {"secret"}}
+	c.Request = httptest.NewRequest("POST", "/api/addEmailInfo", strings.NewReader(form.Encode()))
+	c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s.processEmailInfo(c)
+
+	if recorder.Code != 500 || s.sender != "old@example.com" || s.password != "" {
+		t.Errorf("expect the failure replied and nothing changed, %d, %+v", recorder.Code, s)
+	}
+	if sender, _ := configModule.GetConfig(EMAIL_INFO_CONFIG_PATH_ROOT + "/" + EMAIL_CONFIG_KEY_SENDER); sender != "old@example.com" {
+		t.Errorf("expect the config restored, got %v", sender)
+	}
+}
+
+func TestSmtpEmailModule_ProcessEmailInfoWithoutPassword(t *testing.T) {
+	configModule := &Config.ConfigYamlModule{}
+	if !configModule.InitConfigModule(filepath.Join(t.TempDir(), "mao-config.yaml")) {
+		t.Fatal("fail to init config module")
+	}
+	defer configModule.Shutdown()
+	MaoCommon.RegisterService(MaoApi.ConfigModuleRegisterName, configModule)
+	defer MaoCommon.RegisterService(MaoApi.ConfigModuleRegisterName, nil)
+
+	post := func(s *SmtpEmailModule, form url.Values) int {
+		recorder := httptest.NewRecorder()
+		c, engine := gin.CreateTestContext(recorder)
+		engine.SetHTMLTemplate(template.Must(template.New("index-email.html").Parse("")))
+		c.Request = httptest.NewRequest("POST", "/api/addEmailInfo", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		s.processEmailInfo(c)
+		return recorder.Code
+	}
+
+	// no sec key, the settings without a password can be saved.
+	s := &SmtpEmailModule{}
+	code := post(s, url.Values{EMAIL_API_KEY_SENDER: {"mao@example.com"}, EMAIL_API_KEY_SERVER_ADDRPORT: {"smtp.example.com:25"},
+		EMAIL_API_KEY_AUTH: {EMAIL_AUTH_NONE}, EMAIL_API_KEY_PASSWORD: {""}})
+	if code != 200 || s.sender != "mao@example.com" {
+		t.Errorf("expect the settings saved without the sec key, %d, %+v", code, s)
+	}
+
+	// the stored password is kept if none is posted.
+	t.Setenv(Config.CONFIG_SEC_KEY_ENV, "mao-key")
+	if err := configModule.LoadSecKey(""); err != nil {
+		t.Fatal(err)
+	}
+	configModule.PutSecConfig(EMAIL_INFO_CONFIG_PATH_PASSWORD, "secret")
+	s = &SmtpEmailModule{password: "secret"}
+	if code = post(s, url.Values{EMAIL_API_KEY_SENDER: {"new@example.com"}, EMAIL_API_KEY_SERVER_ADDRPORT: {"smtp.example.com:25"}}); code != 200 {
+		t.Errorf("expect the settings saved, got %d", code)
+	}
+	if password, _ := configModule.GetSecConfig(EMAIL_INFO_CONFIG_PATH_PASSWORD); password != "secret" || s.password != "secret" {
+		t.Errorf("expect the stored password kept, %v", password)
+	}
+}
+
+type recordingOutbox struct {
+	summaries []string
+}
+
+func (o *recordingOutbox) RegisterChannel(channel string, interval time.Duration, deliver MaoApi.NotificationDeliverFunc) {}
+func (o *recordingOutbox) Enqueue(channel string, summary string, message interface{}) (string, error) {
+	o.summaries = append(o.summaries, summary)
+	return summary, nil
+}
+
+func TestSmtpEmailModule_FlushBeforeConfigured(t *testing.T) {
+	outbox := &recordingOutbox{}
+	MaoCommon.RegisterService(MaoApi.OutboxModuleRegisterName, outbox)
+	defer MaoCommon.RegisterService(MaoApi.OutboxModuleRegisterName, nil)
+
+	// the emails are kept in the outbox, and sent after the email info is configured.
+	s := &SmtpEmailModule{sendEmailChannel: make(chan *MaoApi.EmailMessage, 2)}
+	s.SendEmail(&MaoApi.EmailMessage{Subject: "first"})
+	s.SendEmail(&MaoApi.EmailMessage{Subject: "second"})
+	s.flushPendingEmails()
+	if strings.Join(outbox.summaries, ",") != "first,second" {
+		t.Errorf("expect the emails saved to the outbox, %v", outbox.summaries)
+	}
+}
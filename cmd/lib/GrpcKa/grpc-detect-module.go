@@ -14,32 +14,45 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	MODULE_NAME = "GRPC-Detect-module"
 
-	URL_GRPC_SHOW_ALL_SERVICE = "/showAllGrpcService"
+	URL_GRPC_SHOW_ALL_SERVICE     = "/showAllGrpcService"
 	URL_GRPC_SHOW_OFFLINE_SERVICE = "/showOfflineGrpcService"
-	URL_GRPC_DEL_SERVICE = "/delGrpcService"
+	URL_GRPC_DEL_SERVICE          = "/delGrpcService"
+	URL_WEBUI_DASHBOARD           = "/v1/Dashboard" // the servers reporting by gRPC are shown on it
+
+	// the report streams of clients never end by themselves, so they are closed forcibly after it.
+	GRACEFUL_STOP_TIMEOUT = 3 * time.Second
 )
 
 type GrpcDetectModule struct {
-	serverInfo sync.Map
-	mergeChannel chan *MaoApi.GrpcServiceNode
+	serverInfo      sync.Map
+	mergeChannel    chan *MaoApi.GrpcServiceNode
 	rttMergeChannel chan *MaoApi.GrpcServiceNode
 
 	server *grpc.Server
 	pb.UnimplementedMaoServerDiscoveryServer
 
-	checkInterval uint32 // milliseconds
-	leaveTimeout uint32 // milliseconds
+	listenAddr string
+	serving    atomic.Bool // the listener is bound and being served
+
+	needShutdown bool
+	exited       chan struct{} // closed when controlLoop exits
+	startedAt    time.Time
+	startChecked bool // the services known before the start are checked. Only used in controlLoop.
+
+	checkInterval          uint32 // milliseconds
+	leaveTimeout           uint32 // milliseconds
 	refreshShowingInterval uint32 // milliseconds
 
 	// used for web showing, i.e. external get operation
 	// used for processing aux data
-	serverInfoMirror  []*MaoApi.GrpcServiceNode
+	serverInfoMirror []*MaoApi.GrpcServiceNode
 }
 
 // implement pb.UnimplementedMaoServerDiscoveryServer
@@ -86,7 +99,7 @@ func (g *GrpcDetectModule) dealRecv(reportStream pb.MaoServerDiscovery_ReportSer
 				Hostname:       report.GetHostname(),
 				Ips:            report.GetIps(),
 				ServerDateTime: report.GetNowDatetime(),
-				OtherData:		report.GetAuxData(),
+				OtherData:      report.GetAuxData(),
 				RealClientAddr: clientAddr,
 				LocalLastSeen:  time.Now(),
 				Alive:          true,
@@ -96,7 +109,6 @@ func (g *GrpcDetectModule) dealRecv(reportStream pb.MaoServerDiscovery_ReportSer
 	}
 }
 
-
 func (g *GrpcDetectModule) RttMeasure(rttMeasureStream pb.MaoServerDiscovery_RttMeasureServer) error {
 	util.MaoLogM(util.DEBUG, MODULE_NAME, "Triggered new RTT measure session")
 	ctx := rttMeasureStream.Context()
@@ -151,13 +163,35 @@ func (g *GrpcDetectModule) runGrpcServer(listener net.Listener) {
 	if err := g.server.Serve(listener); err != nil {
 		util.MaoLogM(util.ERROR, MODULE_NAME, "%s", err)
 	}
+	g.serving.Store(false)
 	util.MaoLogM(util.INFO, MODULE_NAME, "Serve over")
 }
 
-
-
+// Shutdown stops accepting new reports, and closes the existing streams after GRACEFUL_STOP_TIMEOUT.
+// The aliveness checking is stopped first, so no DOWN notification is sent for the services disconnected by us.
+func (g *GrpcDetectModule) Shutdown() {
+	g.needShutdown = true
+	<-g.exited
+
+	stopped := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(GRACEFUL_STOP_TIMEOUT):
+		util.MaoLogM(util.WARN, MODULE_NAME, "Graceful stop timeout, close the remaining report streams.")
+		g.server.Stop()
+		<-stopped
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+}
 
 func (g *GrpcDetectModule) controlLoop() {
+	defer close(g.exited)
+
 	checkTimer := time.NewTimer(time.Duration(g.checkInterval) * time.Millisecond)
 	for {
 		select {
@@ -172,16 +206,7 @@ func (g *GrpcDetectModule) controlLoop() {
 			if ok && value != nil {
 				server := value.(*MaoApi.GrpcServiceNode)
 				if !server.Alive && serverNode.Alive {
-					emailModule := MaoCommon.ServiceRegistryGetEmailModule()
-					if emailModule == nil {
-						util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get EmailModule, can't send UP notification")
-					} else {
-						emailModule.SendEmail(&MaoApi.EmailMessage{
-							Subject: "Grpc UP notification",
-							Content: fmt.Sprintf("Service: %s\r\nUp Time: %s\r\nDetail: %v\r\n",
-								serverNode.Hostname, time.Now().String(), serverNode),
-						})
-					}
+					MaoCommon.NotifyServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_UP, serverNode, server.LocalLastSeen))
 				}
 				server.ReportTimes = serverNode.ReportTimes
 				server.Hostname = serverNode.Hostname
@@ -195,34 +220,83 @@ func (g *GrpcDetectModule) controlLoop() {
 				// Attention, serverNode instance is not created always. 2023.07.24
 				// TODO: other place may need to be check.
 				g.serverInfo.Store(serverNode.Hostname, serverNode)
+				// the first report since the server starts, there is no UP notification, but the availability starts.
+				if reportModule := MaoCommon.ServiceRegistryGetReportModule(); reportModule != nil && serverNode.Alive {
+					reportModule.RecordServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_UP, serverNode, time.Time{}))
+				}
 			}
 		case <-checkTimer.C:
+			if g.needShutdown {
+				return
+			}
+
 			// aliveness checking
 			g.serverInfo.Range(func(key, value interface{}) bool {
 				service := value.(*MaoApi.GrpcServiceNode)
-				if service.Alive && time.Since(service.LocalLastSeen) > time.Duration(g.leaveTimeout) * time.Millisecond {
+				if service.Alive && time.Since(service.LocalLastSeen) > time.Duration(g.leaveTimeout)*time.Millisecond {
 					service.Alive = false
 					g.mergeChannel <- service
 
-					emailModule := MaoCommon.ServiceRegistryGetEmailModule()
-					if emailModule == nil {
-						util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get EmailModule, can't send DOWN notification")
-					} else {
-						emailModule.SendEmail(&MaoApi.EmailMessage{
-							Subject: "Grpc DOWN notification",
-							Content: fmt.Sprintf("Service: %s\r\nDOWN Time: %s\r\nDetail: %v\r\n",
-								service.Hostname, time.Now().String(), service),
-						})
-					}
+					MaoCommon.NotifyServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_DOWN, service, service.LocalLastSeen))
 				}
 				return true
 			})
+			if !g.startChecked && time.Since(g.startedAt) > time.Duration(g.leaveTimeout)*time.Millisecond {
+				g.startChecked = true
+				g.checkKnownServices()
+			}
 			checkTimer.Reset(time.Duration(g.checkInterval) * time.Millisecond)
 		}
 	}
 }
 
+// checkKnownServices records DOWN for the services known before the start, which don't report in the leave timeout since the start.
+// They have no transition otherwise and are missing from the availability. There is no notification.
+func (g *GrpcDetectModule) checkKnownServices() {
+	reportModule := MaoCommon.ServiceRegistryGetReportModule()
+	if reportModule == nil {
+		return
+	}
+	now := time.Now()
+	for _, last := range reportModule.GetLastServiceEvents(MaoApi.SOURCE_GRPC) {
+		if _, ok := g.serverInfo.Load(last.Key); ok {
+			continue // reported since the start
+		}
+		event := *last
+		event.Type = MaoApi.EMAIL_EVENT_DOWN
+		event.Timestamp = now
+		event.LastSeen = g.startedAt
+		event.Downtime = now.Sub(g.startedAt)
+		event.Page = URL_WEBUI_DASHBOARD
+		reportModule.RecordServiceEvent(&event)
+	}
+}
 
+// newEmailServiceEvent is the context of the email, lastSeen is the time the server reported before the event.
+func newEmailServiceEvent(eventType string, server *MaoApi.GrpcServiceNode, lastSeen time.Time) *MaoApi.EmailServiceEvent {
+	now := time.Now()
+	if lastSeen.Unix() <= 0 {
+		lastSeen = time.Time{} // never reported, e.g. the first report since the server starts.
+	}
+	event := &MaoApi.EmailServiceEvent{
+		Type:        eventType,
+		Source:      "gRPC",
+		ServiceName: server.Hostname,
+		Address:     strings.Join(server.Ips, ", "),
+		Key:         server.Hostname,
+		Rtt:         server.RttDuration,
+		Timestamp:   now,
+		LastSeen:    lastSeen,
+		Page:        URL_WEBUI_DASHBOARD,
+	}
+	if event.Address == "" {
+		event.Address = server.RealClientAddr
+	}
+	if !lastSeen.IsZero() {
+		event.Downtime = now.Sub(lastSeen)
+	}
+	return event
+}
 
 func (g *GrpcDetectModule) refreshShowingService() {
 	for {
@@ -244,6 +318,23 @@ func (g *GrpcDetectModule) GetServiceInfo() []*MaoApi.GrpcServiceNode {
 	return servers
 }
 
+func (g *GrpcDetectModule) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: fmt.Sprintf("listening on %s", g.listenAddr),
+		Metrics: map[string]int64{
+			"services":           int64(len(g.GetServiceInfo())),
+			"mergeQueueDepth":    int64(len(g.mergeChannel)),
+			"rttMergeQueueDepth": int64(len(g.rttMergeChannel)),
+		},
+	}
+	if !g.serving.Load() {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("listener %s is not served", g.listenAddr)
+	}
+	return health
+}
 
 func (g *GrpcDetectModule) showAllServices(c *gin.Context) {
 	c.JSON(200, g.GetServiceInfo())
@@ -263,6 +354,11 @@ func (g *GrpcDetectModule) processDelService(c *gin.Context) {
 		serviceNameList := strings.Fields(serviceNames)
 		for _, s := range serviceNameList {
 			g.serverInfo.Delete(s)
+			if reportModule := MaoCommon.ServiceRegistryGetReportModule(); reportModule != nil {
+				reportModule.RecordServiceEvent(&MaoApi.EmailServiceEvent{
+					Type: MaoApi.SERVICE_EVENT_REMOVED, Source: MaoApi.SOURCE_GRPC, ServiceName: s, Key: s, Timestamp: time.Now(),
+				})
+			}
 		}
 	}
 	c.String(200, "success")
@@ -274,33 +370,53 @@ func (g *GrpcDetectModule) configRestControlInterface() {
 		return
 	}
 
-	restfulServer.RegisterGetApi(URL_GRPC_SHOW_ALL_SERVICE, g.showAllServices)
-	restfulServer.RegisterGetApi(URL_GRPC_SHOW_OFFLINE_SERVICE, g.showOfflineServices)
-	restfulServer.RegisterPostApi(URL_GRPC_DEL_SERVICE, g.processDelService)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_GRPC_SHOW_ALL_SERVICE, &MaoApi.ApiDoc{
+		Summary:  "List all gRPC services, alive or not",
+		Tag:      MODULE_NAME,
+		Response: []*MaoApi.GrpcServiceNode{},
+	}, g.showAllServices)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_GRPC_SHOW_OFFLINE_SERVICE, &MaoApi.ApiDoc{
+		Summary:  "List the offline gRPC services",
+		Tag:      MODULE_NAME,
+		Response: []*MaoApi.GrpcServiceNode{},
+	}, g.showOfflineServices)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_OPERATOR, URL_GRPC_DEL_SERVICE, &MaoApi.ApiDoc{
+		Summary: "Delete gRPC services",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: "serviceNames", In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "hostnames separated by whitespace"},
+		},
+		Response: "success",
+	}, g.processDelService)
 }
 
-
 func (g *GrpcDetectModule) InitGrpcModule(addrPort string) bool {
 	g.mergeChannel = make(chan *MaoApi.GrpcServiceNode, 1024)
 	g.rttMergeChannel = make(chan *MaoApi.GrpcServiceNode, 1024)
+	g.needShutdown = false
+	g.exited = make(chan struct{})
+	g.startedAt = time.Now()
+	g.startChecked = false
 
 	g.checkInterval = 500
 	g.leaveTimeout = 5000
 	g.refreshShowingInterval = 1000
 	g.serverInfoMirror = make([]*MaoApi.GrpcServiceNode, 0)
 
-
 	listener, err := net.Listen("tcp", addrPort)
 	if err != nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to create listener at %s, err: %s", addrPort, err.Error())
 		return false
 	}
 
+	g.listenAddr = listener.Addr().String()
+	g.serving.Store(true)
+
 	g.server = grpc.NewServer()
 	pb.RegisterMaoServerDiscoveryServer(g.server, g)
 	go g.runGrpcServer(listener)
 
-
 	go g.controlLoop()
 	go g.refreshShowingService()
 
@@ -308,4 +424,3 @@ func (g *GrpcDetectModule) InitGrpcModule(addrPort string) bool {
 
 	return true
 }
-
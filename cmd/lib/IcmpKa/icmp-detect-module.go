@@ -14,13 +14,14 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	//addServiceChan *chan string
-	//delServiceChan *chan string
-	//serviceMirror  []*MaoIcmpService
+// addServiceChan *chan string
+// delServiceChan *chan string
+// serviceMirror  []*MaoIcmpService
 )
 
 const (
@@ -31,9 +32,7 @@ const (
 	URL_CONFIG_DEL_SERVICE_IP  = "/delServiceIp"
 	URL_CONFIG_SHOW_SERVICE_IP = "/showServiceIP"
 
-
-
-	ICMP_API_KEY_ADDRESS = "ipv4v6"
+	ICMP_API_KEY_ADDRESS      = "ipv4v6"
 	ICMP_API_KEY_SERVICE_NAME = "serviceName"
 
 	PROTO_ICMP    = 1
@@ -43,21 +42,29 @@ const (
 	ICMP_V6_DETECT_ID = 0x1996
 
 	SERVICE_LIST_CONFIG_PATH = "/icmp-ka/services"
+
+	// the socket is considered broken after so many consecutive receive failures.
+	RECV_FAILURE_THRESHOLD = 10
 )
 
 type IcmpDetectModule struct {
-	connV4       *icmp.PacketConn
-	connV6       *icmp.PacketConn
-	serviceStore sync.Map // address_string -> Service object
+	connV4         *icmp.PacketConn
+	connV6         *icmp.PacketConn
+	recvFailuresV4 atomic.Int64 // consecutive receive failures, for health check
+	recvFailuresV6 atomic.Int64
+	serviceStore   sync.Map // address_string -> Service object
 
 	AddChan chan *MaoApi.MaoIcmpServiceIdentifier // need to be initiated when constructing
-	DelChan chan string // need to be initiated when constructing
+	DelChan chan string                           // need to be initiated when constructing
+
+	configSubscription <-chan *MaoApi.ConfigChangeEvent // the service list in config is changed, e.g. by REST, a rollback or the config file
+	waitingFirstReply  map[string]time.Time             // address -> the time it is added, for the services never seen. Only used in controlLoop.
 
 	// TODO - MAKE IT CONFIGURABLE
 	// configurable parameter
-	sendInterval uint32 // milliseconds
-	checkInterval uint32 // milliseconds
-	leaveTimeout uint32 // milliseconds
+	sendInterval           uint32 // milliseconds
+	checkInterval          uint32 // milliseconds
+	leaveTimeout           uint32 // milliseconds
 	refreshShowingInterval uint32 //
 
 	// TODO - MAKE IT CONFIGURABLE
@@ -66,11 +73,27 @@ type IcmpDetectModule struct {
 
 	// only for web showing, i.e. external get operation
 	serviceMirror []*MaoApi.MaoIcmpService
+
+	needShutdown bool
+	exited       chan struct{} // closed when controlLoop exits
+}
+
+// Shutdown saves the pending added/deleted services to config, then stops detecting.
+func (m *IcmpDetectModule) Shutdown() {
+	m.needShutdown = true
+	<-m.exited
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil && m.configSubscription != nil {
+		configModule.Unsubscribe(m.configSubscription)
+	}
+
+	m.connV4.Close()
+	m.connV6.Close()
+	util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 }
 
 func (m *IcmpDetectModule) sendIcmpLoop() {
 	round := 1
-	for {
+	for !m.needShutdown {
 		util.MaoLogM(util.DEBUG, MODULE_NAME, "Detect Round %d", round)
 		m.serviceStore.Range(func(_, value interface{}) bool {
 			service := value.(*MaoApi.MaoIcmpService)
@@ -94,7 +117,6 @@ func (m *IcmpDetectModule) sendIcmpLoop() {
 				conn = m.connV4
 			}
 
-
 			// To build and send ICMP Request.
 
 			service.DetectCount++
@@ -138,15 +160,25 @@ func (m *IcmpDetectModule) sendIcmpLoop() {
  * For IPv4: PROTO_ICMP_V6, m.connV6
  */
 func (m *IcmpDetectModule) receiveProcessIcmpLoop(protoNum int, conn *icmp.PacketConn) {
+	recvFailures := &m.recvFailuresV4
+	if protoNum == PROTO_ICMP_V6 {
+		recvFailures = &m.recvFailuresV6
+	}
+
 	recvBuf := make([]byte, 2000)
 	for {
 		count, addr, err := conn.ReadFrom(recvBuf)
 		lastseen := time.Now()
 		if err != nil {
+			if m.needShutdown {
+				return
+			}
+			recvFailures.Add(1)
 			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to recv ICMP, freeze %d ms, %s", m.receiveFreezePeriod, err.Error())
 			time.Sleep(time.Duration(m.receiveFreezePeriod) * time.Millisecond)
 			continue
 		}
+		recvFailures.Store(0)
 
 		msg, err := icmp.ParseMessage(protoNum, recvBuf)
 		if err != nil {
@@ -172,6 +204,7 @@ func (m *IcmpDetectModule) receiveProcessIcmpLoop(protoNum int, conn *icmp.Packe
 		value, ok := m.serviceStore.Load(addrStr)
 		if ok && value != nil {
 			service := value.(*MaoApi.MaoIcmpService)
+			previousSeen := service.LastSeen
 			service.LastSeen = lastseen
 			service.RttDuration = service.LastSeen.Sub(service.RttOutboundTimestamp)
 			service.ReportCount++
@@ -179,109 +212,168 @@ func (m *IcmpDetectModule) receiveProcessIcmpLoop(protoNum int, conn *icmp.Packe
 			if !service.Alive {
 				service.Alive = true
 
-				emailModule := MaoCommon.ServiceRegistryGetEmailModule()
-				if emailModule == nil {
-					util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get EmailModule, can't send UP notification")
-				} else {
-					emailModule.SendEmail(&MaoApi.EmailMessage{
-						Subject: "ICMP UP notification",
-						Content: fmt.Sprintf("Service: %s - %s\r\nUP Time: %s\r\nDetail: %v\r\n",
-							service.ServiceName, service.Address, time.Now().String(), service),
-					})
-				}
-
-				
-				// TEMP: test wechat module
-				//wechatModule := MaoCommon.ServiceRegistryGetWechatModule()
-				//if wechatModule == nil {
-				//	util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get WechatModule, can't send UP notification")
-				//} else {
-				//	wechatModule.SendWechatMessage(&MaoApi.WechatMessage{
-				//		Title:       "ICMP UP notification",
-				//		ContentHttp: fmt.Sprintf("Service: %s\r\nUP Time: %s\r\nDetail: %v\r\n",
-				//			service.Address, time.Now().String(), service),
-				//		Url:         "https://www.maojianwei.com/",
-				//	})
-				//}
+				MaoCommon.NotifyServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_UP, service, previousSeen))
 			}
 		}
 	}
 }
 
+func (m *IcmpDetectModule) processAddService(addService *MaoApi.MaoIcmpServiceIdentifier) {
+	if _, ok := m.serviceStore.Load(addService.ServiceIPv4v6); !ok {
+		m.storeNewService(addService)
+		util.MaoLogM(util.DEBUG, MODULE_NAME, "Get new service %s", addService.ServiceIPv4v6)
+		m.addNewServiceToConfig(addService) // TODO: TBD,支持添加servicename
+	}
+}
+
+func (m *IcmpDetectModule) storeNewService(addService *MaoApi.MaoIcmpServiceIdentifier) {
+	m.waitingFirstReply[addService.ServiceIPv4v6] = time.Now()
+	m.serviceStore.Store(addService.ServiceIPv4v6, &MaoApi.MaoIcmpService{
+		Address:              addService.ServiceIPv4v6,
+		ServiceName:          addService.ServiceName,
+		Alive:                false,
+		LastSeen:             time.Unix(0, 0),
+		DetectCount:          0,
+		ReportCount:          0,
+		RttDuration:          0,
+		RttOutboundTimestamp: time.Time{},
+	})
+}
+
+// syncServicesFromConfig applies the changed service list in config, without writing it back.
+func (m *IcmpDetectModule) syncServicesFromConfig(event *MaoApi.ConfigChangeEvent) {
+	if event.Actor == MODULE_NAME {
+		return // written by ourselves, the store is newer than the event.
+	}
+	services := make([]*MaoApi.MaoIcmpServiceIdentifier, 0) // the list is removed
+	if event.NewValue != nil {
+		if services = parseServiceList(event.NewValue); services == nil {
+			return
+		}
+	}
+
+	configured := make(map[string]*MaoApi.MaoIcmpServiceIdentifier)
+	for _, s := range services {
+		if net.ParseIP(s.ServiceIPv4v6) == nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Skip the invalid service address in config: %s", s.ServiceIPv4v6)
+			continue
+		}
+		configured[s.ServiceIPv4v6] = s
+	}
+
+	added, removed := 0, 0
+	m.serviceStore.Range(func(key, value interface{}) bool {
+		if _, ok := configured[key.(string)]; !ok {
+			m.serviceStore.Delete(key)
+			removed++
+		}
+		return true
+	})
+	for address, s := range configured {
+		if value, ok := m.serviceStore.Load(address); ok {
+			value.(*MaoApi.MaoIcmpService).ServiceName = s.ServiceName
+			continue
+		}
+		m.storeNewService(s)
+		added++
+	}
+	if added > 0 || removed > 0 {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Services updated from config, added %d, removed %d", added, removed)
+	}
+}
+
+func (m *IcmpDetectModule) processDelService(delService string) {
+	m.serviceStore.Delete(delService)
+	util.MaoLogM(util.DEBUG, MODULE_NAME, "Del service %s", delService)
+	m.removeOldServiceFromConfig(delService) // todo: TBD,支持删除servicename
+
+	if reportModule := MaoCommon.ServiceRegistryGetReportModule(); reportModule != nil {
+		reportModule.RecordServiceEvent(&MaoApi.EmailServiceEvent{
+			Type: MaoApi.SERVICE_EVENT_REMOVED, Source: MaoApi.SOURCE_ICMP, Address: delService, Key: delService, Timestamp: time.Now(),
+		})
+	}
+
+	topoModule := MaoCommon.ServiceRegistryGetTopoModule()
+	if topoModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get TopoModule, can't send DELETE event")
+	} else {
+		topoModule.SendEvent(&MaoApi.TopoEvent{
+			EventType:   MaoApi.SERVICE_DELETE,
+			EventSource: MaoApi.SOURCE_ICMP,
+			ServiceName: delService,
+			Timestamp:   time.Now(),
+		})
+	}
+}
+
 func (m *IcmpDetectModule) controlLoop() {
+	defer close(m.exited)
+
 	checkTimer := time.NewTimer(time.Duration(m.checkInterval) * time.Millisecond)
 	for {
 		select {
 		case addService := <-m.AddChan:
-			if _, ok := m.serviceStore.Load(addService.ServiceIPv4v6); !ok {
-				m.serviceStore.Store(addService.ServiceIPv4v6, &MaoApi.MaoIcmpService{
-					Address:              addService.ServiceIPv4v6,
-					ServiceName:          addService.ServiceName,
-					Alive:                false,
-					LastSeen:             time.Unix(0, 0),
-					DetectCount:          0,
-					ReportCount:          0,
-					RttDuration:          0,
-					RttOutboundTimestamp: time.Time{},
-				})
-				util.MaoLogM(util.DEBUG, MODULE_NAME, "Get new service %s", addService.ServiceIPv4v6)
-				m.addNewServiceToConfig(addService) // TODO: TBD,支持添加servicename
-			}
+			m.processAddService(addService)
 		case delService := <-m.DelChan:
-			m.serviceStore.Delete(delService)
-			util.MaoLogM(util.DEBUG, MODULE_NAME, "Del service %s", delService)
-			m.removeOldServiceFromConfig(delService) // todo: TBD,支持删除servicename
-
-			topoModule := MaoCommon.ServiceRegistryGetTopoModule()
-			if topoModule == nil {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get TopoModule, can't send DELETE event")
-			} else {
-				topoModule.SendEvent(&MaoApi.TopoEvent{
-					EventType:   MaoApi.SERVICE_DELETE,
-					EventSource: MaoApi.SOURCE_ICMP,
-					ServiceName: delService,
-					Timestamp:   time.Now(),
-				})
+			m.processDelService(delService)
+		case event, ok := <-m.configSubscription:
+			if ok {
+				m.syncServicesFromConfig(event)
 			}
 		case <-checkTimer.C:
+			if m.needShutdown {
+				// the services are persisted by config, don't lose the pending changes.
+				for len(m.AddChan) > 0 || len(m.DelChan) > 0 {
+					select {
+					case addService := <-m.AddChan:
+						m.processAddService(addService)
+					case delService := <-m.DelChan:
+						m.processDelService(delService)
+					}
+				}
+				return
+			}
+
 			// aliveness checking
 			m.serviceStore.Range(func(key, value interface{}) bool {
 				service := value.(*MaoApi.MaoIcmpService)
-				if service.Alive && time.Since(service.LastSeen) > time.Duration(m.leaveTimeout) * time.Millisecond {
+				if service.Alive && time.Since(service.LastSeen) > time.Duration(m.leaveTimeout)*time.Millisecond {
 					service.Alive = false
 
-					emailModule := MaoCommon.ServiceRegistryGetEmailModule()
-					if emailModule == nil {
-						util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get EmailModule, can't send DOWN notification")
-					} else {
-						emailModule.SendEmail(&MaoApi.EmailMessage{
-							Subject: "ICMP DOWN notification",
-							Content: fmt.Sprintf("Service: %s - %s\r\nDOWN Time: %s\r\nDetail: %v\r\n",
-								service.ServiceName, service.Address, time.Now().String(), service),
-						})
-					}
-
-
-					// TEMP: test wechat module
-					//wechatModule := MaoCommon.ServiceRegistryGetWechatModule()
-					//if wechatModule == nil {
-					//	util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get WechatModule, can't send DOWN notification")
-					//} else {
-					//	wechatModule.SendWechatMessage(&MaoApi.WechatMessage{
-					//		Title:       "ICMP DOWN notification",
-					//		ContentHttp: fmt.Sprintf("Service: %s\r\nDOWN Time: %s\r\nDetail: %v\r\n",
-					//			service.Address, time.Now().String(), service),
-					//		Url:         "https://www.maojianwei.com/",
-					//	})
-					//}
+					MaoCommon.NotifyServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_DOWN, service, service.LastSeen))
 				}
 				return true
 			})
+			m.checkFirstReply()
 			checkTimer.Reset(time.Duration(m.checkInterval) * time.Millisecond)
 		}
 	}
 }
 
+// checkFirstReply records DOWN for the services not seen in the leave timeout since they are added,
+// they have no transition otherwise and are missing from the availability. There is no notification.
+func (m *IcmpDetectModule) checkFirstReply() {
+	for address, addedAt := range m.waitingFirstReply {
+		value, ok := m.serviceStore.Load(address)
+		if !ok {
+			delete(m.waitingFirstReply, address) // deleted
+			continue
+		}
+		service := value.(*MaoApi.MaoIcmpService)
+		if service.LastSeen.Unix() > 0 {
+			delete(m.waitingFirstReply, address) // UP
+			continue
+		}
+		if time.Since(addedAt) <= time.Duration(m.leaveTimeout)*time.Millisecond {
+			continue
+		}
+		delete(m.waitingFirstReply, address)
+		if reportModule := MaoCommon.ServiceRegistryGetReportModule(); reportModule != nil {
+			reportModule.RecordServiceEvent(newEmailServiceEvent(MaoApi.EMAIL_EVENT_DOWN, service, addedAt))
+		}
+	}
+}
+
 func (m *IcmpDetectModule) refreshShowingService() {
 	for {
 		time.Sleep(time.Duration(m.refreshShowingInterval) * time.Millisecond)
@@ -294,98 +386,45 @@ func (m *IcmpDetectModule) refreshShowingService() {
 	}
 }
 
-
-
-
 func (m *IcmpDetectModule) getServiceConfig() (serviceList []*MaoApi.MaoIcmpServiceIdentifier) {
-	// todo: TBD: 支持读取serviceName
-
+	serviceList, _ = m.readServiceConfig()
+	return serviceList
+}
 
+// readServiceConfig returns nil and the errCode if the service list can't be read, e.g. not exist or invalid.
+func (m *IcmpDetectModule) readServiceConfig() (serviceList []*MaoApi.MaoIcmpServiceIdentifier, errCode int) {
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
-		return nil
+		return nil, Config.ERR_CODE_SHUTDOWN
 	}
 
-	serviceObj, errCode := configModule.GetConfig(SERVICE_LIST_CONFIG_PATH)
-	if errCode != Config.ERR_CODE_SUCCESS {
+	serviceList = make([]*MaoApi.MaoIcmpServiceIdentifier, 0)
+	if errCode = configModule.GetConfigInto(SERVICE_LIST_CONFIG_PATH, &serviceList); errCode != Config.ERR_CODE_SUCCESS {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get current services from config, errCode: %d", errCode)
-		return nil
+		return nil, errCode
 	}
+	return serviceList, Config.ERR_CODE_SUCCESS
+}
 
-	serviceList, ok := serviceObj.([]*MaoApi.MaoIcmpServiceIdentifier)
-	if !ok {
-		// the list is read from config file
-		serviceObjList, ok := serviceObj.([]interface{})
-		if !ok {
-			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service list config, service list is not array")
-			return nil
-		}
-		serviceList = make([]*MaoApi.MaoIcmpServiceIdentifier, 0)
-		for _, s := range serviceObjList {
-			sMap, ok := s.(map[string]interface{})
-			if !ok {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service node config - map")
-				return nil
-			}
-
-			addressObj, ok := sMap[MaoApi.ICMP_CONFIG_KEY_ADDRESS]
-			if !ok {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service node config - address")
-				return nil
-			}
-			address, ok := addressObj.(string)
-			if !ok {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service node config - address is not a string")
-				return nil
-			}
-
-			serviceNameObj, ok := sMap[MaoApi.ICMP_CONFIG_KEY_SERVICE_NAME]
-			if !ok {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service node config - service name")
-				return nil
-			}
-			serviceName, ok := serviceNameObj.(string)
-			if !ok {
-				util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service node config - service name is not a string")
-				return nil
-			}
-
-			service := &MaoApi.MaoIcmpServiceIdentifier{
-				ServiceIPv4v6: address,
-				ServiceName:   serviceName,
-			}
-			serviceList = append(serviceList, service)
-		}
+// parseServiceList parses the service list in the config change event.
+func parseServiceList(serviceObj interface{}) (serviceList []*MaoApi.MaoIcmpServiceIdentifier) {
+	serviceList = make([]*MaoApi.MaoIcmpServiceIdentifier, 0)
+	if err := Config.DecodeConfig(serviceObj, &serviceList); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service list config, %s", err.Error())
+		return nil
 	}
-
 	return serviceList
-
-
-	//serviceList, ok := serviceObj.([]string)
-	//if !ok {
-	//	// the list is read from config file
-	//	serviceIntfList, ok := serviceObj.([]interface{})
-	//	if !ok {
-	//		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse serviceList config, []string and []interface{}")
-	//		return nil
-	//	}
-	//	serviceList = make([]string, 0)
-	//	for _, s := range serviceIntfList {
-	//		serviceList = append(serviceList, s.(string))
-	//	}
-	//}
-	//return serviceList
 }
 
-func (m *IcmpDetectModule) saveServiceConfig(serviceList []*MaoApi.MaoIcmpServiceIdentifier) (success bool){
+func (m *IcmpDetectModule) saveServiceConfig(serviceList []*MaoApi.MaoIcmpServiceIdentifier) (success bool) {
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
 		return false
 	}
 
-	_, errCode := configModule.PutConfig(SERVICE_LIST_CONFIG_PATH, serviceList) // TODO: 是否可以存对象？
+	_, errCode := configModule.PutConfigBy(MODULE_NAME, SERVICE_LIST_CONFIG_PATH, serviceList) // TODO: 是否可以存对象？
 	if errCode != Config.ERR_CODE_SUCCESS {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to put current services to config, errCode: %d", errCode)
 		return false
@@ -433,10 +472,13 @@ func (m *IcmpDetectModule) removeOldServiceFromConfig(serviceAddr string) (succe
 }
 
 func (m *IcmpDetectModule) initConfigPath() (success bool, serviceConfig []*MaoApi.MaoIcmpServiceIdentifier) {
-	services := m.getServiceConfig()
+	services, errCode := m.readServiceConfig()
 	if services != nil {
 		return true, services
 	}
+	if errCode != Config.ERR_CODE_PATH_NOT_EXIST && errCode != Config.ERR_CODE_PATH_TRANSIT_FAIL {
+		return false, nil // don't overwrite the invalid config, fix it by the config file or a rollback.
+	}
 
 	// the config doesn't exist, init it.
 
@@ -446,7 +488,7 @@ func (m *IcmpDetectModule) initConfigPath() (success bool, serviceConfig []*MaoA
 		return false, nil
 	}
 
-	_, errCode := configModule.PutConfig(SERVICE_LIST_CONFIG_PATH, make([]*MaoApi.MaoIcmpServiceIdentifier, 0)) // TODO-DEBUG
+	_, errCode = configModule.PutConfig(SERVICE_LIST_CONFIG_PATH, make([]*MaoApi.MaoIcmpServiceIdentifier, 0)) // TODO-DEBUG
 	if errCode != Config.ERR_CODE_SUCCESS {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to put empty string array to config, errCode: %d", errCode)
 		return false, nil
@@ -455,9 +497,6 @@ func (m *IcmpDetectModule) initConfigPath() (success bool, serviceConfig []*MaoA
 	return true, services
 }
 
-
-
-
 func (m *IcmpDetectModule) AddService(service *MaoApi.MaoIcmpServiceIdentifier) {
 	if net.ParseIP(service.ServiceIPv4v6) != nil {
 		m.AddChan <- service
@@ -470,8 +509,6 @@ func (m *IcmpDetectModule) DelService(serviceIPv4v6 string) {
 	}
 }
 
-
-
 func (m *IcmpDetectModule) InitIcmpModule() bool {
 	var err error
 	m.connV4, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
@@ -488,11 +525,15 @@ func (m *IcmpDetectModule) InitIcmpModule() bool {
 	}
 	util.MaoLogM(util.INFO, MODULE_NAME, "Listen ICMPv6 ok")
 
-
-
 	m.AddChan = make(chan *MaoApi.MaoIcmpServiceIdentifier, 50)
 	m.DelChan = make(chan string, 50)
+	m.waitingFirstReply = make(map[string]time.Time)
+	m.needShutdown = false
+	m.exited = make(chan struct{})
 
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		configModule.RegisterConfigSchema(SERVICE_LIST_CONFIG_PATH, []*MaoApi.MaoIcmpServiceIdentifier{})
+	}
 	if success, services := m.initConfigPath(); !success {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to init config.")
 	} else {
@@ -501,6 +542,9 @@ func (m *IcmpDetectModule) InitIcmpModule() bool {
 		}
 		util.MaoLogM(util.INFO, MODULE_NAME, "Services loaded from config: %d", len(services))
 	}
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		m.configSubscription = configModule.Subscribe(SERVICE_LIST_CONFIG_PATH)
+	}
 
 	// configurable parameter
 	m.sendInterval = 500
@@ -512,7 +556,6 @@ func (m *IcmpDetectModule) InitIcmpModule() bool {
 	m.receiveFreezePeriod = 10
 	m.serviceMirror = make([]*MaoApi.MaoIcmpService, 0)
 
-
 	go m.receiveProcessIcmpLoop(PROTO_ICMP, m.connV4)
 	go m.receiveProcessIcmpLoop(PROTO_ICMP_V6, m.connV6)
 	go m.sendIcmpLoop()
@@ -525,7 +568,28 @@ func (m *IcmpDetectModule) InitIcmpModule() bool {
 	return true
 }
 
-
+// newEmailServiceEvent is the context of the email, lastSeen is the time the service was seen before the event.
+func newEmailServiceEvent(eventType string, service *MaoApi.MaoIcmpService, lastSeen time.Time) *MaoApi.EmailServiceEvent {
+	now := time.Now()
+	if lastSeen.Unix() <= 0 {
+		lastSeen = time.Time{} // never seen, see storeNewService.
+	}
+	event := &MaoApi.EmailServiceEvent{
+		Type:        eventType,
+		Source:      "ICMP",
+		ServiceName: service.ServiceName,
+		Address:     service.Address,
+		Key:         service.Address,
+		Rtt:         service.RttDuration,
+		Timestamp:   now,
+		LastSeen:    lastSeen,
+		Page:        "/v1" + URL_CONFIG_HOMEPAGE,
+	}
+	if !lastSeen.IsZero() {
+		event.Downtime = now.Sub(lastSeen)
+	}
+	return event
+}
 
 func (m *IcmpDetectModule) GetServices() []*MaoApi.MaoIcmpService {
 	tmp := m.serviceMirror
@@ -535,6 +599,33 @@ func (m *IcmpDetectModule) GetServices() []*MaoApi.MaoIcmpService {
 	return tmp
 }
 
+func (m *IcmpDetectModule) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Metrics: map[string]int64{
+			"services":       int64(len(m.GetServices())),
+			"addQueueDepth":  int64(len(m.AddChan)),
+			"delQueueDepth":  int64(len(m.DelChan)),
+			"recvFailuresV4": m.recvFailuresV4.Load(),
+			"recvFailuresV6": m.recvFailuresV6.Load(),
+		},
+	}
+
+	broken := make([]string, 0)
+	if m.connV4 == nil || m.recvFailuresV4.Load() >= RECV_FAILURE_THRESHOLD {
+		broken = append(broken, "ICMPv4")
+	}
+	if m.connV6 == nil || m.recvFailuresV6.Load() >= RECV_FAILURE_THRESHOLD {
+		broken = append(broken, "ICMPv6")
+	}
+	if len(broken) > 0 {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("socket not working: %s", strings.Join(broken, ", "))
+	}
+	return health
+}
+
 func showConfigPage(c *gin.Context) {
 	c.HTML(200, "index-icmp.html", nil)
 }
@@ -543,7 +634,6 @@ func (m *IcmpDetectModule) showServiceIps(c *gin.Context) {
 	c.JSON(200, m.GetServices())
 }
 
-
 func (m *IcmpDetectModule) parseService(c *gin.Context) []*MaoApi.MaoIcmpServiceIdentifier {
 	services := make([]*MaoApi.MaoIcmpServiceIdentifier, 0)
 
@@ -619,7 +709,7 @@ func (m *IcmpDetectModule) processServiceIp(c *gin.Context) {
 			m.AddService(serviceIpName)
 		}
 	} else {
-		v4Ip, ok := c.GetPostForm("ipv4v6")
+		v4Ip, ok := c.GetPostForm(ICMP_API_KEY_ADDRESS)
 		if ok {
 			v4IpArr := strings.Fields(v4Ip)
 			for _, s := range v4IpArr {
@@ -631,7 +721,6 @@ func (m *IcmpDetectModule) processServiceIp(c *gin.Context) {
 	showConfigPage(c)
 }
 
-
 func (m *IcmpDetectModule) configRestControlInterface() {
 	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
 	if restfulServer == nil {
@@ -640,8 +729,31 @@ func (m *IcmpDetectModule) configRestControlInterface() {
 	}
 
 	restfulServer.RegisterUiPage(URL_CONFIG_HOMEPAGE, showConfigPage)
-	restfulServer.RegisterGetApi(URL_CONFIG_SHOW_SERVICE_IP, m.showServiceIps)
-
-	restfulServer.RegisterPostApi(URL_CONFIG_ADD_SERVICE_IP, m.processServiceIp)
-	restfulServer.RegisterPostApi(URL_CONFIG_DEL_SERVICE_IP, m.processServiceIp)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_CONFIG_SHOW_SERVICE_IP, &MaoApi.ApiDoc{
+		Summary:  "List all ICMP services",
+		Tag:      MODULE_NAME,
+		Response: []*MaoApi.MaoIcmpService{},
+	}, m.showServiceIps)
+
+	type serviceIpName struct {
+		Address     string `json:"address"`
+		ServiceName string `json:"serviceName"`
+	}
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_OPERATOR, URL_CONFIG_ADD_SERVICE_IP, &MaoApi.ApiDoc{
+		Summary:     "Add ICMP services",
+		Description: "Replies the ICMP config page.",
+		Tag:         MODULE_NAME,
+		RequestBody: &struct {
+			ServiceIpName []*serviceIpName `json:"serviceIpName"`
+		}{},
+	}, m.processServiceIp)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_OPERATOR, URL_CONFIG_DEL_SERVICE_IP, &MaoApi.ApiDoc{
+		Summary:     "Delete ICMP services",
+		Description: "Replies the ICMP config page.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: ICMP_API_KEY_ADDRESS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "IPv4/IPv6 addresses separated by whitespace"},
+		},
+	}, m.processServiceIp)
 }
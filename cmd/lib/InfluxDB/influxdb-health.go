@@ -0,0 +1,47 @@
+package InfluxDB
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"time"
+)
+
+const (
+	HEALTH_CHECK_TIMEOUT = 3 * time.Second
+)
+
+// InfluxdbHealthChecker reports the reachability of the configured InfluxDB.
+type InfluxdbHealthChecker struct{}
+
+func (i *InfluxdbHealthChecker) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: config_influxdbUrl,
+	}
+	if config_influxdbUrl == "" {
+		health.Status = MaoApi.HEALTH_STATUS_DISABLED
+		health.Detail = "InfluxDB is not configured"
+		return health
+	}
+
+	client := influxdb2.NewClient(config_influxdbUrl, config_influxdbToken)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	result, err := client.Health(ctx)
+	if err != nil {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("fail to reach %s, %s", config_influxdbUrl, err.Error())
+		return health
+	}
+	if result.Status != domain.HealthCheckStatusPass {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("%s reports %s", config_influxdbUrl, result.Status)
+	}
+	return health
+}
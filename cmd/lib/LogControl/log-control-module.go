@@ -0,0 +1,152 @@
+package LogControl
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const (
+	MODULE_NAME = "Log-Control-module"
+
+	URL_LOGS_HOMEPAGE   = "/Logs"
+	URL_LOG_LEVELS_SHOW = "/showLogLevels"
+	URL_LOG_LEVEL_SET   = "/setLogLevel"
+	URL_RECENT_LOGS     = "/showRecentLogs"
+
+	LOG_API_KEY_MODULE = "module"
+	LOG_API_KEY_LEVEL  = "level"
+	LOG_API_KEY_LIMIT  = "limit"
+
+	DEFAULT_RECENT_LOGS_LIMIT = 200
+)
+
+type LogLevels struct {
+	Global  string            `json:"global"`
+	Modules map[string]string `json:"modules"`
+}
+
+// LogControlModule changes the log levels at runtime, and shows the recent logs kept by util.
+type LogControlModule struct {
+}
+
+func (l *LogControlModule) InitLogControlModule() bool {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return false
+	}
+
+	restfulServer.RegisterUiPage(URL_LOGS_HOMEPAGE, l.showLogsPage)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_LOG_LEVELS_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the global min log level and the overrides of the modules",
+		Tag:      MODULE_NAME,
+		Response: &LogLevels{},
+	}, l.showLogLevels)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_LOG_LEVEL_SET, &MaoApi.ApiDoc{
+		Summary:     "Change the min log level at runtime",
+		Description: "Not saved, the log parameters are applied again after the server restarts. Replies the logs page.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: LOG_API_KEY_MODULE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "the module name, e.g. Email-module. Empty for the global level"},
+			{Name: LOG_API_KEY_LEVEL, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "DEBUG, HOT_DEBUG, INFO, WARN, ERROR or SILENT. Empty to make the module follow the global level"},
+		},
+	}, l.processSetLogLevel)
+	// admin only, the logs may contain something sensitive, e.g. the bootstrap password.
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_ADMIN, URL_RECENT_LOGS, &MaoApi.ApiDoc{
+		Summary: "Show the recent logs, from old to new",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: LOG_API_KEY_MODULE, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "only the logs of the module"},
+			{Name: LOG_API_KEY_LEVEL, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "the min level, e.g. WARN"},
+			{Name: LOG_API_KEY_LIMIT, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_INTEGER,
+				Description: fmt.Sprintf("the newest logs at most, default %d, 0 for all", DEFAULT_RECENT_LOGS_LIMIT)},
+		},
+		Response: []*util.MaoLogEntry{},
+	}, l.showRecentLogs)
+
+	return true
+}
+
+func (l *LogControlModule) showLogsPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "index-logs.html", nil)
+}
+
+func (l *LogControlModule) showLogLevels(c *gin.Context) {
+	global, modules := util.GetMaoLogLevels()
+	levels := &LogLevels{
+		Global:  global.String(),
+		Modules: make(map[string]string, len(modules)),
+	}
+	for m, level := range modules {
+		levels.Modules[m] = level.String()
+	}
+	c.JSON(http.StatusOK, levels)
+}
+
+func (l *LogControlModule) processSetLogLevel(c *gin.Context) {
+	module := c.PostForm(LOG_API_KEY_MODULE)
+	levelStr := c.PostForm(LOG_API_KEY_LEVEL)
+
+	var level util.MaoLogLevel
+	if levelStr != "" {
+		var ok bool
+		if level, ok = util.ParseMaoLogLevel(levelStr); !ok {
+			c.String(http.StatusBadRequest, "%s is invalid: %s", LOG_API_KEY_LEVEL, levelStr)
+			return
+		}
+	} else if module == "" {
+		c.String(http.StatusBadRequest, "%s is required for the global level", LOG_API_KEY_LEVEL)
+		return
+	}
+
+	target := module
+	switch {
+	case module == "":
+		target = "global"
+		util.SetMaoLogLevel(level)
+	case levelStr == "":
+		util.ClearMaoLogModuleLevel(module)
+	default:
+		util.SetMaoLogModuleLevel(module, level)
+	}
+
+	detail := "follow the global level"
+	if levelStr != "" {
+		detail = level.String()
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Log level of %s is changed to %s", target, detail)
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "change log level", target, true, detail)
+
+	l.showLogsPage(c)
+}
+
+func (l *LogControlModule) showRecentLogs(c *gin.Context) {
+	minLevel := util.DEBUG
+	if levelStr := c.Query(LOG_API_KEY_LEVEL); levelStr != "" {
+		var ok bool
+		if minLevel, ok = util.ParseMaoLogLevel(levelStr); !ok {
+			c.String(http.StatusBadRequest, "%s is invalid: %s", LOG_API_KEY_LEVEL, levelStr)
+			return
+		}
+	}
+
+	limit := DEFAULT_RECENT_LOGS_LIMIT
+	if limitStr := c.Query(LOG_API_KEY_LIMIT); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			c.String(http.StatusBadRequest, "%s is invalid: %s", LOG_API_KEY_LIMIT, limitStr)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, util.GetRecentMaoLogs(c.Query(LOG_API_KEY_MODULE), minLevel, limit))
+}
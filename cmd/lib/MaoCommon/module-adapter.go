@@ -0,0 +1,49 @@
+package MaoCommon
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"errors"
+)
+
+// ModuleAdapter makes the modules in the InitXxx/RequireShutdown style a MaoApi.ModuleLifecycle.
+type ModuleAdapter struct {
+	Name      string
+	DependsOn []string
+
+	InitFunc  func() bool
+	StartFunc func() bool // optional
+	StopFunc  func()      // optional
+
+	Checker MaoApi.HealthChecker // optional
+}
+
+func (m *ModuleAdapter) Dependencies() []string {
+	return m.DependsOn
+}
+
+func (m *ModuleAdapter) Init() error {
+	if m.InitFunc != nil && !m.InitFunc() {
+		return errors.New("init fail, please check the logs of " + m.Name)
+	}
+	return nil
+}
+
+func (m *ModuleAdapter) Start() error {
+	if m.StartFunc != nil && !m.StartFunc() {
+		return errors.New("start fail, please check the logs of " + m.Name)
+	}
+	return nil
+}
+
+func (m *ModuleAdapter) Stop() {
+	if m.StopFunc != nil {
+		m.StopFunc()
+	}
+}
+
+func (m *ModuleAdapter) CheckHealth() *MaoApi.ModuleHealth {
+	if m.Checker == nil {
+		return &MaoApi.ModuleHealth{Module: m.Name, Status: MaoApi.HEALTH_STATUS_OK, Detail: "no health check"}
+	}
+	return m.Checker.CheckHealth()
+}
@@ -0,0 +1,159 @@
+package MaoCommon
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"fmt"
+)
+
+const (
+	MODULE_NAME = "Module-Registry"
+)
+
+func moduleConfigPath(configName string, key string) string {
+	return fmt.Sprintf("%s/%s/%s", MaoApi.MODULES_CONFIG_PATH_ROOT, configName, key)
+}
+
+// isModuleEnabled reads /modules/<name>/enabled, EnabledByDefault if it is not configured.
+func isModuleEnabled(option *MaoApi.ModuleOption) bool {
+	configModule := ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		return option.EnabledByDefault
+	}
+
+	path := moduleConfigPath(option.ConfigName, MaoApi.MODULES_CONFIG_KEY_ENABLED)
+	enabledObj, _ := configModule.GetConfig(path)
+	if enabledObj == nil {
+		return option.EnabledByDefault
+	}
+	enabled, ok := enabledObj.(bool)
+	if !ok {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse %s, it should be true or false, use the default: %v", path, option.EnabledByDefault)
+		return option.EnabledByDefault
+	}
+	return enabled
+}
+
+// GetModuleSettings reads /modules/<configName>/settings, returns an empty map if it is not configured.
+func GetModuleSettings(configName string) map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	configModule := ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return settings
+	}
+
+	path := moduleConfigPath(configName, MaoApi.MODULES_CONFIG_KEY_SETTINGS)
+	settingsObj, _ := configModule.GetConfig(path)
+	if settingsObj == nil {
+		return settings
+	}
+	settingsMap, ok := settingsObj.(map[string]interface{})
+	if !ok {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse %s, can't convert to map[string]interface{}", path)
+		return settings
+	}
+	for k, v := range settingsMap {
+		settings[k] = v
+	}
+	return settings
+}
+
+func (e *moduleEntry) status() *MaoApi.ModuleStatus {
+	status := &MaoApi.ModuleStatus{
+		Name:    e.apiName,
+		Enabled: true,
+		Running: e.running,
+	}
+	if e.option != nil {
+		status.ConfigName = e.option.ConfigName
+		status.Optional = true
+		status.HotToggle = e.option.HotToggle
+		status.Enabled = isModuleEnabled(e.option)
+	}
+	status.RestartRequired = status.Enabled != status.Running
+	return status
+}
+
+// GetModuleStatus lists the registered modules in the registration order.
+func GetModuleStatus() []*MaoApi.ModuleStatus {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+
+	statuses := make([]*MaoApi.ModuleStatus, 0, len(moduleNames))
+	for _, name := range moduleNames {
+		statuses = append(statuses, modules[name].status())
+	}
+	return statuses
+}
+
+// SetModuleEnabled saves the toggle of the optional module to the config.
+// The HotToggle module is started or stopped immediately, others are applied after the server restarts.
+// The actor is recorded in the config history.
+func SetModuleEnabled(configName string, enabled bool, actor string) (*MaoApi.ModuleStatus, error) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+
+	var entry *moduleEntry
+	for _, name := range moduleNames {
+		if option := modules[name].option; option != nil && option.ConfigName == configName {
+			entry = modules[name]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%s is not an optional module", configName)
+	}
+
+	configModule := ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		return nil, fmt.Errorf("config module is not ready")
+	}
+	path := moduleConfigPath(configName, MaoApi.MODULES_CONFIG_KEY_ENABLED)
+	if success, errCode := configModule.PutConfigBy(actor, path, enabled); !success {
+		return nil, fmt.Errorf("fail to save %s, errCode: %d", path, errCode)
+	}
+
+	if entry.option.HotToggle && entry.running != enabled {
+		if !enabled {
+			stopModuleAtRuntime(entry)
+		} else if err := startModuleAtRuntime(entry); err != nil {
+			return entry.status(), err
+		}
+	}
+	return entry.status(), nil
+}
+
+func startModuleAtRuntime(entry *moduleEntry) error {
+	for _, dep := range entry.dependencies() {
+		if modules[dep].option == nil && !modules[dep].running {
+			return fmt.Errorf("module %s depends on %s, which is not running", entry.apiName, dep)
+		}
+	}
+
+	if err := initModule(entry); err != nil {
+		return err
+	}
+	if err := entry.lifecycle.Start(); err != nil {
+		stopModuleAtRuntime(entry)
+		return fmt.Errorf("fail to start module %s, %w", entry.apiName, err)
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Module %s is started.", entry.apiName)
+	return nil
+}
+
+func stopModuleAtRuntime(entry *moduleEntry) {
+	// others can't get it since now
+	if entry.serviceInstance != nil {
+		unregisterService(entry.apiName)
+	}
+	stopModule(entry)
+	for i, e := range initializedModules {
+		if e == entry {
+			initializedModules = append(initializedModules[:i], initializedModules[i+1:]...)
+			break
+		}
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Module %s is stopped.", entry.apiName)
+}
@@ -1,6 +1,11 @@
 package MaoCommon
 
-import MaoApi "MaoServerDiscovery/cmd/api"
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"fmt"
+	"time"
+)
 
 // If you add a new api, please provide a util function here for it :)
 
@@ -56,4 +61,76 @@ func ServiceRegistryGetAuxDataModule() (serviceInstance MaoApi.AuxDataModule) {
 func ServiceRegistryGetGatewayModule() (serviceInstance MaoApi.GatewayModule) {
 	gatewayModule, _ := GetService(MaoApi.GatewayModuleRegisterName).(MaoApi.GatewayModule)
 	return gatewayModule
-}
\ No newline at end of file
+}
+
+// if fail, return nil
+func ServiceRegistryGetAuthModule() (serviceInstance MaoApi.AuthModule) {
+	authModule, _ := GetService(MaoApi.AuthModuleRegisterName).(MaoApi.AuthModule)
+	return authModule
+}
+
+// if fail, return nil
+func ServiceRegistryGetAuditModule() (serviceInstance MaoApi.AuditModule) {
+	auditModule, _ := GetService(MaoApi.AuditModuleRegisterName).(MaoApi.AuditModule)
+	return auditModule
+}
+
+// NotifyServiceEvent sends the UP or DOWN of the service to the notifiers, and records it for the availability.
+// The subject and the content of the email are used if there is no template for the event.
+func NotifyServiceEvent(event *MaoApi.EmailServiceEvent) {
+	emailModule := ServiceRegistryGetEmailModule()
+	if emailModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get EmailModule, can't send %s notification of %s", event.Type, event.Name())
+	} else {
+		emailModule.SendEmail(&MaoApi.EmailMessage{
+			Subject:  fmt.Sprintf("%s %s notification", event.Source, event.Type),
+			Content:  fmt.Sprintf("Service: %s - %s\r\n%s Time: %s\r\n", event.Name(), event.Address, event.Type, event.Timestamp.String()),
+			Event:    event.Type,
+			Services: []*MaoApi.EmailServiceEvent{event},
+		})
+	}
+	// the wechat module is optional, nil if it is disabled.
+	if wechatModule := ServiceRegistryGetWechatModule(); wechatModule != nil {
+		wechatModule.SendWechatMessage(&MaoApi.WechatMessage{Event: event})
+	}
+	if reportModule := ServiceRegistryGetReportModule(); reportModule != nil {
+		reportModule.RecordServiceEvent(event)
+	}
+}
+
+// RecordAudit records an event to the AuditModule, the event is logged instead if the AuditModule is not running.
+func RecordAudit(actor string, source string, action string, target string, success bool, detail string) {
+	auditModule := ServiceRegistryGetAuditModule()
+	if auditModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get AuditModule, %s %s by %s: %v, %s", action, target, actor, success, detail)
+		return
+	}
+
+	auditModule.Record(&MaoApi.AuditEvent{
+		Timestamp: time.Now(),
+		Actor:     actor,
+		Source:    source,
+		Action:    action,
+		Target:    target,
+		Success:   success,
+		Detail:    detail,
+	})
+}
+
+// if fail, return nil
+func ServiceRegistryGetSelfCheckModule() (serviceInstance MaoApi.SelfCheckModule) {
+	selfCheckModule, _ := GetService(MaoApi.SelfCheckModuleRegisterName).(MaoApi.SelfCheckModule)
+	return selfCheckModule
+}
+
+// if fail, return nil
+func ServiceRegistryGetOutboxModule() (serviceInstance MaoApi.OutboxModule) {
+	outboxModule, _ := GetService(MaoApi.OutboxModuleRegisterName).(MaoApi.OutboxModule)
+	return outboxModule
+}
+
+// if fail, return nil
+func ServiceRegistryGetReportModule() (serviceInstance MaoApi.ReportModule) {
+	reportModule, _ := GetService(MaoApi.ReportModuleRegisterName).(MaoApi.ReportModule)
+	return reportModule
+}
@@ -1,14 +1,205 @@
 package MaoCommon
 
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/util"
+	"fmt"
+	"sync"
+)
+
 var (
-	serviceRegistry = make(map[string]interface{})
+	serviceRegistry     = make(map[string]interface{})
+	serviceRegistryLock = sync.RWMutex{}
 )
 
 func RegisterService(apiName string, serviceInstancePointer interface{}) {
+	serviceRegistryLock.Lock()
+	defer serviceRegistryLock.Unlock()
 	serviceRegistry[apiName] = serviceInstancePointer
 }
 
+func unregisterService(apiName string) {
+	serviceRegistryLock.Lock()
+	defer serviceRegistryLock.Unlock()
+	delete(serviceRegistry, apiName)
+}
+
 // now: return the instance, not the pointer of the instance
 func GetService(apiName string) (serviceInstance interface{}) {
+	serviceRegistryLock.RLock()
+	defer serviceRegistryLock.RUnlock()
 	return serviceRegistry[apiName]
 }
+
+type moduleEntry struct {
+	apiName         string
+	serviceInstance interface{} // registered to the service registry after Init, nil for none.
+	lifecycle       MaoApi.ModuleLifecycle
+
+	option  *MaoApi.ModuleOption // nil for the modules which can't be disabled
+	running bool                 // initialized and not stopped
+}
+
+var (
+	modules            = make(map[string]*moduleEntry)
+	moduleNames        = make([]string, 0) // in the registration order
+	initializedModules = make([]*moduleEntry, 0)
+	modulesLock        = sync.Mutex{}
+
+	// apiName -> true, read by the REST routes of the modules while modulesLock may be held by a slow Init.
+	runningModules = sync.Map{}
+)
+
+// IsModuleRunning returns true if the module is initialized and not stopped.
+func IsModuleRunning(apiName string) bool {
+	_, ok := runningModules.Load(apiName)
+	return ok
+}
+
+// RegisterModule adds the module to be started by StartModules.
+// serviceInstance is registered as apiName to the service registry after the module is initialized, nil for none.
+func RegisterModule(apiName string, serviceInstance interface{}, lifecycle MaoApi.ModuleLifecycle) {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+
+	if _, ok := modules[apiName]; !ok {
+		moduleNames = append(moduleNames, apiName)
+	}
+	modules[apiName] = &moduleEntry{apiName: apiName, serviceInstance: serviceInstance, lifecycle: lifecycle}
+}
+
+// RegisterOptionalModule is RegisterModule for the module which is enabled or disabled by the config, see MaoApi.ModuleOption.
+// The module depends on the config module implicitly.
+// Depending on an optional module only decides the order, the dependents are started even if it is disabled,
+// so they should tolerate that it is not in the service registry.
+func RegisterOptionalModule(apiName string, serviceInstance interface{}, lifecycle MaoApi.ModuleLifecycle, option *MaoApi.ModuleOption) {
+	RegisterModule(apiName, serviceInstance, lifecycle)
+
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	modules[apiName].option = option
+}
+
+func (e *moduleEntry) dependencies() []string {
+	deps := e.lifecycle.Dependencies()
+	if e.option == nil {
+		return deps
+	}
+	if _, ok := modules[MaoApi.ConfigModuleRegisterName]; !ok {
+		return deps
+	}
+	return append([]string{MaoApi.ConfigModuleRegisterName}, deps...)
+}
+
+// resolveModuleOrder sorts modules by their dependencies. Independent modules keep the registration order.
+func resolveModuleOrder() ([]*moduleEntry, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	order := make([]*moduleEntry, 0, len(moduleNames))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		}
+
+		entry := modules[name]
+		state[name] = visiting
+		for _, dep := range entry.dependencies() {
+			if _, ok := modules[dep]; !ok {
+				return fmt.Errorf("module %s depends on %s, which is not registered", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, entry)
+		return nil
+	}
+
+	for _, name := range moduleNames {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// StartModules initializes all registered modules in the dependency order, then starts them in the same order.
+// The optional modules disabled by the config are skipped.
+// If any module fails, the initialized modules are stopped in the reverse order.
+func StartModules() error {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+
+	order, err := resolveModuleOrder()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range order {
+		if entry.option != nil && !isModuleEnabled(entry.option) {
+			util.MaoLogM(util.INFO, MODULE_NAME, "Module %s is disabled by the config, skip.", entry.apiName)
+			continue
+		}
+		if err := initModule(entry); err != nil {
+			stopModules()
+			return err
+		}
+	}
+
+	for _, entry := range initializedModules {
+		if err := entry.lifecycle.Start(); err != nil {
+			stopModules()
+			return fmt.Errorf("fail to start module %s, %w", entry.apiName, err)
+		}
+	}
+	return nil
+}
+
+func initModule(entry *moduleEntry) error {
+	// the REST routes registered in Init are served only while the module is running.
+	if restfulServer := ServiceRegistryGetRestfulServerModule(); restfulServer != nil {
+		restfulServer.SetRouteOwner(entry.apiName, IsModuleRunning)
+		defer restfulServer.SetRouteOwner("", nil)
+	}
+
+	if err := entry.lifecycle.Init(); err != nil {
+		return fmt.Errorf("fail to init module %s, %w", entry.apiName, err)
+	}
+	entry.running = true
+	runningModules.Store(entry.apiName, true)
+	initializedModules = append(initializedModules, entry)
+	if entry.serviceInstance != nil {
+		RegisterService(entry.apiName, entry.serviceInstance)
+	}
+	return nil
+}
+
+func stopModule(entry *moduleEntry) {
+	entry.lifecycle.Stop()
+	entry.running = false
+	runningModules.Delete(entry.apiName)
+}
+
+// StopModules stops the initialized modules in the reverse order of the initialization.
+func StopModules() {
+	modulesLock.Lock()
+	defer modulesLock.Unlock()
+	stopModules()
+}
+
+func stopModules() {
+	for i := len(initializedModules) - 1; i >= 0; i-- {
+		stopModule(initializedModules[i])
+	}
+	initializedModules = initializedModules[:0]
+}
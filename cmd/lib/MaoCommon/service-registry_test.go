@@ -3,6 +3,7 @@ package MaoCommon
 import (
 	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/cmd/lib/Restful"
+	"strings"
 	"testing"
 )
 
@@ -27,4 +28,189 @@ func TestServiceRegistry_GetService(t *testing.T) {
 	} else {
 		t.Errorf("Fail case: get ConfigModuleRegisterName and cast to ConfigModule, %v, %v", ccc, ok)
 	}
-}
\ No newline at end of file
+}
+type recordingModule struct {
+	ModuleAdapter
+	events *[]string
+}
+
+func newRecordingModule(name string, events *[]string, failInit bool, dependsOn ...string) *recordingModule {
+	m := &recordingModule{events: events}
+	m.Name = name
+	m.DependsOn = dependsOn
+	m.InitFunc = func() bool {
+		*events = append(*events, "init "+name)
+		return !failInit
+	}
+	m.StartFunc = func() bool {
+		*events = append(*events, "start "+name)
+		return true
+	}
+	m.StopFunc = func() {
+		*events = append(*events, "stop "+name)
+	}
+	return m
+}
+
+func resetModules() {
+	modules = make(map[string]*moduleEntry)
+	moduleNames = make([]string, 0)
+	initializedModules = make([]*moduleEntry, 0)
+}
+
+func TestStartModules_DependencyOrder(t *testing.T) {
+	resetModules()
+	events := make([]string, 0)
+	RegisterModule("c", nil, newRecordingModule("c", &events, false, "b"))
+	RegisterModule("a", "instance-a", newRecordingModule("a", &events, false))
+	RegisterModule("b", nil, newRecordingModule("b", &events, false, "a"))
+
+	if err := StartModules(); err != nil {
+		t.Fatal(err)
+	}
+	if GetService("a") != "instance-a" {
+		t.Errorf("module a is not registered as a service after init")
+	}
+	StopModules()
+
+	expect := "init a,init b,init c,start a,start b,start c,stop c,stop b,stop a"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestStartModules_InitFail(t *testing.T) {
+	resetModules()
+	events := make([]string, 0)
+	RegisterModule("a", nil, newRecordingModule("a", &events, false))
+	RegisterModule("b", nil, newRecordingModule("b", &events, true, "a"))
+	RegisterModule("c", nil, newRecordingModule("c", &events, false, "b"))
+
+	if err := StartModules(); err == nil {
+		t.Fatal("expect error when init fails")
+	}
+	expect := "init a,init b,stop a"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestStartModules_BadDependencies(t *testing.T) {
+	resetModules()
+	events := make([]string, 0)
+	RegisterModule("a", nil, newRecordingModule("a", &events, false, "b"))
+	RegisterModule("b", nil, newRecordingModule("b", &events, false, "a"))
+	if err := StartModules(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expect dependency cycle error, got %v", err)
+	}
+
+	resetModules()
+	RegisterModule("a", nil, newRecordingModule("a", &events, false, "missing"))
+	if err := StartModules(); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("expect missing dependency error, got %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("no module should be initialized, got %v", events)
+	}
+}
+
+type mapConfigModule struct {
+	config map[string]interface{}
+}
+
+func (m *mapConfigModule) GetConfig(path string) (interface{}, int) {
+	return m.config[path], 0
+}
+func (m *mapConfigModule) GetSecConfig(path string) (interface{}, int) {
+	return nil, 0
+}
+func (m *mapConfigModule) PutConfig(path string, data interface{}) (bool, int) {
+	m.config[path] = data
+	return true, 0
+}
+func (m *mapConfigModule) PutSecConfig(path string, data interface{}) (bool, int) {
+	return false, 0
+}
+func (m *mapConfigModule) PutConfigBy(actor string, path string, data interface{}) (bool, int) {
+	return m.PutConfig(path, data)
+}
+func (m *mapConfigModule) PutSecConfigBy(actor string, path string, data interface{}) (bool, int) {
+	return m.PutSecConfig(path, data)
+}
+func (m *mapConfigModule) RegisterKeyUpdateListener(listener *chan int) {
+}
+func (m *mapConfigModule) RegisterConfigUpdateListener(path string, listener *chan int) {
+}
+func (m *mapConfigModule) Subscribe(pathPrefix string) <-chan *MaoApi.ConfigChangeEvent {
+	return make(chan *MaoApi.ConfigChangeEvent)
+}
+func (m *mapConfigModule) Unsubscribe(subscription <-chan *MaoApi.ConfigChangeEvent) {
+}
+func (m *mapConfigModule) RegisterConfigSchema(path string, schema interface{}) {
+}
+func (m *mapConfigModule) ValidateConfig(path string, data interface{}) error {
+	return nil
+}
+func (m *mapConfigModule) GetConfigInto(path string, dst interface{}) int {
+	return 2
+}
+
+func TestStartModules_OptionalModules(t *testing.T) {
+	resetModules()
+	configModule := &mapConfigModule{config: map[string]interface{}{
+		"/modules/hot/enabled": false,
+	}}
+	RegisterService(MaoApi.ConfigModuleRegisterName, configModule)
+	defer unregisterService(MaoApi.ConfigModuleRegisterName)
+
+	events := make([]string, 0)
+	RegisterModule("a", nil, newRecordingModule("a", &events, false))
+	RegisterOptionalModule("hot", "instance-hot", newRecordingModule("hot", &events, false, "a"),
+		&MaoApi.ModuleOption{ConfigName: "hot", EnabledByDefault: true, HotToggle: true})
+	RegisterOptionalModule("cold", nil, newRecordingModule("cold", &events, false),
+		&MaoApi.ModuleOption{ConfigName: "cold", EnabledByDefault: true})
+	RegisterModule("b", nil, newRecordingModule("b", &events, false, "hot"))
+
+	if err := StartModules(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "init a,init cold,init b,start a,start cold,start b"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+
+	events = events[:0]
+	status, err := SetModuleEnabled("hot", true, "tester")
+	if err != nil || !status.Running || status.RestartRequired {
+		t.Errorf("expect hot to be running, got %+v, %v", status, err)
+	}
+	if GetService("hot") != "instance-hot" {
+		t.Errorf("module hot is not registered as a service after started")
+	}
+	status, err = SetModuleEnabled("cold", false, "tester")
+	if err != nil || !status.Running || !status.RestartRequired {
+		t.Errorf("expect cold to require restart, got %+v, %v", status, err)
+	}
+	status, err = SetModuleEnabled("hot", false, "tester")
+	if err != nil || status.Running {
+		t.Errorf("expect hot to be stopped, got %+v, %v", status, err)
+	}
+	if GetService("hot") != nil {
+		t.Errorf("module hot is still in the service registry after stopped")
+	}
+	if IsModuleRunning("hot") || !IsModuleRunning("a") {
+		t.Errorf("unexpected running state, hot %v, a %v", IsModuleRunning("hot"), IsModuleRunning("a"))
+	}
+	if _, err := SetModuleEnabled("a", false, "tester"); err == nil {
+		t.Errorf("expect error when toggling a mandatory module")
+	}
+	if configModule.config["/modules/cold/enabled"] != false {
+		t.Errorf("the toggle is not saved to the config, %v", configModule.config)
+	}
+
+	StopModules()
+	expect = "init hot,start hot,stop hot,stop b,stop cold,stop a"
+	if got := strings.Join(events, ","); got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
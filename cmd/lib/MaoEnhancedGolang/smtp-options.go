@@ -0,0 +1,179 @@
+package MaoEnhancedGolang
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+const (
+	SMTP_SECURITY_AUTO     = "auto"     // implicit TLS on port 465, otherwise STARTTLS if the server supports it
+	SMTP_SECURITY_STARTTLS = "starttls" // STARTTLS is required
+	SMTP_SECURITY_TLS      = "tls"      // implicit TLS, i.e. SMTPS
+	SMTP_SECURITY_NONE     = "none"     // plaintext, never STARTTLS
+
+	SMTP_IMPLICIT_TLS_PORT = "465"
+
+	// the stages of SendMailWithOptions, reported by SmtpError.
+	SMTP_STAGE_CONNECT  = "connect" // dial and the greeting
+	SMTP_STAGE_TLS      = "tls"     // the handshake, including the certificate verification
+	SMTP_STAGE_EHLO     = "ehlo"
+	SMTP_STAGE_STARTTLS = "starttls"
+	SMTP_STAGE_AUTH     = "auth"
+	SMTP_STAGE_MAIL     = "mail"
+	SMTP_STAGE_RCPT     = "rcpt"
+	SMTP_STAGE_DATA     = "data"
+	SMTP_STAGE_QUIT     = "quit"
+)
+
+// SmtpOptions is how SendMailWithOptions talks to the server.
+type SmtpOptions struct {
+	Security  string        // SMTP_SECURITY_*, empty is SMTP_SECURITY_AUTO
+	TLSConfig *tls.Config   // the ServerName is the host of the addr if it is empty
+	Auth      smtp.Auth     // nil for no authentication
+	Timeout   time.Duration // the whole session, 0 for no timeout
+}
+
+// SmtpError is the error of SendMailWithOptions, with the stage it fails at.
+type SmtpError struct {
+	Stage string // SMTP_STAGE_*
+	Err   error
+}
+
+func (e *SmtpError) Error() string {
+	return fmt.Sprintf("smtp %s: %s", e.Stage, e.Err.Error())
+}
+
+func (e *SmtpError) Unwrap() error {
+	return e.Err
+}
+
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SmtpError{Stage: stage, Err: err}
+}
+
+// handshake makes the connection TLS, and verifies the server by the config.
+func handshake(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// SendMailWithOptions is SendMail with the security mode, the TLS config and the timeout of options.
+// The error is *SmtpError, and the TLS state is returned if the session is encrypted.
+func SendMailWithOptions(addr string, options *SmtpOptions, from string, to []string, msg []byte) (*tls.ConnectionState, error) {
+	if err := validateLine(from); err != nil {
+		return nil, stageError(SMTP_STAGE_MAIL, err)
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return nil, stageError(SMTP_STAGE_RCPT, err)
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, stageError(SMTP_STAGE_CONNECT, err)
+	}
+
+	security := options.Security
+	if security == "" {
+		security = SMTP_SECURITY_AUTO
+	}
+	if security == SMTP_SECURITY_AUTO && port == SMTP_IMPLICIT_TLS_PORT {
+		security = SMTP_SECURITY_TLS
+	}
+	tlsConfig := &tls.Config{}
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, options.Timeout)
+	if err != nil {
+		return nil, stageError(SMTP_STAGE_CONNECT, err)
+	}
+	if options.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(options.Timeout))
+	}
+	if security == SMTP_SECURITY_TLS {
+		tlsConn, err := handshake(conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, stageError(SMTP_STAGE_TLS, err)
+		}
+		conn = tlsConn
+	}
+	c, err := NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, stageError(SMTP_STAGE_CONNECT, err)
+	}
+	defer c.Close()
+	if err = c.hello(); err != nil {
+		return nil, stageError(SMTP_STAGE_EHLO, err)
+	}
+
+	if security == SMTP_SECURITY_STARTTLS || security == SMTP_SECURITY_AUTO {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if _, _, err = c.cmd(220, "STARTTLS"); err != nil {
+				return nil, stageError(SMTP_STAGE_STARTTLS, err)
+			}
+			tlsConn, err := handshake(c.conn, tlsConfig)
+			if err != nil {
+				return nil, stageError(SMTP_STAGE_TLS, err)
+			}
+			c.conn = tlsConn
+			c.Text = textproto.NewConn(c.conn)
+			c.tls = true
+			if err = c.ehlo(); err != nil {
+				return nil, stageError(SMTP_STAGE_EHLO, err)
+			}
+		} else if security == SMTP_SECURITY_STARTTLS {
+			return nil, stageError(SMTP_STAGE_STARTTLS, errors.New("server doesn't support STARTTLS"))
+		}
+	}
+
+	if options.Auth != nil {
+		if _, ok := c.ext["AUTH"]; !ok {
+			return nil, stageError(SMTP_STAGE_AUTH, errors.New("server doesn't support AUTH"))
+		}
+		if err = c.Auth(options.Auth); err != nil {
+			return nil, stageError(SMTP_STAGE_AUTH, err)
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return nil, stageError(SMTP_STAGE_MAIL, err)
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return nil, stageError(SMTP_STAGE_RCPT, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return nil, stageError(SMTP_STAGE_DATA, err)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return nil, stageError(SMTP_STAGE_DATA, err)
+	}
+	if err = w.Close(); err != nil {
+		return nil, stageError(SMTP_STAGE_DATA, err)
+	}
+
+	var state *tls.ConnectionState
+	if tlsState, ok := c.TLSConnectionState(); ok {
+		state = &tlsState
+	}
+	return state, stageError(SMTP_STAGE_QUIT, c.Quit())
+}
@@ -0,0 +1,219 @@
+package MaoEnhancedGolang
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSmtpUsername = "mao"
+	testSmtpPassword = "secret"
+)
+
+// newTestCertificate returns a self-signed certificate of 127.0.0.1, and the pool trusting it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mao-test-smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// testSmtpServer is a minimal SMTP server, for the stages of SendMailWithOptions.
+type testSmtpServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	startTLS    bool
+	rejectRcpt  string
+	received    chan string
+}
+
+func newTestSmtpServer(t *testing.T, cert tls.Certificate, implicitTLS bool, startTLS bool) *testSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSmtpServer{
+		listener:    listener,
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		implicitTLS: implicitTLS,
+		startTLS:    startTLS,
+		received:    make(chan string, 10),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	encrypted := s.implicitTLS
+	if s.implicitTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 mao-test ESMTP")
+	decode := func(line string) string {
+		data, _ := base64.StdEncoding.DecodeString(line)
+		return string(data)
+	}
+	reply := func(ok bool) {
+		if ok {
+			text.PrintfLine("235 2.7.0 Authentication successful")
+		} else {
+			text.PrintfLine("535 5.7.8 Authentication failed")
+		}
+	}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			text.PrintfLine("250-mao-test")
+			if s.startTLS && !encrypted {
+				text.PrintfLine("250-STARTTLS")
+			}
+			text.PrintfLine("250 AUTH PLAIN CRAM-MD5")
+		case command == "STARTTLS":
+			text.PrintfLine("220 2.0.0 Ready to start TLS")
+			conn = tls.Server(conn, s.tlsConfig)
+			text = textproto.NewConn(conn)
+			encrypted = true
+		case strings.HasPrefix(command, "AUTH PLAIN "):
+			reply(decode(line[len("AUTH PLAIN "):]) == "\x00"+testSmtpUsername+"\x00"+testSmtpPassword)
+		case command == "AUTH CRAM-MD5":
+			challenge := "<1.1@mao-test>"
+			text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+			response, _ := text.ReadLine()
+			mac := hmac.New(md5.New, []byte(testSmtpPassword))
+			mac.Write([]byte(challenge))
+			reply(decode(response) == testSmtpUsername+" "+hex.EncodeToString(mac.Sum(nil)))
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			text.PrintfLine("250 2.1.0 Ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			if s.rejectRcpt != "" && strings.Contains(line, s.rejectRcpt) {
+				text.PrintfLine("550 5.1.1 User unknown")
+			} else {
+				text.PrintfLine("250 2.1.5 Ok")
+			}
+		case command == "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			lines, _ := text.ReadDotLines()
+			s.received <- strings.Join(lines, "\n")
+			text.PrintfLine("250 2.0.0 Ok: queued")
+		case command == "QUIT":
+			text.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			text.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+func expectStage(t *testing.T, err error, stage string) {
+	t.Helper()
+	var smtpErr *SmtpError
+	if !errors.As(err, &smtpErr) || smtpErr.Stage != stage {
+		t.Errorf("expect failing at %s, got %v", stage, err)
+	}
+}
+
+func TestSendMailWithOptions(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	msg := []byte("Subject: probe\r\n\r\nHello\r\n")
+	to := []string{"a@example.com"}
+	trusted := &tls.Config{RootCAs: pool}
+
+	implicit := newTestSmtpServer(t, cert, true, false)
+	addr := implicit.listener.Addr().String()
+	for _, auth := range []smtp.Auth{
+		smtp.PlainAuth("", testSmtpUsername, testSmtpPassword, "127.0.0.1"),
+		smtp.CRAMMD5Auth(testSmtpUsername, testSmtpPassword),
+	} {
+		options := &SmtpOptions{Security: SMTP_SECURITY_TLS, TLSConfig: trusted, Auth: auth, Timeout: 5 * time.Second}
+		state, err := SendMailWithOptions(addr, options, "mao@example.com", to, msg)
+		if err != nil || state == nil {
+			t.Fatalf("fail to send by implicit TLS, %v", err)
+		}
+		if body := <-implicit.received; !strings.Contains(body, "Hello") {
+			t.Errorf("unexpected body %q", body)
+		}
+	}
+	// the certificate is not trusted by the system pool.
+	_, err := SendMailWithOptions(addr, &SmtpOptions{Security: SMTP_SECURITY_TLS, Timeout: 5 * time.Second}, "mao@example.com", to, msg)
+	expectStage(t, err, SMTP_STAGE_TLS)
+	_, err = SendMailWithOptions(addr, &SmtpOptions{Security: SMTP_SECURITY_TLS, TLSConfig: trusted, Timeout: 5 * time.Second,
+		Auth: smtp.CRAMMD5Auth(testSmtpUsername, "wrong")}, "mao@example.com", to, msg)
+	expectStage(t, err, SMTP_STAGE_AUTH)
+
+	starttls := newTestSmtpServer(t, cert, false, true)
+	addr = starttls.listener.Addr().String()
+	state, err := SendMailWithOptions(addr, &SmtpOptions{Security: SMTP_SECURITY_STARTTLS, TLSConfig: trusted, Timeout: 5 * time.Second},
+		"mao@example.com", to, msg)
+	if err != nil || state == nil || len(state.PeerCertificates) == 0 {
+		t.Fatalf("fail to send by STARTTLS, %v", err)
+	}
+	<-starttls.received
+	starttls.rejectRcpt = "b@example.com"
+	_, err = SendMailWithOptions(addr, &SmtpOptions{TLSConfig: trusted}, "mao@example.com", []string{"a@example.com", "b@example.com"}, msg)
+	expectStage(t, err, SMTP_STAGE_RCPT)
+
+	plaintext := newTestSmtpServer(t, cert, false, false)
+	addr = plaintext.listener.Addr().String()
+	_, err = SendMailWithOptions(addr, &SmtpOptions{Security: SMTP_SECURITY_STARTTLS}, "mao@example.com", to, msg)
+	expectStage(t, err, SMTP_STAGE_STARTTLS)
+	if state, err = SendMailWithOptions(addr, &SmtpOptions{}, "mao@example.com", to, msg); err != nil || state != nil {
+		t.Errorf("expect sent in plaintext, %v", err)
+	}
+	<-plaintext.received
+
+	plaintext.listener.Close()
+	_, err = SendMailWithOptions(addr, &SmtpOptions{Timeout: time.Second}, "mao@example.com", to, msg)
+	expectStage(t, err, SMTP_STAGE_CONNECT)
+}
@@ -0,0 +1,413 @@
+package Outbox
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MODULE_NAME = "Notification-Outbox-module"
+
+	DEFAULT_OUTBOX_FILE = "mao-outbox.json"
+
+	URL_OUTBOX_SHOW    = "/showNotifications"
+	URL_OUTBOX_REQUEUE = "/requeueNotification"
+
+	OUTBOX_API_KEY_ID      = "id"
+	OUTBOX_API_KEY_STATUS  = "status"
+	OUTBOX_API_KEY_CHANNEL = "channel"
+
+	OUTBOX_MAX_ATTEMPTS   = 10
+	OUTBOX_RETRY_INITIAL  = 30 * time.Second // doubled after each failure
+	OUTBOX_RETRY_MAX      = time.Hour
+	OUTBOX_QUEUE_CAPACITY = 5000 // the queued ones, Enqueue fails beyond it
+	OUTBOX_KEEP_SENT      = 500  // the recent sent ones, only for showing
+	OUTBOX_KEEP_FAILED    = 500
+)
+
+var ErrOutboxFull = errors.New("the outbox is full")
+
+// outboxChannel delivers the notifications of a channel, interval after the last delivery.
+type outboxChannel struct {
+	deliver      MaoApi.NotificationDeliverFunc
+	interval     time.Duration
+	lastDelivery time.Time
+}
+
+type NotificationOutbox struct {
+	outboxFilename string
+
+	notifications []*MaoApi.Notification // from old to new
+	channels      map[string]*outboxChannel
+	lock          sync.Mutex
+	sequence      uint64
+
+	wakeChannel chan struct{} // a notification may be due
+
+	needShutdown atomic.Bool
+	exited       chan struct{} // closed when outboxLoop exits
+}
+
+func (o *NotificationOutbox) RequireShutdown() {
+	o.needShutdown.Store(true)
+}
+
+// Shutdown tries the due notifications once more, and waits for outboxLoop to exit. The rest are delivered after restart.
+func (o *NotificationOutbox) Shutdown() {
+	o.RequireShutdown()
+	<-o.exited
+}
+
+func (o *NotificationOutbox) RegisterChannel(channel string, interval time.Duration, deliver MaoApi.NotificationDeliverFunc) {
+	o.lock.Lock()
+	o.channels[channel] = &outboxChannel{deliver: deliver, interval: interval}
+	o.lock.Unlock()
+	o.wake()
+}
+
+func (o *NotificationOutbox) Enqueue(channel string, summary string, message interface{}) (string, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	o.lock.Lock()
+	if o.countStatus(MaoApi.NOTIFICATION_STATUS_QUEUED) >= OUTBOX_QUEUE_CAPACITY {
+		o.lock.Unlock()
+		return "", ErrOutboxFull
+	}
+	now := time.Now()
+	o.sequence++
+	n := &MaoApi.Notification{
+		Id:          fmt.Sprintf("%x-%x", now.UnixNano(), o.sequence),
+		Channel:     channel,
+		Summary:     summary,
+		Payload:     payload,
+		Status:      MaoApi.NOTIFICATION_STATUS_QUEUED,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		NextAttempt: now,
+	}
+	o.notifications = append(o.notifications, n)
+	o.saveLocked()
+	o.lock.Unlock()
+
+	o.wake()
+	return n.Id, nil
+}
+
+// GetNotifications returns the copies from new to old, filtered by the status and the channel if they are not empty.
+func (o *NotificationOutbox) GetNotifications(status string, channel string) []*MaoApi.Notification {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	notifications := make([]*MaoApi.Notification, 0)
+	for i := len(o.notifications) - 1; i >= 0; i-- {
+		n := o.notifications[i]
+		if (status == "" || n.Status == status) && (channel == "" || n.Channel == channel) {
+			copied := *n
+			notifications = append(notifications, &copied)
+		}
+	}
+	return notifications
+}
+
+// Requeue delivers the failed or queued notifications again as soon as possible, with the attempts reset.
+// An empty id stands for all the notifications of the status. Returns the number requeued.
+func (o *NotificationOutbox) Requeue(id string, status string) (int, error) {
+	o.lock.Lock()
+	now := time.Now()
+	requeued := 0
+	for _, n := range o.notifications {
+		if (id != "" && n.Id != id) || (id == "" && n.Status != status) {
+			continue
+		}
+		if n.Status == MaoApi.NOTIFICATION_STATUS_SENT {
+			o.lock.Unlock()
+			return 0, fmt.Errorf("notification %s is sent", n.Id)
+		}
+		n.Status, n.Attempts, n.NextAttempt, n.UpdatedAt = MaoApi.NOTIFICATION_STATUS_QUEUED, 0, now, now
+		requeued++
+	}
+	if requeued > 0 {
+		o.saveLocked()
+	}
+	o.lock.Unlock()
+
+	if id != "" && requeued == 0 {
+		return 0, fmt.Errorf("notification %s does not exist", id)
+	}
+	o.wake()
+	return requeued, nil
+}
+
+func (o *NotificationOutbox) CheckHealth() *MaoApi.ModuleHealth {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Metrics: map[string]int64{
+			"queued": int64(o.countStatus(MaoApi.NOTIFICATION_STATUS_QUEUED)),
+			"sent":   int64(o.countStatus(MaoApi.NOTIFICATION_STATUS_SENT)),
+			"failed": int64(o.countStatus(MaoApi.NOTIFICATION_STATUS_FAILED)),
+		},
+	}
+	if health.Metrics["failed"] > 0 {
+		health.Status = MaoApi.HEALTH_STATUS_DEGRADED
+		health.Detail = fmt.Sprintf("%d notifications failed, see %s", health.Metrics["failed"], URL_OUTBOX_SHOW)
+	}
+	return health
+}
+
+func (o *NotificationOutbox) wake() {
+	select {
+	case o.wakeChannel <- struct{}{}:
+	default:
+	}
+}
+
+func (o *NotificationOutbox) countStatus(status string) int {
+	count := 0
+	for _, n := range o.notifications {
+		if n.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// retryDelay is the backoff after the failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := OUTBOX_RETRY_INITIAL
+	for i := 1; i < attempts && delay < OUTBOX_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > OUTBOX_RETRY_MAX {
+		delay = OUTBOX_RETRY_MAX
+	}
+	return delay
+}
+
+// nextDue returns the oldest queued notification due at now, whose channel is registered and out of the send interval.
+func (o *NotificationOutbox) nextDue(now time.Time) (*MaoApi.Notification, MaoApi.NotificationDeliverFunc) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, n := range o.notifications {
+		if n.Status != MaoApi.NOTIFICATION_STATUS_QUEUED || n.NextAttempt.After(now) {
+			continue
+		}
+		if channel, ok := o.channels[n.Channel]; ok && now.Sub(channel.lastDelivery) >= channel.interval {
+			return n, channel.deliver
+		}
+	}
+	return nil, nil
+}
+
+func (o *NotificationOutbox) finishDelivery(n *MaoApi.Notification, err error, now time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	n.Attempts++
+	n.UpdatedAt = now
+	if channel, ok := o.channels[n.Channel]; ok {
+		channel.lastDelivery = now
+	}
+	switch {
+	case err == nil:
+		n.Status, n.SentAt, n.LastError = MaoApi.NOTIFICATION_STATUS_SENT, &now, ""
+	case n.Attempts >= OUTBOX_MAX_ATTEMPTS:
+		n.Status, n.LastError = MaoApi.NOTIFICATION_STATUS_FAILED, err.Error()
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to deliver %s notification %s after %d attempts, %s", n.Channel, n.Id, n.Attempts, err.Error())
+	default:
+		n.NextAttempt, n.LastError = now.Add(retryDelay(n.Attempts)), err.Error()
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to deliver %s notification %s, retry at %s, %s",
+			n.Channel, n.Id, n.NextAttempt.Format(time.RFC3339), err.Error())
+	}
+	o.pruneLocked()
+	o.saveLocked()
+}
+
+// deliverDue delivers the due notifications one by one, the failed ones are due later.
+// The ones in the send interval of the channel are delivered by the next check.
+func (o *NotificationOutbox) deliverDue() {
+	for {
+		n, deliver := o.nextDue(time.Now())
+		if n == nil {
+			return
+		}
+		err := deliver(n.Payload)
+		o.finishDelivery(n, err, time.Now())
+	}
+}
+
+// pruneLocked removes the oldest sent and failed notifications beyond the capacity.
+func (o *NotificationOutbox) pruneLocked() {
+	keep := map[string]int{MaoApi.NOTIFICATION_STATUS_SENT: OUTBOX_KEEP_SENT, MaoApi.NOTIFICATION_STATUS_FAILED: OUTBOX_KEEP_FAILED}
+	kept := make([]*MaoApi.Notification, 0, len(o.notifications))
+	for i := len(o.notifications) - 1; i >= 0; i-- {
+		n := o.notifications[i]
+		if limit, ok := keep[n.Status]; ok {
+			if limit <= 0 {
+				continue
+			}
+			keep[n.Status] = limit - 1
+		}
+		kept = append(kept, n)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	o.notifications = kept
+}
+
+// saveLocked writes all notifications to the file, by a temp file renamed to it.
+func (o *NotificationOutbox) saveLocked() {
+	data, err := json.MarshalIndent(o.notifications, "", "  ")
+	if err == nil {
+		err = util.WriteFileAtomic(o.outboxFilename, data, 0600)
+	}
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save the outbox to %s, %s", o.outboxFilename, err.Error())
+	}
+}
+
+// loadOutbox reads the notifications saved before, a broken file is kept aside.
+func (o *NotificationOutbox) loadOutbox() {
+	data, err := os.ReadFile(o.outboxFilename)
+	if os.IsNotExist(err) {
+		return
+	}
+	notifications := make([]*MaoApi.Notification, 0)
+	if err == nil {
+		err = json.Unmarshal(data, &notifications)
+	}
+	if err != nil {
+		broken := o.outboxFilename + ".broken"
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read the outbox %s, moved to %s. (%s)", o.outboxFilename, broken, err.Error())
+		os.Rename(o.outboxFilename, broken)
+		return
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].CreatedAt.Before(notifications[j].CreatedAt)
+	})
+	o.notifications = notifications
+	if queued := o.countStatus(MaoApi.NOTIFICATION_STATUS_QUEUED); queued > 0 {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Loaded %d queued notifications from %s", queued, o.outboxFilename)
+	}
+}
+
+func (o *NotificationOutbox) outboxLoop() {
+	defer close(o.exited)
+
+	checkInterval := time.Duration(1000) * time.Millisecond
+	checkTimer := time.NewTimer(checkInterval)
+	for {
+		select {
+		case <-o.wakeChannel:
+			o.deliverDue()
+		case <-checkTimer.C:
+			o.deliverDue()
+			if o.needShutdown.Load() {
+				o.lock.Lock()
+				if queued := o.countStatus(MaoApi.NOTIFICATION_STATUS_QUEUED); queued > 0 {
+					util.MaoLogM(util.INFO, MODULE_NAME, "Exiting, %d queued notifications are delivered after restart.", queued)
+				}
+				o.lock.Unlock()
+				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+				return
+			}
+			checkTimer.Reset(checkInterval)
+		}
+	}
+}
+
+func (o *NotificationOutbox) InitOutboxModule(outboxFilename string) bool {
+	o.outboxFilename = outboxFilename
+	o.notifications = make([]*MaoApi.Notification, 0)
+	o.channels = make(map[string]*outboxChannel)
+	o.wakeChannel = make(chan struct{}, 1)
+	o.needShutdown.Store(false)
+	o.exited = make(chan struct{})
+
+	o.loadOutbox()
+
+	go o.outboxLoop()
+
+	o.configRestControlInterface()
+
+	return true
+}
+
+func (o *NotificationOutbox) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_OUTBOX_SHOW, &MaoApi.ApiDoc{
+		Summary: "Show the notifications in the outbox, from new to old",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: OUTBOX_API_KEY_STATUS, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "queued, sent or failed, all if empty"},
+			{Name: OUTBOX_API_KEY_CHANNEL, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "e.g. email, wechat, all if empty"},
+		},
+		Response: []*MaoApi.Notification{},
+	}, o.showNotifications)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_OUTBOX_REQUEUE, &MaoApi.ApiDoc{
+		Summary:     "Requeue the failed notifications",
+		Description: "The notification of the id, or all of the status if the id is empty, is delivered again with the attempts reset.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: OUTBOX_API_KEY_ID, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING},
+			{Name: OUTBOX_API_KEY_STATUS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "failed or queued, used if the id is empty, default failed"},
+		},
+		Response: map[string]int{"requeued": 0},
+	}, o.processRequeue)
+}
+
+func (o *NotificationOutbox) showNotifications(c *gin.Context) {
+	c.JSON(http.StatusOK, o.GetNotifications(c.Query(OUTBOX_API_KEY_STATUS), c.Query(OUTBOX_API_KEY_CHANNEL)))
+}
+
+func (o *NotificationOutbox) processRequeue(c *gin.Context) {
+	id := c.PostForm(OUTBOX_API_KEY_ID)
+	status := c.DefaultPostForm(OUTBOX_API_KEY_STATUS, MaoApi.NOTIFICATION_STATUS_FAILED)
+	if id == "" && status != MaoApi.NOTIFICATION_STATUS_FAILED && status != MaoApi.NOTIFICATION_STATUS_QUEUED {
+		c.String(http.StatusBadRequest, "%s is invalid: %s", OUTBOX_API_KEY_STATUS, status)
+		return
+	}
+
+	target := id
+	if target == "" {
+		target = "all " + status
+	}
+	requeued, err := o.Requeue(id, status)
+	detail := fmt.Sprintf("%d requeued", requeued)
+	if err != nil {
+		detail = err.Error()
+	}
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "requeue notification", target, err == nil, detail)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]int{"requeued": requeued})
+}
@@ -0,0 +1,141 @@
+package Outbox
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitNotification(t *testing.T, o *NotificationOutbox, id string, check func(n *MaoApi.Notification) bool) *MaoApi.Notification {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range o.GetNotifications("", "") {
+			if n.Id == id && check(n) {
+				return n
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for notification %s, %+v", id, o.GetNotifications("", ""))
+	return nil
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, expect := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 9: time.Hour} {
+		if delay := retryDelay(attempts); delay != expect {
+			t.Errorf("attempts %d, expect %s, got %s", attempts, expect, delay)
+		}
+	}
+}
+
+func TestOutbox_DeliverRetryRequeue(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), DEFAULT_OUTBOX_FILE)
+	o := &NotificationOutbox{}
+	o.InitOutboxModule(filename)
+
+	id, err := o.Enqueue(MaoApi.NOTIFICATION_CHANNEL_EMAIL, "ICMP DOWN notification", &MaoApi.EmailMessage{Subject: "ICMP DOWN notification"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := o.GetNotifications(MaoApi.NOTIFICATION_STATUS_QUEUED, ""); len(n) != 1 || n[0].Attempts != 0 {
+		t.Fatalf("expect the notification queued without the channel, %+v", n)
+	}
+
+	var failing atomic.Bool
+	failing.Store(true)
+	delivered := make(chan string, 10)
+	o.RegisterChannel(MaoApi.NOTIFICATION_CHANNEL_EMAIL, 0, func(payload []byte) error {
+		if failing.Load() {
+			return errors.New("connection refused")
+		}
+		delivered <- string(payload)
+		return nil
+	})
+	n := waitNotification(t, o, id, func(n *MaoApi.Notification) bool { return n.Attempts == 1 })
+	if n.Status != MaoApi.NOTIFICATION_STATUS_QUEUED || n.LastError != "connection refused" || time.Until(n.NextAttempt) < 20*time.Second {
+		t.Errorf("expect the retry after the backoff, %+v", n)
+	}
+
+	// requeued at once, instead of waiting for the backoff.
+	failing.Store(false)
+	if count, err := o.Requeue("", MaoApi.NOTIFICATION_STATUS_QUEUED); err != nil || count != 1 {
+		t.Fatalf("unexpected requeue %d, %v", count, err)
+	}
+	n = waitNotification(t, o, id, func(n *MaoApi.Notification) bool { return n.Status == MaoApi.NOTIFICATION_STATUS_SENT })
+	if payload := <-delivered; !strings.Contains(payload, `"Subject":"ICMP DOWN notification"`) {
+		t.Errorf("unexpected payload %s", payload)
+	}
+	if n.SentAt == nil || n.LastError != "" {
+		t.Errorf("unexpected sent notification %+v", n)
+	}
+	if _, err = o.Requeue(id, ""); err == nil {
+		t.Errorf("expect the sent notification not requeued")
+	}
+
+	// gives up after the max attempts.
+	failed, _ := o.Enqueue(MaoApi.NOTIFICATION_CHANNEL_WECHAT, "no channel", &MaoApi.WechatMessage{Title: "no channel"})
+	o.lock.Lock()
+	target := o.notifications[len(o.notifications)-1]
+	target.Attempts = OUTBOX_MAX_ATTEMPTS - 1
+	o.lock.Unlock()
+	o.finishDelivery(target, errors.New("errcode 40014"), time.Now())
+	if n := o.GetNotifications(MaoApi.NOTIFICATION_STATUS_FAILED, MaoApi.NOTIFICATION_CHANNEL_WECHAT); len(n) != 1 || n[0].Id != failed {
+		t.Errorf("expect the notification failed, %+v", n)
+	}
+	if health := o.CheckHealth(); health.Status != MaoApi.HEALTH_STATUS_DEGRADED || health.Metrics["failed"] != 1 || health.Metrics["sent"] != 1 {
+		t.Errorf("unexpected health %+v", health)
+	}
+	o.Shutdown()
+
+	// the outbox is kept after restart, the failed one can be requeued.
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected outbox file %v, %v", info, err)
+	}
+	restarted := &NotificationOutbox{}
+	restarted.InitOutboxModule(filename)
+	defer restarted.Shutdown()
+	if n := restarted.GetNotifications("", ""); len(n) != 2 || n[0].Id != failed || n[1].Id != id {
+		t.Fatalf("unexpected notifications after restart %+v", n)
+	}
+	if count, err := restarted.Requeue("", MaoApi.NOTIFICATION_STATUS_FAILED); err != nil || count != 1 {
+		t.Errorf("unexpected requeue %d, %v", count, err)
+	}
+	if n := restarted.GetNotifications(MaoApi.NOTIFICATION_STATUS_QUEUED, ""); len(n) != 1 || n[0].Attempts != 0 {
+		t.Errorf("expect the failed one queued again, %+v", n)
+	}
+}
+
+func TestOutbox_Prune(t *testing.T) {
+	o := &NotificationOutbox{outboxFilename: filepath.Join(t.TempDir(), DEFAULT_OUTBOX_FILE)}
+	for i := 0; i < OUTBOX_KEEP_SENT+10; i++ {
+		o.notifications = append(o.notifications, &MaoApi.Notification{Id: "sent", Status: MaoApi.NOTIFICATION_STATUS_SENT})
+	}
+	o.notifications = append(o.notifications, &MaoApi.Notification{Id: "queued", Status: MaoApi.NOTIFICATION_STATUS_QUEUED})
+	o.pruneLocked()
+	if len(o.notifications) != OUTBOX_KEEP_SENT+1 || o.notifications[len(o.notifications)-1].Id != "queued" {
+		t.Errorf("unexpected notifications after prune, %d", len(o.notifications))
+	}
+}
+
+func TestOutbox_SendInterval(t *testing.T) {
+	o := &NotificationOutbox{}
+	o.InitOutboxModule(filepath.Join(t.TempDir(), DEFAULT_OUTBOX_FILE))
+	defer o.Shutdown()
+
+	first, _ := o.Enqueue(MaoApi.NOTIFICATION_CHANNEL_EMAIL, "first", &MaoApi.EmailMessage{Subject: "first"})
+	second, _ := o.Enqueue(MaoApi.NOTIFICATION_CHANNEL_EMAIL, "second", &MaoApi.EmailMessage{Subject: "second"})
+	o.RegisterChannel(MaoApi.NOTIFICATION_CHANNEL_EMAIL, 500*time.Millisecond, func(payload []byte) error { return nil })
+
+	sent := func(n *MaoApi.Notification) bool { return n.Status == MaoApi.NOTIFICATION_STATUS_SENT }
+	firstSent := waitNotification(t, o, first, sent).SentAt
+	secondSent := waitNotification(t, o, second, sent).SentAt
+	if gap := secondSent.Sub(*firstSent); gap < 500*time.Millisecond {
+		t.Errorf("expect the second one sent after the interval, gap %s", gap)
+	}
+}
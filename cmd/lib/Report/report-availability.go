@@ -0,0 +1,400 @@
+package Report
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TRANSITION_SERVER_START = "START"                      // all services are unknown until their next transition
+	TRANSITION_SERVER_STOP  = "STOP"                       // all services are unknown until the server starts
+	TRANSITION_REMOVED      = MaoApi.SERVICE_EVENT_REMOVED // the service is deleted, it is unknown from then on
+	TRANSITION_REPORT_SENT  = "REPORT"                     // the scheduled report is sent, the time is the end of its period
+)
+
+// transitionRecord is one line of the transition file.
+type transitionRecord struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"` // MaoApi.EMAIL_EVENT_UP, MaoApi.EMAIL_EVENT_DOWN or TRANSITION_*
+	Source      string    `json:"source,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	ServiceName string    `json:"serviceName,omitempty"`
+	Address     string    `json:"address,omitempty"`
+}
+
+func (r *transitionRecord) serviceKey() string {
+	return r.Source + "\x00" + r.Key
+}
+
+// MaintenanceWindow is excluded from the availability, either one-off by start and end, or weekly by weekdays and hours.
+type MaintenanceWindow struct {
+	Start    string   `yaml:"start,omitempty" json:"start,omitempty"` // RFC3339, e.g. 2026-10-01T02:00:00+08:00
+	End      string   `yaml:"end,omitempty" json:"end,omitempty"`
+	Weekdays []string `yaml:"weekdays,omitempty" json:"weekdays,omitempty" validate:"oneof=Sun|Mon|Tue|Wed|Thu|Fri|Sat"`
+	Hours    string   `yaml:"hours,omitempty" json:"hours,omitempty"` // e.g. 02:00-04:00 in the local time, it may cross midnight
+	Sources  []string `yaml:"sources,omitempty" json:"sources,omitempty" validate:"oneof=ICMP|gRPC"`
+	Services []string `yaml:"services,omitempty" json:"services,omitempty"` // glob patterns of the service names or addresses, all if empty
+	Comment  string   `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// interval is [start, end).
+type interval struct {
+	start, end time.Time
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseHours parses "HH:MM-HH:MM" into the minutes of the day, the end is before the start if it crosses midnight.
+func parseHours(s string) (int, int, error) {
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+	}
+	startMinute, err := parseMinuteOfDay(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	endMinute, err := parseMinuteOfDay(end)
+	if err != nil {
+		return 0, 0, err
+	}
+	if startMinute == endMinute {
+		return 0, 0, fmt.Errorf("%q is empty", s)
+	}
+	return startMinute, endMinute, nil
+}
+
+func (w *MaintenanceWindow) isWeekly() bool {
+	return len(w.Weekdays) > 0 || w.Hours != ""
+}
+
+// check returns the field and the error the schema can't validate, i.e. the times and the patterns.
+func (w *MaintenanceWindow) check() (string, error) {
+	if w.isWeekly() {
+		if w.Start != "" || w.End != "" {
+			return "start", fmt.Errorf("a window is either one-off by start and end, or weekly by weekdays and hours")
+		}
+		if len(w.Weekdays) == 0 {
+			return "weekdays", fmt.Errorf("is required by the hours")
+		}
+		if _, _, err := parseHours(w.Hours); err != nil {
+			return "hours", err
+		}
+	} else {
+		start, err := time.Parse(time.RFC3339, w.Start)
+		if err != nil {
+			return "start", fmt.Errorf("%q is not RFC3339, e.g. 2026-10-01T02:00:00+08:00", w.Start)
+		}
+		end, err := time.Parse(time.RFC3339, w.End)
+		if err != nil {
+			return "end", fmt.Errorf("%q is not RFC3339, e.g. 2026-10-01T04:00:00+08:00", w.End)
+		}
+		if !end.After(start) {
+			return "end", fmt.Errorf("must be after the start")
+		}
+	}
+	for _, pattern := range w.Services {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "services", fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return "", nil
+}
+
+func matchAny(values []string, filter func(string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if filter(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *MaintenanceWindow) match(source string, serviceName string, address string) bool {
+	return matchAny(w.Sources, func(s string) bool { return s == source }) &&
+		matchAny(w.Services, func(pattern string) bool {
+			if matched, _ := path.Match(pattern, serviceName); matched {
+				return true
+			}
+			matched, _ := path.Match(pattern, address)
+			return matched
+		})
+}
+
+// intervals returns the occurrences of the window overlapping [from, to), the invalid windows have none.
+func (w *MaintenanceWindow) intervals(from time.Time, to time.Time) []interval {
+	if _, err := w.check(); err != nil {
+		return nil
+	}
+	if !w.isWeekly() {
+		start, _ := time.Parse(time.RFC3339, w.Start)
+		end, _ := time.Parse(time.RFC3339, w.End)
+		if start.Before(to) && end.After(from) {
+			return []interval{{start, end}}
+		}
+		return nil
+	}
+
+	startMinute, endMinute, _ := parseHours(w.Hours)
+	weekdays := make(map[string]bool, len(w.Weekdays))
+	for _, weekday := range w.Weekdays {
+		weekdays[weekday] = true
+	}
+	result := make([]interval, 0)
+	// from the day before, its window may cross midnight.
+	local := from.Local()
+	for day := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, time.Local); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !weekdays[day.Weekday().String()[:3]] {
+			continue
+		}
+		start := day.Add(time.Duration(startMinute) * time.Minute)
+		end := day.Add(time.Duration(endMinute) * time.Minute)
+		if endMinute < startMinute {
+			end = end.AddDate(0, 0, 1)
+		}
+		if start.Before(to) && end.After(from) {
+			result = append(result, interval{start, end})
+		}
+	}
+	return result
+}
+
+// mergeIntervals sorts and unions the intervals.
+func mergeIntervals(intervals []interval) []interval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+	merged := make([]interval, 0, len(intervals))
+	for _, i := range intervals {
+		if n := len(merged); n > 0 && !i.start.After(merged[n-1].end) {
+			if i.end.After(merged[n-1].end) {
+				merged[n-1].end = i.end
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// overlap is the total time of the merged intervals in [start, end).
+func overlap(merged []interval, start time.Time, end time.Time) time.Duration {
+	total := time.Duration(0)
+	for _, i := range merged {
+		s, e := i.start, i.end
+		if s.Before(start) {
+			s = start
+		}
+		if e.After(end) {
+			e = end
+		}
+		if e.After(s) {
+			total += e.Sub(s)
+		}
+	}
+	return total
+}
+
+func contains(merged []interval, t time.Time) bool {
+	for _, i := range merged {
+		if !t.Before(i.start) && t.Before(i.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceState is the state of a service since the last transition while computing the report.
+type serviceState struct {
+	state       string // UP, DOWN, or empty if it is unknown
+	since       time.Time
+	maintenance []interval
+	up, down    time.Duration
+	maintained  time.Duration
+	unknown     time.Duration
+	row         *MaoApi.ServiceAvailability
+}
+
+// account adds the time of the state from since to until, clipped by [from, to).
+func (st *serviceState) account(until time.Time, from time.Time, to time.Time) {
+	start, end := st.since, until
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return
+	}
+	if st.state == "" {
+		st.unknown += end.Sub(start)
+		return
+	}
+	// only the monitored time is in the maintenance.
+	maintained := overlap(st.maintenance, start, end)
+	st.maintained += maintained
+	if st.state == MaoApi.EMAIL_EVENT_UP {
+		st.up += end.Sub(start) - maintained
+	} else {
+		st.down += end.Sub(start) - maintained
+	}
+}
+
+// computeAvailability replays the transitions sorted by time, for the services monitored in [from, to).
+// The time after now is not counted.
+func computeAvailability(records []*transitionRecord, windows []*MaintenanceWindow, from time.Time, to time.Time, now time.Time) *MaoApi.AvailabilityReport {
+	report := &MaoApi.AvailabilityReport{From: from, To: to, GeneratedAt: now, Services: make([]*MaoApi.ServiceAvailability, 0)}
+	if now.Before(to) {
+		to = now
+	}
+	if !to.After(from) {
+		return report
+	}
+
+	states := make(map[string]*serviceState)
+	keys := make([]string, 0)
+	for _, record := range records {
+		if !record.Time.Before(to) {
+			break
+		}
+		switch record.Type {
+		case TRANSITION_SERVER_START, TRANSITION_SERVER_STOP:
+			for _, st := range states {
+				st.account(record.Time, from, to)
+				st.state, st.since = "", record.Time
+			}
+		case MaoApi.EMAIL_EVENT_UP, MaoApi.EMAIL_EVENT_DOWN, TRANSITION_REMOVED:
+			key := record.serviceKey()
+			st, ok := states[key]
+			if !ok {
+				st = &serviceState{since: record.Time, row: &MaoApi.ServiceAvailability{Source: record.Source, Key: record.Key}}
+				states[key] = st
+				keys = append(keys, key)
+			}
+			if record.Type != TRANSITION_REMOVED {
+				if record.ServiceName != st.row.ServiceName || record.Address != st.row.Address {
+					st.row.ServiceName, st.row.Address = record.ServiceName, record.Address
+					st.maintenance = maintenanceOf(windows, st.row, from, to)
+				}
+			}
+			st.account(record.Time, from, to)
+			if record.Type == MaoApi.EMAIL_EVENT_DOWN && st.state != MaoApi.EMAIL_EVENT_DOWN &&
+				!record.Time.Before(from) && !contains(st.maintenance, record.Time) {
+				st.row.Outages++
+			}
+			st.state, st.since = record.Type, record.Time
+			if record.Type == TRANSITION_REMOVED {
+				st.state = ""
+			}
+		}
+	}
+
+	for _, key := range keys {
+		st := states[key]
+		st.account(to, from, to)
+		if st.up+st.down+st.maintained == 0 {
+			continue // not monitored in the period
+		}
+		row := st.row
+		row.UpSeconds, row.DownSeconds = int64(st.up.Seconds()), int64(st.down.Seconds())
+		row.MaintenanceSeconds, row.UnknownSeconds = int64(st.maintained.Seconds()), int64(st.unknown.Seconds())
+		if st.up+st.down > 0 {
+			availability := float64(st.up) * 100 / float64(st.up+st.down)
+			row.Availability = &availability
+		}
+		if row.Outages > 0 {
+			mttr, mtbf := st.down.Seconds()/float64(row.Outages), st.up.Seconds()/float64(row.Outages)
+			row.MttrSeconds, row.MtbfSeconds = &mttr, &mtbf
+		}
+		report.Services = append(report.Services, row)
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		if report.Services[i].Source != report.Services[j].Source {
+			return report.Services[i].Source < report.Services[j].Source
+		}
+		return report.Services[i].Key < report.Services[j].Key
+	})
+	return report
+}
+
+func maintenanceOf(windows []*MaintenanceWindow, row *MaoApi.ServiceAvailability, from time.Time, to time.Time) []interval {
+	intervals := make([]interval, 0)
+	for _, w := range windows {
+		if w.match(row.Source, row.ServiceName, row.Address) {
+			intervals = append(intervals, w.intervals(from, to)...)
+		}
+	}
+	return mergeIntervals(intervals)
+}
+
+func formatOptional(value *float64, precision int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', precision, 64)
+}
+
+var reportCsvHeader = []string{"source", "key", "serviceName", "address", "availability", "upSeconds", "downSeconds",
+	"maintenanceSeconds", "unknownSeconds", "outages", "mttrSeconds", "mtbfSeconds"}
+
+func writeReportCsv(w io.Writer, report *MaoApi.AvailabilityReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write(reportCsvHeader)
+	for _, s := range report.Services {
+		writer.Write([]string{s.Source, s.Key, s.ServiceName, s.Address, formatOptional(s.Availability, 4),
+			strconv.FormatInt(s.UpSeconds, 10), strconv.FormatInt(s.DownSeconds, 10),
+			strconv.FormatInt(s.MaintenanceSeconds, 10), strconv.FormatInt(s.UnknownSeconds, 10),
+			strconv.Itoa(s.Outages), formatOptional(s.MttrSeconds, 0), formatOptional(s.MtbfSeconds, 0)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatDuration(seconds *float64) string {
+	if seconds == nil {
+		return "-"
+	}
+	return (time.Duration(*seconds) * time.Second).String()
+}
+
+// formatReportText is the plaintext of the report email.
+func formatReportText(report *MaoApi.AvailabilityReport) string {
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "Availability from %s to %s\r\n\r\n", report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+	if len(report.Services) == 0 {
+		builder.WriteString("No service is monitored in the period.\r\n")
+		return builder.String()
+	}
+	fmt.Fprintf(builder, "%-6s %-32s %-24s %12s %8s %14s %14s\r\n", "Source", "Service", "Address", "Availability", "Outages", "MTTR", "MTBF")
+	for _, s := range report.Services {
+		availability := "-"
+		if s.Availability != nil {
+			availability = strconv.FormatFloat(*s.Availability, 'f', 3, 64) + "%"
+		}
+		name := s.ServiceName
+		if name == "" {
+			name = s.Key
+		}
+		fmt.Fprintf(builder, "%-6s %-32s %-24s %12s %8d %14s %14s\r\n", s.Source, name, s.Address, availability, s.Outages,
+			formatDuration(s.MttrSeconds), formatDuration(s.MtbfSeconds))
+	}
+	builder.WriteString("\r\nThe maintenance windows and the time not monitored are excluded from the availability.\r\n")
+	return builder.String()
+}
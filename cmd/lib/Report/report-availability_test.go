@@ -0,0 +1,223 @@
+package Report
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeAvailability(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 1)
+	at := func(hour int) time.Time { return from.Add(time.Duration(hour) * time.Hour) }
+	db := func(eventType string, hour int) *transitionRecord {
+		return &transitionRecord{Time: at(hour), Type: eventType, Source: "ICMP", Key: "10.0.0.1", ServiceName: "db-1", Address: "10.0.0.1"}
+	}
+	web := func(eventType string, hour int) *transitionRecord {
+		return &transitionRecord{Time: at(hour), Type: eventType, Source: "gRPC", Key: "web-1", ServiceName: "web-1", Address: "10.0.0.2"}
+	}
+	records := []*transitionRecord{
+		db(MaoApi.EMAIL_EVENT_UP, -24),
+		web(MaoApi.EMAIL_EVENT_UP, -2),
+		{Time: at(-1), Type: TRANSITION_SERVER_STOP},
+		{Time: at(1), Type: TRANSITION_SERVER_START}, // db-1 and web-1 are unknown
+		db(MaoApi.EMAIL_EVENT_UP, 2),
+		web(MaoApi.EMAIL_EVENT_UP, 3), // in the maintenance all day
+		db(MaoApi.EMAIL_EVENT_DOWN, 6),
+		db(MaoApi.EMAIL_EVENT_UP, 7),
+		db(MaoApi.EMAIL_EVENT_DOWN, 10), // in the maintenance, not an outage
+		db(MaoApi.EMAIL_EVENT_UP, 11),
+		db(MaoApi.EMAIL_EVENT_DOWN, 20),
+		db(MaoApi.EMAIL_EVENT_UP, 23),
+		{Time: at(24), Type: TRANSITION_REPORT_SENT},
+		web(MaoApi.EMAIL_EVENT_UP, 30),
+	}
+	windows := []*MaintenanceWindow{
+		{Start: at(9).Format(time.RFC3339), End: at(12).Format(time.RFC3339), Services: []string{"db-*"}},
+		{Start: at(0).Format(time.RFC3339), End: at(24).Format(time.RFC3339), Sources: []string{"gRPC"}},
+	}
+
+	report := computeAvailability(records, windows, from, to, to.Add(time.Hour))
+	if len(report.Services) != 2 {
+		t.Fatalf("expect db-1 and web-1, %+v", report.Services)
+	}
+	if web := report.Services[1]; web.Key != "web-1" || web.MaintenanceSeconds != 21*3600 || web.UnknownSeconds != 3*3600 || web.Availability != nil {
+		t.Errorf("expect web-1 in the maintenance, %+v", web)
+	}
+	row := report.Services[0]
+	// UP 2-6, 7-9, 12-20, 23-24; DOWN 6-7, 20-23; maintenance 9-12; unknown 0-2.
+	if row.UpSeconds != 15*3600 || row.DownSeconds != 4*3600 || row.MaintenanceSeconds != 3*3600 || row.UnknownSeconds != 2*3600 {
+		t.Errorf("unexpected time, %+v", row)
+	}
+	if row.Outages != 2 || *row.MttrSeconds != 2*3600 || *row.MtbfSeconds != 7.5*3600 {
+		t.Errorf("unexpected outages, %+v", row)
+	}
+	if *row.Availability < 78.94 || *row.Availability > 78.95 {
+		t.Errorf("expect availability 15/19, %f", *row.Availability)
+	}
+
+	// the time after now is not counted.
+	report = computeAvailability(records, nil, from, to, at(8))
+	if row := report.Services[0]; len(report.Services) != 2 || row.UpSeconds != 5*3600 || row.DownSeconds != 3600 || row.Outages != 1 {
+		t.Errorf("unexpected report until now, %+v", row)
+	}
+}
+
+func TestComputeAvailability_Removed(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)
+	records := []*transitionRecord{
+		{Time: from.Add(-time.Hour), Type: MaoApi.EMAIL_EVENT_UP, Source: "ICMP", Key: "10.0.0.1"},
+		{Time: from.Add(time.Hour), Type: TRANSITION_REMOVED, Source: "ICMP", Key: "10.0.0.1"},
+	}
+	report := computeAvailability(records, nil, from, from.AddDate(0, 0, 1), from.AddDate(0, 0, 2))
+	if row := report.Services[0]; row.UpSeconds != 3600 || row.UnknownSeconds != 23*3600 || row.MttrSeconds != nil || *row.Availability != 100 {
+		t.Errorf("expect unknown after removed, %+v", row)
+	}
+}
+
+func TestComputeAvailability_NeverUp(t *testing.T) {
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+	records := []*transitionRecord{
+		{Time: from.Add(-time.Hour), Type: TRANSITION_SERVER_START},
+		// recorded by the detecting module after the leave timeout, dated when the service is added.
+		{Time: from.Add(-time.Hour), Type: MaoApi.EMAIL_EVENT_DOWN, Source: "ICMP", Key: "10.0.0.1", Address: "10.0.0.1"},
+	}
+	report := computeAvailability(records, nil, from, to, to)
+	if len(report.Services) != 1 {
+		t.Fatalf("expect the service down all the month, %+v", report.Services)
+	}
+	if row := report.Services[0]; row.DownSeconds != int64(to.Sub(from).Seconds()) || row.UpSeconds != 0 || *row.Availability != 0 {
+		t.Errorf("expect 0%% availability, %+v", row)
+	}
+}
+
+func TestSlaReportModule_GetLastServiceEvents(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)
+	s := &SlaReportModule{records: []*transitionRecord{
+		{Time: now, Type: MaoApi.EMAIL_EVENT_UP, Source: "gRPC", Key: "web-1"},
+		{Time: now, Type: MaoApi.EMAIL_EVENT_UP, Source: "gRPC", Key: "web-2"},
+		{Time: now, Type: MaoApi.EMAIL_EVENT_UP, Source: "ICMP", Key: "10.0.0.1"},
+		{Time: now.Add(time.Hour), Type: TRANSITION_SERVER_STOP},
+		{Time: now.Add(time.Hour), Type: MaoApi.EMAIL_EVENT_DOWN, Source: "gRPC", Key: "web-1"},
+		{Time: now.Add(time.Hour), Type: TRANSITION_REMOVED, Source: "gRPC", Key: "web-2"},
+	}}
+	events := s.GetLastServiceEvents("gRPC")
+	if len(events) != 1 || events[0].Key != "web-1" || events[0].Type != MaoApi.EMAIL_EVENT_DOWN {
+		t.Errorf("expect the last DOWN of web-1 only, %+v", events)
+	}
+}
+
+func TestMaintenanceWindow_Intervals(t *testing.T) {
+	// 2026-09-06 is Sunday.
+	from := time.Date(2026, 9, 6, 0, 0, 0, 0, time.Local)
+	w := &MaintenanceWindow{Weekdays: []string{"Sat", "Sun"}, Hours: "23:00-01:00"}
+	intervals := w.intervals(from, from.AddDate(0, 0, 7))
+	expect := []time.Time{from.Add(-time.Hour), from.Add(23 * time.Hour), from.AddDate(0, 0, 6).Add(23 * time.Hour)}
+	if len(intervals) != len(expect) {
+		t.Fatalf("unexpected intervals, %+v", intervals)
+	}
+	for i, start := range expect {
+		if !intervals[i].start.Equal(start) || intervals[i].end.Sub(intervals[i].start) != 2*time.Hour {
+			t.Errorf("unexpected interval %d, %+v", i, intervals[i])
+		}
+	}
+
+	merged := mergeIntervals(append(intervals, interval{from, from.Add(24 * time.Hour)}))
+	if overlap(merged, from, from.AddDate(0, 0, 1)) != 24*time.Hour || len(merged) != 2 {
+		t.Errorf("unexpected merged intervals, %+v", merged)
+	}
+}
+
+func TestMaintenanceWindow_Check(t *testing.T) {
+	for field, w := range map[string]*MaintenanceWindow{
+		"start":    {Start: "2026-10-01 02:00", End: "2026-10-01T04:00:00Z"},
+		"end":      {Start: "2026-10-01T04:00:00Z", End: "2026-10-01T02:00:00Z"},
+		"weekdays": {Hours: "02:00-04:00"},
+		"hours":    {Weekdays: []string{"Sun"}, Hours: "02:00"},
+		"services": {Weekdays: []string{"Sun"}, Hours: "02:00-04:00", Services: []string{"db-["}},
+		"":         {Start: "2026-10-01T02:00:00+08:00", End: "2026-10-01T04:00:00+08:00"},
+	} {
+		if got, _ := w.check(); got != field {
+			t.Errorf("expect %q invalid, got %q", field, got)
+		}
+	}
+}
+
+func TestReportPeriod(t *testing.T) {
+	// Wednesday.
+	now := time.Date(2026, 10, 14, 9, 30, 0, 0, time.Local)
+	for schedule, expect := range map[string][2]time.Time{
+		REPORT_SCHEDULE_DAILY:   {time.Date(2026, 10, 13, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 14, 0, 0, 0, 0, time.Local)},
+		REPORT_SCHEDULE_WEEKLY:  {time.Date(2026, 10, 5, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 12, 0, 0, 0, 0, time.Local)},
+		REPORT_SCHEDULE_MONTHLY: {time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		if from, to := reportPeriod(schedule, now); !from.Equal(expect[0]) || !to.Equal(expect[1]) {
+			t.Errorf("unexpected %s period, %s - %s", schedule, from, to)
+		}
+	}
+
+	from, to, err := reportRange("2026-02", "", "", now)
+	if err != nil || !from.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)) || !to.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("unexpected month range, %s - %s, %v", from, to, err)
+	}
+	if from, to, err = reportRange("", "", "", now); err != nil || from.Day() != 1 || !to.Equal(now) {
+		t.Errorf("unexpected default range, %s - %s, %v", from, to, err)
+	}
+	if _, _, err = reportRange("", "2026-10-10", "2026-10-01", now); err == nil {
+		t.Errorf("expect to before from invalid")
+	}
+}
+
+func TestSlaReportModule_Prune(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)
+	old := now.AddDate(0, 0, -REPORT_DEFAULT_RETENTION_DAYS-1)
+	s := &SlaReportModule{transitionFilename: filepath.Join(t.TempDir(), DEFAULT_TRANSITION_FILE)}
+	s.records = []*transitionRecord{
+		{Time: old, Type: MaoApi.EMAIL_EVENT_DOWN, Source: "ICMP", Key: "a"},
+		{Time: old.Add(time.Minute), Type: MaoApi.EMAIL_EVENT_UP, Source: "ICMP", Key: "a"}, // kept, the last state of a
+		{Time: old.Add(2 * time.Minute), Type: MaoApi.EMAIL_EVENT_UP, Source: "ICMP", Key: "b"},
+		{Time: old.Add(3 * time.Minute), Type: TRANSITION_REMOVED, Source: "ICMP", Key: "b"},
+		{Time: old.Add(4 * time.Minute), Type: TRANSITION_SERVER_START}, // kept
+		{Time: now.Add(-time.Hour), Type: MaoApi.EMAIL_EVENT_DOWN, Source: "ICMP", Key: "a"},
+	}
+	s.pruneLocked(now)
+	defer s.file.Close()
+	if len(s.records) != 3 || s.records[0].Type != MaoApi.EMAIL_EVENT_UP || s.records[1].Type != TRANSITION_SERVER_START {
+		t.Fatalf("unexpected records after prune, %+v", s.records)
+	}
+
+	s.appendLocked(&transitionRecord{Time: now, Type: TRANSITION_REPORT_SENT})
+	data, _ := os.ReadFile(s.transitionFilename)
+	if lines := strings.Count(string(data), "\n"); lines != 4 || !s.lastSent.Equal(now) {
+		t.Errorf("expect 4 lines in the file, %d, last sent %s", lines, s.lastSent)
+	}
+
+	loaded := &SlaReportModule{transitionFilename: s.transitionFilename}
+	loaded.loadTransitions()
+	if len(loaded.records) != 4 || !loaded.lastSent.Equal(now) {
+		t.Errorf("unexpected records loaded, %+v", loaded.records)
+	}
+}
+
+func TestWriteReportCsv(t *testing.T) {
+	availability, mttr := 99.5, 60.0
+	report := &MaoApi.AvailabilityReport{Services: []*MaoApi.ServiceAvailability{
+		{Source: "ICMP", Key: "10.0.0.1", ServiceName: "db, primary", Availability: &availability, Outages: 1, MttrSeconds: &mttr},
+	}}
+	buffer := &bytes.Buffer{}
+	if err := writeReportCsv(buffer, report); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 || lines[1] != `ICMP,10.0.0.1,"db, primary",,99.5000,0,0,0,0,1,60,` {
+		t.Errorf("unexpected csv, %q", buffer.String())
+	}
+	if !strings.Contains(formatReportText(report), "99.500%") {
+		t.Errorf("unexpected text, %s", formatReportText(report))
+	}
+}
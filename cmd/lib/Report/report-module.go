@@ -0,0 +1,720 @@
+package Report
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MODULE_NAME = "SLA-Report-module"
+
+	DEFAULT_TRANSITION_FILE = "mao-transitions.jsonl"
+
+	URL_REPORT_SHOW        = "/getAvailabilityReport"
+	URL_REPORT_SEND        = "/sendAvailabilityReport"
+	URL_REPORT_CONFIG      = "/configReport"
+	URL_REPORT_CONFIG_SHOW = "/getReportConfig"
+
+	REPORT_CONFIG_PATH_ROOT = "/report"
+
+	REPORT_CONFIG_KEY_SCHEDULE       = "schedule"
+	REPORT_CONFIG_KEY_RECEIVERS      = "receivers"
+	REPORT_CONFIG_KEY_MAINTENANCE    = "maintenance"
+	REPORT_CONFIG_KEY_RETENTION_DAYS = "retentionDays"
+
+	REPORT_API_KEY_FROM   = "from"
+	REPORT_API_KEY_TO     = "to"
+	REPORT_API_KEY_MONTH  = "month"
+	REPORT_API_KEY_FORMAT = "format"
+
+	REPORT_FORMAT_JSON = "json"
+	REPORT_FORMAT_CSV  = "csv"
+
+	REPORT_SCHEDULE_OFF     = "off"
+	REPORT_SCHEDULE_DAILY   = "daily"
+	REPORT_SCHEDULE_WEEKLY  = "weekly"  // from Monday
+	REPORT_SCHEDULE_MONTHLY = "monthly" // from the 1st
+
+	REPORT_DEFAULT_RETENTION_DAYS = 400
+	REPORT_PRUNE_INTERVAL         = 24 * time.Hour
+)
+
+// ReportConfig is the schema of REPORT_CONFIG_PATH_ROOT.
+type ReportConfig struct {
+	Schedule      string               `yaml:"schedule,omitempty" json:"schedule,omitempty" validate:"oneof=off|daily|weekly|monthly"` // the report of the last period is emailed, off by default
+	Receivers     []string             `yaml:"receivers,omitempty" json:"receivers,omitempty" validate:"email"`                        // the receivers of the email config if empty
+	Maintenance   []*MaintenanceWindow `yaml:"maintenance,omitempty" json:"maintenance,omitempty"`
+	RetentionDays int                  `yaml:"retentionDays,omitempty" json:"retentionDays,omitempty" validate:"min=0,max=3660"` // 0 is REPORT_DEFAULT_RETENTION_DAYS
+}
+
+// SlaReportModule records the UP and DOWN transitions of the KA modules to an append-only file,
+// and computes the availability, the outages, MTTR and MTBF of the services from them.
+type SlaReportModule struct {
+	transitionFilename string
+
+	records     []*transitionRecord // sorted by time
+	file        *os.File
+	lastSent    time.Time // the end of the period of the last scheduled report
+	lastPrune   time.Time
+	writeErrors int64
+	lastError   string
+
+	schedule      string
+	receivers     []string
+	maintenance   []*MaintenanceWindow
+	retentionDays int
+
+	lock sync.Mutex
+
+	configUpdateChannel chan int
+
+	needShutdown atomic.Bool
+	exited       chan struct{} // closed when reportLoop exits
+}
+
+func (s *SlaReportModule) RequireShutdown() {
+	s.needShutdown.Store(true)
+}
+
+func (s *SlaReportModule) Shutdown() {
+	s.RequireShutdown()
+	<-s.exited
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.appendLocked(&transitionRecord{Time: time.Now(), Type: TRANSITION_SERVER_STOP})
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// RecordServiceEvent records the transition. The DOWN is dated when the service was seen last time, not when it is detected.
+func (s *SlaReportModule) RecordServiceEvent(event *MaoApi.EmailServiceEvent) {
+	record := &transitionRecord{
+		Time:        event.Timestamp,
+		Type:        event.Type,
+		Source:      event.Source,
+		Key:         event.Key,
+		ServiceName: event.ServiceName,
+		Address:     event.Address,
+	}
+	if event.Type == MaoApi.EMAIL_EVENT_DOWN && !event.LastSeen.IsZero() && event.LastSeen.Before(event.Timestamp) {
+		record.Time = event.LastSeen
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	s.lock.Lock()
+	s.appendLocked(record)
+	s.lock.Unlock()
+}
+
+func (s *SlaReportModule) GetLastServiceEvents(source string) []*MaoApi.EmailServiceEvent {
+	s.lock.Lock()
+	records := s.records
+	s.lock.Unlock()
+
+	last := make(map[string]*transitionRecord)
+	keys := make([]string, 0)
+	for _, record := range records {
+		if record.Source != source {
+			continue
+		}
+		if _, ok := last[record.Key]; !ok {
+			keys = append(keys, record.Key)
+		}
+		last[record.Key] = record
+	}
+
+	events := make([]*MaoApi.EmailServiceEvent, 0, len(keys))
+	for _, key := range keys {
+		record := last[key]
+		if record.Type == TRANSITION_REMOVED {
+			continue
+		}
+		events = append(events, &MaoApi.EmailServiceEvent{
+			Type:        record.Type,
+			Source:      record.Source,
+			ServiceName: record.ServiceName,
+			Address:     record.Address,
+			Key:         record.Key,
+			Timestamp:   record.Time,
+		})
+	}
+	return events
+}
+
+func (s *SlaReportModule) GetAvailabilityReport(from time.Time, to time.Time) *MaoApi.AvailabilityReport {
+	s.lock.Lock()
+	records, maintenance := s.records, s.maintenance
+	s.lock.Unlock()
+
+	return computeAvailability(records, maintenance, from, to, time.Now())
+}
+
+func (s *SlaReportModule) CheckHealth() *MaoApi.ModuleHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: fmt.Sprintf("schedule %s", s.scheduleName()),
+		Metrics: map[string]int64{
+			"transitions": int64(len(s.records)),
+			"writeErrors": s.writeErrors,
+		},
+	}
+	if !s.lastSent.IsZero() {
+		health.Detail += ", last report to " + s.lastSent.Format(time.RFC3339)
+	}
+	if s.lastError != "" {
+		health.Status = MaoApi.HEALTH_STATUS_DEGRADED
+		health.Detail = fmt.Sprintf("fail to record the transitions to %s, %s", s.transitionFilename, s.lastError)
+	}
+	return health
+}
+
+func (s *SlaReportModule) scheduleName() string {
+	if s.schedule == "" {
+		return REPORT_SCHEDULE_OFF
+	}
+	return s.schedule
+}
+
+// appendLocked keeps the records sorted, and appends the record to the file.
+func (s *SlaReportModule) appendLocked(record *transitionRecord) {
+	i := len(s.records)
+	for i > 0 && s.records[i-1].Time.After(record.Time) {
+		i--
+	}
+	if i == len(s.records) {
+		s.records = append(s.records, record)
+	} else {
+		// copied, the reports being computed keep the old slice.
+		records := make([]*transitionRecord, 0, len(s.records)+1)
+		records = append(append(append(records, s.records[:i]...), record), s.records[i:]...)
+		s.records = records
+	}
+
+	if record.Type == TRANSITION_REPORT_SENT && record.Time.After(s.lastSent) {
+		s.lastSent = record.Time
+	}
+
+	err := errors.New("the transition file is not open")
+	if s.file != nil {
+		var data []byte
+		if data, err = json.Marshal(record); err == nil {
+			_, err = s.file.Write(append(data, '\n'))
+		}
+	}
+	if err != nil {
+		s.writeErrors++
+		if s.lastError == "" {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to record the transition to %s, %s", s.transitionFilename, err.Error())
+		}
+		s.lastError = err.Error()
+		return
+	}
+	s.lastError = ""
+}
+
+// pruneLocked removes the records older than the retention, except the last state of each service,
+// the last START or STOP, and the last report before it, which the later records depend on.
+func (s *SlaReportModule) pruneLocked(now time.Time) {
+	s.lastPrune = now
+	retentionDays := s.retentionDays
+	if retentionDays <= 0 {
+		retentionDays = REPORT_DEFAULT_RETENTION_DAYS
+	}
+	cutoff := now.AddDate(0, 0, -retentionDays)
+
+	keep := make(map[string]int) // the index of the last record before the cutoff, by the service or the type
+	old := 0
+	for ; old < len(s.records) && s.records[old].Time.Before(cutoff); old++ {
+		switch record := s.records[old]; record.Type {
+		case TRANSITION_SERVER_START, TRANSITION_SERVER_STOP:
+			keep["\x00server"] = old
+		case TRANSITION_REPORT_SENT:
+			keep["\x00report"] = old
+		default:
+			keep[record.serviceKey()] = old
+		}
+	}
+	if old == 0 {
+		return
+	}
+	indexes := make([]int, 0, len(keep))
+	for _, i := range keep {
+		if s.records[i].Type != TRANSITION_REMOVED {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == old {
+		return
+	}
+	sort.Ints(indexes)
+	records := make([]*transitionRecord, 0, len(indexes)+len(s.records)-old)
+	for _, i := range indexes {
+		records = append(records, s.records[i])
+	}
+	records = append(records, s.records[old:]...)
+
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+	if err := util.WriteFileAtomic(s.transitionFilename, buffer.Bytes(), 0600); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to prune %s, %s", s.transitionFilename, err.Error())
+		return
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Pruned %d transitions older than %d days", len(s.records)-len(records), retentionDays)
+	s.records = records
+	s.openFileLocked()
+}
+
+func (s *SlaReportModule) openFileLocked() {
+	if s.file != nil {
+		s.file.Close()
+	}
+	file, err := os.OpenFile(s.transitionFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to open %s, the transitions are not recorded. (%s)", s.transitionFilename, err.Error())
+		s.file, s.lastError = nil, err.Error()
+		return
+	}
+	s.file = file
+}
+
+// loadTransitions reads the transitions recorded before, the broken lines are skipped, e.g. the last one written partially.
+func (s *SlaReportModule) loadTransitions() {
+	file, err := os.Open(s.transitionFilename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read %s, %s", s.transitionFilename, err.Error())
+		return
+	}
+	defer file.Close()
+
+	records, broken := make([]*transitionRecord, 0), 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record := &transitionRecord{}
+		if err := json.Unmarshal(line, record); err != nil || record.Time.IsZero() {
+			broken++
+			continue
+		}
+		records = append(records, record)
+		if record.Type == TRANSITION_REPORT_SENT && record.Time.After(s.lastSent) {
+			s.lastSent = record.Time
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read %s, %s", s.transitionFilename, err.Error())
+	}
+	if broken > 0 {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Skip %d broken lines of %s", broken, s.transitionFilename)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	s.records = records
+	util.MaoLogM(util.INFO, MODULE_NAME, "Loaded %d transitions from %s", len(records), s.transitionFilename)
+}
+
+func (s *SlaReportModule) loadReportConfig() {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return
+	}
+
+	reportConfig := &ReportConfig{}
+	errCode := configModule.GetConfigInto(REPORT_CONFIG_PATH_ROOT, reportConfig)
+	if errCode == Config.ERR_CODE_PATH_TRANSIT_FAIL || errCode == Config.ERR_CODE_PATH_NOT_EXIST {
+		util.MaoLogM(util.DEBUG, MODULE_NAME, "There is no report config, the scheduled report is off.")
+		return
+	}
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read report config, code: %d, %v", errCode, errCode)
+		return
+	}
+
+	s.lock.Lock()
+	s.applyConfigLocked(reportConfig)
+	s.lock.Unlock()
+}
+
+func (s *SlaReportModule) applyConfigLocked(reportConfig *ReportConfig) {
+	s.schedule = reportConfig.Schedule
+	s.receivers = reportConfig.Receivers
+	s.maintenance = reportConfig.Maintenance
+	s.retentionDays = reportConfig.RetentionDays
+}
+
+// reportPeriod returns the last whole period of the schedule before now, in the local time.
+func reportPeriod(schedule string, now time.Time) (time.Time, time.Time) {
+	now = now.Local()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch schedule {
+	case REPORT_SCHEDULE_DAILY:
+		return today.AddDate(0, 0, -1), today
+	case REPORT_SCHEDULE_WEEKLY:
+		monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return monday.AddDate(0, 0, -7), monday
+	default:
+		first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+		return first.AddDate(0, -1, 0), first
+	}
+}
+
+// sendReport emails the report by the email module, to the report receivers, or as the email config routes it.
+func (s *SlaReportModule) sendReport(from time.Time, to time.Time) error {
+	emailModule := MaoCommon.ServiceRegistryGetEmailModule()
+	if emailModule == nil {
+		return errors.New("fail to get EmailModule")
+	}
+	s.lock.Lock()
+	receivers := s.receivers
+	s.lock.Unlock()
+
+	report := s.GetAvailabilityReport(from, to)
+	emailModule.SendEmail(&MaoApi.EmailMessage{
+		Subject: fmt.Sprintf("Availability report %s to %s",
+			from.Local().Format("2006-01-02"), to.Add(-time.Nanosecond).Local().Format("2006-01-02")),
+		Content:   formatReportText(report),
+		Receivers: receivers,
+	})
+	return nil
+}
+
+// checkSchedule sends the report of the last period if it is not sent, e.g. the server was stopped at the end of the period.
+func (s *SlaReportModule) checkSchedule(now time.Time) {
+	s.lock.Lock()
+	schedule, lastSent := s.scheduleName(), s.lastSent
+	if now.Sub(s.lastPrune) >= REPORT_PRUNE_INTERVAL {
+		s.pruneLocked(now)
+	}
+	s.lock.Unlock()
+
+	if schedule == REPORT_SCHEDULE_OFF {
+		return
+	}
+	from, to := reportPeriod(schedule, now)
+	if !lastSent.Before(to) {
+		return
+	}
+	if err := s.sendReport(from, to); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send the %s report, %s", schedule, err.Error())
+		return
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Sent the %s report from %s to %s", schedule, from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	s.lock.Lock()
+	s.appendLocked(&transitionRecord{Time: to, Type: TRANSITION_REPORT_SENT})
+	s.lock.Unlock()
+}
+
+func (s *SlaReportModule) reportLoop() {
+	defer close(s.exited)
+
+	checkInterval := time.Duration(1000) * time.Millisecond
+	checkTimer := time.NewTimer(checkInterval)
+	for {
+		select {
+		case <-s.configUpdateChannel:
+			s.loadReportConfig()
+		case <-checkTimer.C:
+			if s.needShutdown.Load() {
+				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+				return
+			}
+			s.checkSchedule(time.Now())
+			checkTimer.Reset(checkInterval)
+		}
+	}
+}
+
+func (s *SlaReportModule) InitSlaReportModule(transitionFilename string) bool {
+	s.transitionFilename = transitionFilename
+	s.records = make([]*transitionRecord, 0)
+	s.configUpdateChannel = make(chan int, 1)
+	s.needShutdown.Store(false)
+	s.exited = make(chan struct{})
+
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		configModule.RegisterConfigSchema(REPORT_CONFIG_PATH_ROOT, &ReportConfig{})
+		configModule.RegisterConfigUpdateListener(REPORT_CONFIG_PATH_ROOT, &s.configUpdateChannel)
+	}
+	s.loadReportConfig()
+	s.loadTransitions()
+
+	s.lock.Lock()
+	s.pruneLocked(time.Now())
+	if s.file == nil {
+		s.openFileLocked()
+	}
+	// the services are unknown until they are seen again.
+	s.appendLocked(&transitionRecord{Time: time.Now(), Type: TRANSITION_SERVER_START})
+	s.lock.Unlock()
+
+	go s.reportLoop()
+
+	s.configRestControlInterface()
+
+	return true
+}
+
+func (s *SlaReportModule) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	rangeParams := func(in string) []*MaoApi.ApiParam {
+		return []*MaoApi.ApiParam{
+			{Name: REPORT_API_KEY_MONTH, In: in, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "e.g. 2026-09, the whole month in the local time, instead of from and to"},
+			{Name: REPORT_API_KEY_FROM, In: in, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "2006-01-02 in the local time or RFC3339, the 1st of this month by default"},
+			{Name: REPORT_API_KEY_TO, In: in, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "exclusive, 2006-01-02 in the local time or RFC3339, now by default"},
+		}
+	}
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_REPORT_SHOW, &MaoApi.ApiDoc{
+		Summary: "Show the availability, the outages, MTTR and MTBF of the services",
+		Description: "Computed from the UP and DOWN transitions of the ICMP and gRPC KA modules. " +
+			"The maintenance windows and the time not monitored are excluded from the availability.",
+		Tag: MODULE_NAME,
+		Params: append(rangeParams(MaoApi.API_PARAM_IN_QUERY), &MaoApi.ApiParam{
+			Name: REPORT_API_KEY_FORMAT, In: MaoApi.API_PARAM_IN_QUERY, Type: MaoApi.API_PARAM_TYPE_STRING,
+			Description: "json or csv, json by default, csv is downloaded as a file"}),
+		Response: &MaoApi.AvailabilityReport{},
+	}, s.showAvailabilityReport)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_REPORT_SEND, &MaoApi.ApiDoc{
+		Summary:     "Email the availability report now",
+		Description: "Sent to the report receivers, or the receivers of the email config if they are empty.",
+		Tag:         MODULE_NAME,
+		Params:      rangeParams(MaoApi.API_PARAM_IN_FORM),
+	}, s.processSendReport)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_REPORT_CONFIG_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the report config",
+		Tag:      MODULE_NAME,
+		Response: &ReportConfig{},
+	}, s.showReportConfig)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_REPORT_CONFIG, &MaoApi.ApiDoc{
+		Summary:     "Update the report config",
+		Description: "Only the provided fields are updated. Replies the report config, or 400 with the invalid fields (MaoApi.ConfigSchemaError).",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: REPORT_CONFIG_KEY_SCHEDULE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "off, daily, weekly (from Monday) or monthly, the report of the last period is emailed"},
+			{Name: REPORT_CONFIG_KEY_RECEIVERS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "email addresses separated by whitespace, the receivers of the email config if empty"},
+			{Name: REPORT_CONFIG_KEY_MAINTENANCE, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "JSON list of {start, end} in RFC3339 or {weekdays, hours}, with the optional sources, services and comment"},
+			{Name: REPORT_CONFIG_KEY_RETENTION_DAYS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_INTEGER,
+				Description: "the transitions older than it are removed, 0 is 400"},
+		},
+		Response: &ReportConfig{},
+	}, s.processReportConfig)
+}
+
+// parseReportTime parses the date in the local time, or RFC3339.
+func parseReportTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// reportRange returns the period of the params, this month until now by default.
+func reportRange(month string, fromStr string, toStr string, now time.Time) (time.Time, time.Time, error) {
+	month, fromStr, toStr = strings.TrimSpace(month), strings.TrimSpace(fromStr), strings.TrimSpace(toStr)
+	if month != "" {
+		first, err := time.ParseInLocation("2006-01", month, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s is invalid: %s", REPORT_API_KEY_MONTH, month)
+		}
+		return first, first.AddDate(0, 1, 0), nil
+	}
+
+	local := now.Local()
+	from, to := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, time.Local), now
+	var err error
+	if fromStr != "" {
+		if from, err = parseReportTime(fromStr); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s is invalid: %s", REPORT_API_KEY_FROM, fromStr)
+		}
+	}
+	if toStr != "" {
+		if to, err = parseReportTime(toStr); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s is invalid: %s", REPORT_API_KEY_TO, toStr)
+		}
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s must be after %s", REPORT_API_KEY_TO, REPORT_API_KEY_FROM)
+	}
+	return from, to, nil
+}
+
+func (s *SlaReportModule) showAvailabilityReport(c *gin.Context) {
+	from, to, err := reportRange(c.Query(REPORT_API_KEY_MONTH), c.Query(REPORT_API_KEY_FROM), c.Query(REPORT_API_KEY_TO), time.Now())
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	format := c.DefaultQuery(REPORT_API_KEY_FORMAT, REPORT_FORMAT_JSON)
+	if format != REPORT_FORMAT_JSON && format != REPORT_FORMAT_CSV {
+		c.String(http.StatusBadRequest, "%s is invalid: %s", REPORT_API_KEY_FORMAT, format)
+		return
+	}
+
+	report := s.GetAvailabilityReport(from, to)
+	if format == REPORT_FORMAT_JSON {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	filename := fmt.Sprintf("mao-availability-%s-%s.csv", from.Local().Format("20060102"), to.Local().Format("20060102"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := writeReportCsv(c.Writer, report); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to write the CSV report, %s", err.Error())
+	}
+}
+
+func (s *SlaReportModule) processSendReport(c *gin.Context) {
+	from, to, err := reportRange(c.PostForm(REPORT_API_KEY_MONTH), c.PostForm(REPORT_API_KEY_FROM), c.PostForm(REPORT_API_KEY_TO), time.Now())
+	if err == nil {
+		err = s.sendReport(from, to)
+	}
+	target := fmt.Sprintf("%s to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	detail := "success"
+	if err != nil {
+		detail = err.Error()
+	}
+	MaoCommon.RecordAudit(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), c.ClientIP(), "send availability report", target, err == nil, detail)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.String(http.StatusOK, "success")
+}
+
+func (s *SlaReportModule) currentConfig() *ReportConfig {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &ReportConfig{
+		Schedule:      s.schedule,
+		Receivers:     s.receivers,
+		Maintenance:   s.maintenance,
+		RetentionDays: s.retentionDays,
+	}
+}
+
+func (s *SlaReportModule) showReportConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, s.currentConfig())
+}
+
+func (s *SlaReportModule) processReportConfig(c *gin.Context) {
+	reportConfig := s.currentConfig()
+
+	if schedule, ok := c.GetPostForm(REPORT_CONFIG_KEY_SCHEDULE); ok {
+		reportConfig.Schedule = strings.TrimSpace(schedule)
+	}
+	if receivers, ok := c.GetPostForm(REPORT_CONFIG_KEY_RECEIVERS); ok {
+		reportConfig.Receivers = strings.Fields(receivers)
+	}
+	if maintenanceStr, ok := c.GetPostForm(REPORT_CONFIG_KEY_MAINTENANCE); ok {
+		maintenance := make([]*MaintenanceWindow, 0)
+		if strings.TrimSpace(maintenanceStr) != "" {
+			if err := json.Unmarshal([]byte(maintenanceStr), &maintenance); err != nil {
+				c.JSON(http.StatusBadRequest, &MaoApi.ConfigSchemaError{Path: REPORT_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+					{Field: REPORT_CONFIG_KEY_MAINTENANCE, Message: "must be a JSON list, " + err.Error()},
+				}})
+				return
+			}
+		}
+		for i, window := range maintenance {
+			if window == nil {
+				continue // rejected by the schema
+			}
+			if field, err := window.check(); err != nil {
+				c.JSON(http.StatusBadRequest, &MaoApi.ConfigSchemaError{Path: REPORT_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+					{Field: fmt.Sprintf("%s[%d].%s", REPORT_CONFIG_KEY_MAINTENANCE, i, field), Message: err.Error()},
+				}})
+				return
+			}
+		}
+		reportConfig.Maintenance = maintenance
+	}
+	if retentionStr, ok := c.GetPostForm(REPORT_CONFIG_KEY_RETENTION_DAYS); ok {
+		retentionDays, err := strconv.Atoi(strings.TrimSpace(retentionStr))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, &MaoApi.ConfigSchemaError{Path: REPORT_CONFIG_PATH_ROOT, Fields: []*MaoApi.ConfigFieldError{
+				{Field: REPORT_CONFIG_KEY_RETENTION_DAYS, Message: "must be an integer"},
+			}})
+			return
+		}
+		reportConfig.RetentionDays = retentionDays
+	}
+
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance, can't save report config")
+	} else {
+		// the invalid fields are shown, and nothing is changed.
+		if err := configModule.ValidateConfig(REPORT_CONFIG_PATH_ROOT, reportConfig); err != nil {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+
+		data := make(map[string]interface{})
+		if reportConfig.Schedule != "" {
+			data[REPORT_CONFIG_KEY_SCHEDULE] = reportConfig.Schedule
+		}
+		if len(reportConfig.Receivers) > 0 {
+			data[REPORT_CONFIG_KEY_RECEIVERS] = reportConfig.Receivers
+		}
+		if len(reportConfig.Maintenance) > 0 {
+			data[REPORT_CONFIG_KEY_MAINTENANCE] = reportConfig.Maintenance
+		}
+		if reportConfig.RetentionDays != 0 {
+			data[REPORT_CONFIG_KEY_RETENTION_DAYS] = reportConfig.RetentionDays
+		}
+		configModule.PutConfigBy(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), REPORT_CONFIG_PATH_ROOT, data)
+	}
+
+	s.lock.Lock()
+	s.applyConfigLocked(reportConfig)
+	s.lock.Unlock()
+
+	c.JSON(http.StatusOK, reportConfig)
+}
@@ -0,0 +1,38 @@
+package RestApiV2
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const (
+	ERR_INVALID_PARAMETER = "invalid_parameter"
+	ERR_NOT_FOUND         = "not_found"
+	ERR_UNAVAILABLE       = "unavailable"
+	ERR_INTERNAL          = "internal_error"
+)
+
+// ErrorBody is the body of all non-2xx responses of the v2 API.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"` // the query parameter or body field which is invalid
+}
+
+func replyError(c *gin.Context, httpStatus int, code string, field string, message string) {
+	c.AbortWithStatusJSON(httpStatus, &ErrorBody{
+		Error: ErrorDetail{
+			Code:    code,
+			Message: message,
+			Field:   field,
+		},
+	})
+}
+
+func replyInvalidParameter(c *gin.Context, field string, message string) {
+	replyError(c, http.StatusBadRequest, ERR_INVALID_PARAMETER, field, message)
+}
@@ -0,0 +1,514 @@
+package RestApiV2
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MODULE_NAME = "RestApiV2-module"
+
+	URL_V2_SERVICES = "/v2/services"
+	// key: the address for ICMP services, the hostname for gRPC services.
+	URL_V2_SERVICE        = "/v2/services/:source/:key"
+	URL_V2_SERVICE_LABELS = "/v2/services/:source/:key/labels"
+
+	SERVICE_LABELS_CONFIG_PATH = MaoApi.SERVICE_LABELS_CONFIG_PATH
+
+	DEFAULT_PAGE_SIZE = 50
+	MAX_PAGE_SIZE     = 500
+
+	MAX_LABELS_PER_SERVICE = 32
+)
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,63}$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.:/@-]{0,128}$`)
+
+	// sort key -> less function
+	serviceSortFields = map[string]func(a, b *ServiceResource) bool{
+		"id":       func(a, b *ServiceResource) bool { return a.Id < b.Id },
+		"name":     func(a, b *ServiceResource) bool { return a.Name < b.Name },
+		"source":   func(a, b *ServiceResource) bool { return a.Source < b.Source },
+		"alive":    func(a, b *ServiceResource) bool { return !a.Alive && b.Alive },
+		"lastSeen": func(a, b *ServiceResource) bool { return a.LastSeen.Before(b.LastSeen) },
+		"rttNs":    func(a, b *ServiceResource) bool { return a.RttNs < b.RttNs },
+	}
+)
+
+// ServiceResource is the normalized view of the services detected by all KA modules.
+type ServiceResource struct {
+	Id        string            `json:"id"` // <source>/<key>
+	Source    string            `json:"source"`
+	Name      string            `json:"name"`
+	Addresses []string          `json:"addresses"`
+	Alive     bool              `json:"alive"`
+	LastSeen  time.Time         `json:"lastSeen"`
+	RttNs     int64             `json:"rttNs"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type ServiceListResponse struct {
+	Items    []interface{} `json:"items"`
+	Total    int           `json:"total"` // the number of matched services before pagination
+	Page     int           `json:"page"`
+	PageSize int           `json:"pageSize"`
+}
+
+type serviceQuery struct {
+	alive    *bool
+	sources  map[string]bool // lower case
+	nameGlob string
+	labels   map[string]*string // nil value: only require the key exists
+
+	sortFields []string // "-" prefix for descending
+	page       int
+	pageSize   int
+	fields     []string
+}
+
+type ServiceApiV2Module struct {
+}
+
+func (m *ServiceApiV2Module) InitServiceApiV2Module() bool {
+	m.configRestControlInterface()
+	return true
+}
+
+func (m *ServiceApiV2Module) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	query := func(name string, typ string, description string) *MaoApi.ApiParam {
+		return &MaoApi.ApiParam{Name: name, In: MaoApi.API_PARAM_IN_QUERY, Type: typ, Description: description}
+	}
+	sourceParam := &MaoApi.ApiParam{Name: "source", In: MaoApi.API_PARAM_IN_PATH, Type: MaoApi.API_PARAM_TYPE_STRING,
+		Description: fmt.Sprintf("%s or %s, case-insensitive", MaoApi.SOURCE_ICMP, MaoApi.SOURCE_GRPC)}
+	keyParam := &MaoApi.ApiParam{Name: "key", In: MaoApi.API_PARAM_IN_PATH, Type: MaoApi.API_PARAM_TYPE_STRING,
+		Description: "the address for ICMP services, the hostname for gRPC services"}
+
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_V2_SERVICES, &MaoApi.ApiDoc{
+		Summary: "List services of all sources",
+		Tag:     MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			query("alive", MaoApi.API_PARAM_TYPE_BOOLEAN, "only alive or dead services"),
+			query("source", MaoApi.API_PARAM_TYPE_STRING, "sources separated by comma"),
+			query("name", MaoApi.API_PARAM_TYPE_STRING, "glob of the name, e.g. node-*"),
+			query("label", MaoApi.API_PARAM_TYPE_STRING, "key or key=value, repeatable, all must match"),
+			query("sort", MaoApi.API_PARAM_TYPE_STRING, "fields separated by comma, - prefix for descending, e.g. -alive,name"),
+			query("page", MaoApi.API_PARAM_TYPE_INTEGER, "starts from 1"),
+			query("pageSize", MaoApi.API_PARAM_TYPE_INTEGER, fmt.Sprintf("default %d, at most %d", DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)),
+			query("fields", MaoApi.API_PARAM_TYPE_STRING, "fields of items to return, separated by comma"),
+		},
+		Response: &struct {
+			ServiceListResponse
+			Items []*ServiceResource `json:"items"`
+		}{},
+	}, m.listServices)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_V2_SERVICE, &MaoApi.ApiDoc{
+		Summary:  "Show a service",
+		Tag:      MODULE_NAME,
+		Params:   []*MaoApi.ApiParam{sourceParam, keyParam},
+		Response: &ServiceResource{},
+	}, m.getService)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_OPERATOR, URL_V2_SERVICE_LABELS, &MaoApi.ApiDoc{
+		Summary:     "Replace all labels of a service",
+		Description: "The service doesn't need to be detected yet. Empty labels for removing all.",
+		Tag:         MODULE_NAME,
+		Params:      []*MaoApi.ApiParam{sourceParam, keyParam},
+		RequestBody: &struct {
+			Labels map[string]string `json:"labels"`
+		}{},
+		Response: &struct {
+			Labels map[string]string `json:"labels"`
+		}{},
+	}, m.setServiceLabels)
+}
+
+func parseServiceQuery(c *gin.Context) (query *serviceQuery, field string, err error) {
+	query = &serviceQuery{
+		sortFields: []string{"id"},
+		page:       1,
+		pageSize:   DEFAULT_PAGE_SIZE,
+	}
+
+	if v, ok := c.GetQuery("alive"); ok {
+		alive, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, "alive", fmt.Errorf("alive should be true or false")
+		}
+		query.alive = &alive
+	}
+
+	if v, ok := c.GetQuery("source"); ok {
+		query.sources = make(map[string]bool)
+		for _, s := range strings.Split(v, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if s != strings.ToLower(MaoApi.SOURCE_ICMP) && s != strings.ToLower(MaoApi.SOURCE_GRPC) {
+				return nil, "source", fmt.Errorf("unknown source %q, should be %s or %s", s, MaoApi.SOURCE_ICMP, MaoApi.SOURCE_GRPC)
+			}
+			query.sources[s] = true
+		}
+	}
+
+	if v, ok := c.GetQuery("name"); ok {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, "name", fmt.Errorf("malformed name glob")
+		}
+		query.nameGlob = v
+	}
+
+	if vs, ok := c.GetQueryArray("label"); ok {
+		query.labels = make(map[string]*string)
+		for _, v := range vs {
+			kv := strings.SplitN(v, "=", 2)
+			if !labelKeyPattern.MatchString(kv[0]) {
+				return nil, "label", fmt.Errorf("malformed label selector %q, should be key or key=value", v)
+			}
+			if len(kv) == 2 {
+				query.labels[kv[0]] = &kv[1]
+			} else {
+				query.labels[kv[0]] = nil
+			}
+		}
+	}
+
+	if v, ok := c.GetQuery("sort"); ok {
+		query.sortFields = make([]string, 0)
+		for _, s := range strings.Split(v, ",") {
+			if _, ok := serviceSortFields[strings.TrimPrefix(s, "-")]; !ok {
+				return nil, "sort", fmt.Errorf("unknown sort field %q", s)
+			}
+			query.sortFields = append(query.sortFields, s)
+		}
+	}
+
+	if v, ok := c.GetQuery("page"); ok {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return nil, "page", fmt.Errorf("page should be a positive integer")
+		}
+		query.page = page
+	}
+
+	if v, ok := c.GetQuery("pageSize"); ok {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > MAX_PAGE_SIZE {
+			return nil, "pageSize", fmt.Errorf("pageSize should be in [1, %d]", MAX_PAGE_SIZE)
+		}
+		query.pageSize = pageSize
+	}
+
+	if v, ok := c.GetQuery("fields"); ok {
+		known := make(map[string]bool)
+		for _, f := range serviceResourceFields() {
+			known[f] = true
+		}
+		for _, f := range strings.Split(v, ",") {
+			if !known[f] {
+				return nil, "fields", fmt.Errorf("unknown field %q", f)
+			}
+			query.fields = append(query.fields, f)
+		}
+	}
+
+	return query, "", nil
+}
+
+// serviceResourceFields returns the json names of ServiceResource.
+func serviceResourceFields() []string {
+	return []string{"id", "source", "name", "addresses", "alive", "lastSeen", "rttNs", "labels"}
+}
+
+func (q *serviceQuery) match(s *ServiceResource) bool {
+	if q.alive != nil && *q.alive != s.Alive {
+		return false
+	}
+	if q.sources != nil && !q.sources[strings.ToLower(s.Source)] {
+		return false
+	}
+	if q.nameGlob != "" {
+		if ok, _ := path.Match(q.nameGlob, s.Name); !ok {
+			return false
+		}
+	}
+	for k, v := range q.labels {
+		value, ok := s.Labels[k]
+		if !ok || (v != nil && *v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *serviceQuery) sort(services []*ServiceResource) {
+	sort.SliceStable(services, func(i, j int) bool {
+		for _, f := range q.sortFields {
+			less := serviceSortFields[strings.TrimPrefix(f, "-")]
+			a, b := services[i], services[j]
+			if strings.HasPrefix(f, "-") {
+				a, b = b, a
+			}
+			if less(a, b) {
+				return true
+			}
+			if less(b, a) {
+				return false
+			}
+		}
+		return false
+	})
+}
+
+// selectFields keeps only the required fields of the service, or returns the service itself if no field is required.
+func (q *serviceQuery) selectFields(s *ServiceResource) (interface{}, error) {
+	if len(q.fields) == 0 {
+		return s, nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]interface{})
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]interface{})
+	for _, f := range q.fields {
+		selected[f] = all[f]
+	}
+	return selected, nil
+}
+
+func getServiceLabels() map[string]map[string]map[string]string {
+	labels := make(map[string]map[string]map[string]string)
+
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return labels
+	}
+
+	labelsObj, errCode := configModule.GetConfig(SERVICE_LABELS_CONFIG_PATH)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		return labels // no label is configured
+	}
+
+	sourceMap, ok := labelsObj.(map[string]interface{})
+	if !ok {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse service labels config, it is not a map")
+		return labels
+	}
+	for source, nameObj := range sourceMap {
+		nameMap, ok := nameObj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		labels[source] = make(map[string]map[string]string)
+		for name, kvObj := range nameMap {
+			kvMap, ok := kvObj.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			kv := make(map[string]string)
+			for k, v := range kvMap {
+				kv[k] = fmt.Sprintf("%v", v)
+			}
+			labels[source][name] = kv
+		}
+	}
+	return labels
+}
+
+func getAllServices() []*ServiceResource {
+	services := make([]*ServiceResource, 0)
+	labels := getServiceLabels()
+
+	labelsOf := func(source string, key string) map[string]string {
+		if kv, ok := labels[source][key]; ok {
+			return kv
+		}
+		return make(map[string]string)
+	}
+
+	icmpModule := MaoCommon.ServiceRegistryGetIcmpKaModule()
+	if icmpModule != nil {
+		for _, s := range icmpModule.GetServices() {
+			name := s.ServiceName
+			if name == "" {
+				name = s.Address
+			}
+			services = append(services, &ServiceResource{
+				Id:        MaoApi.SOURCE_ICMP + "/" + s.Address,
+				Source:    MaoApi.SOURCE_ICMP,
+				Name:      name,
+				Addresses: []string{s.Address},
+				Alive:     s.Alive,
+				LastSeen:  s.LastSeen,
+				RttNs:     s.RttDuration.Nanoseconds(),
+				Labels:    labelsOf(MaoApi.SOURCE_ICMP, s.Address),
+			})
+		}
+	}
+
+	grpcModule := MaoCommon.ServiceRegistryGetGrpcKaModule()
+	if grpcModule != nil {
+		for _, s := range grpcModule.GetServiceInfo() {
+			addresses := make([]string, len(s.Ips))
+			copy(addresses, s.Ips)
+			services = append(services, &ServiceResource{
+				Id:        MaoApi.SOURCE_GRPC + "/" + s.Hostname,
+				Source:    MaoApi.SOURCE_GRPC,
+				Name:      s.Hostname,
+				Addresses: addresses,
+				Alive:     s.Alive,
+				LastSeen:  s.LocalLastSeen,
+				RttNs:     s.RttDuration.Nanoseconds(),
+				Labels:    labelsOf(MaoApi.SOURCE_GRPC, s.Hostname),
+			})
+		}
+	}
+
+	return services
+}
+
+// normalizeSource maps the source in the url to MaoApi.SOURCE_*, case-insensitively.
+func normalizeSource(source string) (string, bool) {
+	switch strings.ToLower(source) {
+	case strings.ToLower(MaoApi.SOURCE_ICMP):
+		return MaoApi.SOURCE_ICMP, true
+	case strings.ToLower(MaoApi.SOURCE_GRPC):
+		return MaoApi.SOURCE_GRPC, true
+	}
+	return "", false
+}
+
+func (m *ServiceApiV2Module) listServices(c *gin.Context) {
+	query, field, err := parseServiceQuery(c)
+	if err != nil {
+		replyInvalidParameter(c, field, err.Error())
+		return
+	}
+
+	matched := make([]*ServiceResource, 0)
+	for _, s := range getAllServices() {
+		if query.match(s) {
+			matched = append(matched, s)
+		}
+	}
+	query.sort(matched)
+
+	begin := (query.page - 1) * query.pageSize
+	end := begin + query.pageSize
+	if begin > len(matched) {
+		begin = len(matched)
+	}
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	items := make([]interface{}, 0, end-begin)
+	for _, s := range matched[begin:end] {
+		item, err := query.selectFields(s)
+		if err != nil {
+			replyError(c, http.StatusInternalServerError, ERR_INTERNAL, "", err.Error())
+			return
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(http.StatusOK, &ServiceListResponse{
+		Items:    items,
+		Total:    len(matched),
+		Page:     query.page,
+		PageSize: query.pageSize,
+	})
+}
+
+func (m *ServiceApiV2Module) getService(c *gin.Context) {
+	source, ok := normalizeSource(c.Param("source"))
+	if !ok {
+		replyInvalidParameter(c, "source", fmt.Sprintf("unknown source %q", c.Param("source")))
+		return
+	}
+
+	id := source + "/" + c.Param("key")
+	for _, s := range getAllServices() {
+		if s.Id == id {
+			c.JSON(http.StatusOK, s)
+			return
+		}
+	}
+	replyError(c, http.StatusNotFound, ERR_NOT_FOUND, "", fmt.Sprintf("service %s is not found", id))
+}
+
+// setServiceLabels replaces all labels of the service. The service doesn't need to be detected yet.
+// Body: {"labels": {"<key>": "<value>"}}, empty labels for removing all.
+func (m *ServiceApiV2Module) setServiceLabels(c *gin.Context) {
+	source, ok := normalizeSource(c.Param("source"))
+	if !ok {
+		replyInvalidParameter(c, "source", fmt.Sprintf("unknown source %q", c.Param("source")))
+		return
+	}
+	key := c.Param("key")
+
+	var body struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		replyInvalidParameter(c, "", "body should be {\"labels\": {\"<key>\": \"<value>\"}}")
+		return
+	}
+	if len(body.Labels) > MAX_LABELS_PER_SERVICE {
+		replyInvalidParameter(c, "labels", fmt.Sprintf("at most %d labels", MAX_LABELS_PER_SERVICE))
+		return
+	}
+	labels := make(map[string]interface{})
+	for k, v := range body.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			replyInvalidParameter(c, "labels", fmt.Sprintf("invalid label key %q", k))
+			return
+		}
+		if !labelValuePattern.MatchString(v) {
+			replyInvalidParameter(c, "labels", fmt.Sprintf("invalid value of label %q", k))
+			return
+		}
+		labels[k] = v
+	}
+
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		replyError(c, http.StatusServiceUnavailable, ERR_UNAVAILABLE, "", "config module is not ready")
+		return
+	}
+
+	var data interface{} = labels
+	if len(labels) == 0 {
+		data = nil // remove the labels
+	}
+	configPath := fmt.Sprintf("%s/%s/%s", SERVICE_LABELS_CONFIG_PATH, source, key)
+	if success, errCode := configModule.PutConfigBy(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), configPath, data); !success {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save labels of %s/%s, errCode: %d", source, key, errCode)
+		replyError(c, http.StatusInternalServerError, ERR_INTERNAL, "", fmt.Sprintf("fail to save labels, errCode: %d", errCode))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"labels": body.Labels})
+}
@@ -0,0 +1,87 @@
+package RestApiV2
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newQueryContext(rawQuery string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v2/services?"+rawQuery, nil)
+	return c
+}
+
+func TestParseServiceQuery_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"alive=maybe":  "alive",
+		"source=http":  "source",
+		"name=[":       "name",
+		"label==x":     "label",
+		"sort=unknown": "sort",
+		"page=0":       "page",
+		"pageSize=501": "pageSize",
+		"fields=ips":   "fields",
+	}
+	for rawQuery, wantField := range cases {
+		_, field, err := parseServiceQuery(newQueryContext(rawQuery))
+		if err == nil || field != wantField {
+			t.Errorf("%s: field = %q, err = %v, want field %q", rawQuery, field, err, wantField)
+		}
+	}
+}
+
+func TestServiceQuery_MatchAndSort(t *testing.T) {
+	services := []*ServiceResource{
+		{Id: "ICMP/10.0.0.1", Source: "ICMP", Name: "router", Alive: true, RttNs: 30, Labels: map[string]string{"site": "bj"}},
+		{Id: "gRPC/node-1", Source: "gRPC", Name: "node-1", Alive: true, RttNs: 10, Labels: map[string]string{"site": "sh"}},
+		{Id: "gRPC/node-2", Source: "gRPC", Name: "node-2", Alive: false, RttNs: 20, Labels: map[string]string{}},
+	}
+
+	query, _, err := parseServiceQuery(newQueryContext("alive=true&source=grpc,icmp&label=site&sort=-rttNs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	matched := make([]*ServiceResource, 0)
+	for _, s := range services {
+		if query.match(s) {
+			matched = append(matched, s)
+		}
+	}
+	query.sort(matched)
+	if len(matched) != 2 || matched[0].Id != "ICMP/10.0.0.1" || matched[1].Id != "gRPC/node-1" {
+		t.Errorf("unexpected result: %v", matched)
+	}
+
+	query, _, _ = parseServiceQuery(newQueryContext("name=node-*&label=site=sh"))
+	if !query.match(services[1]) || query.match(services[0]) || query.match(services[2]) {
+		t.Errorf("name glob or label value is not matched correctly")
+	}
+}
+
+func TestServiceQuery_SelectFields(t *testing.T) {
+	query, _, _ := parseServiceQuery(newQueryContext("fields=id,alive"))
+	item, err := query.selectFields(&ServiceResource{Id: "gRPC/node-1", Alive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := item.(map[string]interface{})
+	if len(selected) != 2 || selected["id"] != "gRPC/node-1" || selected["alive"] != true {
+		t.Errorf("unexpected fields: %v", selected)
+	}
+}
+
+func TestListServices_ErrorBody(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v2/services?page=-1", nil)
+
+	(&ServiceApiV2Module{}).listServices(c)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	if body := w.Body.String(); body != `{"error":{"code":"invalid_parameter","message":"page should be a positive integer","field":"page"}}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
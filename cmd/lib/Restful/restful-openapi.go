@@ -0,0 +1,266 @@
+package Restful
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+
+	// the schema of nested types deeper than it is left open, e.g. for recursive types.
+	OPENAPI_MAX_SCHEMA_DEPTH = 8
+)
+
+type apiRoute struct {
+	method string
+	path   string // full path, with the gin style parameters, e.g. /api/v2/services/:source
+	role   MaoApi.Role
+	doc    *MaoApi.ApiDoc // nil if the route is not documented
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// schemaOf generates the JSON schema of t, following the rules of encoding/json.
+func schemaOf(t reflect.Type, depth int) map[string]interface{} {
+	if depth > OPENAPI_MAX_SCHEMA_DEPTH {
+		return map[string]interface{}{}
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), depth+1)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), depth+1)}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		addStructProperties(t, properties, depth)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+
+	// interface{} and others, any value.
+	return map[string]interface{}{}
+}
+
+func addStructProperties(t reflect.Type, properties map[string]interface{}, depth int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && strings.Split(tag, ",")[0] == "" {
+			addStructProperties(field.Type, properties, depth) // embedded fields are promoted
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		properties[name] = schemaOf(field.Type, depth+1)
+	}
+}
+
+// openApiPath converts gin path parameters to OpenAPI ones, e.g. /a/:b -> /a/{b}
+func openApiPath(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func openApiResponse(description string, sample interface{}) map[string]interface{} {
+	response := map[string]interface{}{"description": description}
+	if sample == nil {
+		return response
+	}
+
+	if _, ok := sample.(string); ok {
+		response["content"] = map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		}
+	} else {
+		response["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(sample), 0)},
+		}
+	}
+	return response
+}
+
+func openApiOperation(route *apiRoute) map[string]interface{} {
+	operation := map[string]interface{}{
+		"x-mao-role": MaoApi.RoleString[route.role],
+	}
+
+	responses := map[string]interface{}{}
+	if route.role != MaoApi.ROLE_PUBLIC {
+		operation["security"] = []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+			map[string]interface{}{"cookieAuth": []string{}},
+		}
+		responses["401"] = openApiResponse("Unauthorized", nil)
+		responses["403"] = openApiResponse("Forbidden, requires role "+MaoApi.RoleString[route.role], nil)
+	}
+	operation["responses"] = responses
+
+	doc := route.doc
+	if doc == nil {
+		doc = &MaoApi.ApiDoc{Summary: "Undocumented"}
+	}
+
+	operation["summary"] = doc.Summary
+	if doc.Description != "" {
+		operation["description"] = doc.Description
+	}
+	if doc.Tag != "" {
+		operation["tags"] = []string{doc.Tag}
+	}
+	responses["200"] = openApiResponse("OK", doc.Response)
+
+	// all path parameters must be declared, even if they are not documented.
+	documented := make(map[string]bool)
+	for _, p := range doc.Params {
+		if p.In == MaoApi.API_PARAM_IN_PATH {
+			documented[p.Name] = true
+		}
+	}
+	params := doc.Params
+	for _, s := range strings.Split(route.path, "/") {
+		if (strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*")) && !documented[s[1:]] {
+			params = append(params, &MaoApi.ApiParam{Name: s[1:], In: MaoApi.API_PARAM_IN_PATH, Type: MaoApi.API_PARAM_TYPE_STRING})
+		}
+	}
+
+	parameters := make([]interface{}, 0)
+	formProperties := make(map[string]interface{})
+	formRequired := make([]string, 0)
+	for _, p := range params {
+		schema := map[string]interface{}{"type": p.Type}
+		if p.In == MaoApi.API_PARAM_IN_FORM {
+			if p.Description != "" {
+				schema["description"] = p.Description
+			}
+			formProperties[p.Name] = schema
+			if p.Required {
+				formRequired = append(formRequired, p.Name)
+			}
+			continue
+		}
+
+		parameters = append(parameters, map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"required":    p.Required || p.In == MaoApi.API_PARAM_IN_PATH,
+			"description": p.Description,
+			"schema":      schema,
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if len(formProperties) > 0 {
+		formSchema := map[string]interface{}{"type": "object", "properties": formProperties}
+		if len(formRequired) > 0 {
+			formSchema["required"] = formRequired
+		}
+		operation["requestBody"] = map[string]interface{}{
+			"required": len(formRequired) > 0,
+			"content": map[string]interface{}{
+				"application/x-www-form-urlencoded": map[string]interface{}{"schema": formSchema},
+			},
+		}
+	} else if doc.RequestBody != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(doc.RequestBody), 0)},
+			},
+		}
+	}
+
+	return operation
+}
+
+func (r *RestfulServerImpl) buildOpenApiDocument() map[string]interface{} {
+	r.routesLock.RLock()
+	apiRoutes := append([]*apiRoute(nil), r.apiRoutes...)
+	r.routesLock.RUnlock()
+
+	paths := make(map[string]interface{})
+	for _, route := range apiRoutes {
+		p := openApiPath(route.path)
+		item, ok := paths[p].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[p] = item
+		}
+		item[strings.ToLower(route.method)] = openApiOperation(route)
+	}
+
+	version := r.version
+	if version == "" {
+		version = "unknown"
+	}
+
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "Mao-Service-Discovery",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"cookieAuth": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": MaoApi.AUTH_SESSION_COOKIE_NAME},
+			},
+		},
+	}
+}
+
+func (r *RestfulServerImpl) showOpenApiJson(c *gin.Context) {
+	c.JSON(http.StatusOK, r.buildOpenApiDocument())
+}
+
+func (r *RestfulServerImpl) showOpenApiViewer(c *gin.Context) {
+	c.HTML(http.StatusOK, "index-openapi.html", nil)
+}
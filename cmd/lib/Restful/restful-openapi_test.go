@@ -0,0 +1,93 @@
+package Restful
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchemaOf(t *testing.T) {
+	type embedded struct {
+		Total int `json:"total"`
+	}
+	type sample struct {
+		embedded
+		Name     string            `json:"name"`
+		Seen     time.Time         `json:"seen"`
+		Labels   map[string]string `json:"labels"`
+		Ips      []string
+		Hidden   string `json:"-"`
+		internal string
+	}
+
+	schema := schemaOf(reflect.TypeOf(&sample{}), 0)
+	properties := schema["properties"].(map[string]interface{})
+
+	for _, name := range []string{"total", "name", "seen", "labels", "Ips"} {
+		if _, ok := properties[name]; !ok {
+			t.Errorf("property %s is missing", name)
+		}
+	}
+	for _, name := range []string{"Hidden", "-", "internal", "embedded"} {
+		if _, ok := properties[name]; ok {
+			t.Errorf("property %s should not exist", name)
+		}
+	}
+	if properties["seen"].(map[string]interface{})["format"] != "date-time" {
+		t.Errorf("time.Time should be a date-time string")
+	}
+}
+
+func TestBuildOpenApiDocument(t *testing.T) {
+	r := &RestfulServerImpl{}
+	r.apiRoutes = []*apiRoute{
+		{method: "GET", path: "/api/v2/services/:source/:key", role: MaoApi.ROLE_VIEWER, doc: &MaoApi.ApiDoc{
+			Summary: "Show a service",
+			Params:  []*MaoApi.ApiParam{{Name: "source", In: MaoApi.API_PARAM_IN_PATH, Type: MaoApi.API_PARAM_TYPE_STRING}},
+		}},
+		{method: "POST", path: "/api/delGrpcService", role: MaoApi.ROLE_OPERATOR, doc: &MaoApi.ApiDoc{
+			Summary: "Delete gRPC services",
+			Params:  []*MaoApi.ApiParam{{Name: "serviceNames", In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true}},
+		}},
+		{method: "POST", path: "/api/login", role: MaoApi.ROLE_PUBLIC},
+	}
+
+	data, err := json.Marshal(r.buildOpenApiDocument())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Security    []interface{} `json:"security"`
+			Parameters  []struct{ Name, In string }
+			RequestBody struct {
+				Content map[string]interface{} `json:"content"`
+			} `json:"requestBody"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	get, ok := doc.Paths["/api/v2/services/{source}/{key}"]["get"]
+	if !ok {
+		t.Fatalf("path parameters are not converted: %v", doc.Paths)
+	}
+	if len(get.Parameters) != 2 || get.Parameters[1].Name != "key" || get.Parameters[1].In != "path" {
+		t.Errorf("undocumented path parameter is not declared: %v", get.Parameters)
+	}
+
+	post := doc.Paths["/api/delGrpcService"]["post"]
+	if _, ok := post.RequestBody.Content["application/x-www-form-urlencoded"]; !ok {
+		t.Errorf("form parameters should be in the form body")
+	}
+	if len(post.Security) == 0 {
+		t.Errorf("protected api should declare security")
+	}
+
+	if login := doc.Paths["/api/login"]["post"]; len(login.Security) != 0 {
+		t.Errorf("public api should not declare security")
+	}
+}
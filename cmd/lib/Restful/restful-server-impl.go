@@ -1,76 +1,276 @@
 package Restful
 
 import (
+	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/util"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
 )
 
 const (
 	MODULE_NAME = "Restful-Server-module"
+
+	URL_LOGIN_PAGE = "/login"
+
+	URL_OPENAPI_JSON = "/openapi.json"
+	URL_OPENAPI_VIEWER = "/ApiDoc"
+
+	// waiting for the in-flight requests while shutting down
+	SHUTDOWN_TIMEOUT = 5 * time.Second
 )
 
+// route is kept to build the engine again, gin can't add a route while serving.
+type route struct {
+	method string
+	path string
+	handlers []gin.HandlerFunc
+}
+
 type RestfulServerImpl struct {
-	restful *gin.Engine
+	restful *gin.Engine // nil if a route is added since it is built, see servingEngine
 
 	serviceAddr string
 
 	uiPageLinks []string
 	getApiLinks []string
 	postApiLinks []string
+
+	apiRoutes []*apiRoute // for the OpenAPI document
+	routes []*route
+	registeredRoutes map[string]bool // "METHOD path", a module re-initialized at runtime registers its apis again
+	routesLock sync.RWMutex // routes can be added while serving, e.g. a module is enabled at runtime
+
+	// the routes are owned by the module being initialized, and served only while it is running.
+	routeOwner string
+	moduleRunning func(module string) bool
+	version string
+
+	authModule MaoApi.AuthModule
+
+	// nil for plain HTTP
+	tlsConfig *tls.Config
+	httpServer *http.Server
+
+	// empty for no HTTP-to-HTTPS redirect listener
+	redirectAddr string
+	redirectServer *http.Server
 }
 
 func (r *RestfulServerImpl) InitRestfulServer() {
 	gin.SetMode(gin.ReleaseMode)
-	r.restful = gin.Default()
+	r.registeredRoutes = make(map[string]bool)
+	r.restful = r.buildEngine() // fail fast if the resources are missing
 
-	r.restful.LoadHTMLGlob("resource/html/*")
-	r.restful.Static("/js", "resource/static/js")
-	r.restful.Static("/css", "resource/static/css")
-	r.restful.Static("/static", "resource/static")
-	r.restful.StaticFile("/favicon.ico", "resource/static/favicon.ico")
+	// not need to initiate []string
 
+	r.RegisterUiPage(URL_OPENAPI_VIEWER, r.showOpenApiViewer)
+	r.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_OPENAPI_JSON, &MaoApi.ApiDoc{
+		Summary:  "OpenAPI 3 document of all registered APIs",
+		Tag:      MODULE_NAME,
+		Response: map[string]interface{}{},
+	}, r.showOpenApiJson)
+}
 
-	r.restful.GET("/", r.showHomePage)
-	r.restful.GET("/api", r.showApiListPage)
+// SetVersion sets the version published in the OpenAPI document.
+func (r *RestfulServerImpl) SetVersion(version string) {
+	r.version = version
+}
 
-	// not need to initiate []string
+func (r *RestfulServerImpl) SetAuthModule(authModule MaoApi.AuthModule) {
+	r.authModule = authModule
+}
+
+// authorize returns a middleware which rejects the request if it doesn't carry a credential of the required role.
+// For UI pages, the unauthenticated request is redirected to the login page.
+func (r *RestfulServerImpl) authorize(role MaoApi.Role, uiPage bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if role == MaoApi.ROLE_PUBLIC {
+			return
+		}
+
+		authModule := r.authModule
+		if authModule == nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Reject %s, auth module is not ready.", c.Request.URL.Path)
+			c.String(http.StatusServiceUnavailable, "auth module is not ready")
+			c.Abort()
+			return
+		}
+
+		httpStatus := authModule.Authorize(c, role)
+		if httpStatus == http.StatusOK {
+			return
+		}
+
+		if uiPage && httpStatus == http.StatusUnauthorized {
+			c.Redirect(http.StatusFound, URL_LOGIN_PAGE)
+		} else {
+			c.String(httpStatus, http.StatusText(httpStatus))
+		}
+		c.Abort()
+	}
+}
+
+func (r *RestfulServerImpl) withAuthorize(role MaoApi.Role, uiPage bool, handlers []gin.HandlerFunc) []gin.HandlerFunc {
+	return append([]gin.HandlerFunc{r.authorize(role, uiPage)}, handlers...)
 }
 
 func (r *RestfulServerImpl) showHomePage(c *gin.Context) {
 	c.HTML(200, "index.html", nil)
 }
 
+func (r *RestfulServerImpl) showLoginPage(c *gin.Context) {
+	c.HTML(200, "index-login.html", nil)
+}
+
+// buildEngine creates a gin engine with the static resources and all routes added, must be called with routesLock held.
+func (r *RestfulServerImpl) buildEngine() *gin.Engine {
+	engine := gin.Default()
+
+	engine.LoadHTMLGlob("resource/html/*")
+	engine.Static("/js", "resource/static/js")
+	engine.Static("/css", "resource/static/css")
+	engine.Static("/static", "resource/static")
+	engine.StaticFile("/favicon.ico", "resource/static/favicon.ico")
+
+	engine.GET("/", r.authorize(MaoApi.ROLE_VIEWER, true), r.showHomePage)
+	engine.GET("/api", r.authorize(MaoApi.ROLE_VIEWER, true), r.showApiListPage)
+	engine.GET(URL_LOGIN_PAGE, r.showLoginPage)
+
+	for _, rt := range r.routes {
+		engine.Handle(rt.method, rt.path, rt.handlers...)
+	}
+	return engine
+}
+
+// servingEngine returns the engine with all routes added, it is built again if any route is added since the last time.
+// The engine is never modified after it is returned, so the requests are served without the lock.
+func (r *RestfulServerImpl) servingEngine() *gin.Engine {
+	r.routesLock.RLock()
+	engine := r.restful
+	r.routesLock.RUnlock()
+	if engine != nil {
+		return engine
+	}
+
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	if r.restful == nil {
+		r.restful = r.buildEngine()
+	}
+	return r.restful
+}
+
+func (r *RestfulServerImpl) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.servingEngine().ServeHTTP(w, req)
+}
+
+// SetRouteOwner marks the routes registered since now as owned by the module, "" for none.
+// gin can't remove a route, so the routes of the module respond 503 while running(module) is false, e.g. it is disabled at runtime.
+func (r *RestfulServerImpl) SetRouteOwner(module string, running func(module string) bool) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	r.routeOwner = module
+	r.moduleRunning = running
+}
+
+func moduleGate(module string, running func(module string) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !running(module) {
+			c.String(http.StatusServiceUnavailable, "module %s is not running", module)
+			c.Abort()
+		}
+	}
+}
+
+// addRoute returns false if the route has been registered, the registered handlers are kept.
+// The path is appended to the links for the list page, and the api, if not nil, to the OpenAPI document.
+func (r *RestfulServerImpl) addRoute(method string, path string, handlers []gin.HandlerFunc, links *[]string, api *apiRoute) bool {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+
+	key := method + " " + path
+	if r.registeredRoutes[key] {
+		util.MaoLogM(util.DEBUG, MODULE_NAME, "%s has been registered, skip.", key)
+		return false
+	}
+	r.registeredRoutes[key] = true
+	if r.routeOwner != "" && r.moduleRunning != nil {
+		handlers = append([]gin.HandlerFunc{moduleGate(r.routeOwner, r.moduleRunning)}, handlers...)
+	}
+	r.routes = append(r.routes, &route{method: method, path: path, handlers: handlers})
+	r.restful = nil // built again for the next request
+	*links = append(*links, path)
+	if api != nil {
+		api.method, api.path = method, path
+		r.apiRoutes = append(r.apiRoutes, api)
+	}
+	return true
+}
+
 func (r *RestfulServerImpl) RegisterUiPage(relativePath string, handlers ...gin.HandlerFunc) {
-	r.restful.GET("/v1" + relativePath, handlers...)
-	r.uiPageLinks = append(r.uiPageLinks, "/v1" + relativePath)
+	r.addRoute(http.MethodGet, "/v1" + relativePath, r.withAuthorize(MaoApi.ROLE_VIEWER, true, handlers), &r.uiPageLinks, nil)
 }
 
 func (r *RestfulServerImpl) RegisterGetApi(relativePath string, handlers ...gin.HandlerFunc) {
-	r.restful.GET("/api" + relativePath, handlers...)
-	r.getApiLinks = append(r.getApiLinks, "/api" + relativePath)
+	r.RegisterGetApiWithRole(MaoApi.ROLE_VIEWER, relativePath, handlers...)
 }
 
 func (r *RestfulServerImpl) RegisterPostApi(relativePath string, handlers ...gin.HandlerFunc) {
-	r.restful.POST("/api" + relativePath, handlers...)
-	r.postApiLinks = append(r.postApiLinks, "/api" + relativePath)
+	r.RegisterPostApiWithRole(MaoApi.ROLE_OPERATOR, relativePath, handlers...)
+}
+
+func (r *RestfulServerImpl) RegisterGetApiWithRole(role MaoApi.Role, relativePath string, handlers ...gin.HandlerFunc) {
+	r.RegisterGetApiWithDoc(role, relativePath, nil, handlers...)
+}
+
+func (r *RestfulServerImpl) RegisterPostApiWithRole(role MaoApi.Role, relativePath string, handlers ...gin.HandlerFunc) {
+	r.RegisterPostApiWithDoc(role, relativePath, nil, handlers...)
+}
+
+func (r *RestfulServerImpl) RegisterGetApiWithDoc(role MaoApi.Role, relativePath string, doc *MaoApi.ApiDoc, handlers ...gin.HandlerFunc) {
+	r.addRoute(http.MethodGet, "/api" + relativePath, r.withAuthorize(role, false, handlers),
+		&r.getApiLinks, &apiRoute{role: role, doc: doc})
+}
+
+func (r *RestfulServerImpl) RegisterPostApiWithDoc(role MaoApi.Role, relativePath string, doc *MaoApi.ApiDoc, handlers ...gin.HandlerFunc) {
+	r.addRoute(http.MethodPost, "/api" + relativePath, r.withAuthorize(role, false, handlers),
+		&r.postApiLinks, &apiRoute{role: role, doc: doc})
+}
+
+func (r *RestfulServerImpl) RegisterProbeApi(relativePath string, doc *MaoApi.ApiDoc, handlers ...gin.HandlerFunc) {
+	r.addRoute(http.MethodGet, relativePath, handlers, &r.getApiLinks, &apiRoute{role: MaoApi.ROLE_PUBLIC, doc: doc})
 }
 
 func (r *RestfulServerImpl) showApiListPage(c *gin.Context) {
 	htmlHead := `<!DOCTYPE html><html lang="en"><head><meta charset="UTF-8"><title>MaoServiceDiscovery: URLs</title></head><body>`
 
-	ret := "UI:<br/>"
-	for _, v := range r.uiPageLinks {
+	ret := fmt.Sprintf(`OpenAPI: <a href="%s">%s</a>, <a href="/v1%s">viewer</a><br/><br/>`,
+		"/api" + URL_OPENAPI_JSON, "/api" + URL_OPENAPI_JSON, URL_OPENAPI_VIEWER)
+
+	r.routesLock.RLock()
+	uiPageLinks := append([]string(nil), r.uiPageLinks...)
+	getApiLinks := append([]string(nil), r.getApiLinks...)
+	postApiLinks := append([]string(nil), r.postApiLinks...)
+	r.routesLock.RUnlock()
+
+	ret += "UI:<br/>"
+	for _, v := range uiPageLinks {
 		ret = fmt.Sprintf(`%s<a href="%s">%s</a><br/>`, ret, v, v)
 	}
 
 	ret += "<br/>GET API:<br/>"
-	for _, v := range r.getApiLinks {
+	for _, v := range getApiLinks {
 		ret = fmt.Sprintf(`%s<a href="%s">%s</a><br/>`, ret, v, v)
 	}
 
 	ret += "<br/>POST API:<br/>"
-	for _, v := range r.postApiLinks {
+	for _, v := range postApiLinks {
 		ret = fmt.Sprintf("%s%s<br/>", ret, v)
 	}
 
@@ -83,14 +283,51 @@ func (r *RestfulServerImpl) showApiListPage(c *gin.Context) {
 }
 
 func (r *RestfulServerImpl) startRestfulServer() {
-	util.MaoLogM(util.INFO, MODULE_NAME, "Starting web show %s ...", r.serviceAddr)
-	err := r.restful.Run(r.serviceAddr)
-	if err != nil {
+	var err error
+	if r.tlsConfig != nil {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Starting web show with HTTPS %s ...", r.serviceAddr)
+		err = r.httpServer.ListenAndServeTLS("", "") // the certificate is served by tlsConfig.GetCertificate
+	} else {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Starting web show %s ...", r.serviceAddr)
+		err = r.httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to run rest server, %s", err)
 	}
 }
 
 func (r *RestfulServerImpl) StartRestfulServerDaemon(webAddr string) {
 	r.serviceAddr = webAddr
+	r.httpServer = &http.Server{
+		Addr:      r.serviceAddr,
+		Handler:   r,
+		TLSConfig: r.tlsConfig,
+	}
 	go r.startRestfulServer()
-}
\ No newline at end of file
+
+	if r.tlsConfig != nil && r.redirectAddr != "" {
+		r.redirectServer = &http.Server{
+			Addr:    r.redirectAddr,
+			Handler: http.HandlerFunc(r.redirectToHttps),
+		}
+		go r.startHttpRedirectServer()
+	}
+}
+
+// ShutdownRestfulServer stops accepting new requests, and waits for the in-flight ones in SHUTDOWN_TIMEOUT.
+// It is safe to call it more than once.
+func (r *RestfulServerImpl) ShutdownRestfulServer() {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	for _, server := range []*http.Server{r.redirectServer, r.httpServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to shutdown %s gracefully, close it, %s", server.Addr, err.Error())
+			server.Close()
+		}
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+}
@@ -0,0 +1,42 @@
+package Restful
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRestfulServerImpl_RouteOwner(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir("../../.."); err != nil { // for the resources
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	r := &RestfulServerImpl{}
+	r.InitRestfulServer()
+
+	running := map[string]bool{"hot": true}
+	r.SetRouteOwner("hot", func(module string) bool { return running[module] })
+	r.RegisterProbeApi("/hot", nil, func(c *gin.Context) { c.String(http.StatusOK, "hot") })
+	r.SetRouteOwner("", nil)
+	r.RegisterProbeApi("/cold", nil, func(c *gin.Context) { c.String(http.StatusOK, "cold") })
+
+	serve := func(path string) int {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+	if serve("/hot") != http.StatusOK || serve("/cold") != http.StatusOK {
+		t.Errorf("routes added after init are not served")
+	}
+	running["hot"] = false
+	if code := serve("/hot"); code != http.StatusServiceUnavailable {
+		t.Errorf("expect 503 while the module is stopped, got %d", code)
+	}
+	if serve("/cold") != http.StatusOK {
+		t.Errorf("route without owner should be served")
+	}
+}
@@ -0,0 +1,225 @@
+package Restful
+
+import (
+	"MaoServerDiscovery/util"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TLS_CERT_FILE = "mao-web-cert.pem"
+	DEFAULT_TLS_KEY_FILE  = "mao-web-key.pem"
+
+	SELF_SIGNED_CERT_VALIDITY = 3 * 365 * 24 * time.Hour
+
+	CERT_RELOAD_CHECK_INTERVAL = 10 * time.Second
+)
+
+// certReloader serves the certificate for TLS handshakes, and reloads it when the cert/key files change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert     *tls.Certificate
+	certTime time.Time // the latest modification time of the cert/key files
+	lock     sync.RWMutex
+}
+
+func getFilesModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := getFilesModTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.certTime = modTime
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) reloadLoop() {
+	for {
+		time.Sleep(CERT_RELOAD_CHECK_INTERVAL)
+
+		modTime, err := getFilesModTime(cr.certFile, cr.keyFile)
+		if err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to check TLS cert/key files, %s", err.Error())
+			continue
+		}
+
+		cr.lock.RLock()
+		changed := modTime.After(cr.certTime)
+		cr.lock.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// keep serving the old certificate if the new files are broken, e.g. only one of them is replaced.
+		if err := cr.load(); err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to reload TLS cert/key, keep the old one, %s", err.Error())
+			continue
+		}
+		util.MaoLogM(util.INFO, MODULE_NAME, "Reloaded TLS cert %s", cr.certFile)
+	}
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// generateSelfSignedCert writes a self-signed ECDSA P-256 cert/key pair for the hostname and loopback addresses.
+func generateSelfSignedCert(certFile string, keyFile string) error {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, err := util.GetHostname()
+	if err != nil {
+		hostname = "Mao-Unknown"
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Mao-Service-Discovery"},
+			CommonName:   hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if ips, err := util.GetUnicastIp(); err == nil {
+		for _, ip := range ips {
+			template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+		}
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	// write the key first, the cert reloader checks both files.
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	return os.WriteFile(certFile, certPem, 0644)
+}
+
+// EnableTls makes the Restful server listen with HTTPS. It must be called before StartRestfulServerDaemon.
+// If selfSigned is true and the cert/key files don't exist, a self-signed pair will be generated at the first start.
+func (r *RestfulServerImpl) EnableTls(certFile string, keyFile string, selfSigned bool) bool {
+	if certFile == "" {
+		certFile = DEFAULT_TLS_CERT_FILE
+	}
+	if keyFile == "" {
+		keyFile = DEFAULT_TLS_KEY_FILE
+	}
+
+	if selfSigned && !fileExists(certFile) && !fileExists(keyFile) {
+		util.MaoLogM(util.WARN, MODULE_NAME, "TLS cert not found, generating a self-signed one: %s, %s", certFile, keyFile)
+		if err := generateSelfSignedCert(certFile, keyFile); err != nil {
+			util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to generate self-signed TLS cert, %s", err.Error())
+			return false
+		}
+	}
+
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.load(); err != nil {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to load TLS cert/key, %s", err.Error())
+		return false
+	}
+	go reloader.reloadLoop()
+
+	r.tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	return true
+}
+
+// EnableHttpRedirect starts an extra plain HTTP listener, which redirects all requests to the HTTPS listener.
+func (r *RestfulServerImpl) EnableHttpRedirect(redirectAddr string) {
+	r.redirectAddr = redirectAddr
+}
+
+func (r *RestfulServerImpl) redirectToHttps(w http.ResponseWriter, req *http.Request) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host // no port in the Host header
+	}
+	_, port, err := net.SplitHostPort(r.serviceAddr)
+	if err != nil {
+		http.Error(w, "https listener is misconfigured", http.StatusInternalServerError)
+		return
+	}
+
+	target := "https://" + net.JoinHostPort(host, port) + req.URL.RequestURI()
+	http.Redirect(w, req, target, http.StatusPermanentRedirect)
+}
+
+func (r *RestfulServerImpl) startHttpRedirectServer() {
+	util.MaoLogM(util.INFO, MODULE_NAME, "Starting HTTP-to-HTTPS redirect %s ...", r.redirectAddr)
+	err := r.redirectServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		util.MaoLogM(util.ERROR, MODULE_NAME, "Fail to run HTTP redirect server, %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package Restful
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertAndReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if err := generateSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("generate: %s", err)
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	first, _ := cr.getCertificate(nil)
+
+	if err := generateSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("regenerate: %s", err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if err := cr.load(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	second, _ := cr.getCertificate(nil)
+	if first == second || string(first.Certificate[0]) == string(second.Certificate[0]) {
+		t.Errorf("certificate is not reloaded")
+	}
+}
+
+func TestRedirectToHttps(t *testing.T) {
+	r := &RestfulServerImpl{serviceAddr: "[::]:29999"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:8080/v1/Dashboard?a=1", nil)
+	w := httptest.NewRecorder()
+	r.redirectToHttps(w, req)
+
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusPermanentRedirect)
+	}
+	if got, want := w.Header().Get("Location"), "https://example.com:29999/v1/Dashboard?a=1"; got != want {
+		t.Errorf("location = %s, want %s", got, want)
+	}
+}
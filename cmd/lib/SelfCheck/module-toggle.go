@@ -0,0 +1,86 @@
+package SelfCheck
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const (
+	URL_MODULES_HOMEPAGE = "/Modules"
+	URL_MODULES_SHOW     = "/showModules"
+	URL_MODULES_ENABLE   = "/enableModule"
+
+	MODULES_API_KEY_NAME    = "name"
+	MODULES_API_KEY_ENABLED = "enabled"
+)
+
+func (s *SelfCheckModule) configModuleToggleInterface(restfulServer MaoApi.RestfulServerModule) {
+	restfulServer.RegisterUiPage(URL_MODULES_HOMEPAGE, s.showModulesPage)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_MODULES_SHOW, &MaoApi.ApiDoc{
+		Summary:  "List the modules, and whether they are enabled and running",
+		Tag:      MODULE_NAME,
+		Response: []*MaoApi.ModuleStatus{},
+	}, s.showModules)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_MODULES_ENABLE, &MaoApi.ApiDoc{
+		Summary: "Enable or disable an optional module",
+		Description: "Saved to /modules/<name>/enabled in the config. The hot-toggle modules are started or stopped immediately, " +
+			"others after the server restarts. It is applied in background, replies the modules page.",
+		Tag: MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: MODULES_API_KEY_NAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "the config name of the module, e.g. mysql"},
+			{Name: MODULES_API_KEY_ENABLED, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "true or false"},
+		},
+	}, s.processEnableModule)
+}
+
+func (s *SelfCheckModule) showModulesPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "index-modules.html", nil)
+}
+
+func (s *SelfCheckModule) showModules(c *gin.Context) {
+	c.JSON(http.StatusOK, MaoCommon.GetModuleStatus())
+}
+
+func (s *SelfCheckModule) processEnableModule(c *gin.Context) {
+	name := c.PostForm(MODULES_API_KEY_NAME)
+	enabled, err := strconv.ParseBool(c.PostForm(MODULES_API_KEY_ENABLED))
+	if name == "" || err != nil {
+		c.String(http.StatusBadRequest, "%s and %s(true or false) are required", MODULES_API_KEY_NAME, MODULES_API_KEY_ENABLED)
+		return
+	}
+
+	optional := false
+	for _, status := range MaoCommon.GetModuleStatus() {
+		if status.Optional && status.ConfigName == name {
+			optional = true
+			break
+		}
+	}
+	if !optional {
+		c.String(http.StatusBadRequest, "%s is not an optional module", name)
+		return
+	}
+
+	// In background, because the module may register its restful apis while starting,
+	// which waits for the in-flight requests, including this one.
+	actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+	source := c.ClientIP()
+	go func() {
+		_, err := MaoCommon.SetModuleEnabled(name, enabled, actor)
+		detail := fmt.Sprintf("enabled: %v", enabled)
+		if err != nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to toggle module %s, %s", name, err.Error())
+			detail = fmt.Sprintf("%s, %s", detail, err.Error())
+		}
+		MaoCommon.RecordAudit(actor, source, "toggle module", name, err == nil, detail)
+	}()
+
+	s.showModulesPage(c)
+}
@@ -0,0 +1,207 @@
+package SelfCheck
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/util"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	MODULE_NAME = "Self-Check-module"
+
+	URL_HEALTHZ   = "/healthz"
+	URL_READYZ    = "/readyz"
+	URL_SELFCHECK = "/selfcheck"
+
+	CHECK_TIMEOUT = 5 * time.Second
+
+	RUNTIME_MODULE_NAME = "Runtime"
+)
+
+type healthCheckerEntry struct {
+	checker  MaoApi.HealthChecker
+	critical bool
+}
+
+type SelfCheckReport struct {
+	Status        string                 `json:"status"` // HEALTH_STATUS_OK, HEALTH_STATUS_DEGRADED or HEALTH_STATUS_DOWN
+	Timestamp     time.Time              `json:"timestamp"`
+	UptimeSeconds int64                  `json:"uptimeSeconds"`
+	Modules       []*MaoApi.ModuleHealth `json:"modules"`
+}
+
+type SelfCheckModule struct {
+	checkers     []*healthCheckerEntry
+	checkersLock sync.RWMutex
+
+	startTime time.Time
+}
+
+// AddHealthChecker adds the checker once, a module re-initialized at runtime may add it again.
+func (s *SelfCheckModule) AddHealthChecker(checker MaoApi.HealthChecker, critical bool) {
+	s.checkersLock.Lock()
+	defer s.checkersLock.Unlock()
+	for _, e := range s.checkers {
+		if e.checker == checker {
+			return
+		}
+	}
+	s.checkers = append(s.checkers, &healthCheckerEntry{checker: checker, critical: critical})
+}
+
+// CheckHealth reports the runtime of the server itself.
+func (s *SelfCheckModule) CheckHealth() *MaoApi.ModuleHealth {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	return &MaoApi.ModuleHealth{
+		Module: RUNTIME_MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Metrics: map[string]int64{
+			"goroutines":     int64(runtime.NumGoroutine()),
+			"heapAllocBytes": int64(memStats.HeapAlloc),
+			"numGC":          int64(memStats.NumGC),
+		},
+	}
+}
+
+// runChecks runs the checkers concurrently. The checker which doesn't return in CHECK_TIMEOUT is reported as down.
+func (s *SelfCheckModule) runChecks(onlyCritical bool) []*MaoApi.ModuleHealth {
+	s.checkersLock.RLock()
+	entries := make([]*healthCheckerEntry, 0, len(s.checkers))
+	for _, e := range s.checkers {
+		if e.critical || !onlyCritical {
+			entries = append(entries, e)
+		}
+	}
+	s.checkersLock.RUnlock()
+
+	results := make([]*MaoApi.ModuleHealth, len(entries))
+	wg := sync.WaitGroup{}
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, e *healthCheckerEntry) {
+			defer wg.Done()
+
+			resultChannel := make(chan *MaoApi.ModuleHealth, 1)
+			go func() {
+				resultChannel <- e.checker.CheckHealth()
+			}()
+
+			var health *MaoApi.ModuleHealth
+			select {
+			case health = <-resultChannel:
+			case <-time.After(CHECK_TIMEOUT):
+				health = &MaoApi.ModuleHealth{
+					Module: fmt.Sprintf("%T", e.checker),
+					Status: MaoApi.HEALTH_STATUS_DOWN,
+					Detail: "health check timeout",
+				}
+				util.MaoLogM(util.WARN, MODULE_NAME, "Health check timeout, %T", e.checker)
+			}
+			health.Critical = e.critical
+			results[i] = health
+		}(i, e)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// overallStatus is down if any critical module is down, degraded if any module is degraded or down.
+func overallStatus(modules []*MaoApi.ModuleHealth) string {
+	status := MaoApi.HEALTH_STATUS_OK
+	for _, m := range modules {
+		switch m.Status {
+		case MaoApi.HEALTH_STATUS_DOWN:
+			if m.Critical {
+				return MaoApi.HEALTH_STATUS_DOWN
+			}
+			status = MaoApi.HEALTH_STATUS_DEGRADED
+		case MaoApi.HEALTH_STATUS_DEGRADED:
+			status = MaoApi.HEALTH_STATUS_DEGRADED
+		}
+	}
+	return status
+}
+
+func (s *SelfCheckModule) InitSelfCheckModule() bool {
+	s.checkers = make([]*healthCheckerEntry, 0)
+	s.startTime = time.Now()
+
+	s.AddHealthChecker(s, false)
+
+	s.configRestControlInterface()
+
+	return true
+}
+
+func (s *SelfCheckModule) configRestControlInterface() {
+	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
+	if restfulServer == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get RestfulServerModule, unable to register restful apis.")
+		return
+	}
+
+	restfulServer.RegisterProbeApi(URL_HEALTHZ, &MaoApi.ApiDoc{
+		Summary:  "Liveness probe, ok if the server is running",
+		Tag:      MODULE_NAME,
+		Response: "ok",
+	}, s.showHealthz)
+	restfulServer.RegisterProbeApi(URL_READYZ, &MaoApi.ApiDoc{
+		Summary:     "Readiness probe, ok if all critical modules are working",
+		Description: "Replies 503 with the failed critical modules if not ready.",
+		Tag:         MODULE_NAME,
+		Response:    &SelfCheckReport{},
+	}, s.showReadyz)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_SELFCHECK, &MaoApi.ApiDoc{
+		Summary:  "Self diagnostics of all modules",
+		Tag:      MODULE_NAME,
+		Response: &SelfCheckReport{},
+	}, s.showSelfCheck)
+
+	s.configModuleToggleInterface(restfulServer)
+}
+
+func (s *SelfCheckModule) showHealthz(c *gin.Context) {
+	c.String(http.StatusOK, MaoApi.HEALTH_STATUS_OK)
+}
+
+func (s *SelfCheckModule) showReadyz(c *gin.Context) {
+	modules := s.runChecks(true)
+	status := overallStatus(modules)
+
+	report := &SelfCheckReport{
+		Status:        status,
+		Timestamp:     time.Now(),
+		UptimeSeconds: int64(time.Since(s.startTime).Seconds()),
+		Modules:       make([]*MaoApi.ModuleHealth, 0),
+	}
+	if status == MaoApi.HEALTH_STATUS_DOWN {
+		// only the failed modules, without details, because the probe is public.
+		for _, m := range modules {
+			if m.Status == MaoApi.HEALTH_STATUS_DOWN {
+				report.Modules = append(report.Modules, &MaoApi.ModuleHealth{Module: m.Module, Status: m.Status, Critical: m.Critical})
+			}
+		}
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *SelfCheckModule) showSelfCheck(c *gin.Context) {
+	modules := s.runChecks(false)
+	c.JSON(http.StatusOK, &SelfCheckReport{
+		Status:        overallStatus(modules),
+		Timestamp:     time.Now(),
+		UptimeSeconds: int64(time.Since(s.startTime).Seconds()),
+		Modules:       modules,
+	})
+}
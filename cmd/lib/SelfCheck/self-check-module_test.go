@@ -0,0 +1,69 @@
+package SelfCheck
+
+import (
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeChecker struct {
+	health MaoApi.ModuleHealth
+}
+
+func (f *fakeChecker) CheckHealth() *MaoApi.ModuleHealth {
+	h := f.health
+	return &h
+}
+
+func TestOverallStatus(t *testing.T) {
+	cases := []struct {
+		modules []*MaoApi.ModuleHealth
+		expect  string
+	}{
+		{[]*MaoApi.ModuleHealth{{Status: MaoApi.HEALTH_STATUS_OK}, {Status: MaoApi.HEALTH_STATUS_DISABLED}}, MaoApi.HEALTH_STATUS_OK},
+		{[]*MaoApi.ModuleHealth{{Status: MaoApi.HEALTH_STATUS_OK}, {Status: MaoApi.HEALTH_STATUS_DEGRADED, Critical: true}}, MaoApi.HEALTH_STATUS_DEGRADED},
+		{[]*MaoApi.ModuleHealth{{Status: MaoApi.HEALTH_STATUS_DOWN}}, MaoApi.HEALTH_STATUS_DEGRADED},
+		{[]*MaoApi.ModuleHealth{{Status: MaoApi.HEALTH_STATUS_DEGRADED}, {Status: MaoApi.HEALTH_STATUS_DOWN, Critical: true}}, MaoApi.HEALTH_STATUS_DOWN},
+	}
+	for i, c := range cases {
+		if got := overallStatus(c.modules); got != c.expect {
+			t.Errorf("case %d: expect %s, got %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestReadyzOnlyCritical(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &SelfCheckModule{}
+	s.InitSelfCheckModule()
+	s.AddHealthChecker(&fakeChecker{MaoApi.ModuleHealth{Module: "email", Status: MaoApi.HEALTH_STATUS_DOWN, Detail: "secret"}}, false)
+
+	router := gin.New()
+	router.GET(URL_READYZ, s.showReadyz)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, URL_READYZ, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("non-critical failure must not fail readiness, got %d", w.Code)
+	}
+
+	s.AddHealthChecker(&fakeChecker{MaoApi.ModuleHealth{Module: "config", Status: MaoApi.HEALTH_STATUS_DOWN, Detail: "secret"}}, true)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, URL_READYZ, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503, got %d", w.Code)
+	}
+
+	report := &SelfCheckReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Modules) != 1 || report.Modules[0].Module != "config" || report.Modules[0].Detail != "" {
+		t.Errorf("expect only the failed critical module without detail, got %+v", report.Modules)
+	}
+}
@@ -14,9 +14,11 @@ import (
 const (
 	SOAP_HEADER_KEY = "SOAPAction"
 
+	DEFAULT_ROUTER_ADDR = "192.168.1.1:1900"
+
 
 	/* ============================== ipc ============================== */
-	SOAP_URL_WANIPConnection   = "http://192.168.1.1:1900/ipc"
+	SOAP_PATH_WANIPConnection   = "/ipc"
 
 	// ========== GetUptime ==========
 	SOAP_HEADER_VALUE_GetUptime 		= "urn:schemas-upnp-org:service:WANIPConnection:1#GetStatusInfo"
@@ -30,7 +32,7 @@ const (
 
 
 	/* ============================== ifc ============================== */
-	SOAP_URL_WANCommonInterfaceConfig   = "http://192.168.1.1:1900/ifc"
+	SOAP_PATH_WANCommonInterfaceConfig   = "/ifc"
 
 	// ========== GetTotalBytesSent ==========
 	SOAP_HEADER_VALUE_GetTotalBytesSent = "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1#GetTotalBytesSent"
@@ -53,6 +55,19 @@ const (
 	SOAP_KEYWORD_GetTotalPacketsReceived		= "NewTotalPacketsReceived"
 )
 
+var (
+	routerAddr = DEFAULT_ROUTER_ADDR
+)
+
+// SetRouterAddr sets the address of the router's UPnP service, e.g. 192.168.1.1:1900
+func SetRouterAddr(addr string) {
+	routerAddr = addr
+}
+
+func soapUrl(soapPath string) string {
+	return "http://" + routerAddr + soapPath
+}
+
 func requestSoapData(soapUrl, soapHeader, soapBody string) (*[]byte, error) {
 
 	postData := bytes.NewReader([]byte(soapBody))
@@ -93,7 +108,7 @@ func getDataString(data string, keyword string) (string, error) {
 }
 
 func GetTotalBytesSent() (uint64, error) {
-	body, err := requestSoapData(SOAP_URL_WANCommonInterfaceConfig, SOAP_HEADER_VALUE_GetTotalBytesSent, SOAP_MSG_GetTotalBytesSent)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANCommonInterfaceConfig), SOAP_HEADER_VALUE_GetTotalBytesSent, SOAP_MSG_GetTotalBytesSent)
 	if err != nil {
 		return 0, err
 	}
@@ -109,7 +124,7 @@ func GetTotalBytesSent() (uint64, error) {
 }
 
 func GetTotalBytesReceived() (uint64, error) {
-	body, err := requestSoapData(SOAP_URL_WANCommonInterfaceConfig, SOAP_HEADER_VALUE_GetTotalBytesReceived, SOAP_MSG_GetTotalBytesReceived)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANCommonInterfaceConfig), SOAP_HEADER_VALUE_GetTotalBytesReceived, SOAP_MSG_GetTotalBytesReceived)
 	if err != nil {
 		return 0, err
 	}
@@ -125,7 +140,7 @@ func GetTotalBytesReceived() (uint64, error) {
 }
 
 func GetTotalPacketsSent() (uint64, error) {
-	body, err := requestSoapData(SOAP_URL_WANCommonInterfaceConfig, SOAP_HEADER_VALUE_GetTotalPacketsSent, SOAP_MSG_GetTotalPacketsSent)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANCommonInterfaceConfig), SOAP_HEADER_VALUE_GetTotalPacketsSent, SOAP_MSG_GetTotalPacketsSent)
 	if err != nil {
 		return 0, err
 	}
@@ -141,7 +156,7 @@ func GetTotalPacketsSent() (uint64, error) {
 }
 
 func GetTotalPacketsReceived() (uint64, error) {
-	body, err := requestSoapData(SOAP_URL_WANCommonInterfaceConfig, SOAP_HEADER_VALUE_GetTotalPacketsReceived, SOAP_MSG_GetTotalPacketsReceived)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANCommonInterfaceConfig), SOAP_HEADER_VALUE_GetTotalPacketsReceived, SOAP_MSG_GetTotalPacketsReceived)
 	if err != nil {
 		return 0, err
 	}
@@ -157,7 +172,7 @@ func GetTotalPacketsReceived() (uint64, error) {
 }
 
 func GetUptime() (uint64, error) {
-	body, err := requestSoapData(SOAP_URL_WANIPConnection, SOAP_HEADER_VALUE_GetUptime, SOAP_MSG_GetUptime)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANIPConnection), SOAP_HEADER_VALUE_GetUptime, SOAP_MSG_GetUptime)
 	if err != nil {
 		return 0, err
 	}
@@ -173,7 +188,7 @@ func GetUptime() (uint64, error) {
 }
 
 func GetExternalIPAddress() (string, error) {
-	body, err := requestSoapData(SOAP_URL_WANIPConnection, SOAP_HEADER_VALUE_GetExternalIPAddress, SOAP_MSG_GetExternalIPAddress)
+	body, err := requestSoapData(soapUrl(SOAP_PATH_WANIPConnection), SOAP_HEADER_VALUE_GetExternalIPAddress, SOAP_MSG_GetExternalIPAddress)
 	if err != nil {
 		return "", err
 	}
@@ -3,15 +3,21 @@ package Soap
 import (
 	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/cmd/lib/InfluxDB"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/util"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxdb2Api "github.com/influxdata/influxdb-client-go/v2/api"
+	"sync"
 	"time"
 )
 
 const (
 	p_TPLINK_MODULE_NAME = "TPLINK-Gateway-module"
 
+	// /modules/gateway/settings/routerAddr
+	MODULE_CONFIG_NAME = "gateway"
+	SETTINGS_KEY_ROUTER_ADDR = "routerAddr"
+
 	FLAG_GATEWAY_BytesReceivedSpeed = 1 << 0
 	FLAG_GATEWAY_BytesSentSpeed = 1 << 1
 	FLAG_GATEWAY_PacketsReceivedSpeed = 1 << 2
@@ -48,6 +54,19 @@ type TplinkGatewayModule struct {
 	PacketsReceivedSpeed uint64
 	PacketsSentSpeed uint64
 	Uptime uint64
+
+	needShutdown bool
+	loops sync.WaitGroup // controlLoop and pushLoop
+}
+
+func (t *TplinkGatewayModule) RequireShutdown() {
+	t.needShutdown = true
+}
+
+// Shutdown waits for the loops to exit, the collected data is pushed to InfluxDB.
+func (t *TplinkGatewayModule) Shutdown() {
+	t.RequireShutdown()
+	t.loops.Wait()
 }
 
 func (t *TplinkGatewayModule) publishInfluxDB(writeAPI *influxdb2Api.WriteAPI, finishFlag uint) {
@@ -98,6 +117,8 @@ func (t *TplinkGatewayModule) publishInfluxDB(writeAPI *influxdb2Api.WriteAPI, f
 }
 
 func (t *TplinkGatewayModule) pushLoop(triggerChannel *chan uint) {
+	defer t.loops.Done()
+
 	var client *influxdb2.Client
 	var writeApi *influxdb2Api.WriteAPI
 
@@ -107,6 +128,9 @@ func (t *TplinkGatewayModule) pushLoop(triggerChannel *chan uint) {
 		if writeApi != nil {
 			break
 		}
+		if t.needShutdown {
+			return
+		}
 		time.Sleep(1 * time.Second)
 	}
 	defer (*client).Close()
@@ -117,8 +141,15 @@ func (t *TplinkGatewayModule) pushLoop(triggerChannel *chan uint) {
 }
 
 func (t *TplinkGatewayModule) controlLoop(triggerChannel *chan uint) {
+	defer t.loops.Done()
+	defer close(*triggerChannel) // pushLoop exits after pushing the rest
+
 	for {
 		time.Sleep(2 * time.Second)
+		if t.needShutdown {
+			util.MaoLogM(util.INFO, p_TPLINK_MODULE_NAME, "Exit.")
+			return
+		}
 		var finishFlag uint = 0
 
 		newBytesReceived, err := GetTotalBytesReceived()
@@ -212,7 +243,17 @@ func (t *TplinkGatewayModule) controlLoop(triggerChannel *chan uint) {
 }
 
 func (t *TplinkGatewayModule) InitTplinkGatewayModule() bool {
+	t.needShutdown = false
+
+	addr, ok := MaoCommon.GetModuleSettings(MODULE_CONFIG_NAME)[SETTINGS_KEY_ROUTER_ADDR].(string)
+	if !ok || addr == "" {
+		addr = DEFAULT_ROUTER_ADDR
+	}
+	SetRouterAddr(addr)
+	util.MaoLogM(util.INFO, p_TPLINK_MODULE_NAME, "Collect the statistics from the router %s", addr)
+
 	triggerChannel := make(chan uint, 100)
+	t.loops.Add(2)
 	go t.controlLoop(&triggerChannel)
 	go t.pushLoop(&triggerChannel)
 	return true
@@ -2,20 +2,29 @@ package branch
 
 import (
 	"MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Audit"
+	"MaoServerDiscovery/cmd/lib/Auth"
 	"MaoServerDiscovery/cmd/lib/AuxDataProcessor"
 	config "MaoServerDiscovery/cmd/lib/Config"
 	"MaoServerDiscovery/cmd/lib/Email"
 	"MaoServerDiscovery/cmd/lib/GrpcKa"
 	icmpKa "MaoServerDiscovery/cmd/lib/IcmpKa"
 	"MaoServerDiscovery/cmd/lib/InfluxDB"
+	"MaoServerDiscovery/cmd/lib/LogControl"
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
+	"MaoServerDiscovery/cmd/lib/Outbox"
+	"MaoServerDiscovery/cmd/lib/Report"
+	"MaoServerDiscovery/cmd/lib/RestApiV2"
 	"MaoServerDiscovery/cmd/lib/Restful"
+	"MaoServerDiscovery/cmd/lib/SelfCheck"
 	"MaoServerDiscovery/cmd/lib/Soap"
 	MaoDatabase "MaoServerDiscovery/incubator/Database"
 	"MaoServerDiscovery/incubator/MaoCloudMonitor"
 	"MaoServerDiscovery/incubator/OnosTopoShow"
+	"MaoServerDiscovery/incubator/Wechat"
 	"MaoServerDiscovery/util"
 	parent "MaoServerDiscovery/util"
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net"
@@ -79,9 +88,13 @@ func getGrpcServices() []*MaoApi.GrpcServiceNode {
 	return grpcModule.GetServiceInfo()
 }
 
-func traceServicesForTopologyShow() {
+func traceServicesForTopologyShow(ctx context.Context) {
 	for {
-		time.Sleep(3 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(3 * time.Second):
+		}
 
 		topoModule := MaoCommon.ServiceRegistryGetTopoModule()
 		if topoModule == nil {
@@ -206,129 +219,318 @@ func showMergeServiceIP(c *gin.Context) {
 
 func RunServer(
 	report_server_addr *net.IP, report_server_port uint32, web_server_addr *net.IP, web_server_port uint32,
+	web_tls_cert string, web_tls_key string, web_tls_self_signed bool, web_http_redirect_port uint32,
 	influxdbUrl string, influxdbToken string, influxdbOrgBucket string,
 	cli_dump_interval uint32, refresh_interval uint32, minLogLevel util.MaoLogLevel, silent bool,
-	disable_gateway_module bool, version string) {
+	disable_gateway_module bool, config_sec_key_file string, config_sec_algorithm string,
+	config_backend string, config_backend_endpoint string, version string) (exitCode int) {
 
 	util.InitMaoLog(minLogLevel)
 
-	// ====== Restful Server module - part 1/2 ======
+	// ====== Restful Server module ======
 	restfulServer := &Restful.RestfulServerImpl{}
-	restfulServer.InitRestfulServer()
-
-	MaoCommon.RegisterService(MaoApi.RestfulServerRegisterName, restfulServer)
-
-	// register server.go's api
-	//restfulServer.RegisterGetApi("/json", showServers) // Mao: Deprecated, 2022.07.08.
-	//restfulServer.RegisterGetApi("/plain", showServerPlain) // Mao: Deprecated, 2022.07.08.
-	restfulServer.RegisterGetApi("/showMergeServiceIP", showMergeServiceIP)
-	restfulServer.RegisterUiPage("/Dashboard", showMergeServer)
-	// ==============================================
+	MaoCommon.RegisterModule(MaoApi.RestfulServerRegisterName, restfulServer, &MaoCommon.ModuleAdapter{
+		Name: Restful.MODULE_NAME,
+		InitFunc: func() bool {
+			restfulServer.InitRestfulServer()
+			restfulServer.SetVersion(version)
+
+			// register server.go's api
+			//restfulServer.RegisterGetApi("/json", showServers) // Mao: Deprecated, 2022.07.08.
+			//restfulServer.RegisterGetApi("/plain", showServerPlain) // Mao: Deprecated, 2022.07.08.
+			restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, "/showMergeServiceIP", &MaoApi.ApiDoc{
+				Summary:     "List ICMP services and alive gRPC services in one array",
+				Description: "Deprecated, the items are MaoIcmpService or GrpcServiceNode. Use /api/v2/services instead.",
+				Tag:         s_MODULE_NAME,
+				Response:    []interface{}{},
+			}, showMergeServiceIP)
+			restfulServer.RegisterUiPage("/Dashboard", showMergeServer)
+			return true
+		},
+		// started after all modules are initialized, so all restful apis are registered.
+		StartFunc: func() bool {
+			if web_tls_self_signed || web_tls_cert != "" {
+				if !restfulServer.EnableTls(web_tls_cert, web_tls_key, web_tls_self_signed) {
+					return false
+				}
+				if web_http_redirect_port != 0 {
+					restfulServer.EnableHttpRedirect(parent.GetAddrPort(web_server_addr, web_http_redirect_port))
+				}
+			}
+			restfulServer.StartRestfulServerDaemon(parent.GetAddrPort(web_server_addr, web_server_port))
+			return true
+		},
+		StopFunc: restfulServer.ShutdownRestfulServer,
+	})
+	// ====================================
+
+	// ====== Self Check module ======
+	selfCheckModule := &SelfCheck.SelfCheckModule{}
+	MaoCommon.RegisterModule(MaoApi.SelfCheckModuleRegisterName, selfCheckModule, &MaoCommon.ModuleAdapter{
+		Name:      SelfCheck.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName},
+		InitFunc:  selfCheckModule.InitSelfCheckModule,
+		Checker:   selfCheckModule,
+	})
+	// ===============================
 
 	// ====== Config(YAML) module ======
 	configModule := &config.ConfigYamlModule{}
-	if !configModule.InitConfigModule(config.DEFAULT_CONFIG_FILE) {
-		return
-	}
-
-	MaoCommon.RegisterService(MaoApi.ConfigModuleRegisterName, configModule)
+	MaoCommon.RegisterModule(MaoApi.ConfigModuleRegisterName, configModule, &MaoCommon.ModuleAdapter{
+		Name:      config.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(configModule, true)
+			if err := configModule.SetSecAlgorithm(config_sec_algorithm); err != nil {
+				util.MaoLogM(util.ERROR, s_MODULE_NAME, "%s", err.Error())
+				return false
+			}
+			if config_backend != config.CONFIG_BACKEND_FILE {
+				store, err := config.NewConfigStore(config_backend, config_backend_endpoint)
+				if err != nil {
+					util.MaoLogM(util.ERROR, s_MODULE_NAME, "Fail to open the config backend %s, %s", config_backend, err.Error())
+					return false
+				}
+				configModule.SetConfigStore(store)
+			}
+			if !configModule.InitConfigModule(config.DEFAULT_CONFIG_FILE) {
+				return false
+			}
+			// before the modules reading the sec configs, e.g. email and MYSQL.
+			if err := configModule.LoadSecKey(config_sec_key_file); err != nil {
+				util.MaoLogM(util.ERROR, s_MODULE_NAME, "%s", err.Error())
+				return false
+			}
+			return true
+		},
+		StopFunc: configModule.Shutdown,
+		Checker:  configModule,
+	})
 	// =================================
 
-	// ====== gRPC KA module ======
-	grpcModule := &GrpcKa.GrpcDetectModule{}
-	grpcModule.InitGrpcModule(parent.GetAddrPort(report_server_addr, report_server_port))
+	// ====== Audit module ======
+	auditModule := &Audit.AuditModule{}
+	MaoCommon.RegisterModule(MaoApi.AuditModuleRegisterName, auditModule, &MaoCommon.ModuleAdapter{
+		Name:      Audit.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(auditModule, false)
+			return auditModule.InitAuditModule(Audit.DEFAULT_AUDIT_FILE)
+		},
+		StopFunc: auditModule.Shutdown,
+		Checker:  auditModule,
+	})
+	// ==========================
+
+	// ====== Local Auth module ======
+	authModule := &Auth.LocalAuthModule{}
+	MaoCommon.RegisterModule(MaoApi.AuthModuleRegisterName, authModule, &MaoCommon.ModuleAdapter{
+		Name:      Auth.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.ConfigModuleRegisterName, MaoApi.AuditModuleRegisterName},
+		InitFunc:  authModule.InitLocalAuthModule,
+		StopFunc:  authModule.RequireShutdown,
+	})
+	// ===============================
+
+	// ====== Notification Outbox module ======
+	outboxModule := &Outbox.NotificationOutbox{}
+	MaoCommon.RegisterModule(MaoApi.OutboxModuleRegisterName, outboxModule, &MaoCommon.ModuleAdapter{
+		Name:      Outbox.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.AuditModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(outboxModule, false)
+			return outboxModule.InitOutboxModule(Outbox.DEFAULT_OUTBOX_FILE)
+		},
+		StopFunc: outboxModule.Shutdown,
+		Checker:  outboxModule,
+	})
+	// ========================================
 
-	MaoCommon.RegisterService(MaoApi.GrpcKaModuleRegisterName, grpcModule)
+	// ====== SMTP Email module ======
+	smtpEmailModule := &Email.SmtpEmailModule{}
+	MaoCommon.RegisterModule(MaoApi.EmailModuleRegisterName, smtpEmailModule, &MaoCommon.ModuleAdapter{
+		Name: Email.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.OutboxModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(smtpEmailModule, false)
+			return smtpEmailModule.InitSmtpEmailModule()
+		},
+		StopFunc: smtpEmailModule.Shutdown,
+		Checker:  smtpEmailModule,
+	})
 	// ============================
 
-	// ====== ICMP KA module ======
-	icmpDetectModule := &icmpKa.IcmpDetectModule{}
-	if !icmpDetectModule.InitIcmpModule() {
-		return
-	}
+	// ====== SLA Report module ======
+	slaReportModule := &Report.SlaReportModule{}
+	MaoCommon.RegisterModule(MaoApi.ReportModuleRegisterName, slaReportModule, &MaoCommon.ModuleAdapter{
+		Name: Report.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.EmailModuleRegisterName, MaoApi.AuditModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(slaReportModule, false)
+			return slaReportModule.InitSlaReportModule(Report.DEFAULT_TRANSITION_FILE)
+		},
+		StopFunc: slaReportModule.Shutdown,
+		Checker:  slaReportModule,
+	})
+	// ===============================
 
-	MaoCommon.RegisterService(MaoApi.IcmpKaModuleRegisterName, icmpDetectModule)
+	// ====== gRPC KA module ======
+	grpcModule := &GrpcKa.GrpcDetectModule{}
+	MaoCommon.RegisterModule(MaoApi.GrpcKaModuleRegisterName, grpcModule, &MaoCommon.ModuleAdapter{
+		Name: GrpcKa.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.EmailModuleRegisterName,
+			MaoApi.ReportModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(grpcModule, true)
+			return grpcModule.InitGrpcModule(parent.GetAddrPort(report_server_addr, report_server_port))
+		},
+		StopFunc: grpcModule.Shutdown,
+		Checker:  grpcModule,
+	})
 	// ============================
 
-	// ====== SMTP Email module ======
-	smtpEmailModule := &Email.SmtpEmailModule{}
-	if !smtpEmailModule.InitSmtpEmailModule() {
-		return
+	// ====== Topology module ======
+	hostname, err := util.GetHostname()
+	if err != nil {
+		hostname = "Mao-Unknown"
 	}
+	onosTopoModule := &OnosTopoShow.OnosTopoModule{}
+	MaoCommon.RegisterOptionalModule(MaoApi.TopoModuleRegisterName, onosTopoModule, &MaoCommon.ModuleAdapter{
+		Name:      OnosTopoShow.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.ConfigModuleRegisterName},
+		InitFunc: func() bool {
+			return onosTopoModule.InitOnosTopoModule(hostname, version)
+		},
+		StopFunc: onosTopoModule.Shutdown,
+	}, &MaoApi.ModuleOption{ConfigName: OnosTopoShow.MODULE_CONFIG_NAME, EnabledByDefault: true, HotToggle: true})
+	// =================================
 
-	MaoCommon.RegisterService(MaoApi.EmailModuleRegisterName, smtpEmailModule)
+	// ====== ICMP KA module ======
+	icmpDetectModule := &icmpKa.IcmpDetectModule{}
+	MaoCommon.RegisterModule(MaoApi.IcmpKaModuleRegisterName, icmpDetectModule, &MaoCommon.ModuleAdapter{
+		Name: icmpKa.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.EmailModuleRegisterName, MaoApi.TopoModuleRegisterName, MaoApi.ReportModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(icmpDetectModule, true)
+			return icmpDetectModule.InitIcmpModule()
+		},
+		StopFunc: icmpDetectModule.Shutdown,
+		Checker:  icmpDetectModule,
+	})
 	// ============================
 
 	// ====== MYSQL SYNC module ======
 	mysqlSyncModule := &MaoDatabase.MysqlDataPublisher{}
-	if !mysqlSyncModule.InitMysqlDataPublisher() {
-		return
-	}
+	MaoCommon.RegisterOptionalModule(MaoDatabase.MODULE_NAME, nil, &MaoCommon.ModuleAdapter{
+		Name: MaoDatabase.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.GrpcKaModuleRegisterName, MaoApi.IcmpKaModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(mysqlSyncModule, false)
+			return mysqlSyncModule.InitMysqlDataPublisher()
+		},
+		StopFunc: mysqlSyncModule.Shutdown,
+		Checker:  mysqlSyncModule,
+	}, &MaoApi.ModuleOption{ConfigName: MaoDatabase.MODULE_CONFIG_NAME, EnabledByDefault: true, HotToggle: true})
 	// ============================
 
 	// ====== Wechat Message module ======
-	//wechatMessageModule := &Wechat.WechatMessageModule{}
-	//if !wechatMessageModule.InitWechatMessageModule() {
-	//	return
-	//}
-	//
-	//MaoCommon.RegisterService(MaoApi.WechatModuleRegisterName, wechatMessageModule)
+	wechatMessageModule := &Wechat.WechatMessageModule{}
+	MaoCommon.RegisterOptionalModule(MaoApi.WechatModuleRegisterName, wechatMessageModule, &MaoCommon.ModuleAdapter{
+		Name: Wechat.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.SelfCheckModuleRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.OutboxModuleRegisterName},
+		InitFunc: func() bool {
+			selfCheckModule.AddHealthChecker(wechatMessageModule, false)
+			return wechatMessageModule.InitWechatMessageModule()
+		},
+		StopFunc: wechatMessageModule.Shutdown,
+		Checker:  wechatMessageModule,
+	}, &MaoApi.ModuleOption{ConfigName: Wechat.MODULE_CONFIG_NAME, EnabledByDefault: false})
 	// ============================
 
-	// ====== Topology module ======
-	hostname, err := util.GetHostname()
-	if err != nil {
-		hostname = "Mao-Unknown"
-	}
-	onosTopoModule := &OnosTopoShow.OnosTopoModule{}
-	onosTopoModule.InitOnosTopoModule(hostname, version)
-
-	MaoCommon.RegisterService(MaoApi.TopoModuleRegisterName, onosTopoModule)
-	// =================================
-
 	// ====== MaoCloud Monitor Wrapper module ======
 	maoCloudMonitorWrapper := &MaoCloudMonitor.MaoCloudMonitorWrapper{}
-	maoCloudMonitorWrapper.InitMaoCloudMonitorWrapper()
-
-	MaoCommon.RegisterService(MaoApi.MaoCloudModuleRegisterName, maoCloudMonitorWrapper)
+	MaoCommon.RegisterOptionalModule(MaoApi.MaoCloudModuleRegisterName, maoCloudMonitorWrapper, &MaoCommon.ModuleAdapter{
+		Name:      MaoCloudMonitor.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName},
+		InitFunc: func() bool {
+			maoCloudMonitorWrapper.InitMaoCloudMonitorWrapper()
+			return true
+		},
+	}, &MaoApi.ModuleOption{ConfigName: MaoCloudMonitor.MODULE_CONFIG_NAME, EnabledByDefault: true})
 	// =================================
 
-	// ====== Restful Server module - part 2/2 ======
-	restfulServer.StartRestfulServerDaemon(parent.GetAddrPort(web_server_addr, web_server_port))
-	// ==============================================
+	// ====== Log Control module ======
+	logControlModule := &LogControl.LogControlModule{}
+	MaoCommon.RegisterModule(LogControl.MODULE_NAME, nil, &MaoCommon.ModuleAdapter{
+		Name:      LogControl.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.AuditModuleRegisterName},
+		InitFunc:  logControlModule.InitLogControlModule,
+	})
+	// ================================
+
+	// ====== Restful API v2 module ======
+	serviceApiV2Module := &RestApiV2.ServiceApiV2Module{}
+	MaoCommon.RegisterModule(RestApiV2.MODULE_NAME, nil, &MaoCommon.ModuleAdapter{
+		Name: RestApiV2.MODULE_NAME,
+		DependsOn: []string{MaoApi.RestfulServerRegisterName, MaoApi.ConfigModuleRegisterName,
+			MaoApi.GrpcKaModuleRegisterName, MaoApi.IcmpKaModuleRegisterName},
+		InitFunc: serviceApiV2Module.InitServiceApiV2Module,
+	})
+	// ===================================
 
 	// ====== Aux Data Processor module ======
-	InfluxDB.ConfigInfluxdbUtils(influxdbUrl, influxdbToken, influxdbOrgBucket)
-
 	auxDataModule := &AuxDataProcessor.AuxDataProcessorModule{}
-	auxDataModule.InitAuxDataProcessor()
-
-	MaoCommon.RegisterService(MaoApi.AuxDataModuleRegisterName, auxDataModule)
-
-	envTempProcessor := AuxDataProcessor.EnvTempProcessor{}
-	var envTempProcessorAux MaoApi.AuxDataProcessor = envTempProcessor
-	auxDataModule.AddProcessor(&envTempProcessorAux)
+	MaoCommon.RegisterModule(MaoApi.AuxDataModuleRegisterName, auxDataModule, &MaoCommon.ModuleAdapter{
+		Name:      AuxDataProcessor.MODULE_NAME,
+		DependsOn: []string{MaoApi.SelfCheckModuleRegisterName, MaoApi.GrpcKaModuleRegisterName},
+		InitFunc: func() bool {
+			InfluxDB.ConfigInfluxdbUtils(influxdbUrl, influxdbToken, influxdbOrgBucket)
+			selfCheckModule.AddHealthChecker(&InfluxDB.InfluxdbHealthChecker{}, false)
+
+			auxDataModule.InitAuxDataProcessor()
+
+			envTempProcessor := AuxDataProcessor.EnvTempProcessor{}
+			var envTempProcessorAux MaoApi.AuxDataProcessor = envTempProcessor
+			auxDataModule.AddProcessor(&envTempProcessorAux)
+			return true
+		},
+	})
 	// =======================================
 
 	// ====== Gateway module ======
-	if disable_gateway_module == false {
-		gatewayModule := &Soap.TplinkGatewayModule{}
-		if !gatewayModule.InitTplinkGatewayModule() {
-			return
-		}
+	// disable_gateway_module is the default, if the module is not in the config.
+	gatewayModule := &Soap.TplinkGatewayModule{}
+	MaoCommon.RegisterOptionalModule(MaoApi.GatewayModuleRegisterName, gatewayModule, &MaoCommon.ModuleAdapter{
+		Name:     MaoApi.GatewayModuleRegisterName,
+		InitFunc: gatewayModule.InitTplinkGatewayModule,
+		StopFunc: gatewayModule.Shutdown,
+	}, &MaoApi.ModuleOption{ConfigName: Soap.MODULE_CONFIG_NAME, EnabledByDefault: !disable_gateway_module, HotToggle: true})
+	// ============================
+
+	ctx, stop := shutdownContext()
+	defer stop()
 
-		MaoCommon.RegisterService(MaoApi.GatewayModuleRegisterName, gatewayModule)
+	if err := MaoCommon.StartModules(); err != nil {
+		util.MaoLogM(util.ERROR, s_MODULE_NAME, "Fail to start the server, %s", err.Error())
+		return EXIT_CODE_FAIL
 	}
-	// ============================
 
 	if !silent {
 		go startCliOutput(cli_dump_interval)
 	}
 
-	traceServicesForTopologyShow()
+	go traceServicesForTopologyShow(ctx)
 
 	// updateServerAlive(refresh_interval) // Mao: Deprecated, 2022.07.08.
-	for {
-		time.Sleep(1 * time.Minute)
-	}
+	<-ctx.Done()
+	stop()
+	util.MaoLogM(util.INFO, s_MODULE_NAME, "Shutting down, grace period %s ...", SHUTDOWN_GRACE_PERIOD)
+
+	// stop accepting requests first, the modules behind the apis are stopping.
+	return shutdownWithin(s_MODULE_NAME, SHUTDOWN_GRACE_PERIOD, restfulServer.ShutdownRestfulServer, MaoCommon.StopModules)
 }
@@ -0,0 +1,46 @@
+package branch
+
+import (
+	"MaoServerDiscovery/util"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	EXIT_CODE_OK               = 0
+	EXIT_CODE_FAIL             = 1 // fail to start, e.g. wrong args, port in use
+	EXIT_CODE_SHUTDOWN_TIMEOUT = 2 // the grace period expired before everything is flushed
+
+	// the whole shutdown must finish in it, then we exit anyway.
+	// Docker kills the container 10s after SIGTERM by default, use e.g. "docker stop -t 20" for a complete shutdown.
+	SHUTDOWN_GRACE_PERIOD = 15 * time.Second
+)
+
+// shutdownContext is cancelled by SIGINT or SIGTERM.
+// Call stop after it is done, then a second signal kills the process immediately.
+func shutdownContext() (ctx context.Context, stop context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// shutdownWithin runs the steps in order, and gives up if they don't finish in gracePeriod.
+func shutdownWithin(moduleName string, gracePeriod time.Duration, steps ...func()) int {
+	done := make(chan struct{})
+	go func() {
+		for _, step := range steps {
+			step()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		util.MaoLogM(util.INFO, moduleName, "Shutdown completed.")
+		return EXIT_CODE_OK
+	case <-time.After(gracePeriod):
+		util.MaoLogM(util.ERROR, moduleName, "Shutdown is not completed in %s, exit anyway.", gracePeriod)
+		return EXIT_CODE_SHUTDOWN_TIMEOUT
+	}
+}
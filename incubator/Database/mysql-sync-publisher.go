@@ -1,6 +1,7 @@
 package MaoDatabase
 
 import (
+	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/cmd/lib/Config"
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/util"
@@ -16,6 +17,7 @@ import (
 
 const (
 	MODULE_NAME = "MYSQL-DB-SYNC-incubator"
+	MODULE_CONFIG_NAME = "mysql" // /modules/mysql/enabled
 	MYSQL_DB_TABLE_CREATE_SQL =
 		"create table if not exists MaoServiceDiscovery (" +
 			"Service_IP nvarchar(1024)," +
@@ -55,6 +57,8 @@ const (
 	MYSQL_API_KEY_USERNAME = "username"
 	MYSQL_API_KEY_PASSWORD = "password"
 	MYSQL_API_KEY_DB_NAME = "databaseName"
+
+	HEALTH_CHECK_PING_TIMEOUT = 3 * time.Second
 )
 
 type MysqlDataPublisher struct {
@@ -69,8 +73,21 @@ type MysqlDataPublisher struct {
 	dataSourceName string
 
 	secConfigChannel chan int
+	configSubscription <-chan *MaoApi.ConfigChangeEvent // the mysql config is changed, e.g. by a rollback or the config file
 
 	dbConn *sql.DB
+
+	needShutdown bool
+	exited chan struct{} // closed when databaseEventLoop exits
+}
+
+// Shutdown syncs the services to the database for the last time, and closes the connection.
+func (m *MysqlDataPublisher) Shutdown() {
+	m.needShutdown = true
+	<-m.exited
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil && m.configSubscription != nil {
+		configModule.Unsubscribe(m.configSubscription)
+	}
 }
 
 
@@ -143,6 +160,8 @@ func (m *MysqlDataPublisher) databaseInsertServices(dbTx *sql.Tx) error {
 }
 
 func (m *MysqlDataPublisher) databaseEventLoop() {
+	defer close(m.exited)
+
 	updateInterval := time.Duration(1000) * time.Millisecond
 	updateTimer := time.NewTimer(updateInterval)
 
@@ -151,6 +170,10 @@ func (m *MysqlDataPublisher) databaseEventLoop() {
 		select {
 		case <-m.secConfigChannel:
 			m.loadMysqlSecConfig()
+		case event, ok := <-m.configSubscription:
+			if ok {
+				m.processMysqlConfigChange(event)
+			}
 		case <-updateTimer.C:
 			for {
 				if m.dbConn == nil {
@@ -183,6 +206,14 @@ func (m *MysqlDataPublisher) databaseEventLoop() {
 
 				break // this "for" runs just once. because we need to reset the timer.
 			}
+
+			if m.needShutdown {
+				if m.dbConn != nil {
+					m.dbConn.Close()
+				}
+				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
+				return
+			}
 			updateTimer.Reset(updateInterval)
 		}
 	}
@@ -196,8 +227,23 @@ func (m *MysqlDataPublisher) configRestControlInterface() {
 	}
 
 	restfulServer.RegisterUiPage(URL_MYSQL_HOMEPAGE, m.showMysqlPage)
-	restfulServer.RegisterGetApi(URL_MYSQL_SHOW, m.showMysqlInfo)
-	restfulServer.RegisterPostApi(URL_MYSQL_CONFIG, m.processMysqlInfo)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_MYSQL_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the MYSQL config, without the password",
+		Tag:      MODULE_NAME,
+		Response: map[string]interface{}{},
+	}, m.showMysqlInfo)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_MYSQL_CONFIG, &MaoApi.ApiDoc{
+		Summary:     "Update the MYSQL config and reconnect",
+		Description: "Replies the MYSQL config page, or a failure message.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: MYSQL_API_KEY_USERNAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true},
+			{Name: MYSQL_API_KEY_PASSWORD, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true},
+			{Name: MYSQL_API_KEY_SERVER_IP_DOMAIN_NAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true},
+			{Name: MYSQL_API_KEY_SERVER_PORT, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_INTEGER, Required: true},
+			{Name: MYSQL_API_KEY_DB_NAME, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true},
+		},
+	}, m.processMysqlInfo)
 }
 
 func (m *MysqlDataPublisher) showMysqlPage(c *gin.Context) {
@@ -215,23 +261,47 @@ func (m *MysqlDataPublisher) showMysqlInfo(c *gin.Context) {
 	c.JSON(200, data)
 }
 
-func (m *MysqlDataPublisher) loadMysqlSecConfig() {
+func (m *MysqlDataPublisher) loadMysqlPassword() bool {
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
-		return
+		return false
 	}
 
 	password, errCode := configModule.GetSecConfig(MYSQL_INFO_CONFIG_PATH_PASSWORD)
 	if errCode != Config.ERR_CODE_SUCCESS {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read mysql config, code: %d, %v", errCode, errCode)
-		return
+		return false
 	}
 
-	var ok bool
-	m.password, ok = password.(string)
+	passwordStr, ok := password.(string)
 	if !ok {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse mysql config - password")
+		return false
+	}
+	m.password = passwordStr
+	return true
+}
+
+// processMysqlConfigChange reloads the config changed by others, and reconnects if the data source is changed.
+func (m *MysqlDataPublisher) processMysqlConfigChange(event *MaoApi.ConfigChangeEvent) {
+	util.MaoLogM(util.DEBUG, MODULE_NAME, "Config %s is changed by %s, version %d", event.Path, event.Actor, event.Version)
+	m.loadMysqlConfig()
+	m.loadMysqlPassword()
+
+	dataSourceName := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", m.username, m.password, m.ipDomainName, m.port, m.databaseName)
+	if dataSourceName == m.dataSourceName {
+		return // e.g. reconnected by the restful api already.
+	}
+	if !m.reConstructMysqlConnection() {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to re-construct MYSQL connection.")
+	} else {
+		util.MaoLogM(util.INFO, MODULE_NAME, "Reconnected to MYSQL database after the config is changed.")
+	}
+}
+
+func (m *MysqlDataPublisher) loadMysqlSecConfig() {
+	if !m.loadMysqlPassword() {
 		return
 	}
 
@@ -350,8 +420,9 @@ func (m *MysqlDataPublisher) processMysqlInfo(c *gin.Context) {
 		data[MYSQL_CONFIG_KEY_DB_NAME] = m.databaseName
 
 		// Attention: password can't be outputted !!!
-		configModule.PutConfig(MYSQL_INFO_CONFIG_PATH_ROOT, data)
-		configModule.PutSecConfig(MYSQL_INFO_CONFIG_PATH_PASSWORD, m.password)
+		actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+		configModule.PutConfigBy(actor, MYSQL_INFO_CONFIG_PATH_ROOT, data)
+		configModule.PutSecConfigBy(actor, MYSQL_INFO_CONFIG_PATH_PASSWORD, m.password)
 	}
 
 	if !m.reConstructMysqlConnection() {
@@ -386,6 +457,42 @@ func (m * MysqlDataPublisher) reConstructMysqlConnection() bool {
 	return m.initDatabaseTable()
 }
 
+func (m *MysqlDataPublisher) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: fmt.Sprintf("connected to %s:%d/%s", m.ipDomainName, m.port, m.databaseName),
+	}
+
+	if m.needShutdown {
+		health.Status = MaoApi.HEALTH_STATUS_DISABLED
+		health.Detail = "MYSQL sync is stopped"
+		return health
+	}
+
+	dbConn := m.dbConn
+	if dbConn == nil || m.ipDomainName == "" {
+		health.Status = MaoApi.HEALTH_STATUS_DISABLED
+		health.Detail = "MYSQL is not configured"
+		return health
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_CHECK_PING_TIMEOUT)
+	defer cancel()
+	if err := dbConn.PingContext(ctx); err != nil {
+		health.Status = MaoApi.HEALTH_STATUS_DOWN
+		health.Detail = fmt.Sprintf("fail to ping %s:%d, %s", m.ipDomainName, m.port, err.Error())
+		return health
+	}
+
+	stats := dbConn.Stats()
+	health.Metrics = map[string]int64{
+		"openConnections": int64(stats.OpenConnections),
+		"inUse":           int64(stats.InUse),
+	}
+	return health
+}
+
 func (m *MysqlDataPublisher) registerSecConfigListener() {
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
@@ -395,6 +502,7 @@ func (m *MysqlDataPublisher) registerSecConfigListener() {
 
 	// register config-secKey listener
 	configModule.RegisterKeyUpdateListener(&m.secConfigChannel)
+	m.configSubscription = configModule.Subscribe(MYSQL_INFO_CONFIG_PATH_ROOT)
 }
 
 func (m *MysqlDataPublisher) InitMysqlDataPublisher() bool {
@@ -406,11 +514,15 @@ func (m *MysqlDataPublisher) InitMysqlDataPublisher() bool {
 	//m.port = port
 	//m.databaseName = databaseName
 
+	m.needShutdown = false
+	m.exited = make(chan struct{})
+
 	m.reConstructMysqlConnection()
 
-	m.secConfigChannel = make(chan int)
+	m.secConfigChannel = make(chan int, 1)
 	m.registerSecConfigListener()
 	m.loadMysqlConfig()
+	m.loadMysqlSecConfig() // the sec key may be loaded at startup.
 
 	go m.databaseEventLoop()
 
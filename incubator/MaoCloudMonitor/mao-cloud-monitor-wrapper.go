@@ -1,6 +1,7 @@
 package MaoCloudMonitor
 
 import (
+	MaoApi "MaoServerDiscovery/cmd/api"
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/util"
 	"errors"
@@ -13,6 +14,10 @@ import (
 const (
 	MODULE_NAME                    = "Mao-Cloud-Monitor"
 	URL_MAOCLOUD_MERGE_ALL_STATION = "/getMaoCloudMergeAllStation"
+
+	// /modules/maoCloud/settings/stations, the monitor urls of the stations
+	MODULE_CONFIG_NAME    = "maoCloud"
+	SETTINGS_KEY_STATIONS = "stations"
 )
 
 type MaoCloudMonitorWrapper struct {
@@ -29,7 +34,11 @@ func (mw *MaoCloudMonitorWrapper) configRestControlInterface() {
 		return
 	}
 
-	restfulServer.RegisterGetApi(URL_MAOCLOUD_MERGE_ALL_STATION, mw.getMergeAllStation)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_MAOCLOUD_MERGE_ALL_STATION, &MaoApi.ApiDoc{
+		Summary:  "Merge the info of all MaoCloud monitor stations",
+		Tag:      MODULE_NAME,
+		Response: map[string][]map[string]string{},
+	}, mw.getMergeAllStation)
 }
 
 func getRemoteStationInfo(station_monitor_url string) (string, error) {
@@ -66,13 +75,29 @@ func convertStationInfoToMap(info string) map[string]interface{} {
 	return data
 }
 
+// getStationList reads the settings on every request, so the stations can be changed at runtime.
+func getStationList() []string {
+	stations := make([]string, 0)
+
+	stationsObj, ok := MaoCommon.GetModuleSettings(MODULE_CONFIG_NAME)[SETTINGS_KEY_STATIONS].([]interface{})
+	if !ok {
+		return stations
+	}
+	for _, stationObj := range stationsObj {
+		if station, ok := stationObj.(string); ok {
+			stations = append(stations, station)
+		}
+	}
+	return stations
+}
+
 func (mw *MaoCloudMonitorWrapper) getMergeAllStation(c *gin.Context) {
 
-	demo_station_list := []string{}
+	station_list := getStationList()
 
 	data_list := make([]interface{}, 0)
 
-	for _, station := range demo_station_list {
+	for _, station := range station_list {
 		info, _ := getRemoteStationInfo(station)
 		station_map := convertStationInfoToMap(info)
 		data_list = append(data_list, station_map)
@@ -10,11 +10,13 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const (
 	MODULE_NAME = "ONOS-Topology-module"
+	MODULE_CONFIG_NAME = "onos" // /modules/onos/enabled
 
 	ADD_DEVICE_API_SUFFIX = "/MaoIntegration/addDevice"
 	REMOVE_DEVICE_API_SUFFIX = "/MaoIntegration/removeDevice"
@@ -58,18 +60,30 @@ type OnosTopoModule struct {
 	portMapping		map[string]uint // local-remote-protocol => local port number
 
 	needShutdown bool
+	exited chan struct{} // closed when topoEventLoop exits
 	topoEventChannel chan *MaoApi.TopoEvent
+	configUpdateChannel chan int // the onos config is changed, e.g. the config file is edited
+
+	pendingRequests sync.WaitGroup // requests to ONOS in flight
 }
 
 func (o *OnosTopoModule) RequireShutdown() {
 	o.needShutdown = true
 }
 
+// Shutdown sends the pending events to ONOS and waits for topoEventLoop to exit.
+func (o *OnosTopoModule) Shutdown() {
+	o.RequireShutdown()
+	<-o.exited
+}
+
 func (o *OnosTopoModule) InitOnosTopoModule(hostname string, version string) bool {
 	o.hostname = hostname
 	o.version = version
 	o.needShutdown = false
+	o.exited = make(chan struct{})
 	o.topoEventChannel = make(chan *MaoApi.TopoEvent, 1024)
+	o.configUpdateChannel = make(chan int, 1)
 
 	o.portIterators = make(map[string]uint)
 	o.portIterators[hostname] = 1
@@ -77,6 +91,9 @@ func (o *OnosTopoModule) InitOnosTopoModule(hostname string, version string) boo
 	o.portMapping = make(map[string]uint)
 
 	o.loadOnosConfig()
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		configModule.RegisterConfigUpdateListener(ONOS_CONFIG_PATH, &o.configUpdateChannel)
+	}
 
 	o.configRestControlInterface()
 
@@ -139,8 +156,20 @@ func (o *OnosTopoModule) configRestControlInterface() {
 	}
 
 	restfulServer.RegisterUiPage(URL_ONOS_HOMEPAGE, o.showOnosPage)
-	restfulServer.RegisterGetApi(URL_ONOS_SHOW, o.showOnosInfo)
-	restfulServer.RegisterPostApi(URL_ONOS_CONFIG, o.processOnosInfo)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_ONOS_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the ONOS config and the derived ONOS API URLs",
+		Tag:      MODULE_NAME,
+		Response: map[string]string{},
+	}, o.showOnosInfo)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_OPERATOR, URL_ONOS_CONFIG, &MaoApi.ApiDoc{
+		Summary:     "Update the ONOS config",
+		Description: "Replies the ONOS config page.",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: ONOS_CONFIG_KEY_ADDRPORT, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING, Required: true,
+				Description: "e.g. 127.0.0.1:8181"},
+		},
+	}, o.processOnosInfo)
 }
 
 func (o *OnosTopoModule) showOnosPage(c *gin.Context) {
@@ -173,7 +202,7 @@ func (o *OnosTopoModule) processOnosInfo(c *gin.Context) {
 	} else {
 		data := make(map[string]interface{})
 		data[ONOS_CONFIG_KEY_ADDRPORT] = o.addrPort
-		configModule.PutConfig(ONOS_CONFIG_PATH, data)
+		configModule.PutConfigBy(c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME), ONOS_CONFIG_PATH, data)
 
 		// Mao: These configs can be restored, so we don't need to save them.
 		//
@@ -232,10 +261,62 @@ func (o *OnosTopoModule) configOnosEndpointAPI(addrPort string) {
 
 
 func (o *OnosTopoModule) SendEvent(event *MaoApi.TopoEvent) {
+	if o.needShutdown {
+		return // stopped or disabled, the services will be traced again after it is started.
+	}
 	o.topoEventChannel <- event
 }
 
+// goRequest sends the request to ONOS asynchronously, and tracks it for shutdown.
+func (o *OnosTopoModule) goRequest(request func()) {
+	o.pendingRequests.Add(1)
+	go func() {
+		defer o.pendingRequests.Done()
+		request()
+	}()
+}
+
+func (o *OnosTopoModule) processTopoEvent(event *MaoApi.TopoEvent) {
+	qingdao := len(o.topoEventChannel)
+	util.MaoLogM(util.DEBUG, MODULE_NAME, "buffer len: %d", qingdao)
+	switch event.EventType {
+	case MaoApi.SERVICE_UP:
+		localPort, ok1 := o.portMapping[fmt.Sprintf("%s-%s-%s", o.hostname, event.ServiceName, event.EventSource)]
+		if !ok1 {
+			localPort = o.portIterators[o.hostname]
+			o.portIterators[o.hostname] = localPort + 1
+			o.portMapping[fmt.Sprintf("%s-%s-%s", o.hostname, event.ServiceName, event.EventSource)] = localPort
+		}
+
+		servicePort, ok2 := o.portMapping[fmt.Sprintf("%s-%s-%s", event.ServiceName, o.hostname, event.EventSource)]
+		if !ok2 {
+			servicePort, ok2 = o.portIterators[event.ServiceName]
+			if !ok2 {
+				servicePort = 1
+			}
+			o.portIterators[event.ServiceName] = servicePort + 1
+			o.portMapping[fmt.Sprintf("%s-%s-%s", event.ServiceName, o.hostname, event.EventSource)] = servicePort
+		}
+
+		o.goRequest(func() {
+			o.topoAddDevice(event.ServiceName, event.Timestamp.String(), event.EventSource)
+			o.topoAddLink(o.hostname, localPort, event.ServiceName, servicePort)
+		})
+	case MaoApi.SERVICE_DOWN:
+		o.goRequest(func() {
+			//o.topoAddDevice(event.ServiceName, event.Timestamp.String(), event.EventSource)
+			o.topoOfflineDevice(event.ServiceName)
+		})
+	case MaoApi.SERVICE_DELETE:
+		o.goRequest(func() {
+			o.topoDeleteDevice(event.ServiceName)
+		})
+	}
+}
+
 func (o *OnosTopoModule) topoEventLoop() {
+	defer close(o.exited)
+
 	kaInterval := time.Duration(1000) * time.Millisecond
 	kaShutdownTimer := time.NewTimer(kaInterval)
 
@@ -244,48 +325,28 @@ func (o *OnosTopoModule) topoEventLoop() {
 	for {
 		select {
 		case event := <-o.topoEventChannel:
-			qingdao := len(o.topoEventChannel)
-			util.MaoLogM(util.DEBUG, MODULE_NAME, "buffer len: %d", qingdao)
-			switch event.EventType {
-			case MaoApi.SERVICE_UP:
-				localPort, ok1 := o.portMapping[fmt.Sprintf("%s-%s-%s", o.hostname, event.ServiceName, event.EventSource)]
-				if !ok1 {
-					localPort = o.portIterators[o.hostname]
-					o.portIterators[o.hostname] = localPort + 1
-					o.portMapping[fmt.Sprintf("%s-%s-%s", o.hostname, event.ServiceName, event.EventSource)] = localPort
-				}
-
-				servicePort, ok2 := o.portMapping[fmt.Sprintf("%s-%s-%s", event.ServiceName, o.hostname, event.EventSource)]
-				if !ok2 {
-					servicePort, ok2 = o.portIterators[event.ServiceName]
-					if !ok2 {
-						servicePort = 1
-					}
-					o.portIterators[event.ServiceName] = servicePort + 1
-					o.portMapping[fmt.Sprintf("%s-%s-%s", event.ServiceName, o.hostname, event.EventSource)] = servicePort
-				}
-
-				go func() {
-					o.topoAddDevice(event.ServiceName, event.Timestamp.String(), event.EventSource)
-					o.topoAddLink(o.hostname, localPort, event.ServiceName, servicePort)
-				}()
-			case MaoApi.SERVICE_DOWN:
-				go func(){
-					//o.topoAddDevice(event.ServiceName, event.Timestamp.String(), event.EventSource)
-					o.topoOfflineDevice(event.ServiceName)
-				}()
-			case MaoApi.SERVICE_DELETE:
-				go o.topoDeleteDevice(event.ServiceName)
+			o.processTopoEvent(event)
+		case <-o.configUpdateChannel:
+			if addrPort := o.getAddrPortConfig(); addrPort != ONOS_CONFIG_INVALID_ADDRPORT && addrPort != o.addrPort {
+				util.MaoLogM(util.INFO, MODULE_NAME, "ONOS endpoint is updated from config: %s", addrPort)
+				o.addrPort = addrPort
+				o.configOnosEndpointAPI(addrPort)
 			}
 		case <-kaShutdownTimer.C:
 			if o.needShutdown {
 				if len(o.topoEventChannel) != 0 {
-					util.MaoLogM(util.WARN, MODULE_NAME, "Exiting, but the topoEventChannel is not empty, len: %d", len(o.topoEventChannel))
+					util.MaoLogM(util.INFO, MODULE_NAME, "Exiting, flush %d pending events.", len(o.topoEventChannel))
+				}
+				for len(o.topoEventChannel) > 0 {
+					o.processTopoEvent(<-o.topoEventChannel)
 				}
+				o.pendingRequests.Wait()
 				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 				return
 			}
-			go o.topoAddDevice(o.hostname, o.version, time.Now().String())
+			o.goRequest(func() {
+				o.topoAddDevice(o.hostname, o.version, time.Now().String())
+			})
 			kaShutdownTimer.Reset(kaInterval)
 		}
 	}
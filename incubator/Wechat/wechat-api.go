@@ -0,0 +1,207 @@
+package Wechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WECHAT_API_BASE_URL = "https://qyapi.weixin.qq.com"
+
+	URL_PATH_GET_ACCESS_TOKEN = "/cgi-bin/gettoken"
+	URL_PATH_SEND_MESSAGE     = "/cgi-bin/message/send"
+
+	WECHAT_HTTP_TIMEOUT = 10 * time.Second
+	// the token is refreshed a bit earlier than expires_in, so it never expires in flight.
+	WECHAT_TOKEN_EXPIRY_MARGIN = 5 * time.Minute
+
+	// the errcodes of the token, the token is fetched again and the message is sent once more.
+	WECHAT_ERRCODE_INVALID_CREDENTIAL   = 40001
+	WECHAT_ERRCODE_INVALID_ACCESS_TOKEN = 40014
+	WECHAT_ERRCODE_ACCESS_TOKEN_EXPIRED = 42001
+
+	WECHAT_MSGTYPE_TEXT     = "text"
+	WECHAT_MSGTYPE_TEXTCARD = "textcard"
+	WECHAT_TO_ALL           = "@all"
+)
+
+// WechatApiError is the non-zero errcode replied by the WeChat Work API.
+type WechatApiError struct {
+	Api     string
+	ErrCode int
+	ErrMsg  string
+}
+
+func (e *WechatApiError) Error() string {
+	return fmt.Sprintf("%s: errcode %d, %s", e.Api, e.ErrCode, e.ErrMsg)
+}
+
+func isTokenError(err error) bool {
+	apiErr, ok := err.(*WechatApiError)
+	return ok && (apiErr.ErrCode == WECHAT_ERRCODE_INVALID_CREDENTIAL ||
+		apiErr.ErrCode == WECHAT_ERRCODE_INVALID_ACCESS_TOKEN ||
+		apiErr.ErrCode == WECHAT_ERRCODE_ACCESS_TOKEN_EXPIRED)
+}
+
+type wechatApiResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+type wechatAccessTokenResponse struct {
+	wechatApiResponse
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"` // seconds
+}
+
+type wechatSendResponse struct {
+	wechatApiResponse
+	InvalidUser  string `json:"invaliduser"`
+	InvalidParty string `json:"invalidparty"`
+	InvalidTag   string `json:"invalidtag"`
+}
+
+type wechatText struct {
+	Content string `json:"content"`
+}
+
+type wechatTextCard struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Url         string `json:"url"`
+}
+
+type wechatSendRequest struct {
+	ToUser   string          `json:"touser,omitempty"` // ids separated by "|", or WECHAT_TO_ALL
+	ToParty  string          `json:"toparty,omitempty"`
+	ToTag    string          `json:"totag,omitempty"`
+	MsgType  string          `json:"msgtype"`
+	AgentId  int64           `json:"agentid"`
+	Text     *wechatText     `json:"text,omitempty"`
+	TextCard *wechatTextCard `json:"textcard,omitempty"`
+}
+
+// wechatApiClient talks to the WeChat Work API, the access token is cached until it expires.
+type wechatApiClient struct {
+	httpClient *http.Client
+
+	lock     sync.Mutex
+	tokenKey string // the corp id and the secret of the token, it is fetched again if they are changed
+	token    string
+	expiry   time.Time
+}
+
+func newWechatApiClient() *wechatApiClient {
+	return &wechatApiClient{httpClient: &http.Client{Timeout: WECHAT_HTTP_TIMEOUT}}
+}
+
+// call sends the request and decodes the reply into response, the non-zero errcode is returned as *WechatApiError.
+func (a *wechatApiClient) call(request *http.Request, api string, response interface{}, result *wechatApiResponse) error {
+	resp, err := a.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %d", api, resp.StatusCode)
+	}
+	if err = json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("%s: invalid reply, %s", api, err.Error())
+	}
+	if result.ErrCode != 0 {
+		return &WechatApiError{Api: api, ErrCode: result.ErrCode, ErrMsg: result.ErrMsg}
+	}
+	return nil
+}
+
+// accessToken returns the cached token, or fetches a new one if it is expired.
+func (a *wechatApiClient) accessToken(baseUrl string, corpId string, secret string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := corpId + "\x00" + secret
+	if a.tokenKey == key && a.token != "" && time.Now().Before(a.expiry) {
+		return a.token, nil
+	}
+
+	query := url.Values{"corpid": {corpId}, "corpsecret": {secret}}
+	request, err := http.NewRequest(http.MethodGet, baseUrl+URL_PATH_GET_ACCESS_TOKEN+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	response := &wechatAccessTokenResponse{}
+	if err = a.call(request, "gettoken", response, &response.wechatApiResponse); err != nil {
+		return "", err
+	}
+	if response.AccessToken == "" {
+		return "", fmt.Errorf("gettoken: no access_token in the reply")
+	}
+
+	a.tokenKey, a.token = key, response.AccessToken
+	a.expiry = time.Now().Add(time.Duration(response.ExpiresIn)*time.Second - WECHAT_TOKEN_EXPIRY_MARGIN)
+	return a.token, nil
+}
+
+// invalidate drops the token, if it is not refreshed by others meanwhile.
+func (a *wechatApiClient) invalidate(token string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.token == token {
+		a.token = ""
+	}
+}
+
+// tokenExpiry is zero if there is no cached token.
+func (a *wechatApiClient) tokenExpiry() time.Time {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.token == "" {
+		return time.Time{}
+	}
+	return a.expiry
+}
+
+func (a *wechatApiClient) sendOnce(baseUrl string, token string, data []byte) (*wechatSendResponse, error) {
+	request, err := http.NewRequest(http.MethodPost,
+		baseUrl+URL_PATH_SEND_MESSAGE+"?"+url.Values{"access_token": {token}}.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	response := &wechatSendResponse{}
+	return response, a.call(request, "message/send", response, &response.wechatApiResponse)
+}
+
+// send sends the message, the token is fetched again once if it is rejected, e.g. revoked before the expiry.
+func (a *wechatApiClient) send(baseUrl string, corpId string, secret string, message *wechatSendRequest) (*wechatSendResponse, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	baseUrl = strings.TrimRight(baseUrl, "/")
+
+	for retried := false; ; retried = true {
+		token, err := a.accessToken(baseUrl, corpId, secret)
+		if err != nil {
+			return nil, err
+		}
+		response, err := a.sendOnce(baseUrl, token, data)
+		if err != nil && isTokenError(err) && !retried {
+			a.invalidate(token)
+			continue
+		}
+		return response, err
+	}
+}
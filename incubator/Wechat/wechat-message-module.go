@@ -2,69 +2,114 @@ package Wechat
 
 import (
 	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/Config"
 	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"MaoServerDiscovery/util"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"html"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	MODULE_NAME = "Wechat-Message-module"
+	MODULE_CONFIG_NAME = "wechat" // /modules/wechat/enabled
 
 	URL_WECHAT_HOMEPAGE = "/configWechat"
 	URL_WECHAT_CONFIG   = "/addWechatInfo"
 	URL_WECHAT_SHOW   = "/getWechatInfo"
 
 	WECHAT_INFO_CONFIG_PATH = "/wechat"
-)
+	WECHAT_INFO_CONFIG_PATH_SECRET = "/wechat/agentSecret"
 
-const (
+	WECHAT_CONFIG_KEY_CORP_ID = "corpId"
+	WECHAT_CONFIG_KEY_AGENT_ID = "agentId"
+	WECHAT_CONFIG_KEY_GLOBAL_RECEIVERS = "globalReceivers"
+	WECHAT_CONFIG_KEY_GLOBAL_PARTIES = "globalParties"
+	WECHAT_CONFIG_KEY_GLOBAL_TAGS = "globalTags"
+	WECHAT_CONFIG_KEY_WEBUI_URL = "webUiUrl"
+	WECHAT_CONFIG_KEY_API_URL = "apiUrl"
 
-	URL_TEMPLATE_GET_ACCESS_TOKEN = "https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=%s&corpsecret=%s"
-	URL_TEMPLATE_SEND_MESSAGE = "https://qyapi.weixin.qq.com/cgi-bin/message/send?access_token=%s"
-
-	TEXT_CARD_JSON_TEMPLATE =
-		"{" +
-			"\"touser\":\"%s\"," +
-			"\"toparty\":\"\"," +
-			"\"totag\":\"\"," +
-			"\"msgtype\":\"textcard\"," +
-			"\"agentid\": %s," +
-			"\"textcard\": {" +
-					"\"title\":\"%s\"," +
-					"\"description\":\"%s\"," +
-					"\"url\":\"%s\"" +
-			"}" +
-		"}"
+	WECHAT_API_KEY_AGENT_SECRET = "agentSecret"
+
+	WECHAT_QUEUE_SIZE = 1024
+	WECHAT_SEND_INTERVAL = 1 * time.Second // the gap between two messages
 )
 
+// WechatConfig is the schema of WECHAT_INFO_CONFIG_PATH, the agent secret is a sec config beside it.
+type WechatConfig struct {
+	CorpId          string   `yaml:"corpId" validate:"required"` // Attention, the tags MUST be modified simultaneously with WECHAT_CONFIG_KEY_*.
+	AgentId         string   `yaml:"agentId" validate:"required"`
+	GlobalReceivers []string `yaml:"globalReceivers"`                  // user ids
+	GlobalParties   []string `yaml:"globalParties,omitempty"`          // department ids
+	GlobalTags      []string `yaml:"globalTags,omitempty"`             // tag ids, all empty stands for all receivers
+	WebUiUrl        string   `yaml:"webUiUrl,omitempty"`               // e.g. https://mao.example.com:29999, for the links in the messages
+	ApiUrl          string   `yaml:"apiUrl,omitempty"`                 // WECHAT_API_BASE_URL if empty, e.g. a proxy
+}
+
 type WechatMessageModule struct {
 
 	corpId		string
 	agentId		string
 	agentSecret	string // corpsecret. Attention: agentSecret can't be outputted !!!
 	globalReceivers []string  // length == 0 and nil stand for all receivers.
-
+	globalParties []string
+	globalTags []string
+	webUiUrl string
+	apiUrl string
+	api *wechatApiClient
 
 	// input the message
 	sendWechatMessageChannel chan *MaoApi.WechatMessage
 	lastSendTimestamp        time.Time
+	droppedMessages atomic.Int64 // the queue is full
+
+	secConfigChannel chan int
+	configUpdateChannel chan int // the wechat config is changed, e.g. the config file is edited
 
 	// same as the other module, it is expected to be global
 	//checkInterval uint32
 
 	needShutdown bool
+	exited chan struct{} // closed when sendWechatMessageLoop exits
 }
 
 func (w *WechatMessageModule) RequireShutdown() {
 	w.needShutdown = true
 }
 
+// Shutdown saves the pending messages to the outbox and waits for sendWechatMessageLoop to exit.
+func (w *WechatMessageModule) Shutdown() {
+	w.RequireShutdown()
+	<-w.exited
+}
+
+// flushPendingMessages saves all pending messages without the interval, because we are exiting.
+func (w *WechatMessageModule) flushPendingMessages() {
+	if len(w.sendWechatMessageChannel) == 0 {
+		return
+	}
+	util.MaoLogM(util.INFO, MODULE_NAME, "Exiting, flush %d pending wechat messages.", len(w.sendWechatMessageChannel))
+	for len(w.sendWechatMessageChannel) > 0 {
+		w.deliverWechatMessage(<-w.sendWechatMessageChannel)
+	}
+}
+
 
+// SendWechatMessage never blocks the detecting modules, the message is dropped and counted if the queue is full.
 func (w *WechatMessageModule) SendWechatMessage(message *MaoApi.WechatMessage) {
-	w.sendWechatMessageChannel <- message
+	select {
+	case w.sendWechatMessageChannel <- message:
+	default:
+		if dropped := w.droppedMessages.Add(1); dropped%100 == 1 {
+			util.MaoLogM(util.WARN, MODULE_NAME, "The wechat message queue is full, drop %q, %d dropped.", message.Title, dropped)
+		}
+	}
 }
 
 func (w *WechatMessageModule) checkWechatInfo() bool {
@@ -76,93 +121,181 @@ func (w *WechatMessageModule) checkWechatInfo() bool {
 }
 
 
-//func (w *WechatMessageModule) getAccessToken;
-
-func (w *WechatMessageModule) sendWechatMessage(m *MaoApi.WechatMessage) {
+func (w *WechatMessageModule) CheckHealth() *MaoApi.ModuleHealth {
+	health := &MaoApi.ModuleHealth{
+		Module: MODULE_NAME,
+		Status: MaoApi.HEALTH_STATUS_OK,
+		Detail: fmt.Sprintf("WeChat Work corp %s, agent %s", w.corpId, w.agentId),
+		Metrics: map[string]int64{
+			"sendQueueDepth":  int64(len(w.sendWechatMessageChannel)),
+			"droppedMessages": w.droppedMessages.Load(),
+		},
+	}
+	if w.api != nil {
+		if expiry := w.api.tokenExpiry(); !expiry.IsZero() {
+			health.Metrics["tokenExpiresInSeconds"] = int64(time.Until(expiry).Seconds())
+		}
+	}
+	if !w.checkWechatInfo() {
+		health.Status = MaoApi.HEALTH_STATUS_DISABLED
+		health.Detail = "WeChat Work is not configured"
+	}
+	return health
+}
 
+// deliverWechatMessage saves the message to the outbox, which sends it and retries on failure. It is sent directly without the outbox.
+// Before the wechat info is configured, the message is kept in the outbox, and retried until it is.
+func (w *WechatMessageModule) deliverWechatMessage(m *MaoApi.WechatMessage) {
+	outbox := MaoCommon.ServiceRegistryGetOutboxModule()
 	if !w.checkWechatInfo() {
-		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send wechat message, please config wechat info first.")
-		return
+		if outbox == nil {
+			util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send wechat message, please config wechat info first.")
+			return
+		}
+		util.MaoLogM(util.WARN, MODULE_NAME, "Wechat info is not configured, keep %q in the outbox until it is.", m.Title)
 	}
 
-	receiverConfig := w.globalReceivers
-	if m.Receivers != nil {
-		receiverConfig = m.Receivers
+	if outbox != nil {
+		_, err := outbox.Enqueue(MaoApi.NOTIFICATION_CHANNEL_WECHAT, m.Title, m)
+		if err == nil {
+			return
+		}
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to save the wechat message to the outbox, send it directly. (%s)", err.Error())
+	}
+	if err := w.sendWechatMessage(m); err != nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send wechat message, %s", err.Error())
 	}
+}
 
-	receivers := ""
-	if len(receiverConfig) == 0 {
-		receivers = "@all"
-	} else {
-		receivers = fmt.Sprintf("%s%s", receivers, receiverConfig[0])
-		for i := 1; i < len(receiverConfig); i++ {
-			receivers = fmt.Sprintf("%s%s", receivers, "|")
-			receivers = fmt.Sprintf("%s%s", receivers, receiverConfig[i])
+// deliverOutboxWechatMessage is the deliver function of the wechat channel of the outbox. It fails if the wechat info is not configured, the outbox retries it later.
+func (w *WechatMessageModule) deliverOutboxWechatMessage(payload []byte) error {
+	m := &MaoApi.WechatMessage{}
+	if err := json.Unmarshal(payload, m); err != nil {
+		return err
+	}
+	return w.sendWechatMessage(m)
+}
+
+// resolveUrl returns the absolute url of the message, the WebUI paths are resolved by webUiUrl. Empty if it can't.
+func resolveUrl(url string, webUiUrl string) string {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return url
+	}
+	if webUiUrl == "" {
+		return ""
+	}
+	return strings.TrimRight(webUiUrl, "/") + url
+}
+
+// renderEvent fills the title, the content and the url of the message by the service event if they are empty.
+func renderEvent(m *MaoApi.WechatMessage) (title string, content string, url string) {
+	title, content, url = m.Title, m.ContentHttp, m.Url
+	e := m.Event
+	if e == nil {
+		return
+	}
+	if title == "" {
+		title = fmt.Sprintf("%s service %s is %s", e.Source, e.Name(), e.Type)
+	}
+	if content == "" {
+		content = fmt.Sprintf(`<div class="gray">%s</div><div class="normal">Address: %s</div>`,
+			e.Timestamp.Format("2006-01-02 15:04:05"), html.EscapeString(e.Address))
+		if e.Downtime > 0 && e.Type == MaoApi.EMAIL_EVENT_UP {
+			content += fmt.Sprintf(`<div class="highlight">It was down for %s</div>`, e.Downtime.Round(time.Second))
+		} else if e.Downtime > 0 {
+			content += fmt.Sprintf(`<div class="highlight">Last seen %s ago</div>`, e.Downtime.Round(time.Second))
 		}
 	}
+	if url == "" {
+		url = e.Page
+	}
+	return
+}
 
-	wechatJson := fmt.Sprintf(TEXT_CARD_JSON_TEMPLATE, receivers, w.agentId, m.Title, m.ContentHttp, m.Url)
-	util.MaoLogM(util.HOT_DEBUG, MODULE_NAME, "Prepare wechat json:\n%s", wechatJson)
-	
+// buildSendRequest targets the receivers of the message, or the global ones if the message doesn't specify.
+// It is a textcard if there is a url, otherwise a text message, e.g. the webUiUrl is not configured.
+func (w *WechatMessageModule) buildSendRequest(m *MaoApi.WechatMessage) (*wechatSendRequest, error) {
+	agentId, err := strconv.ParseInt(w.agentId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("agentId %q is not an integer", w.agentId)
+	}
+	request := &wechatSendRequest{AgentId: agentId}
 
-	//http.Get(fmt.Sprintf(URL_TEMPLATE_GET_ACCESS_TOKEN, ))
+	users, parties, tags := w.globalReceivers, w.globalParties, w.globalTags
+	if m.Receivers != nil || m.Parties != nil || m.Tags != nil {
+		users, parties, tags = m.Receivers, m.Parties, m.Tags
+	}
+	request.ToUser, request.ToParty, request.ToTag = strings.Join(users, "|"), strings.Join(parties, "|"), strings.Join(tags, "|")
+	if request.ToUser == "" && request.ToParty == "" && request.ToTag == "" {
+		request.ToUser = WECHAT_TO_ALL
+	}
 
+	title, content, url := renderEvent(m)
+	if url = resolveUrl(url, w.webUiUrl); url != "" {
+		request.MsgType = WECHAT_MSGTYPE_TEXTCARD
+		request.TextCard = &wechatTextCard{Title: title, Description: content, Url: url}
+	} else {
+		request.MsgType = WECHAT_MSGTYPE_TEXT
+		request.Text = &wechatText{Content: title + "\n" + content}
+	}
+	return request, nil
+}
 
-	//req := http.Post("https://qyapi.weixin.qq.com/cgi-bin/message/send", )
-	
-	return
+func (w *WechatMessageModule) sendWechatMessage(m *MaoApi.WechatMessage) error {
+
+	if !w.checkWechatInfo() {
+		return errors.New("wechat info is not configured")
+	}
+
+	request, err := w.buildSendRequest(m)
+	if err != nil {
+		return err
+	}
+	apiUrl := w.apiUrl
+	if apiUrl == "" {
+		apiUrl = WECHAT_API_BASE_URL
+	}
+	title, _, _ := renderEvent(m)
+	util.MaoLogM(util.HOT_DEBUG, MODULE_NAME, "Sending wechat message %q to user %q, party %q, tag %q",
+		title, request.ToUser, request.ToParty, request.ToTag)
 
-	// TODO
-
-	//// Set up authentication information everytime, that allows to update:
-	//// username, password, smtpServerAddrPort, sender, receiver
-	//auth := AuthLOGIN(s.username, s.password)
-	//
-	//// TODO: how to build multiple receivers string?
-	//// TODO: support multiple receivers
-	//msg := fmt.Sprintf("To: %s\r\n" +
-	//	"Subject: %s%s\r\n" + "\r\n" +
-	//	"%s\r\n",
-	//	s.receiver[0], SUBJECT_FIX_PREFIX, m.Subject, m.Content)
-	//
-	////msg := []byte("To: @.com\r\n" +
-	////	"Subject: MaoReport: beijing tower\r\n" +
-	////	"\r\n" +
-	////	"This is the email body.\r\n")
-	//
-	//// TODO: make it configurable
-	//tlsConfig := &tls.Config{
-	//	InsecureSkipVerify: true,
-	//}
-	//
-	//// Connect to the server, authenticate, set the sender and recipient,
-	//// and send the email all in one step.
-	//err := MaoEnhancedGolang.SendMail(s.smtpServerAddrPort, auth, s.sender, s.receiver, []byte(msg), tlsConfig)
-	//if err != nil {
-	//	util.MaoLogM(util.WARN, MODULE_NAME, "Fail to send email, %s", err.Error())
-	//}
+	response, err := w.api.send(apiUrl, w.corpId, w.agentSecret, request)
+	if err != nil {
+		return err
+	}
+	// errcode is 0 if some receivers are valid.
+	if response.InvalidUser != "" || response.InvalidParty != "" || response.InvalidTag != "" {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Some receivers of %q are invalid, user %q, party %q, tag %q",
+			title, response.InvalidUser, response.InvalidParty, response.InvalidTag)
+	}
+	return nil
 }
 
 func (w *WechatMessageModule) sendWechatMessageLoop() {
+	defer close(w.exited)
+
 	checkInterval := time.Duration(1000) * time.Millisecond
 	checkShutdownTimer := time.NewTimer(checkInterval)
 	for {
 		select {
 		case message := <-w.sendWechatMessageChannel:
-			if time.Now().Sub(w.lastSendTimestamp) < 1 * time.Second {
-				freezeTimer := time.NewTimer(time.Duration(1) * time.Second)
+			if time.Now().Sub(w.lastSendTimestamp) < WECHAT_SEND_INTERVAL {
+				freezeTimer := time.NewTimer(WECHAT_SEND_INTERVAL)
 				sent := false
 				for !sent {
 					select {
 					case <-freezeTimer.C:
 						util.MaoLogM(util.INFO, MODULE_NAME, "Sending wechat message, pending: %d", len(w.sendWechatMessageChannel))
-						w.sendWechatMessage(message)
+						w.deliverWechatMessage(message)
 						w.lastSendTimestamp = time.Now()
 						sent = true
 					case <-checkShutdownTimer.C:
 						util.MaoLogM(util.HOT_DEBUG, MODULE_NAME, "CheckShutdown while freezing, event queue len %d", len(w.sendWechatMessageChannel))
 						if w.needShutdown {
-							util.MaoLogM(util.WARN, MODULE_NAME, "Exit while freezing, the sendWechatMessageChannel len: %d", len(w.sendWechatMessageChannel))
+							util.MaoLogM(util.INFO, MODULE_NAME, "Exiting while freezing, send the message now.")
+							w.deliverWechatMessage(message)
+							w.flushPendingMessages()
+							util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 							return
 						}
 						checkShutdownTimer.Reset(checkInterval)
@@ -170,15 +303,18 @@ func (w *WechatMessageModule) sendWechatMessageLoop() {
 				}
 			} else {
 				util.MaoLogM(util.INFO, MODULE_NAME, "Sending wechat message, pending: %d", len(w.sendWechatMessageChannel))
-				w.sendWechatMessage(message)
+				w.deliverWechatMessage(message)
 				w.lastSendTimestamp = time.Now()
 			}
+		case <-w.secConfigChannel:
+			w.loadWechatSecConfig()
+		case <-w.configUpdateChannel:
+			w.loadWechatConfig()
+			w.loadWechatSecConfig()
 		case <-checkShutdownTimer.C:
 			util.MaoLogM(util.HOT_DEBUG, MODULE_NAME, "CheckShutdown, event queue len %d", len(w.sendWechatMessageChannel))
 			if w.needShutdown {
-				if len(w.sendWechatMessageChannel) != 0 {
-					util.MaoLogM(util.WARN, MODULE_NAME, "Exiting, but the sendWechatMessageChannel is not empty, len: %d", len(w.sendWechatMessageChannel))
-				}
+				w.flushPendingMessages()
 				util.MaoLogM(util.INFO, MODULE_NAME, "Exit.")
 				return
 			}
@@ -188,8 +324,24 @@ func (w *WechatMessageModule) sendWechatMessageLoop() {
 }
 
 func (w *WechatMessageModule) InitWechatMessageModule() bool {
-	w.sendWechatMessageChannel = make(chan *MaoApi.WechatMessage, 1024)
+	w.sendWechatMessageChannel = make(chan *MaoApi.WechatMessage, WECHAT_QUEUE_SIZE)
+	w.secConfigChannel = make(chan int, 1)
+	w.configUpdateChannel = make(chan int, 1)
 	w.needShutdown = false
+	w.exited = make(chan struct{})
+	w.api = newWechatApiClient()
+
+	if configModule := MaoCommon.ServiceRegistryGetConfigModule(); configModule != nil {
+		configModule.RegisterConfigSchema(WECHAT_INFO_CONFIG_PATH, &WechatConfig{})
+		configModule.RegisterKeyUpdateListener(&w.secConfigChannel)
+		configModule.RegisterConfigUpdateListener(WECHAT_INFO_CONFIG_PATH, &w.configUpdateChannel)
+	}
+	w.loadWechatConfig()
+	w.loadWechatSecConfig() // the sec key may be loaded at startup.
+
+	if outbox := MaoCommon.ServiceRegistryGetOutboxModule(); outbox != nil {
+		outbox.RegisterChannel(MaoApi.NOTIFICATION_CHANNEL_WECHAT, WECHAT_SEND_INTERVAL, w.deliverOutboxWechatMessage)
+	}
 
 	go w.sendWechatMessageLoop()
 
@@ -198,6 +350,57 @@ func (w *WechatMessageModule) InitWechatMessageModule() bool {
 	return true
 }
 
+func (w *WechatMessageModule) loadWechatSecConfig() {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return
+	}
+
+	secret, errCode := configModule.GetSecConfig(WECHAT_INFO_CONFIG_PATH_SECRET)
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read wechat agent secret, code: %d", errCode)
+		return
+	}
+	agentSecret, ok := secret.(string)
+	if !ok {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to parse wechat config - agentSecret")
+		return
+	}
+	w.agentSecret = agentSecret
+	util.MaoLogM(util.INFO, MODULE_NAME, "Loaded sec config")
+}
+
+func (w *WechatMessageModule) loadWechatConfig() {
+	configModule := MaoCommon.ServiceRegistryGetConfigModule()
+	if configModule == nil {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance")
+		return
+	}
+
+	wechatConfig := &WechatConfig{}
+	errCode := configModule.GetConfigInto(WECHAT_INFO_CONFIG_PATH, wechatConfig)
+	if errCode == Config.ERR_CODE_PATH_TRANSIT_FAIL || errCode == Config.ERR_CODE_PATH_NOT_EXIST {
+		util.MaoLogM(util.WARN, MODULE_NAME, "There is no wechat config. You may need to config wechat module.")
+		return
+	}
+	if errCode != Config.ERR_CODE_SUCCESS {
+		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to read wechat config, code: %d", errCode)
+		return
+	}
+	w.applyWechatConfig(wechatConfig)
+}
+
+func (w *WechatMessageModule) applyWechatConfig(wechatConfig *WechatConfig) {
+	w.corpId = wechatConfig.CorpId
+	w.agentId = wechatConfig.AgentId
+	w.globalReceivers = wechatConfig.GlobalReceivers
+	w.globalParties = wechatConfig.GlobalParties
+	w.globalTags = wechatConfig.GlobalTags
+	w.webUiUrl = wechatConfig.WebUiUrl
+	w.apiUrl = wechatConfig.ApiUrl
+}
+
 func (w *WechatMessageModule) configRestControlInterface() {
 	restfulServer := MaoCommon.ServiceRegistryGetRestfulServerModule()
 	if restfulServer == nil {
@@ -205,9 +408,33 @@ func (w *WechatMessageModule) configRestControlInterface() {
 		return
 	}
 
-	restfulServer.RegisterGetApi(URL_WECHAT_HOMEPAGE, w.showWechatPage)
-	restfulServer.RegisterGetApi(URL_WECHAT_SHOW, w.showWechatInfo)
-	restfulServer.RegisterPostApi(URL_WECHAT_CONFIG, w.processWechatInfo)
+	restfulServer.RegisterUiPage(URL_WECHAT_HOMEPAGE, w.showWechatPage)
+	restfulServer.RegisterGetApiWithDoc(MaoApi.ROLE_VIEWER, URL_WECHAT_SHOW, &MaoApi.ApiDoc{
+		Summary:  "Show the WeChat config, without the agent secret",
+		Tag:      MODULE_NAME,
+		Response: map[string]interface{}{},
+	}, w.showWechatInfo)
+	restfulServer.RegisterPostApiWithDoc(MaoApi.ROLE_ADMIN, URL_WECHAT_CONFIG, &MaoApi.ApiDoc{
+		Summary:     "Update the WeChat config",
+		Description: "Only the provided fields are updated. Replies the WeChat config page, or 400 with the invalid fields (MaoApi.ConfigSchemaError).",
+		Tag:         MODULE_NAME,
+		Params: []*MaoApi.ApiParam{
+			{Name: WECHAT_CONFIG_KEY_CORP_ID, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING},
+			{Name: WECHAT_CONFIG_KEY_AGENT_ID, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_INTEGER},
+			{Name: WECHAT_API_KEY_AGENT_SECRET, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "empty keeps the current secret"},
+			{Name: WECHAT_CONFIG_KEY_GLOBAL_RECEIVERS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "WeChat user ids separated by whitespace"},
+			{Name: WECHAT_CONFIG_KEY_GLOBAL_PARTIES, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "department ids separated by whitespace"},
+			{Name: WECHAT_CONFIG_KEY_GLOBAL_TAGS, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "tag ids separated by whitespace, the users, departments and tags all empty stand for all receivers"},
+			{Name: WECHAT_CONFIG_KEY_WEBUI_URL, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "e.g. https://mao.example.com:29999, for the links in the messages"},
+			{Name: WECHAT_CONFIG_KEY_API_URL, In: MaoApi.API_PARAM_IN_FORM, Type: MaoApi.API_PARAM_TYPE_STRING,
+				Description: "empty for " + WECHAT_API_BASE_URL},
+		},
+	}, w.processWechatInfo)
 }
 
 func (w *WechatMessageModule) showWechatPage(c *gin.Context) {
@@ -216,9 +443,13 @@ func (w *WechatMessageModule) showWechatPage(c *gin.Context) {
 
 func (w *WechatMessageModule) showWechatInfo(c *gin.Context) {
 	data := make(map[string]interface{})
-	data["corpId"] = w.corpId
-	data["agentId"] = w.agentId
-	data["globalReceivers"] = w.globalReceivers
+	data[WECHAT_CONFIG_KEY_CORP_ID] = w.corpId
+	data[WECHAT_CONFIG_KEY_AGENT_ID] = w.agentId
+	data[WECHAT_CONFIG_KEY_GLOBAL_RECEIVERS] = w.globalReceivers
+	data[WECHAT_CONFIG_KEY_GLOBAL_PARTIES] = w.globalParties
+	data[WECHAT_CONFIG_KEY_GLOBAL_TAGS] = w.globalTags
+	data[WECHAT_CONFIG_KEY_WEBUI_URL] = w.webUiUrl
+	data[WECHAT_CONFIG_KEY_API_URL] = w.apiUrl
 
 	// Attention: agentSecret can't be outputted !!!
 	c.JSON(200, data)
@@ -226,42 +457,85 @@ func (w *WechatMessageModule) showWechatInfo(c *gin.Context) {
 
 func (w *WechatMessageModule) processWechatInfo(c *gin.Context) {
 
-	// TODO: check and limit the length of corpId/agentId/agentSecret. Prevent injection attack
-
-	corpId, ok := c.GetPostForm("corpId")
-	if ok {
-		w.corpId = corpId
+	wechatConfig := &WechatConfig{
+		CorpId:          w.corpId,
+		AgentId:         w.agentId,
+		GlobalReceivers: w.globalReceivers,
+		GlobalParties:   w.globalParties,
+		GlobalTags:      w.globalTags,
+		WebUiUrl:        w.webUiUrl,
+		ApiUrl:          w.apiUrl,
 	}
+	agentSecret := w.agentSecret
 
-	agentId, ok := c.GetPostForm("agentId")
-	if ok {
-		w.agentId = agentId
+	if corpId, ok := c.GetPostForm(WECHAT_CONFIG_KEY_CORP_ID); ok {
+		wechatConfig.CorpId = strings.TrimSpace(corpId)
 	}
-
-	agentSecret, ok := c.GetPostForm("agentSecret")
-	if ok {
-		w.agentSecret = agentSecret
+	if agentId, ok := c.GetPostForm(WECHAT_CONFIG_KEY_AGENT_ID); ok {
+		wechatConfig.AgentId = strings.TrimSpace(agentId)
+		if _, err := strconv.ParseInt(wechatConfig.AgentId, 10, 64); err != nil {
+			c.JSON(400, &MaoApi.ConfigSchemaError{Path: WECHAT_INFO_CONFIG_PATH, Fields: []*MaoApi.ConfigFieldError{
+				{Field: WECHAT_CONFIG_KEY_AGENT_ID, Message: "must be an integer"},
+			}})
+			return
+		}
 	}
-
-	globalReceiversStr, ok := c.GetPostForm("globalReceivers")
-	if ok {
-		globalReceivers := strings.Fields(globalReceiversStr)
-		w.globalReceivers = globalReceivers
+	if secret := strings.TrimSpace(c.PostForm(WECHAT_API_KEY_AGENT_SECRET)); secret != "" {
+		agentSecret = secret
+	}
+	if globalReceiversStr, ok := c.GetPostForm(WECHAT_CONFIG_KEY_GLOBAL_RECEIVERS); ok {
+		wechatConfig.GlobalReceivers = strings.Fields(globalReceiversStr)
+	}
+	if globalPartiesStr, ok := c.GetPostForm(WECHAT_CONFIG_KEY_GLOBAL_PARTIES); ok {
+		wechatConfig.GlobalParties = strings.Fields(globalPartiesStr)
+	}
+	if globalTagsStr, ok := c.GetPostForm(WECHAT_CONFIG_KEY_GLOBAL_TAGS); ok {
+		wechatConfig.GlobalTags = strings.Fields(globalTagsStr)
+	}
+	if webUiUrl, ok := c.GetPostForm(WECHAT_CONFIG_KEY_WEBUI_URL); ok {
+		wechatConfig.WebUiUrl = strings.TrimSpace(webUiUrl)
+	}
+	if apiUrl, ok := c.GetPostForm(WECHAT_CONFIG_KEY_API_URL); ok {
+		wechatConfig.ApiUrl = strings.TrimSpace(apiUrl)
 	}
-
 
 	configModule := MaoCommon.ServiceRegistryGetConfigModule()
 	if configModule == nil {
 		util.MaoLogM(util.WARN, MODULE_NAME, "Fail to get config module instance, can't save wechat info")
 	} else {
+		// the invalid fields are shown, and nothing is changed.
+		if err := configModule.ValidateConfig(WECHAT_INFO_CONFIG_PATH, wechatConfig); err != nil {
+			c.JSON(400, err)
+			return
+		}
+
 		data := make(map[string]interface{})
-		data["corpId"] = w.corpId
-		data["agentId"] = w.agentId
-		data["globalReceivers"] = w.globalReceivers
+		data[WECHAT_CONFIG_KEY_CORP_ID] = wechatConfig.CorpId
+		data[WECHAT_CONFIG_KEY_AGENT_ID] = wechatConfig.AgentId
+		data[WECHAT_CONFIG_KEY_GLOBAL_RECEIVERS] = wechatConfig.GlobalReceivers
+		if len(wechatConfig.GlobalParties) > 0 {
+			data[WECHAT_CONFIG_KEY_GLOBAL_PARTIES] = wechatConfig.GlobalParties
+		}
+		if len(wechatConfig.GlobalTags) > 0 {
+			data[WECHAT_CONFIG_KEY_GLOBAL_TAGS] = wechatConfig.GlobalTags
+		}
+		if wechatConfig.WebUiUrl != "" {
+			data[WECHAT_CONFIG_KEY_WEBUI_URL] = wechatConfig.WebUiUrl
+		}
+		if wechatConfig.ApiUrl != "" {
+			data[WECHAT_CONFIG_KEY_API_URL] = wechatConfig.ApiUrl
+		}
 
 		// Attention: agentSecret can't be outputted !!!
-		configModule.PutConfig(WECHAT_INFO_CONFIG_PATH, data)
+		actor := c.GetString(MaoApi.AUTH_CONTEXT_KEY_USERNAME)
+		configModule.PutConfigBy(actor, WECHAT_INFO_CONFIG_PATH, data)
+		if agentSecret != "" {
+			configModule.PutSecConfigBy(actor, WECHAT_INFO_CONFIG_PATH_SECRET, agentSecret)
+		}
 	}
 
+	w.applyWechatConfig(wechatConfig)
+	w.agentSecret = agentSecret
+
 	w.showWechatPage(c)
-}
\ No newline at end of file
+}
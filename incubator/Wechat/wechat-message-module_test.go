@@ -1,14 +1,16 @@
 package Wechat
 
 import (
-	"bytes"
+	MaoApi "MaoServerDiscovery/cmd/api"
+	"MaoServerDiscovery/cmd/lib/MaoCommon"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestWechatMessageModule_SendWechatMessage(t *testing.T) {
@@ -17,92 +19,137 @@ func TestWechatMessageModule_SendWechatMessage(t *testing.T) {
 	log.Println(globalReceivers)
 }
 
+// testQyapi is a local stand-in of qyapi.weixin.qq.com.
+type testQyapi struct {
+	lock       sync.Mutex
+	tokens     int    // gettoken calls
+	token      string // the valid one
+	sendErr    int    // the errcode of the next send
+	sent       []*wechatSendRequest
+	invalidTag string
+}
 
+func (q *testQyapi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	reply := func(data map[string]interface{}) {
+		json.NewEncoder(w).Encode(data)
+	}
+	switch r.URL.Path {
+	case URL_PATH_GET_ACCESS_TOKEN:
+		if r.URL.Query().Get("corpid") != "corp" || r.URL.Query().Get("corpsecret") != "secret" {
+			reply(map[string]interface{}{"errcode": 40013, "errmsg": "invalid corpid"})
+			return
+		}
+		q.tokens++
+		q.token = strings.Repeat("t", q.tokens)
+		reply(map[string]interface{}{"errcode": 0, "errmsg": "ok", "access_token": q.token, "expires_in": 7200})
+	case URL_PATH_SEND_MESSAGE:
+		if r.URL.Query().Get("access_token") != q.token {
+			reply(map[string]interface{}{"errcode": WECHAT_ERRCODE_INVALID_ACCESS_TOKEN, "errmsg": "invalid access_token"})
+			return
+		}
+		if q.sendErr != 0 {
+			reply(map[string]interface{}{"errcode": q.sendErr, "errmsg": "rejected"})
+			q.sendErr = 0
+			return
+		}
+		request := &wechatSendRequest{}
+		json.NewDecoder(r.Body).Decode(request)
+		q.sent = append(q.sent, request)
+		reply(map[string]interface{}{"errcode": 0, "errmsg": "ok", "invalidtag": q.invalidTag})
+	default:
+		http.NotFound(w, r)
+	}
+}
 
+func TestWechatMessageModule_SendByQyapi(t *testing.T) {
+	qyapi := &testQyapi{}
+	server := httptest.NewServer(qyapi)
+	defer server.Close()
 
+	w := &WechatMessageModule{api: newWechatApiClient()}
+	w.applyWechatConfig(&WechatConfig{CorpId: "corp", AgentId: "1000002", GlobalReceivers: []string{"mao", "jian"},
+		WebUiUrl: "https://mao.example.com/", ApiUrl: server.URL})
+	w.agentSecret = "secret"
 
-type WechatAccessTokenResponse struct {
-	ErrCode		int		`json:"errcode"`
-	ErrMsg		string	`json:"errmsg"`
-	AccessToken	string	`json:"access_token"`
-	ExpiresIn	int		`json:"expires_in"`
-}
-func TestWechatMessageModule_SendWechatMessage2(t *testing.T) {
-
-	req, err := http.NewRequest("GET", fmt.Sprintf(URL_TEMPLATE_GET_ACCESS_TOKEN,
-		"", ""), nil)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	event := &MaoApi.EmailServiceEvent{Type: MaoApi.EMAIL_EVENT_UP, Source: "ICMP", ServiceName: "db-1", Address: "10.0.0.1",
+		Timestamp: time.Now(), Downtime: 90 * time.Second, Page: "/v1/configIcmp"}
+	if err := w.sendWechatMessage(&MaoApi.WechatMessage{Event: event}); err != nil {
+		t.Fatal(err)
 	}
-
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	// the token is cached.
+	qyapi.invalidTag = "9"
+	w.webUiUrl = ""
+	if err := w.sendWechatMessage(&MaoApi.WechatMessage{Title: "notice", ContentHttp: "hello", Url: "", Tags: []string{"1", "9"}}); err != nil {
+		t.Fatal(err)
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf(err.Error())
-		return
+	if qyapi.tokens != 1 || len(qyapi.sent) != 2 {
+		t.Fatalf("expect one token for two messages, %d tokens, %d sent", qyapi.tokens, len(qyapi.sent))
 	}
-	log.Println(body)
-
-	accessTokenResponse := WechatAccessTokenResponse{}
-	err = json.Unmarshal(body, &accessTokenResponse)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	card := qyapi.sent[0]
+	if card.ToUser != "mao|jian" || card.AgentId != 1000002 || card.MsgType != WECHAT_MSGTYPE_TEXTCARD || card.TextCard == nil ||
+		card.TextCard.Title != "ICMP service db-1 is UP" || card.TextCard.Url != "https://mao.example.com/v1/configIcmp" ||
+		!strings.Contains(card.TextCard.Description, "It was down for 1m30s") {
+		t.Errorf("unexpected textcard %+v, %+v", card, card.TextCard)
 	}
-	log.Println(body)
-	log.Println(accessTokenResponse)
-
-	if accessTokenResponse.ErrCode != 0 {
-		log.Println(accessTokenResponse)
-		return
+	// the global receivers are not used if the message specifies, and it is a text without the url.
+	text := qyapi.sent[1]
+	if text.ToUser != "" || text.ToTag != "1|9" || text.MsgType != WECHAT_MSGTYPE_TEXT || text.Text.Content != "notice\nhello" {
+		t.Errorf("unexpected text %+v", text)
 	}
-	// =====================================
 
-	data :=
-		"{" +
-			"\"touser\":\"@all\"," +
-			"\"toparty\":\"\"," +
-			"\"totag\":\"\"," +
-			"\"msgtype\":\"textcard\"," +
-			"\"agentid\": 123456789," +
-			"\"textcard\": {" +
-			"\"title\":\"青岛雷达\"," +
-			"\"description\":\"beijing<br>good day\"," +
-			"\"url\":\"https://www.baidu.com/\"" +
-			"}" +
-			"}"
-	postData := bytes.NewReader([]byte(data))
-	req, err = http.NewRequest("POST", fmt.Sprintf(URL_TEMPLATE_SEND_MESSAGE, accessTokenResponse.AccessToken), postData)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	// the token is fetched again if it is revoked before the expiry.
+	qyapi.lock.Lock()
+	qyapi.invalidTag = ""
+	qyapi.token = "revoked"
+	qyapi.lock.Unlock()
+	if err := w.sendWechatMessage(&MaoApi.WechatMessage{Receivers: []string{}}); err != nil || qyapi.tokens != 2 {
+		t.Fatalf("expect sent by a new token, %d tokens, %v", qyapi.tokens, err)
 	}
-
-	client = http.Client{}
-	resp, err = client.Do(req)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	if to := qyapi.sent[2].ToUser; to != WECHAT_TO_ALL {
+		t.Errorf("expect all receivers, got %q", to)
 	}
-	defer resp.Body.Close()
 
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err.Error())
-		return
+	// the other errcodes fail the delivery, the outbox retries it.
+	qyapi.sendErr = 45009
+	err := w.sendWechatMessage(&MaoApi.WechatMessage{Title: "rate limited"})
+	if apiErr, ok := err.(*WechatApiError); !ok || apiErr.ErrCode != 45009 || qyapi.tokens != 2 {
+		t.Errorf("expect errcode 45009, %v", err)
 	}
+	w.agentSecret = "wrong"
+	if err = w.sendWechatMessage(&MaoApi.WechatMessage{Title: "wrong secret"}); err == nil || !strings.Contains(err.Error(), "40013") {
+		t.Errorf("expect errcode 40013 of gettoken, %v", err)
+	}
+	w.agentId = "agent"
+	if err = w.sendWechatMessage(&MaoApi.WechatMessage{Title: "invalid agent"}); err == nil {
+		t.Errorf("expect the invalid agentId failing")
+	}
+}
 
-	log.Println(body)
-
+type recordingOutbox struct {
+	summaries []string
 }
 
+func (o *recordingOutbox) RegisterChannel(channel string, interval time.Duration, deliver MaoApi.NotificationDeliverFunc) {
+}
+func (o *recordingOutbox) Enqueue(channel string, summary string, message interface{}) (string, error) {
+	o.summaries = append(o.summaries, summary)
+	return summary, nil
+}
 
+func TestWechatMessageModule_DeliverBeforeConfigured(t *testing.T) {
+	outbox := &recordingOutbox{}
+	MaoCommon.RegisterService(MaoApi.OutboxModuleRegisterName, outbox)
+	defer MaoCommon.RegisterService(MaoApi.OutboxModuleRegisterName, nil)
 
+	// the message is kept in the outbox, and its delivery fails until the wechat info is configured.
+	w := &WechatMessageModule{}
+	w.deliverWechatMessage(&MaoApi.WechatMessage{Title: "ICMP DOWN"})
+	if strings.Join(outbox.summaries, ",") != "ICMP DOWN" {
+		t.Errorf("expect the message saved to the outbox, %v", outbox.summaries)
+	}
+	if err := w.deliverOutboxWechatMessage([]byte(`{"Title":"ICMP DOWN"}`)); err == nil {
+		t.Errorf("expect the delivery failed before the wechat info is configured")
+	}
+}
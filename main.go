@@ -2,6 +2,7 @@ package main
 
 import (
 	branch "MaoServerDiscovery/cmd"
+	"MaoServerDiscovery/cmd/lib/Config"
 	"MaoServerDiscovery/util"
 	"errors"
 	"fmt"
@@ -29,6 +30,9 @@ const (
 	3. Add a reader and some checking rules of the parameter in something like readServerArgs()
 	4. Add the global variant in the module entry like branch.RunServer()
 	5. Add some introductions for the parameter before the init()
+
+	Every parameter can also be set by the MAO_<NAME> environment variable or the --config file automatically,
+	see branch.ApplyFlagSources().
  */
 
 var (
@@ -41,10 +45,26 @@ var (
 	minLogLevel util.MaoLogLevel
 	silent bool
 
+	log_format_json bool
+	log_file string
+	log_file_max_size uint32
+	log_file_max_backups uint32
+	log_module_levels map[string]util.MaoLogLevel
+
 
 	web_server_addr net.IP
 	web_server_port uint32
 
+	web_tls_cert string
+	web_tls_key string
+	web_tls_self_signed bool
+	web_http_redirect_port uint32
+
+	config_sec_key_file string
+	config_sec_algorithm string
+	config_backend string
+	config_backend_endpoint string
+
 	cli_dump_interval uint32
 	refresh_interval uint32
 
@@ -87,21 +107,27 @@ var generalClientCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := readGeneralClientArgs(cmd); err != nil {
 			util.MaoLog(util.ERROR, "Wrong Args for general client: %s", err.Error())
-			return
+			os.Exit(branch.EXIT_CODE_FAIL)
+		}
+		if err := setupMaoLog(); err != nil {
+			util.MaoLog(util.ERROR, "Fail to setup the log: %s", err.Error())
+			os.Exit(branch.EXIT_CODE_FAIL)
 		}
 
 		if nat66Gateway == true {
 			if runtime.GOOS != `linux` || os.Getgid() != 0 {
 				util.MaoLog(util.ERROR, "nat66Gateway is usable only in linux with root privilege")
-				return
+				os.Exit(branch.EXIT_CODE_FAIL)
 			}
 		}
 
 		client := &branch.GeneralClientV2{}
-		client.Run(&report_server_addr, report_server_port, report_interval, silent,
+		exitCode := client.Run(&report_server_addr, report_server_port, report_interval, silent,
 			influxdbUrl, influxdbOrgBucket, influxdbToken,
 			nat66Gateway, nat66Persistent, gpsMonitor, gpsPersistent, envTempMonitor, envTempPersistent,
 			minLogLevel)
+		util.CloseMaoLogFile()
+		os.Exit(exitCode)
 
 		//branch.RunGeneralClient(&report_server_addr, report_server_port, report_interval, silent,
 		//	influxdbUrl, influxdbOrgBucket, influxdbToken,
@@ -118,7 +144,11 @@ var serverCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := readServerArgs(cmd); err != nil {
 			util.MaoLog(util.ERROR, "Wrong Args for server: %s", err.Error())
-			return
+			os.Exit(branch.EXIT_CODE_FAIL)
+		}
+		if err := setupMaoLog(); err != nil {
+			util.MaoLog(util.ERROR, "Fail to setup the log: %s", err.Error())
+			os.Exit(branch.EXIT_CODE_FAIL)
 		}
 
 		//ss,_ := rootCmd.PersistentFlags().GetString("report_server_addr")
@@ -134,10 +164,13 @@ var serverCmd = &cobra.Command{
 		//
 		//fmt.Printf("---\n%v, %d\n", args, len(args))
 		//return
-		branch.RunServer(&report_server_addr, report_server_port, &web_server_addr, web_server_port,
+		exitCode := branch.RunServer(&report_server_addr, report_server_port, &web_server_addr, web_server_port,
+			web_tls_cert, web_tls_key, web_tls_self_signed, web_http_redirect_port,
 			influxdbUrl, influxdbToken, influxdbOrgBucket,
 			cli_dump_interval, refresh_interval, minLogLevel, silent,
-			disable_gateway_module, ROOT_VERSION)
+			disable_gateway_module, config_sec_key_file, config_sec_algorithm, config_backend, config_backend_endpoint, ROOT_VERSION)
+		util.CloseMaoLogFile()
+		os.Exit(exitCode)
 	},
 }
 
@@ -151,15 +184,75 @@ var versionCmd = &cobra.Command{
 	},
 }
 
+var healthCheckCmd = &cobra.Command{
+	Use: "healthcheck",
+	Short:   "Mao: Probe the readiness of a running server, exit with 0 if ready. For Docker HEALTHCHECK.",
+	Long:    "Mao-Service-Discovery: Probe the readiness of a running server, exit with 0 if ready. For Docker HEALTHCHECK.",
+	Run: func(cmd *cobra.Command, args []string) {
+		url, _ := cmd.Flags().GetString("url")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		os.Exit(branch.RunHealthCheck(url, insecure))
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use: "config",
+	Short:   "Mao: Export or import the config of a running server, by an admin api key.",
+	Long:    "Mao-Service-Discovery: Export or import the config of a running server, by an admin api key. e.g. for rebuilding the server.",
+}
+
+var configExportCmd = &cobra.Command{
+	Use: "export",
+	Short:   "Mao: Save the whole config of a running server to a bundle file.",
+	Long:    "Mao-Service-Discovery: Save the whole config of a running server to a bundle file. The users and api keys are not exported.",
+	Run: func(cmd *cobra.Command, args []string) {
+		server, _ := cmd.Flags().GetString("server")
+		apiKey, _ := cmd.Flags().GetString("api_key")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		secrets, _ := cmd.Flags().GetString("secrets")
+		file, _ := cmd.Flags().GetString("file")
+		os.Exit(branch.RunConfigExport(server, apiKey, insecure, secrets, file))
+	},
+}
+
+var configImportCmd = &cobra.Command{
+	Use: "import",
+	Short:   "Mao: Preview the changes of a bundle file on a running server, and apply them with --apply.",
+	Long:    "Mao-Service-Discovery: Preview the changes of a bundle file on a running server, and apply them with --apply.",
+	Run: func(cmd *cobra.Command, args []string) {
+		server, _ := cmd.Flags().GetString("server")
+		apiKey, _ := cmd.Flags().GetString("api_key")
+		insecure, _ := cmd.Flags().GetBool("insecure")
+		file, _ := cmd.Flags().GetString("file")
+		apply, _ := cmd.Flags().GetBool("apply")
+		os.Exit(branch.RunConfigImport(server, apiKey, insecure, file, apply))
+	},
+}
+
 /**
 Common:
+	- config : YAML file of "flag_name: value". Also MAO_<FLAG_NAME> environment variables, e.g. MAO_LOG_LEVEL.
+	           Precedence: flag > env > file > default.
 	- report_server_addr : connect to / listen on the addr, for service discovery
 	- report_server_port : connect to / listen on the port, for service discovery
 	- log : min log level. If set to INFO, DEBUG log will not be outputted.
 	- silent : if true, no log will be outputted. prior to the log parameter.
+	- log_format : text or json. json outputs one object per line, with ts, level, module, msg and fields.
+	- log_module_levels : min log level for some modules, prior to log_level. (e.g. Restful-Server-module=DEBUG,SMTP-Email-module=WARN)
+	- log_file : also write the logs to the file, rotated by log_file_max_size (MB) and keeping log_file_max_backups of old files.
 Server:
 	- web_server_addr : listen on the addr, for web control
 	- web_server_port : listen on the port, for web control
+	- web_tls_cert : cert file for HTTPS of web control. HTTPS is enabled if the cert or the key is set.
+	- web_tls_key : key file for HTTPS of web control.
+	- web_tls_self_signed : enable HTTPS with a self-signed cert, generated at the first start if the files don't exist.
+	- web_http_redirect_port : listen on the port with plain HTTP, and redirect all requests to HTTPS. 0 for disabled.
+	- config_sec_key_file : file of the key for the sec configs, loaded at startup. Otherwise MAO_CONFIG_SEC_KEY, or mao-config.yaml.key if it exists.
+	  The key files should be 0600 or 0400.
+	- config_sec_algorithm : sm4-gcm or aes-256-gcm, for the sec configs put later. It is recorded with each sec config.
+	- config_backend : where the config is stored, file (mao-config.yaml), etcd or mysql. The servers with the same etcd or mysql share one config.
+	- config_backend_endpoint : the etcd gateway URLs separated by ",", e.g. http://127.0.0.1:2379, or the MYSQL DSN, e.g. user:password@tcp(127.0.0.1:3306)/mao.
+	  Set the DSN by MAO_CONFIG_BACKEND_ENDPOINT, to keep the password out of the command line.
 
 	- cli_dump_interval : interval for dump all services info. (milliseconds)
 	//- refresh_interval : interval for refresh the status of clients. (milliseconds)
@@ -181,15 +274,32 @@ Client:
 	- enable_aux_env_temp_persistent : enable to upload environment temperature to Influxdb
  */
 func init() {
+	rootCmd.PersistentFlags().String(branch.FLAG_CONFIG, "", "YAML file of \"flag_name: value\" for the flags not set in the command line. " +
+		"MAO_<FLAG_NAME> environment variables are prior to the file, e.g. MAO_LOG_LEVEL=WARN. (Optional)")
 	rootCmd.PersistentFlags().String("report_server_addr","::","IP address for gRPC KA module. (e.g. 2001:db8::1)")
 	rootCmd.PersistentFlags().Uint32("report_server_port",28888,"Port for gRPC KA module.")
 	rootCmd.PersistentFlags().String("log_level", "INFO","The min level for the logs outputted. (e.g. DEBUG, INFO, WARN, ERROR, SILENT)")
 	rootCmd.PersistentFlags().Bool("silent", false,"Don't output the server list periodically. (default: false)")
+	rootCmd.PersistentFlags().String("log_format", "text","The format of the logs, text or json.")
+	rootCmd.PersistentFlags().String("log_module_levels", "","The min log level for some modules, prior to log_level. (e.g. Restful-Server-module=DEBUG,SMTP-Email-module=WARN) (Optional)")
+	rootCmd.PersistentFlags().String("log_file", "","Also write the logs to the file, rotated by size. (Optional)")
+	rootCmd.PersistentFlags().Uint32("log_file_max_size", util.DEFAULT_LOG_FILE_MAX_SIZE_MB,"Rotate the log file when it exceeds the size, in MB.")
+	rootCmd.PersistentFlags().Uint32("log_file_max_backups", util.DEFAULT_LOG_FILE_MAX_BACKUPS,"The number of rotated log files to keep.")
 
 
 	//serverCmd.Flags().String("main_server_addr","::","::")
 	serverCmd.Flags().String("web_server_addr","::","IP address for Restful server.")
 	serverCmd.Flags().Uint32("web_server_port",29999,"Port for Restful server.")
+	serverCmd.Flags().String("web_tls_cert","","Cert file in PEM for HTTPS of Restful server. HTTPS is enabled if the cert or the key is set. (Optional)")
+	serverCmd.Flags().String("web_tls_key","","Key file in PEM for HTTPS of Restful server. (Optional)")
+	serverCmd.Flags().Bool("web_tls_self_signed",false,"Enable HTTPS with a self-signed cert, which is generated at the first start if the cert/key files don't exist. (Optional) (default: false)")
+	serverCmd.Flags().Uint32("web_http_redirect_port",0,"Port for plain HTTP, which redirects all requests to HTTPS. 0 for disabled. (Optional)")
+	serverCmd.Flags().String("config_sec_key_file","","File of the key for sec configs, 0600 or 0400, loaded at startup. " +
+		"Otherwise the MAO_CONFIG_SEC_KEY environment variable, or mao-config.yaml.key if it exists. (Optional)")
+	serverCmd.Flags().String("config_sec_algorithm","sm4-gcm","The algorithm for encrypting sec configs, sm4-gcm or aes-256-gcm. The existing ones are still decrypted by their own.")
+	serverCmd.Flags().String("config_backend","file","Where the config is stored, file, etcd or mysql. The servers using the same etcd or mysql share one config.")
+	serverCmd.Flags().String("config_backend_endpoint","","The etcd gateway URLs separated by \",\" (e.g. http://127.0.0.1:2379), or the MYSQL DSN (e.g. user:password@tcp(127.0.0.1:3306)/mao). " +
+		"Required by etcd and mysql.")
 
 	serverCmd.Flags().Uint32("cli_dump_interval", 1000, "The interval to output all services info to the CLI, in milliseconds.")
 	//serverCmd.Flags().Uint32("refresh_interval", 1000, "The interval to refresh the status of clients, in milliseconds.")
@@ -198,7 +308,20 @@ func init() {
 	serverCmd.Flags().String("influxdb_org_bucket","","Same name for Org and Bucket. (Optional)")
 	serverCmd.Flags().String("influxdb_token","","Token string obtained from Influxdb. (Optional)")
 
-	serverCmd.Flags().Bool("disable_gateway_module",false,"Disable all Gateway modules. (Optional) (default: false)")
+	serverCmd.Flags().Bool("disable_gateway_module",false,"Disable all Gateway modules, if /modules/gateway/enabled is not in the config. (Optional) (default: false)")
+
+
+	healthCheckCmd.Flags().String("url", branch.HEALTHCHECK_DEFAULT_URL, "URL of the readiness probe of the server.")
+	healthCheckCmd.Flags().Bool("insecure", false, "Skip verifying the cert of the server, e.g. a self-signed cert. (default: false)")
+
+	configCmd.PersistentFlags().String("server", branch.CONFIG_BUNDLE_DEFAULT_SERVER, "URL of the running server.")
+	configCmd.PersistentFlags().String("api_key", "", "Admin api key of the server. Otherwise the MAO_API_KEY environment variable.")
+	configCmd.PersistentFlags().Bool("insecure", false, "Skip verifying the cert of the server, e.g. a self-signed cert. (default: false)")
+	configExportCmd.Flags().String("secrets", "omitted", "The sec configs are encrypted under the current sec key, or omitted. (encrypted, omitted)")
+	configExportCmd.Flags().String("file", "mao-config-bundle.yaml", "The bundle file, \"-\" for stdout.")
+	configImportCmd.Flags().String("file", "mao-config-bundle.yaml", "The bundle file.")
+	configImportCmd.Flags().Bool("apply", false, "Apply the changes, otherwise only preview them. (default: false)")
+	configCmd.AddCommand(configExportCmd, configImportCmd)
 
 
 	generalClientCmd.Flags().Uint32("report_interval", 1000, "The interval to collect data and report to server, in milliseconds.")
@@ -219,6 +342,11 @@ func init() {
 
 func readRootArgs(cmd *cobra.Command) error {
 
+	// all flags of the command, including the persistent flags of rootCmd
+	if err := branch.ApplyFlagSources(cmd.Flags(), os.LookupEnv); err != nil {
+		return err
+	}
+
 	report_server_addr_str, err := rootCmd.PersistentFlags().GetString("report_server_addr")
 	if err != nil {
 		return err
@@ -257,6 +385,72 @@ func readRootArgs(cmd *cobra.Command) error {
 		return err
 	}
 
+	log_format, err := rootCmd.PersistentFlags().GetString("log_format")
+	if err != nil {
+		return err
+	}
+	switch log_format {
+	case "text":
+		log_format_json = false
+	case "json":
+		log_format_json = true
+	default:
+		return errors.New("log_format is invalid")
+	}
+
+	module_levels_str, err := rootCmd.PersistentFlags().GetString("log_module_levels")
+	if err != nil {
+		return err
+	}
+	log_module_levels = make(map[string]util.MaoLogLevel)
+	for _, item := range strings.Split(module_levels_str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("log_module_levels is invalid: %s", item)
+		}
+		level, ok := util.ParseMaoLogLevel(kv[1])
+		if !ok {
+			return fmt.Errorf("log_module_levels is invalid: %s", item)
+		}
+		log_module_levels[strings.TrimSpace(kv[0])] = level
+	}
+
+	log_file, err = rootCmd.PersistentFlags().GetString("log_file")
+	if err != nil {
+		return err
+	}
+
+	log_file_max_size, err = rootCmd.PersistentFlags().GetUint32("log_file_max_size")
+	if err != nil {
+		return err
+	}
+	if log_file_max_size < 1 {
+		return errors.New("log_file_max_size is invalid")
+	}
+
+	log_file_max_backups, err = rootCmd.PersistentFlags().GetUint32("log_file_max_backups")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setupMaoLog applies the log parameters, the global min level is set by the module entry.
+func setupMaoLog() error {
+	util.SetMaoLogJson(log_format_json)
+	for module, level := range log_module_levels {
+		util.SetMaoLogModuleLevel(module, level)
+	}
+	if log_file != "" {
+		if err := util.EnableMaoLogFile(log_file, int(log_file_max_size), int(log_file_max_backups)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -292,6 +486,64 @@ func readServerArgs(cmd *cobra.Command) error {
 		return errors.New("web_server_port is invalid")
 	}
 
+	web_tls_cert, err = cmd.Flags().GetString("web_tls_cert")
+	if err != nil {
+		return err
+	}
+
+	web_tls_key, err = cmd.Flags().GetString("web_tls_key")
+	if err != nil {
+		return err
+	}
+
+	web_tls_self_signed, err = cmd.Flags().GetBool("web_tls_self_signed")
+	if err != nil {
+		return err
+	}
+	if !web_tls_self_signed && (web_tls_cert == "") != (web_tls_key == "") {
+		return errors.New("web_tls_cert and web_tls_key should be set together")
+	}
+
+	web_http_redirect_port, err = cmd.Flags().GetUint32("web_http_redirect_port")
+	if err != nil {
+		return err
+	}
+	if web_http_redirect_port > 65535 || web_http_redirect_port == web_server_port {
+		return errors.New("web_http_redirect_port is invalid")
+	}
+	if web_http_redirect_port != 0 && !web_tls_self_signed && web_tls_cert == "" {
+		return errors.New("web_http_redirect_port requires HTTPS, please set web_tls_cert and web_tls_key, or web_tls_self_signed")
+	}
+
+
+	config_sec_key_file, err = cmd.Flags().GetString("config_sec_key_file")
+	if err != nil {
+		return err
+	}
+
+	config_sec_algorithm, err = cmd.Flags().GetString("config_sec_algorithm")
+	if err != nil {
+		return err
+	}
+	if !Config.IsSecAlgorithm(config_sec_algorithm) {
+		return errors.New("config_sec_algorithm is invalid")
+	}
+
+	config_backend, err = cmd.Flags().GetString("config_backend")
+	if err != nil {
+		return err
+	}
+	config_backend_endpoint, err = cmd.Flags().GetString("config_backend_endpoint")
+	if err != nil {
+		return err
+	}
+	if config_backend != "file" && config_backend != "etcd" && config_backend != "mysql" {
+		return errors.New("config_backend is invalid")
+	}
+	if config_backend != "file" && config_backend_endpoint == "" {
+		return errors.New("config_backend_endpoint is required by etcd and mysql")
+	}
+
 
 	cli_dump_interval, err = cmd.Flags().GetUint32("cli_dump_interval")
 	if err != nil {
@@ -417,7 +669,7 @@ func main() {
 	   util.MaoLog(util.INFO, "enable pprof: %v", http.ListenAndServe("0.0.0.0:39999", nil))
 	}()
 
-	rootCmd.AddCommand(versionCmd, generalClientCmd, serverCmd)
+	rootCmd.AddCommand(versionCmd, generalClientCmd, serverCmd, healthCheckCmd, configCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		//util.MaoLog(util.ERROR, fmt.Sprintf("Fail to execute rootCmd: %s", err))
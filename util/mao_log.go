@@ -1,9 +1,15 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type MaoLogLevel uint8
@@ -17,26 +23,184 @@ const (
 	SILENT
 )
 
+const (
+	MAO_LOG_TEXT_TIME_FORMAT = "2006/01/02 15:04:05"
+)
+
 var (
 	MaoLogLevelString = [6]string{"DEBUG", "HOT_DEBUG", "INFO ", "WARN ", "ERROR", "SILENT"}
 	minShowingLevel   = INFO // default is INFO
+
+	moduleLevels = make(map[string]MaoLogLevel) // override minShowingLevel for the module
+	levelsLock   = sync.RWMutex{}
+
+	jsonOutput               = false
+	stdout     io.Writer     = os.Stdout
+	fileSink   *rotatingFile // nil for disabled
+	outputLock = sync.Mutex{}
 )
 
+// MaoLogFields are the structured fields of a log, outputted as "key=value" in text, or an object in JSON.
+type MaoLogFields map[string]interface{}
+
+type MaoLogEntry struct {
+	Timestamp time.Time    `json:"ts"`
+	Level     string       `json:"level"`
+	Module    string       `json:"module,omitempty"`
+	Message   string       `json:"msg"`
+	Fields    MaoLogFields `json:"fields,omitempty"`
+}
+
 func InitMaoLog(minLogLevel MaoLogLevel) {
-	log.SetOutput(os.Stdout)
+	log.SetOutput(os.Stdout) // for the logs not from MaoLog
+	SetMaoLogLevel(minLogLevel)
+}
+
+// ParseMaoLogLevel accepts the names in MaoLogLevelString, case-insensitive.
+func ParseMaoLogLevel(levelStr string) (MaoLogLevel, bool) {
+	levelStr = strings.ToUpper(strings.TrimSpace(levelStr))
+	for i, s := range MaoLogLevelString {
+		if strings.TrimSpace(s) == levelStr {
+			return MaoLogLevel(i), true
+		}
+	}
+	return SILENT, false
+}
+
+func (l MaoLogLevel) String() string {
+	if int(l) >= len(MaoLogLevelString) {
+		return fmt.Sprintf("LEVEL(%d)", l)
+	}
+	return strings.TrimSpace(MaoLogLevelString[l])
+}
+
+// SetMaoLogLevel changes the global min level, it can be called at runtime.
+func SetMaoLogLevel(minLogLevel MaoLogLevel) {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
 	minShowingLevel = minLogLevel
 }
 
-func MaoLog(level MaoLogLevel, format string, a ...interface{}) {
-	if minShowingLevel > level || minShowingLevel == SILENT {
-		return
+// SetMaoLogModuleLevel overrides the global min level for the module, it can be called at runtime.
+func SetMaoLogModuleLevel(moduleName string, minLogLevel MaoLogLevel) {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	moduleLevels[moduleName] = minLogLevel
+}
+
+// ClearMaoLogModuleLevel makes the module follow the global min level again.
+func ClearMaoLogModuleLevel(moduleName string) {
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+	delete(moduleLevels, moduleName)
+}
+
+// GetMaoLogLevels returns the global min level and the overrides of the modules.
+func GetMaoLogLevels() (global MaoLogLevel, modules map[string]MaoLogLevel) {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+
+	modules = make(map[string]MaoLogLevel, len(moduleLevels))
+	for m, l := range moduleLevels {
+		modules[m] = l
+	}
+	return minShowingLevel, modules
+}
+
+// SetMaoLogJson switches the output to one JSON object per line.
+func SetMaoLogJson(enable bool) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	jsonOutput = enable
+}
+
+func isMaoLogEnabled(level MaoLogLevel, moduleName string) bool {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+
+	minLevel, ok := moduleLevels[moduleName]
+	if !ok {
+		minLevel = minShowingLevel
 	}
-	log.Printf("%s: %s", MaoLogLevelString[level], fmt.Sprintf(format, a...))
+	return minLevel <= level && minLevel != SILENT
+}
+
+func MaoLog(level MaoLogLevel, format string, a ...interface{}) {
+	MaoLogMF(level, "", nil, format, a...)
 }
 
 func MaoLogM(level MaoLogLevel, moduleName string, format string, a ...interface{}) {
-	if minShowingLevel > level || minShowingLevel == SILENT {
+	MaoLogMF(level, moduleName, nil, format, a...)
+}
+
+// MaoLogMF is MaoLogM with structured fields.
+func MaoLogMF(level MaoLogLevel, moduleName string, fields MaoLogFields, format string, a ...interface{}) {
+	if !isMaoLogEnabled(level, moduleName) {
 		return
 	}
-	log.Printf("%s: %s: %s", MaoLogLevelString[level], moduleName, fmt.Sprintf(format, a ...))
+
+	entry := &MaoLogEntry{
+		Timestamp: time.Now(),
+		Level:     level.String(),
+		Module:    moduleName,
+		Message:   fmt.Sprintf(format, a...),
+		Fields:    fields,
+	}
+	recentLogs.append(entry)
+	writeMaoLog(level, entry)
+}
+
+func writeMaoLog(level MaoLogLevel, entry *MaoLogEntry) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	var line []byte
+	if jsonOutput {
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			// e.g. a field can't be marshaled, keep the message at least.
+			line, _ = json.Marshal(&MaoLogEntry{
+				Timestamp: entry.Timestamp,
+				Level:     entry.Level,
+				Module:    entry.Module,
+				Message:   entry.Message,
+				Fields:    MaoLogFields{"fieldsError": err.Error()},
+			})
+		}
+		line = append(line, '\n')
+	} else {
+		line = []byte(formatTextLog(level, entry))
+	}
+
+	stdout.Write(line)
+	if fileSink != nil {
+		if err := fileSink.write(line); err != nil {
+			fmt.Fprintf(stdout, "%s ERROR: Fail to write the log file, %s\n", time.Now().Format(MAO_LOG_TEXT_TIME_FORMAT), err.Error())
+		}
+	}
+}
+
+// formatTextLog keeps the format of the standard log package: "2006/01/02 15:04:05 INFO : module: message key=value"
+func formatTextLog(level MaoLogLevel, entry *MaoLogEntry) string {
+	sb := strings.Builder{}
+	sb.WriteString(entry.Timestamp.Format(MAO_LOG_TEXT_TIME_FORMAT))
+	sb.WriteString(" ")
+	sb.WriteString(MaoLogLevelString[level])
+	sb.WriteString(": ")
+	if entry.Module != "" {
+		sb.WriteString(entry.Module)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(entry.Message)
+
+	keys := make([]string, 0, len(entry.Fields))
+	for k := range entry.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf(" %s=%v", k, entry.Fields[k]))
+	}
+	sb.WriteString("\n")
+	return sb.String()
 }
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	RECENT_LOGS_CAPACITY = 2000
+
+	DEFAULT_LOG_FILE_MAX_SIZE_MB = 10
+	DEFAULT_LOG_FILE_MAX_BACKUPS = 3
+)
+
+var (
+	recentLogs = &logRing{entries: make([]*MaoLogEntry, RECENT_LOGS_CAPACITY)}
+)
+
+// logRing keeps the recent logs in memory, for showing them in the WebUI.
+type logRing struct {
+	entries []*MaoLogEntry
+	next    int
+	full    bool
+	lock    sync.Mutex
+}
+
+func (r *logRing) append(entry *MaoLogEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// GetRecentMaoLogs returns the recent logs from old to new, filtered by the module (empty for all) and the min level.
+// At most limit logs are returned, the newest ones; 0 for no limit.
+func GetRecentMaoLogs(moduleName string, minLevel MaoLogLevel, limit int) []*MaoLogEntry {
+	recentLogs.lock.Lock()
+	ordered := make([]*MaoLogEntry, 0, len(recentLogs.entries))
+	if recentLogs.full {
+		ordered = append(ordered, recentLogs.entries[recentLogs.next:]...)
+	}
+	ordered = append(ordered, recentLogs.entries[:recentLogs.next]...)
+	recentLogs.lock.Unlock()
+
+	logs := make([]*MaoLogEntry, 0)
+	for _, e := range ordered {
+		if moduleName != "" && e.Module != moduleName {
+			continue
+		}
+		if level, ok := ParseMaoLogLevel(e.Level); ok && level < minLevel {
+			continue
+		}
+		logs = append(logs, e)
+	}
+	if limit > 0 && len(logs) > limit {
+		logs = logs[len(logs)-limit:]
+	}
+	return logs
+}
+
+// rotatingFile renames path to path.1, path.1 to path.2 ... when it exceeds maxSize, and keeps maxBackups of them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// EnableMaoLogFile writes the logs to the file too, in the same format as stdout.
+func EnableMaoLogFile(path string, maxSizeMB int, maxBackups int) error {
+	if maxSizeMB <= 0 || maxBackups < 0 {
+		return fmt.Errorf("invalid log file size %dMB or backups %d", maxSizeMB, maxBackups)
+	}
+	sink := &rotatingFile{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return err
+	}
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if fileSink != nil {
+		fileSink.file.Close()
+	}
+	fileSink = sink
+	return nil
+}
+
+// CloseMaoLogFile flushes and closes the log file, the logs are outputted to stdout only since now.
+func CloseMaoLogFile() {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if fileSink != nil {
+		fileSink.file.Close()
+		fileSink = nil
+	}
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) write(line []byte) error {
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+
+	if f.maxBackups == 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+	return f.open()
+}
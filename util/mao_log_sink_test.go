@@ -0,0 +1,76 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func captureMaoLog(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	stdout = buf
+	t.Cleanup(func() {
+		stdout = os.Stdout
+		SetMaoLogJson(false)
+		SetMaoLogLevel(INFO)
+		ClearMaoLogModuleLevel("Test-Verbose")
+	})
+	return buf
+}
+
+func TestMaoLog_ModuleLevelAndJson(t *testing.T) {
+	buf := captureMaoLog(t)
+	SetMaoLogLevel(WARN)
+	SetMaoLogModuleLevel("Test-Verbose", DEBUG)
+	SetMaoLogJson(true)
+
+	MaoLogM(INFO, "Test-Quiet", "dropped")
+	MaoLogMF(DEBUG, "Test-Verbose", MaoLogFields{"ip": "::1"}, "kept %d", 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expect 1 log, got %q", buf.String())
+	}
+	entry := &MaoLogEntry{}
+	if err := json.Unmarshal([]byte(lines[0]), entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "DEBUG" || entry.Module != "Test-Verbose" || entry.Message != "kept 1" || entry.Fields["ip"] != "::1" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	logs := GetRecentMaoLogs("Test-Verbose", DEBUG, 1)
+	if len(logs) != 1 || logs[0].Message != "kept 1" {
+		t.Errorf("unexpected recent logs %+v", logs)
+	}
+}
+
+func TestMaoLog_FileRotation(t *testing.T) {
+	captureMaoLog(t)
+	path := filepath.Join(t.TempDir(), "mao.log")
+	if err := EnableMaoLogFile(path, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer CloseMaoLogFile()
+
+	msg := strings.Repeat("x", 100*1024)
+	for i := 0; i < 25; i++ {
+		MaoLogM(WARN, "Test", "%s", msg)
+	}
+	CloseMaoLogFile()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("expect %s, %s", name, err.Error())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("expect at most 2 backups")
+	}
+	if info, _ := os.Stat(path + ".1"); info != nil && info.Size() > 1024*1024 {
+		t.Errorf("expect rotated at 1MB, got %d", info.Size())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 )
 
 func GetHostname() (string, error) {
@@ -50,4 +51,32 @@ func GetAddrPort(addr *net.IP, port uint32) string {
 	} else {
 		return fmt.Sprintf("%s:%d", addr.String(), port)
 	}
-}
\ No newline at end of file
+}
+
+// WriteFileAtomic writes to a temp file in the same dir, then renames it to the filename,
+// the file is either the old one or the new one if we crash in the middle.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
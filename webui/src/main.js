@@ -21,6 +21,15 @@ app.config.globalProperties.$http = Axios.create({
     baseUrl: "https://www.maojianwei.com/resources/",
     timeout: 3000
 })
+app.config.globalProperties.$http.interceptors.response.use(
+    response => response,
+    error => {
+        // the session is expired or not logged in yet
+        if (error.response && error.response.status === 401) {
+            window.location.href = "/login"
+        }
+        return Promise.reject(error)
+    })
 console.log("4 ===")
 
 
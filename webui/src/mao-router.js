@@ -12,6 +12,7 @@ import ONOS from "@/components/ONOS";
 import ApiListOldApi from "@/components/ApiListOldApi.vue"
 import ConfigGrpc from "@/components/config/ConfigGrpc.vue";
 import ConfigCenter from "@/components/config/ConfigCenter.vue";
+import ConfigUsers from "@/components/config/ConfigUsers.vue";
 
 // Vue.use(VueRouter)
 
@@ -77,6 +78,12 @@ export default createRouter({
                         components: {
                             maoConfig: ConfigAllText
                         }
+                    },
+                    {
+                        path: 'users',
+                        components: {
+                            maoConfig: ConfigUsers
+                        }
                     }
                 ]
             },